@@ -0,0 +1,139 @@
+package client
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+	"net"
+)
+
+// AnonymizerKeySize is the size of the keys used by Anonymizer.
+const AnonymizerKeySize = 32
+
+// Anonymizer replaces IP addresses with prefix-preserving
+// pseudonyms, using the Crypto-PAn scheme: two addresses that share
+// an n-bit prefix map to pseudonyms that also share an n-bit prefix,
+// and nothing else. Pseudonyms depend only on the key, so datasets
+// anonymized with the same key can be joined.
+//
+// An Anonymizer is safe for concurrent use.
+type Anonymizer struct {
+	block cipher.Block
+	// Fills the bits of the cipher input that don't come from the
+	// address.
+	pad [aes.BlockSize]byte
+	// Keyed separately from block, for port pseudonyms.
+	portBlock cipher.Block
+
+	// Also replace port numbers with pseudonyms. Like IPs, equal
+	// ports map to equal pseudonyms, so port preservation can still
+	// be analyzed.
+	MaskPorts bool
+}
+
+// NewAnonymizer returns an Anonymizer using key, which must be
+// AnonymizerKeySize bytes long. The first half of the key is the AES
+// key, the second half seeds the padding, as in Crypto-PAn.
+func NewAnonymizer(key []byte) (*Anonymizer, error) {
+	if len(key) != AnonymizerKeySize {
+		return nil, fmt.Errorf("anonymizer key is %d bytes, want %d", len(key), AnonymizerKeySize)
+	}
+	block, err := aes.NewCipher(key[:16])
+	if err != nil {
+		return nil, err
+	}
+	ret := &Anonymizer{block: block}
+	block.Encrypt(ret.pad[:], key[16:])
+
+	var portKey [16]byte
+	block.Encrypt(portKey[:], []byte("natprobe ports\x00\x00"))
+	if ret.portBlock, err = aes.NewCipher(portKey[:]); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// NewRandomAnonymizer returns an Anonymizer with a random key, whose
+// pseudonyms can't be linked to any other dataset.
+func NewRandomAnonymizer() (*Anonymizer, error) {
+	key := make([]byte, AnonymizerKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return NewAnonymizer(key)
+}
+
+// IP returns the pseudonym of ip. IPv4 addresses map to IPv4
+// addresses, IPv6 to IPv6. Unspecified addresses are returned as-is,
+// since they carry no information.
+func (a *Anonymizer) IP(ip net.IP) net.IP {
+	if len(ip) == 0 || ip.IsUnspecified() {
+		return ip
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return net.IP(a.anonymize(ip4)).To16()
+	}
+	return net.IP(a.anonymize(ip.To16()))
+}
+
+// anonymize returns the Crypto-PAn pseudonym of addr: bit i of the
+// output is bit i of addr, flipped by the first bit of the
+// encryption of addr's first i bits, padded to a full block.
+func (a *Anonymizer) anonymize(addr []byte) []byte {
+	var (
+		in, out [aes.BlockSize]byte
+		ret     = make([]byte, len(addr))
+	)
+	for i := 0; i < len(addr)*8; i++ {
+		copy(in[:], a.pad[:])
+		for j := 0; j <= i/8; j++ {
+			in[j] = addr[j]
+		}
+		// Keep the first i bits of the address, and the rest of the
+		// pad.
+		mask := byte(0xff) >> uint(i%8)
+		in[i/8] = addr[i/8]&^mask | a.pad[i/8]&mask
+		a.block.Encrypt(out[:], in[:])
+
+		bit := (addr[i/8] >> uint(7-i%8)) & 1
+		ret[i/8] |= (bit ^ out[0]>>7) << uint(7-i%8)
+	}
+	return ret
+}
+
+// Port returns the pseudonym of port, or port itself if MaskPorts
+// isn't set. Port 0 is returned as-is.
+func (a *Anonymizer) Port(port int) int {
+	if !a.MaskPorts || port <= 0 || port > 0xffff {
+		return port
+	}
+	// A 4-round Feistel network over the two bytes of the port makes
+	// a keyed permutation of all ports. It may map a port to 0, in
+	// which case cycle-walk to the next pseudonym.
+	for {
+		l, r := byte(port>>8), byte(port)
+		for round := byte(0); round < 4; round++ {
+			l, r = r, l^a.feistel(round, r)
+		}
+		port = int(l)<<8 | int(r)
+		if port != 0 {
+			return port
+		}
+	}
+}
+
+func (a *Anonymizer) feistel(round, b byte) byte {
+	var in, out [aes.BlockSize]byte
+	in[0], in[1] = round, b
+	a.portBlock.Encrypt(out[:], in[:])
+	return out[0]
+}
+
+func (a *Anonymizer) udpAddr(addr *net.UDPAddr) {
+	if addr == nil {
+		return
+	}
+	addr.IP = a.IP(addr.IP)
+	addr.Port = a.Port(addr.Port)
+}
@@ -0,0 +1,135 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"testing"
+)
+
+// jsonIPs returns all the IPs in the JSON document bs, whether bare or
+// in "ip:port" strings.
+func jsonIPs(t *testing.T, bs []byte) map[string]bool {
+	t.Helper()
+	var doc interface{}
+	if err := json.Unmarshal(bs, &doc); err != nil {
+		t.Fatal(err)
+	}
+	ret := map[string]bool{}
+	var walk func(v interface{})
+	walk = func(v interface{}) {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			for _, e := range v {
+				walk(e)
+			}
+		case []interface{}:
+			for _, e := range v {
+				walk(e)
+			}
+		case string:
+			if host, _, err := net.SplitHostPort(v); err == nil {
+				v = host
+			}
+			if ip := net.ParseIP(v); ip != nil && !ip.IsUnspecified() {
+				ret[ip.String()] = true
+			}
+		}
+	}
+	walk(doc)
+	return ret
+}
+
+func testAnonymizer(t *testing.T) *Anonymizer {
+	t.Helper()
+	a, err := NewAnonymizer(bytes.Repeat([]byte{42}, AnonymizerKeySize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func TestAnonymizeResult(t *testing.T) {
+	r := testResult()
+	orig, err := json.Marshal(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	origIPs := jsonIPs(t, orig)
+	if !origIPs["192.168.1.1"] || !origIPs["203.0.113.1"] {
+		t.Fatalf("test result is missing the gateway or a server IP, only has %v", origIPs)
+	}
+
+	r.AnonymizeWith(testAnonymizer(t))
+	anon, err := json.Marshal(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ip := range jsonIPs(t, anon) {
+		if origIPs[ip] {
+			t.Errorf("original address %s in anonymized result", ip)
+		}
+	}
+}
+
+func TestAnonymizeAnalysis(t *testing.T) {
+	r := testResult()
+	a := r.Analyze()
+	orig, err := json.Marshal(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	origIPs := jsonIPs(t, orig)
+
+	anon, err := a.Anonymized(testAnonymizer(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs, err := json.Marshal(anon)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ip := range jsonIPs(t, bs) {
+		if origIPs[ip] {
+			t.Errorf("original address %s in anonymized analysis", ip)
+		}
+	}
+	if !anon.CGNAT {
+		t.Error("anonymized analysis lost the CGNAT conclusion")
+	}
+
+	// The analysis is a copy, the result is untouched.
+	after, err := json.Marshal(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(orig, after) {
+		t.Error("Anonymized modified the original analysis")
+	}
+}
+
+func TestSubmissionAnonymized(t *testing.T) {
+	r := testResult()
+	orig, err := json.Marshal(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	origIPs := jsonIPs(t, orig)
+
+	sub, err := NewSubmission(r, testAnonymizer(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs, err := json.Marshal(sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ip := range jsonIPs(t, bs) {
+		if origIPs[ip] {
+			t.Errorf("original address %s in submission", ip)
+		}
+	}
+	if !sub.Analysis.CGNAT {
+		t.Error("submission lost the CGNAT conclusion")
+	}
+}
@@ -2,24 +2,38 @@ package client
 
 import (
 	"context"
-	"encoding/binary"
 	"fmt"
 	"net"
 	"time"
 
+	"github.com/go-logr/logr"
 	"go.universe.tf/natprobe/internal"
 )
 
 // Options configures the probe. All zero values are replaced with
 // sensible defaults.
 type Options struct {
-	// The addresses of probe servers to use.
+	// The addresses of probe servers to use. If empty, probe servers
+	// are found with Discover.
 	ServerAddrs []string
-	// The ports to probe on the probe servers.
+	// The ports to probe on the probe servers. If empty, the ports
+	// that discovered servers listen on, or internal.Ports.
 	Ports []int
+	// Configures discovery, when ServerAddrs is empty. Discovery's
+	// timeout is always ResolveDuration.
+	Discovery *DiscoveryOptions
 
 	// How long server name resolution can take.
 	ResolveDuration time.Duration
+	// The resolver to look up probe servers with. If nil,
+	// net.DefaultResolver.
+	Resolver Resolver
+
+	// Probe all the IPs that probe servers resolve to, rather than
+	// only the two reachable ones with the lowest RTT.
+	DisableSelection bool
+	// How long pinging probe servers for selection can take.
+	SelectionDuration time.Duration
 
 	// How long the mapping phase takes.
 	MappingDuration time.Duration
@@ -33,18 +47,39 @@ type Options struct {
 	FirewallDuration time.Duration
 	// How frequently to send firewal probe packets for each socket.
 	FirewallTransmitInterval time.Duration
+
+	// The highest TTL to probe the path to a probe server with.
+	PathMaxHops int
+	// How long the path probing phase takes.
+	PathDuration time.Duration
+
+	// The gateway to query over NAT-PMP and PCP. If nil, the gateway
+	// of the default route.
+	Gateway net.IP
+	// The port that the gateway serves NAT-PMP and PCP on.
+	GatewayPort int
+	// How long each exchange of the gateway probe can take: each
+	// request to the gateway, and the check of its mapping against a
+	// probe server.
+	GatewayDuration time.Duration
+
+	// If set, receives events as the probe progresses.
+	Observer Observer
+	// If set, receives logs about the probe's progress. Phase-level
+	// messages are logged at V(1), per-packet messages at V(2).
+	Logger logr.Logger
 }
 
 func (o *Options) addDefaults() {
-	if len(o.ServerAddrs) == 0 {
-		o.ServerAddrs = []string{"natprobe1-4.universe.tf.", "natprobe2-4.universe.tf."}
-	}
-	if len(o.Ports) == 0 {
-		o.Ports = internal.Ports
-	}
 	if o.ResolveDuration == 0 {
 		o.ResolveDuration = 3 * time.Second
 	}
+	if o.Resolver == nil {
+		o.Resolver = net.DefaultResolver
+	}
+	if o.SelectionDuration == 0 {
+		o.SelectionDuration = time.Second
+	}
 	if o.MappingDuration == 0 {
 		o.MappingDuration = 3 * time.Second
 	}
@@ -60,34 +95,137 @@ func (o *Options) addDefaults() {
 	if o.FirewallTransmitInterval == 0 {
 		o.FirewallTransmitInterval = 50 * time.Millisecond
 	}
+	if o.PathMaxHops == 0 {
+		o.PathMaxHops = 8
+	}
+	if o.PathDuration == 0 {
+		o.PathDuration = time.Second
+	}
+	if o.GatewayPort == 0 {
+		o.GatewayPort = internal.PortMapPort
+	}
+	if o.GatewayDuration == 0 {
+		o.GatewayDuration = time.Second
+	}
 }
 
 // Probe probes the NAT behavior between the local machine and remote probe servers.
+//
+// Probe always returns a Result. If probing fails partway through,
+// the Result holds the data gathered until then, and the returned
+// error says what went wrong. Errors can be inspected with errors.Is
+// and errors.As for ErrNoWorkingServer, ErrCanceled, *ResolveError
+// and *SocketError.
 func Probe(ctx context.Context, opts *Options) (*Result, error) {
 	if opts == nil {
 		opts = &Options{}
 	}
 	opts.addDefaults()
+	rep := newReporter(opts)
+
+	// usedOpts also records the servers and ports that discovery
+	// picks.
+	usedOpts := *opts
+	usedOpts.Discovery = nil
+	usedOpts.Resolver = nil
+	usedOpts.Observer = nil
+	usedOpts.Logger = nil
+	ret := &Result{
+		Metadata: &Metadata{
+			ToolVersion: toolVersion(),
+			Started:     time.Now(),
+			Options:     &usedOpts,
+		},
+	}
+
+	// The gateway only needs a working probe server to check its
+	// mapping against, query it while the rest of the probe runs.
+	// Failing to find or query it doesn't fail the probe, the analysis
+	// just has less to go on.
+	var (
+		gatewayAddr = make(chan *net.UDPAddr, 1)
+		gatewayDone = make(chan *GatewayProbe, 1)
+	)
+	go func() {
+		gw, _ := probeGateway(ctx, opts.Gateway, opts.GatewayPort, opts.GatewayDuration, gatewayAddr, rep)
+		gatewayDone <- gw
+	}()
+
+	finish := func(err error) (*Result, error) {
+		// Lets the gateway probe finish, if no server answered.
+		close(gatewayAddr)
+		ret.Gateway = <-gatewayDone
+		ret.Metadata.Duration = time.Since(ret.Metadata.Started)
+		if ctx.Err() != nil {
+			err = canceledError{ctx.Err()}
+		}
+		return ret, err
+	}
 
 	addrs, err := net.InterfaceAddrs()
 	if err != nil {
-		return nil, fmt.Errorf("enumerating local addresses: %s", err)
+		return finish(fmt.Errorf("enumerating local addresses: %w", err))
 	}
-	var localIPs []net.IP
 	for _, addr := range addrs {
 		if ipnet, ok := addr.(*net.IPNet); ok {
 			if ipnet.IP.To4() != nil {
-				localIPs = append(localIPs, ipnet.IP)
+				ret.LocalIPs = append(ret.LocalIPs, ipnet.IP)
 			}
 		}
 	}
 
 	// Assemble destination UDP addresses.
-	ips, err := resolveServerAddrs(ctx, opts.ServerAddrs, opts.ResolveDuration)
-	if err != nil {
-		return nil, err
+	rep.notify(&Event{Type: EventPhaseStarted, Phase: PhaseResolve})
+	if len(usedOpts.ServerAddrs) == 0 {
+		var discovery DiscoveryOptions
+		if opts.Discovery != nil {
+			discovery = *opts.Discovery
+		}
+		discovery.Timeout = opts.ResolveDuration
+		if discovery.Resolver == nil {
+			discovery.Resolver = opts.Resolver
+		}
+		servers, err := discover(ctx, &discovery, rep)
+		if err != nil {
+			rep.notify(&Event{Type: EventPhaseFinished, Phase: PhaseResolve, Err: err})
+			return finish(err)
+		}
+		var ports []int
+		usedOpts.ServerAddrs, ports = serverAddrs(servers, CapabilityProbe)
+		if len(usedOpts.Ports) == 0 {
+			usedOpts.Ports = ports
+		}
+	}
+	if len(usedOpts.Ports) == 0 {
+		usedOpts.Ports = internal.Ports
+	}
+	// Probe the servers that resolved, even if others didn't, but
+	// still report the failure.
+	ips, resolveErr := resolveServerAddrs(ctx, opts.Resolver, usedOpts.ServerAddrs, opts.ResolveDuration, rep)
+	rep.notify(&Event{Type: EventPhaseFinished, Phase: PhaseResolve, Err: resolveErr})
+	if len(ips) == 0 {
+		return finish(resolveErr)
+	}
+	if ctx.Err() != nil {
+		return finish(nil)
 	}
-	dests := dests(ips, opts.Ports)
+
+	// Only probe the closest servers, if there's a choice. If none
+	// of them respond to pings, probe them all anyway: the mapping
+	// phase reports the failure in more detail.
+	if !opts.DisableSelection && len(ips) > 2 {
+		ret.Selection, err = selectServers(ctx, ips, usedOpts.Ports, opts.SelectionDuration, opts.MappingTransmitInterval, rep)
+		if err != nil {
+			return finish(err)
+		}
+		if ctx.Err() != nil {
+			return finish(nil)
+		}
+		if len(ret.Selection.Selected) > 0 {
+			ips = ret.Selection.Selected
+		}
+	}
+	dests := dests(ips, usedOpts.Ports)
 
 	// Channel for the mapping probe to pass a working server to the firewall.
 	var (
@@ -99,26 +237,36 @@ func Probe(ctx context.Context, opts *Options) (*Result, error) {
 	// If we get any successful mapping response, use that address for
 	// firewall probing.
 	go func() {
-		fw, err := probeFirewall(ctx, workingAddr, opts.FirewallDuration, opts.FirewallTransmitInterval)
+		fw, err := probeFirewall(ctx, workingAddr, opts.FirewallDuration, opts.FirewallTransmitInterval, rep)
 		firewall = fw
 		firewallDone <- err
 	}()
 
 	// Probe the NAT for its mapping behavior.
-	probes, err := probeMapping(ctx, dests, opts.MappingSockets, opts.MappingDuration, opts.MappingTransmitInterval, workingAddr)
-	if err != nil {
-		return nil, err
+	ret.MappingProbes, ret.ServerStats, err = probeMapping(ctx, dests, opts.MappingSockets, opts.MappingDuration, opts.MappingTransmitInterval, workingAddr, rep)
+
+	// Probe the path to a server that answered, alongside the rest of
+	// the firewall probe. Like the gateway, it's optional.
+	for _, probe := range ret.MappingProbes {
+		if !probe.Timeout && ctx.Err() == nil {
+			ret.EgressIP = egressIP(probe.Remote)
+			gatewayAddr <- copyUDPAddr(probe.Remote)
+			ret.Path, _ = probePath(ctx, probe.Remote, opts.PathMaxHops, opts.PathDuration, rep)
+			break
+		}
 	}
 
-	if err = <-firewallDone; err != nil {
-		return nil, err
+	// A mapping failure is more interesting than the firewall probe
+	// failing for lack of a working server.
+	if fwErr := <-firewallDone; err == nil {
+		err = fwErr
+	}
+	ret.FirewallProbes = firewall
+	if err == nil {
+		err = resolveErr
 	}
 
-	return &Result{
-		LocalIPs:       localIPs,
-		MappingProbes:  probes,
-		FirewallProbes: firewall,
-	}, nil
+	return finish(err)
 }
 
 func dests(ips []net.IP, ports []int) []*net.UDPAddr {
@@ -131,66 +279,17 @@ func dests(ips []net.IP, ports []int) []*net.UDPAddr {
 	return ret
 }
 
-func probeFirewall(ctx context.Context, workingAddr chan *net.UDPAddr, duration time.Duration, txInterval time.Duration) (*FirewallProbe, error) {
-	dest := <-workingAddr
-	if dest == nil {
-		return nil, fmt.Errorf("no working server addresses available for firewall probing")
-	}
-	conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
-	if err != nil {
-		return nil, err
-	}
-	defer conn.Close()
-
-	ctx, cancel := context.WithTimeout(ctx, duration)
-	defer cancel()
-
-	deadline, ok := ctx.Deadline()
-	if !ok {
-		panic("deadline unexpectedly not set in context")
-	}
-	if err = conn.SetReadDeadline(deadline); err != nil {
-		return nil, err
-	}
-
-	go transmit(ctx, conn, []*net.UDPAddr{dest}, txInterval, true)
-
-	var (
-		ret = FirewallProbe{
-			Local:  copyUDPAddr(conn.LocalAddr().(*net.UDPAddr)),
-			Remote: copyUDPAddr(dest),
-		}
-		buf  [1500]byte
-		seen = map[string]bool{}
-	)
-	for {
-		n, addr, err := conn.ReadFromUDP(buf[:])
-		if err != nil {
-			if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
-				return &ret, nil
-			}
-			return nil, err
-		}
-
-		if n != 18 {
-			continue
-		}
-
-		if !seen[addr.String()] {
-			ret.Received = append(ret.Received, addr)
-			seen[addr.String()] = true
-		}
-	}
-}
-
-func probeMapping(ctx context.Context, dests []*net.UDPAddr, sockets int, duration time.Duration, txInterval time.Duration, workingAddr chan *net.UDPAddr) ([]*MappingProbe, error) {
+func probeMapping(ctx context.Context, dests []*net.UDPAddr, sockets int, duration time.Duration, txInterval time.Duration, workingAddr chan *net.UDPAddr, rep *reporter) ([]*MappingProbe, []*ServerStats, error) {
 	defer close(workingAddr)
+	rep.notify(&Event{Type: EventPhaseStarted, Phase: PhaseMapping})
+	defer rep.notify(&Event{Type: EventPhaseFinished, Phase: PhaseMapping})
 
 	ctx, cancel := context.WithTimeout(ctx, duration)
 	defer cancel()
 
 	type result struct {
 		probes []*MappingProbe
+		stats  []*ServerStats
 		err    error
 	}
 
@@ -198,29 +297,38 @@ func probeMapping(ctx context.Context, dests []*net.UDPAddr, sockets int, durati
 
 	for i := 0; i < sockets; i++ {
 		go func() {
-			res, err := probeOneMapping(ctx, dests, txInterval, workingAddr)
-			done <- result{probes: res, err: err}
+			res, stats, err := probeOneMapping(ctx, dests, txInterval, workingAddr, rep)
+			done <- result{probes: res, stats: stats, err: err}
 		}()
 	}
 
-	var ret []*MappingProbe
+	// Keep whatever the sockets gathered, even if some of them
+	// failed.
+	var (
+		ret   []*MappingProbe
+		stats []*ServerStats
+		err   error
+	)
 	for i := 0; i < sockets; i++ {
 		res := <-done
-		if res.err != nil {
-			return nil, res.err
+		if res.err != nil && err == nil {
+			err = res.err
 		}
 		ret = append(ret, res.probes...)
+		stats = append(stats, res.stats...)
 	}
 
-	return ret, nil
+	return ret, mergeServerStats(stats), err
 }
 
-func probeOneMapping(ctx context.Context, dests []*net.UDPAddr, txInterval time.Duration, workingAddr chan *net.UDPAddr) (ret []*MappingProbe, err error) {
+func probeOneMapping(ctx context.Context, dests []*net.UDPAddr, txInterval time.Duration, workingAddr chan *net.UDPAddr, rep *reporter) (ret []*MappingProbe, stats []*ServerStats, err error) {
 	conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
 	if err != nil {
-		return nil, err
+		return nil, nil, &SocketError{"listen", err}
 	}
 	defer conn.Close()
+	local := copyUDPAddr(conn.LocalAddr().(*net.UDPAddr))
+	rep.notify(&Event{Type: EventSocketOpened, Phase: PhaseMapping, Local: local})
 
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
@@ -230,10 +338,25 @@ func probeOneMapping(ctx context.Context, dests []*net.UDPAddr, txInterval time.
 		panic("deadline unexpectedly not set in context")
 	}
 	if err = conn.SetReadDeadline(deadline); err != nil {
-		return nil, err
+		return nil, nil, &SocketError{"set deadline", err}
 	}
+	defer cancelReads(ctx, conn)()
 
-	go transmit(ctx, conn, dests, txInterval, false)
+	exchange := newExchangeStats(dests)
+	txDone := make(chan struct{})
+	go func() {
+		defer close(txDone)
+		transmit(ctx, conn, dests, txInterval, func(dest *net.UDPAddr, err error) {
+			if err == nil {
+				exchange.sent(dest)
+			}
+			rep.notify(&Event{Type: EventPacketSent, Phase: PhaseMapping, Local: local, Remote: dest, Err: err})
+		})
+	}()
+	defer func() {
+		cancel()
+		<-txDone
+	}()
 
 	var (
 		buf  [1500]byte
@@ -245,31 +368,37 @@ func probeOneMapping(ctx context.Context, dests []*net.UDPAddr, txInterval time.
 		n, addr, err := conn.ReadFromUDP(buf[:])
 		if err != nil {
 			if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+				if time.Now().Before(deadline) {
+					// Canceled before the phase ended, so
+					// unanswered destinations might still
+					// have answered.
+					return ret, exchange.get(), nil
+				}
 				for _, dest := range dests {
 					if !seenByDest[dest.String()] {
 						ret = append(ret, &MappingProbe{
-							Local:   copyUDPAddr(conn.LocalAddr().(*net.UDPAddr)),
+							Local:   copyUDPAddr(local),
 							Remote:  copyUDPAddr(dest),
 							Timeout: true,
 						})
+						rep.notify(&Event{Type: EventTimeout, Phase: PhaseMapping, Local: local, Remote: dest})
 					}
 				}
-				return ret, nil
+				return ret, exchange.get(), nil
 			}
-			return nil, err
+			return ret, exchange.get(), &SocketError{"read", err}
 		}
 
-		if n != 18 {
+		mapped, _, _, ok := internal.ParseResponse(buf[:n])
+		if !ok {
 			continue
 		}
+		exchange.received(addr)
 
-		mapped := &net.UDPAddr{
-			IP:   net.IP(buf[:16]),
-			Port: int(binary.BigEndian.Uint16(buf[16:18])),
-		}
+		rep.notify(&Event{Type: EventResponseReceived, Phase: PhaseMapping, Local: local, Remote: copyUDPAddr(addr), Mapped: copyUDPAddr(mapped)})
 
 		probe := &MappingProbe{
-			Local:  copyUDPAddr(conn.LocalAddr().(*net.UDPAddr)),
+			Local:  copyUDPAddr(local),
 			Mapped: copyUDPAddr(mapped),
 			Remote: copyUDPAddr(addr),
 		}
@@ -285,24 +414,27 @@ func probeOneMapping(ctx context.Context, dests []*net.UDPAddr, txInterval time.
 	}
 }
 
-func transmit(ctx context.Context, conn *net.UDPConn, dests []*net.UDPAddr, txInterval time.Duration, cycle bool) {
-	var req [180]byte
+// transmit sends probe packets from conn to each of dests every
+// txInterval until ctx is done. If sent is set, it is called after
+// each attempt to send a packet.
+func transmit(ctx context.Context, conn *net.UDPConn, dests []*net.UDPAddr, txInterval time.Duration, sent func(dest *net.UDPAddr, err error)) {
+	var req [internal.ProbeLen]byte
 	done := make(chan struct{})
 	for _, dest := range dests {
 		go func(dest *net.UDPAddr) {
 			defer func() { done <- struct{}{} }()
 
 			for {
-				if cycle {
-					req[0] = (req[0] + 1) % 4
-				}
-				if _, err := conn.WriteToUDP(req[:], dest); err != nil {
-					// TODO: log, somehow...
+				_, err := conn.WriteToUDP(req[:], dest)
+				if sent != nil {
+					sent(dest, err)
 				}
+				timer := time.NewTimer(txInterval)
 				select {
 				case <-ctx.Done():
+					timer.Stop()
 					return
-				case <-time.After(txInterval):
+				case <-timer.C:
 				}
 			}
 		}(dest)
@@ -313,27 +445,80 @@ func transmit(ctx context.Context, conn *net.UDPConn, dests []*net.UDPAddr, txIn
 	}
 }
 
-func resolveServerAddrs(ctx context.Context, addrs []string, timeout time.Duration) (ips []net.IP, err error) {
+// cancelReads makes pending and future reads on conn fail with a
+// timeout as soon as ctx is done, rather than waiting for the read
+// deadline. The returned function must be called once reads are
+// finished.
+func cancelReads(ctx context.Context, conn *net.UDPConn) (stop func()) {
+	var (
+		done   = make(chan struct{})
+		exited = make(chan struct{})
+	)
+	go func() {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			conn.SetReadDeadline(time.Now())
+		case <-done:
+		}
+	}()
+	return func() {
+		close(done)
+		<-exited
+	}
+}
+
+// resolveServerAddrs resolves addrs to IPv4 addresses. Names that
+// fail to resolve are skipped: if any do, the IPs of the other names
+// are returned along with a *ResolveError for the first failure.
+func resolveServerAddrs(ctx context.Context, r Resolver, addrs []string, timeout time.Duration, rep *reporter) (ips []net.IP, err error) {
 	ctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 
+	var firstErr error
 	for _, addr := range addrs {
-		results, err := net.DefaultResolver.LookupIPAddr(ctx, addr)
+		results, err := r.LookupIPAddr(ctx, addr)
 		if err != nil {
-			return nil, err
+			rep.notify(&Event{Type: EventResolved, Phase: PhaseResolve, Name: addr, Err: err})
+			if firstErr == nil {
+				firstErr = &ResolveError{addr, err}
+			}
+			continue
 		}
 
+		var resolved []net.IP
 		for _, result := range results {
 			ip := result.IP.To4()
 			if ip == nil {
 				continue
 			}
-			ips = append(ips, ip)
+			resolved = append(resolved, ip)
 		}
+		rep.notify(&Event{Type: EventResolved, Phase: PhaseResolve, Name: addr, IPs: resolved})
+		ips = append(ips, resolved...)
+	}
+
+	switch {
+	case firstErr != nil:
+		return ips, firstErr
+	case len(ips) == 0:
+		return nil, fmt.Errorf("%w: probe servers have no IPv4 addresses", ErrNoWorkingServer)
 	}
 	return ips, nil
 }
 
+// egressIP returns the local IP that traffic to dest leaves from, or
+// nil if there's no route to it. Connecting a UDP socket picks the
+// route without sending anything.
+func egressIP(dest *net.UDPAddr) net.IP {
+	conn, err := net.DialUDP("udp4", nil, dest)
+	if err != nil {
+		return nil
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP
+}
+
 func copyUDPAddr(a *net.UDPAddr) *net.UDPAddr {
 	return &net.UDPAddr{
 		IP:   append(net.IP(nil), a.IP...),
@@ -0,0 +1,174 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+
+	"go.universe.tf/natprobe/internal"
+)
+
+// loopbackServer answers probes on 127.0.0.1 like a probe server,
+// until the returned socket is closed.
+func loopbackServer(t *testing.T) *net.UDPConn {
+	t.Helper()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		var buf [1500]byte
+		for {
+			n, addr, err := conn.ReadFromUDP(buf[:])
+			if err != nil {
+				return
+			}
+			txid, hasTxID := internal.ProbeTxID(buf[:n])
+			conn.WriteToUDP(internal.MarshalResponse(addr, txid, hasTxID), addr)
+		}
+	}()
+	return conn
+}
+
+// blackhole returns a port on 127.0.0.1 that never answers.
+func blackhole(t *testing.T) *net.UDPConn {
+	t.Helper()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+// stubResolver answers DNS lookups from its maps, and fails lookups
+// of anything else as not found. IP literals resolve to themselves,
+// like with net.Resolver.
+type stubResolver struct {
+	hosts map[string][]net.IP
+	// SRV records by _service._proto.name.
+	srvs map[string][]*net.SRV
+}
+
+func (r *stubResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IPAddr{{IP: ip}}, nil
+	}
+	ips, ok := r.hosts[host]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	var ret []net.IPAddr
+	for _, ip := range ips {
+		ret = append(ret, net.IPAddr{IP: ip})
+	}
+	return ret, nil
+}
+
+func (r *stubResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	qname := "_" + service + "._" + proto + "." + name
+	srvs, ok := r.srvs[qname]
+	if !ok {
+		return "", nil, &net.DNSError{Err: "no such host", Name: qname, IsNotFound: true}
+	}
+	return qname, srvs, nil
+}
+
+func TestProbeCancel(t *testing.T) {
+	server := loopbackServer(t)
+	defer server.Close()
+	silent := blackhole(t)
+	defer silent.Close()
+	// Let the servers' goroutines start before counting.
+	time.Sleep(50 * time.Millisecond)
+	before := runtime.NumGoroutine()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(500*time.Millisecond, cancel)
+	res, err := Probe(ctx, &Options{
+		ServerAddrs: []string{"127.0.0.1"},
+		Ports: []int{
+			server.LocalAddr().(*net.UDPAddr).Port,
+			silent.LocalAddr().(*net.UDPAddr).Port,
+		},
+		MappingDuration: 10 * time.Second,
+		Gateway:         net.IPv4(127, 0, 0, 1),
+	})
+	if !errors.Is(err, ErrCanceled) || !errors.Is(err, context.Canceled) {
+		t.Fatalf("Probe returned error %v, want ErrCanceled", err)
+	}
+	if res == nil {
+		t.Fatal("Probe returned no result")
+	}
+	answered := 0
+	for _, p := range res.MappingProbes {
+		if p.Timeout {
+			t.Errorf("canceled probe recorded a timeout from %s to %s", p.Local, p.Remote)
+		} else {
+			answered++
+		}
+	}
+	if answered == 0 {
+		t.Error("no mapping probe was answered before cancellation")
+	}
+
+	// Goroutines take a moment to exit after their sockets close.
+	var after int
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if after = runtime.NumGoroutine(); after <= before {
+			return
+		}
+	}
+	buf := make([]byte, 1<<16)
+	t.Fatalf("%d goroutines before Probe, %d after:\n%s", before, after, buf[:runtime.Stack(buf, true)])
+}
+
+func TestResolvePartial(t *testing.T) {
+	const bad = "missing.example."
+	r := &stubResolver{hosts: map[string][]net.IP{
+		"probe.example.": {net.IPv4(127, 0, 0, 1), net.ParseIP("::1")},
+	}}
+	ips, err := resolveServerAddrs(context.Background(), r, []string{"probe.example.", bad}, time.Second, nil)
+	var rerr *ResolveError
+	if !errors.As(err, &rerr) || rerr.Name != bad {
+		t.Fatalf("resolveServerAddrs returned error %v, want a ResolveError for %s", err, bad)
+	}
+	if len(ips) != 1 || !ips[0].Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Fatalf("resolveServerAddrs returned %v, want [127.0.0.1]", ips)
+	}
+}
+
+func TestProbeResolvePartial(t *testing.T) {
+	server := loopbackServer(t)
+	defer server.Close()
+
+	res, err := Probe(context.Background(), &Options{
+		ServerAddrs: []string{"probe.example.", "missing.example."},
+		Resolver: &stubResolver{hosts: map[string][]net.IP{
+			"probe.example.": {net.IPv4(127, 0, 0, 1)},
+		}},
+		Ports:            []int{server.LocalAddr().(*net.UDPAddr).Port},
+		ResolveDuration:  time.Second,
+		MappingDuration:  300 * time.Millisecond,
+		FirewallDuration: 300 * time.Millisecond,
+		PathMaxHops:      1,
+		PathDuration:     100 * time.Millisecond,
+		Gateway:          net.IPv4(127, 0, 0, 1),
+		GatewayDuration:  100 * time.Millisecond,
+	})
+	var rerr *ResolveError
+	if !errors.As(err, &rerr) {
+		t.Fatalf("Probe returned error %v, want a ResolveError", err)
+	}
+	answered := false
+	for _, p := range res.MappingProbes {
+		if !p.Timeout {
+			answered = true
+		}
+	}
+	if !answered {
+		t.Error("Probe didn't probe the server that resolved")
+	}
+}
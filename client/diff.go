@@ -0,0 +1,198 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Change is a difference in one NAT behavior between two analyses.
+type Change struct {
+	// The behavior that changed, named after the corresponding
+	// Analysis field or method, e.g. "mappingBehavior".
+	Property string
+	// Human-readable values before and after the change.
+	Before string
+	After  string
+	// The change makes NAT traversal harder.
+	Regression bool
+}
+
+func (c *Change) String() string {
+	ret := fmt.Sprintf("%s: %s -> %s", c.Property, c.Before, c.After)
+	if c.Regression {
+		ret += " (regression)"
+	}
+	return ret
+}
+
+// Diff is the set of behavior changes between two analyses of the
+// same network.
+type Diff struct {
+	Changes []*Change
+}
+
+// Compare returns the differences in NAT behavior between before and
+// after.
+func Compare(before, after *Analysis) *Diff {
+	var ret Diff
+	add := func(prop, b, a string, regression bool) {
+		if b == a {
+			return
+		}
+		ret.Changes = append(ret.Changes, &Change{
+			Property:   prop,
+			Before:     b,
+			After:      a,
+			Regression: regression,
+		})
+	}
+
+	add("noData", strconv.FormatBool(before.NoData), strconv.FormatBool(after.NoData), after.NoData)
+	if before.NoData || after.NoData {
+		// Nothing else is meaningful without data on both sides.
+		return &ret
+	}
+
+	add("noNAT", strconv.FormatBool(before.NoNAT), strconv.FormatBool(after.NoNAT), before.NoNAT)
+
+	bm, am := before.MappingBehavior(), after.MappingBehavior()
+	add("mappingBehavior", bm.String(), am.String(), am.strictness() > bm.strictness())
+	bf, af := before.FilteringBehavior(), after.FilteringBehavior()
+	// Behavior becoming unknown, or known again, isn't a regression
+	// by itself.
+	add("filteringBehavior", bf.String(), af.String(), bf != UnknownBehavior && af != UnknownBehavior && af.strictness() > bf.strictness())
+	add("unsolicitedInbound", before.UnsolicitedInbound.String(), after.UnsolicitedInbound.String(), before.UnsolicitedInbound == InboundAllowed && after.UnsolicitedInbound == InboundBlocked)
+	add("thirdPartyInbound", before.ThirdPartyInbound.String(), after.ThirdPartyInbound.String(), before.ThirdPartyInbound == InboundAllowed && after.ThirdPartyInbound == InboundBlocked)
+
+	add("mappingPreservesSourcePort", strconv.FormatBool(before.MappingPreservesSourcePort), strconv.FormatBool(after.MappingPreservesSourcePort), before.MappingPreservesSourcePort)
+	add("mappingSequential", strconv.FormatBool(before.MappingSequential), strconv.FormatBool(after.MappingSequential), before.MappingSequential)
+	add("multiplePublicIPs", strconv.FormatBool(before.MultiplePublicIPs), strconv.FormatBool(after.MultiplePublicIPs), after.MultiplePublicIPs)
+	add("cgnat", strconv.FormatBool(before.CGNAT), strconv.FormatBool(after.CGNAT), after.CGNAT)
+	add("doubleNAT", strconv.FormatBool(before.DoubleNAT), strconv.FormatBool(after.DoubleNAT), after.DoubleNAT)
+	add("portMapping", orNone(before.PortMapping), orNone(after.PortMapping), before.PortMapping != "" && after.PortMapping == "")
+
+	wasFiltered := map[int]bool{}
+	for _, port := range before.FilteredEgress {
+		wasFiltered[port] = true
+	}
+	newlyFiltered := false
+	for _, port := range after.FilteredEgress {
+		if !wasFiltered[port] {
+			newlyFiltered = true
+		}
+	}
+	add("filteredEgress", joinPorts(before.FilteredEgress), joinPorts(after.FilteredEgress), newlyFiltered)
+
+	// The public IP changing is worth knowing about, but isn't a
+	// regression by itself.
+	add("publicIPs", joinIPs(before.PublicIPs), joinIPs(after.PublicIPs), false)
+
+	return &ret
+}
+
+// Regressed reports whether any change in the diff is a regression.
+func (d *Diff) Regressed() bool {
+	for _, c := range d.Changes {
+		if c.Regression {
+			return true
+		}
+	}
+	return false
+}
+
+// String returns a human-readable description of the diff.
+func (d *Diff) String() string {
+	if len(d.Changes) == 0 {
+		return "No changes in NAT behavior."
+	}
+	var b bytes.Buffer
+	for _, c := range d.Changes {
+		fmt.Fprintf(&b, "%s\n", c)
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+type jsonChange struct {
+	Property   string `json:"property"`
+	Before     string `json:"before"`
+	After      string `json:"after"`
+	Regression bool   `json:"regression"`
+}
+
+type jsonDiff struct {
+	header
+	Regressed bool          `json:"regressed"`
+	Changes   []*jsonChange `json:"changes"`
+}
+
+// MarshalJSON implements json.Marshaler.
+func (d Diff) MarshalJSON() ([]byte, error) {
+	ret := jsonDiff{
+		header:    header{SchemaVersion, kindDiff},
+		Regressed: d.Regressed(),
+		Changes:   []*jsonChange{},
+	}
+	for _, c := range d.Changes {
+		ret.Changes = append(ret.Changes, &jsonChange{
+			Property:   c.Property,
+			Before:     c.Before,
+			After:      c.After,
+			Regression: c.Regression,
+		})
+	}
+	return json.Marshal(ret)
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (d *Diff) UnmarshalJSON(bs []byte) error {
+	var j jsonDiff
+	if err := json.Unmarshal(bs, &j); err != nil {
+		return err
+	}
+	if err := j.check(kindDiff); err != nil {
+		return err
+	}
+	*d = Diff{}
+	for _, c := range j.Changes {
+		d.Changes = append(d.Changes, &Change{
+			Property:   c.Property,
+			Before:     c.Before,
+			After:      c.After,
+			Regression: c.Regression,
+		})
+	}
+	return nil
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "none"
+	}
+	return s
+}
+
+func joinPorts(ports []int) string {
+	if len(ports) == 0 {
+		return "none"
+	}
+	var ret []string
+	for _, p := range ports {
+		ret = append(ret, strconv.Itoa(p))
+	}
+	return strings.Join(ret, ",")
+}
+
+func joinIPs(ips []net.IP) string {
+	if len(ips) == 0 {
+		return "none"
+	}
+	var ret []string
+	for _, ip := range ips {
+		ret = append(ret, ip.String())
+	}
+	return strings.Join(ret, ",")
+}
@@ -0,0 +1,394 @@
+package client
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultServerAddrs are the probe server names used when discovery
+// finds nothing better.
+var DefaultServerAddrs = []string{"natprobe1.universe.tf.", "natprobe2.universe.tf."}
+
+// DefaultServer is the host:port of the probe server used by the
+// single-server tests, like hole punching, when none is given.
+var DefaultServer = net.JoinHostPort(DefaultServerAddrs[0], "3478")
+
+// BootstrapIPs are probe server IPs to fall back to when DNS doesn't
+// work at all. Builds made with the Makefile embed the IPs that
+// DefaultServerAddrs resolved to at build time.
+var BootstrapIPs = parseIPs(bootstrapIPs)
+
+// bootstrapIPs is the comma-separated source of BootstrapIPs, set
+// with -ldflags "-X go.universe.tf/natprobe/client.bootstrapIPs=...".
+var bootstrapIPs string
+
+func parseIPs(s string) []net.IP {
+	var ret []net.IP
+	for _, f := range strings.Split(s, ",") {
+		if ip := net.ParseIP(strings.TrimSpace(f)); ip != nil {
+			ret = append(ret, ip)
+		}
+	}
+	return ret
+}
+
+// Server capabilities, as listed in server directories.
+const (
+	// The server answers mapping and firewall probes. All servers
+	// have this capability.
+	CapabilityProbe = "probe"
+	// The server pairs up clients for hole punching tests. All
+	// servers have this capability.
+	CapabilityRendezvous = "rendezvous"
+	// The server sprays packets for birthday spraying experiments.
+	CapabilitySpray = "spray"
+)
+
+// Server is a probe server found by discovery.
+type Server struct {
+	// The server's DNS name, if it has one.
+	Name string
+	IPs  []net.IP
+	// The ports the server listens on, nil if unknown.
+	Ports []int
+	// What the server can do, nil if unknown.
+	Capabilities []string
+}
+
+func (s *Server) has(capability string) bool {
+	if s.Capabilities == nil {
+		return capability == CapabilityProbe || capability == CapabilityRendezvous
+	}
+	for _, c := range s.Capabilities {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
+
+// A Resolver looks up DNS records. *net.Resolver implements it.
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupSRV(ctx context.Context, service, proto, name string) (cname string, addrs []*net.SRV, err error)
+}
+
+// DiscoveryOptions configures probe server discovery. All zero values
+// are replaced with sensible defaults.
+type DiscoveryOptions struct {
+	// The domain whose _natprobe._udp SRV records list probe servers.
+	Domain string
+	// URL of a signed server directory, see ParseDirectory. Directory
+	// discovery is skipped if either DirectoryURL or DirectoryKey is
+	// unset.
+	DirectoryURL string
+	// The public key that must have signed the directory.
+	DirectoryKey ed25519.PublicKey
+	// Server names to resolve if neither SRV records nor the
+	// directory list any servers.
+	Names []string
+	// Server IPs to use if nothing else works, e.g. because DNS is
+	// blocked.
+	BootstrapIPs []net.IP
+	// How long discovery can take.
+	Timeout time.Duration
+	// The resolver to look up SRV records and server names with.
+	Resolver Resolver
+}
+
+func (o *DiscoveryOptions) addDefaults() {
+	if o.Domain == "" {
+		o.Domain = "universe.tf."
+	}
+	if len(o.Names) == 0 {
+		o.Names = DefaultServerAddrs
+	}
+	if len(o.BootstrapIPs) == 0 {
+		o.BootstrapIPs = BootstrapIPs
+	}
+	if o.Timeout == 0 {
+		o.Timeout = 3 * time.Second
+	}
+	if o.Resolver == nil {
+		o.Resolver = net.DefaultResolver
+	}
+}
+
+// Discover finds probe servers, trying in order: DNS SRV records for
+// opts.Domain, the signed server directory, resolving opts.Names, and
+// finally opts.BootstrapIPs.
+func Discover(ctx context.Context, opts *DiscoveryOptions) ([]*Server, error) {
+	return discover(ctx, opts, nil)
+}
+
+func discover(ctx context.Context, opts *DiscoveryOptions, rep *reporter) ([]*Server, error) {
+	if opts == nil {
+		opts = &DiscoveryOptions{}
+	}
+	opts.addDefaults()
+
+	ctx, cancel := context.WithTimeout(ctx, opts.Timeout)
+	defer cancel()
+
+	if servers := discoverSRV(ctx, opts.Resolver, opts.Domain, rep); len(servers) > 0 {
+		return servers, nil
+	}
+
+	if opts.DirectoryURL != "" && opts.DirectoryKey != nil {
+		servers, err := fetchDirectory(ctx, opts.DirectoryURL, opts.DirectoryKey)
+		if err != nil {
+			rep.notify(&Event{Type: EventResolved, Phase: PhaseResolve, Name: opts.DirectoryURL, Err: err})
+		} else if len(servers) > 0 {
+			return servers, nil
+		}
+	}
+
+	var servers []*Server
+	for _, name := range opts.Names {
+		if ips := lookupIPv4(ctx, opts.Resolver, name, rep); len(ips) > 0 {
+			servers = append(servers, &Server{Name: name, IPs: ips})
+		}
+	}
+	if len(servers) > 0 {
+		return servers, nil
+	}
+
+	for _, ip := range opts.BootstrapIPs {
+		servers = append(servers, &Server{IPs: []net.IP{ip}})
+	}
+	if len(servers) > 0 {
+		return servers, nil
+	}
+
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return nil, fmt.Errorf("%w: discovery found no probe servers", ErrNoWorkingServer)
+}
+
+// discoverServer returns the host:port of a discovered server that
+// has capability.
+func discoverServer(ctx context.Context, opts *DiscoveryOptions, capability string) (string, error) {
+	servers, err := discover(ctx, opts, nil)
+	if err != nil {
+		return "", err
+	}
+	for _, s := range servers {
+		if !s.has(capability) || len(s.IPs) == 0 {
+			continue
+		}
+		port := 3478
+		if len(s.Ports) > 0 {
+			port = s.Ports[0]
+		}
+		return net.JoinHostPort(s.IPs[0].String(), strconv.Itoa(port)), nil
+	}
+	return "", fmt.Errorf("%w: discovery found no probe server with the %s capability", ErrNoWorkingServer, capability)
+}
+
+// discoverSRV returns the servers listed in domain's _natprobe._udp
+// SRV records. A server listed in several records listens on all of
+// their ports.
+func discoverSRV(ctx context.Context, r Resolver, domain string, rep *reporter) []*Server {
+	_, srvs, err := r.LookupSRV(ctx, "natprobe", "udp", domain)
+	if err != nil {
+		rep.notify(&Event{Type: EventResolved, Phase: PhaseResolve, Name: "_natprobe._udp." + domain, Err: err})
+		return nil
+	}
+
+	var (
+		ret    []*Server
+		byName = map[string]*Server{}
+	)
+	for _, srv := range srvs {
+		if s := byName[srv.Target]; s != nil {
+			s.Ports = append(s.Ports, int(srv.Port))
+			continue
+		}
+		s := &Server{Name: srv.Target, Ports: []int{int(srv.Port)}}
+		byName[srv.Target] = s
+		if s.IPs = lookupIPv4(ctx, r, srv.Target, rep); len(s.IPs) > 0 {
+			ret = append(ret, s)
+		}
+	}
+	for _, s := range ret {
+		sort.Ints(s.Ports)
+	}
+	return ret
+}
+
+func lookupIPv4(ctx context.Context, r Resolver, name string, rep *reporter) []net.IP {
+	addrs, err := r.LookupIPAddr(ctx, name)
+	if err != nil {
+		rep.notify(&Event{Type: EventResolved, Phase: PhaseResolve, Name: name, Err: err})
+		return nil
+	}
+	var ret []net.IP
+	for _, addr := range addrs {
+		if ip := addr.IP.To4(); ip != nil {
+			ret = append(ret, ip)
+		}
+	}
+	rep.notify(&Event{Type: EventResolved, Phase: PhaseResolve, Name: name, IPs: ret})
+	return ret
+}
+
+// serverAddrs returns the IPs of the servers that have capability, as
+// strings suitable for Options.ServerAddrs, and the ports that all of
+// those servers listen on.
+func serverAddrs(servers []*Server, capability string) (addrs []string, ports []int) {
+	portCount := map[int]int{}
+	n := 0
+	for _, s := range servers {
+		if !s.has(capability) {
+			continue
+		}
+		for _, ip := range s.IPs {
+			addrs = append(addrs, ip.String())
+		}
+		if s.Ports == nil {
+			// Unknown ports, assume the default ones.
+			continue
+		}
+		n++
+		for _, port := range s.Ports {
+			portCount[port]++
+		}
+	}
+	for port, count := range portCount {
+		if count == n {
+			ports = append(ports, port)
+		}
+	}
+	sort.Ints(ports)
+	return addrs, ports
+}
+
+// Directory is a list of probe servers, published as a signed JSON
+// document.
+type Directory struct {
+	// The directory must not be used after this time.
+	Expires time.Time
+	Servers []*Server
+}
+
+// signedDirectory is the published form of a Directory. The directory
+// is signed as an opaque byte string, so that the signature doesn't
+// depend on how JSON is encoded.
+type signedDirectory struct {
+	// The JSON encoding of a Directory.
+	Directory []byte `json:"directory"`
+	// The ed25519 signature of Directory.
+	Signature []byte `json:"signature"`
+}
+
+// SignDirectory returns the published form of d, signed with key.
+func SignDirectory(d *Directory, key ed25519.PrivateKey) ([]byte, error) {
+	bs, err := json.Marshal(d)
+	if err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(signedDirectory{
+		Directory: bs,
+		Signature: ed25519.Sign(key, bs),
+	}, "", "  ")
+}
+
+// ParseDirectory verifies that the published directory bs is signed
+// by key and hasn't expired, and returns its contents.
+func ParseDirectory(bs []byte, key ed25519.PublicKey) (*Directory, error) {
+	var signed signedDirectory
+	if err := json.Unmarshal(bs, &signed); err != nil {
+		return nil, err
+	}
+	if !ed25519.Verify(key, signed.Directory, signed.Signature) {
+		return nil, errors.New("invalid directory signature")
+	}
+
+	var ret Directory
+	if err := json.Unmarshal(signed.Directory, &ret); err != nil {
+		return nil, err
+	}
+	if time.Now().After(ret.Expires) {
+		return nil, fmt.Errorf("directory expired at %s", ret.Expires)
+	}
+	return &ret, nil
+}
+
+func fetchDirectory(ctx context.Context, url string, key ed25519.PublicKey) ([]*Server, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching directory: HTTP status %s", resp.Status)
+	}
+	bs, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	d, err := ParseDirectory(bs, key)
+	if err != nil {
+		return nil, err
+	}
+	return d.Servers, nil
+}
+
+type jsonDirectory struct {
+	header
+	Expires time.Time     `json:"expires"`
+	Servers []*jsonServer `json:"servers"`
+}
+
+type jsonServer struct {
+	Name         string   `json:"name,omitempty"`
+	IPs          []net.IP `json:"ips"`
+	Ports        []int    `json:"ports,omitempty"`
+	Capabilities []string `json:"capabilities,omitempty"`
+}
+
+// MarshalJSON implements json.Marshaler.
+func (d Directory) MarshalJSON() ([]byte, error) {
+	j := jsonDirectory{
+		header:  header{SchemaVersion, kindDirectory},
+		Expires: d.Expires,
+	}
+	for _, s := range d.Servers {
+		j.Servers = append(j.Servers, &jsonServer{s.Name, s.IPs, s.Ports, s.Capabilities})
+	}
+	return json.Marshal(j)
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (d *Directory) UnmarshalJSON(bs []byte) error {
+	var j jsonDirectory
+	if err := json.Unmarshal(bs, &j); err != nil {
+		return err
+	}
+	if err := j.check(kindDirectory); err != nil {
+		return err
+	}
+	*d = Directory{
+		Expires: j.Expires,
+	}
+	for _, s := range j.Servers {
+		d.Servers = append(d.Servers, &Server{s.Name, s.IPs, s.Ports, s.Capabilities})
+	}
+	return nil
+}
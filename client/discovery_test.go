@@ -0,0 +1,231 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func testDirectory() *Directory {
+	return &Directory{
+		Expires: time.Now().Add(time.Hour).UTC().Round(time.Second),
+		Servers: []*Server{
+			{Name: "probe1.example.", IPs: []net.IP{net.ParseIP("203.0.113.1")}, Ports: []int{3478, 4000}, Capabilities: []string{CapabilityProbe, CapabilityRendezvous}},
+			{IPs: []net.IP{net.ParseIP("203.0.113.2")}, Ports: []int{3478}, Capabilities: []string{CapabilitySpray}},
+		},
+	}
+}
+
+func TestDirectorySignature(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPub, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sign := func(d *Directory) []byte {
+		bs, err := SignDirectory(d, priv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return bs
+	}
+	// tamper swaps a server IP in a signed directory, keeping the
+	// signature.
+	tamper := func(bs []byte) []byte {
+		var signed signedDirectory
+		if err := json.Unmarshal(bs, &signed); err != nil {
+			t.Fatal(err)
+		}
+		signed.Directory = bytes.Replace(signed.Directory, []byte("203.0.113.1"), []byte("192.0.2.66"), 1)
+		ret, err := json.Marshal(signed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ret
+	}
+	expired := testDirectory()
+	expired.Expires = time.Now().Add(-time.Minute)
+
+	tests := []struct {
+		desc    string
+		bs      []byte
+		key     ed25519.PublicKey
+		wantErr bool
+	}{
+		{"good signature", sign(testDirectory()), pub, false},
+		{"signed by another key", sign(testDirectory()), otherPub, true},
+		{"expired", sign(expired), pub, true},
+		{"tampered", tamper(sign(testDirectory())), pub, true},
+		{"not JSON", []byte("directory"), pub, true},
+	}
+	for _, test := range tests {
+		d, err := ParseDirectory(test.bs, test.key)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%s: ParseDirectory accepted the directory", test.desc)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: ParseDirectory: %s", test.desc, err)
+			continue
+		}
+		want := testDirectory()
+		if !d.Expires.Equal(want.Expires) || !reflect.DeepEqual(canonicalServers(d.Servers), canonicalServers(want.Servers)) {
+			t.Errorf("%s: ParseDirectory returned %+v, want %+v", test.desc, d, want)
+		}
+	}
+}
+
+// canonicalServers makes the IPs in servers 16 bytes long, so that
+// they compare equal regardless of how they were parsed.
+func canonicalServers(servers []*Server) []*Server {
+	canonicalIPs(reflect.ValueOf(servers))
+	return servers
+}
+
+func TestDiscoverSRV(t *testing.T) {
+	r := &stubResolver{
+		hosts: map[string][]net.IP{
+			"probe1.example.": {net.ParseIP("203.0.113.1"), net.ParseIP("2001:db8::1")},
+			"probe2.example.": {net.ParseIP("203.0.113.2")},
+		},
+		srvs: map[string][]*net.SRV{
+			"_natprobe._udp.example.": {
+				{Target: "probe1.example.", Port: 4000},
+				{Target: "probe2.example.", Port: 3478},
+				{Target: "probe1.example.", Port: 3478},
+				// Doesn't resolve, so it's skipped.
+				{Target: "gone.example.", Port: 3478},
+			},
+		},
+	}
+	got := canonicalServers(discoverSRV(context.Background(), r, "example.", nil))
+	want := canonicalServers([]*Server{
+		{Name: "probe1.example.", IPs: []net.IP{net.ParseIP("203.0.113.1")}, Ports: []int{3478, 4000}},
+		{Name: "probe2.example.", IPs: []net.IP{net.ParseIP("203.0.113.2")}, Ports: []int{3478}},
+	})
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("discoverSRV returned %s, want %s", serverList(got), serverList(want))
+	}
+
+	if got := discoverSRV(context.Background(), r, "other.example.", nil); got != nil {
+		t.Errorf("discoverSRV found %s for a domain without SRV records", serverList(got))
+	}
+}
+
+func serverList(servers []*Server) string {
+	bs, _ := json.Marshal(servers)
+	return string(bs)
+}
+
+func TestDiscoverFallback(t *testing.T) {
+	srv := map[string][]*net.SRV{
+		"_natprobe._udp.example.": {{Target: "srv.example.", Port: 3478}},
+	}
+	hosts := map[string][]net.IP{
+		"srv.example.":   {net.ParseIP("203.0.113.1")},
+		"probe.example.": {net.ParseIP("203.0.113.2")},
+	}
+	bootstrap := []net.IP{net.ParseIP("203.0.113.3")}
+
+	tests := []struct {
+		desc      string
+		r         *stubResolver
+		bootstrap []net.IP
+		want      string
+		wantErr   bool
+	}{
+		{"SRV records", &stubResolver{hosts: hosts, srvs: srv}, bootstrap, "203.0.113.1", false},
+		{"no SRV records", &stubResolver{hosts: hosts}, bootstrap, "203.0.113.2", false},
+		{"no DNS", &stubResolver{}, bootstrap, "203.0.113.3", false},
+		{"nothing", &stubResolver{}, nil, "", true},
+	}
+	for _, test := range tests {
+		servers, err := Discover(context.Background(), &DiscoveryOptions{
+			Domain:       "example.",
+			Names:        []string{"probe.example."},
+			BootstrapIPs: test.bootstrap,
+			Resolver:     test.r,
+		})
+		if test.wantErr {
+			if !errors.Is(err, ErrNoWorkingServer) {
+				t.Errorf("%s: Discover returned %s, %v, want ErrNoWorkingServer", test.desc, serverList(servers), err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: Discover: %s", test.desc, err)
+			continue
+		}
+		if len(servers) != 1 || len(servers[0].IPs) != 1 || servers[0].IPs[0].String() != test.want {
+			t.Errorf("%s: Discover returned %s, want a server at %s", test.desc, serverList(servers), test.want)
+		}
+	}
+}
+
+func TestDiscoverServer(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := SignDirectory(testDirectory(), priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(signed)
+	}))
+	defer dir.Close()
+
+	// Servers found by name have unknown capabilities, which count as
+	// probing and rendezvous but not spraying.
+	byName := &DiscoveryOptions{
+		Names:    []string{"probe.example."},
+		Resolver: &stubResolver{hosts: map[string][]net.IP{"probe.example.": {net.ParseIP("203.0.113.9")}}},
+	}
+	fromDirectory := &DiscoveryOptions{
+		DirectoryURL: dir.URL,
+		DirectoryKey: pub,
+		Resolver:     &stubResolver{},
+	}
+
+	tests := []struct {
+		desc       string
+		opts       *DiscoveryOptions
+		capability string
+		want       string
+	}{
+		{"rendezvous by name", byName, CapabilityRendezvous, "203.0.113.9:3478"},
+		{"spray by name", byName, CapabilitySpray, ""},
+		{"rendezvous from directory", fromDirectory, CapabilityRendezvous, "203.0.113.1:3478"},
+		{"spray from directory", fromDirectory, CapabilitySpray, "203.0.113.2:3478"},
+	}
+	for _, test := range tests {
+		opts := *test.opts
+		got, err := discoverServer(context.Background(), &opts, test.capability)
+		if test.want == "" {
+			if !errors.Is(err, ErrNoWorkingServer) {
+				t.Errorf("%s: discoverServer returned %q, %v, want ErrNoWorkingServer", test.desc, got, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: discoverServer: %s", test.desc, err)
+		} else if got != test.want {
+			t.Errorf("%s: discoverServer returned %s, want %s", test.desc, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrNoWorkingServer is returned by Probe when no probe server
+	// address could be resolved or responded to mapping probes.
+	ErrNoWorkingServer = errors.New("no working probe server")
+	// ErrCanceled is returned by Probe when its context is canceled
+	// or expires before probing completes. The error also wraps the
+	// context's error.
+	ErrCanceled = errors.New("probe canceled")
+)
+
+// ResolveError is returned by Probe when a probe server name fails
+// to resolve. Probe still probes the servers whose names did resolve,
+// if any, so the Result may be complete despite the error.
+type ResolveError struct {
+	// The name that failed to resolve.
+	Name string
+	Err  error
+}
+
+func (e *ResolveError) Error() string {
+	return fmt.Sprintf("resolving probe server %q: %s", e.Name, e.Err)
+}
+
+// Unwrap returns the underlying resolver error.
+func (e *ResolveError) Unwrap() error { return e.Err }
+
+// SocketError is returned by Probe when a local UDP socket fails.
+type SocketError struct {
+	// The failed operation, e.g. "listen" or "read".
+	Op  string
+	Err error
+}
+
+func (e *SocketError) Error() string {
+	return fmt.Sprintf("UDP socket %s: %s", e.Op, e.Err)
+}
+
+// Unwrap returns the underlying socket error.
+func (e *SocketError) Unwrap() error { return e.Err }
+
+// canceledError wraps a context error so that it matches both
+// ErrCanceled and the context error with errors.Is.
+type canceledError struct {
+	err error
+}
+
+func (e canceledError) Error() string { return fmt.Sprintf("%s: %s", ErrCanceled, e.err) }
+
+func (e canceledError) Is(target error) bool { return target == ErrCanceled }
+
+func (e canceledError) Unwrap() error { return e.err }
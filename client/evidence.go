@@ -0,0 +1,254 @@
+package client
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+)
+
+// Evidence is the probe data behind one conclusion of an Analysis.
+type Evidence struct {
+	// There were no observations to draw the conclusion from, so the
+	// verdict is only a default. Confidence is 0.
+	Unknown bool
+	// How much the data backs the conclusion, from 0 (no usable data)
+	// to 1 (certain). See confidence for how it's scored.
+	Confidence float64
+	// Mapping probes consistent with the conclusion.
+	SupportingMappings []*MappingProbe
+	// Mapping probes inconsistent with the conclusion.
+	ContradictingMappings []*MappingProbe
+	// Firewall probe receptions consistent with the conclusion.
+	SupportingReceptions []*net.UDPAddr
+	// Firewall probe receptions inconsistent with the conclusion.
+	ContradictingReceptions []*net.UDPAddr
+	// Addresses seen upstream of the client consistent with the
+	// conclusion.
+	SupportingAddresses []*AddressObservation
+	// Addresses seen upstream of the client inconsistent with the
+	// conclusion.
+	ContradictingAddresses []*AddressObservation
+}
+
+// AddressObservation is an IP address seen while probing, and where
+// it was seen.
+type AddressObservation struct {
+	// "local" for a local IP, "hop N" for the router N hops away on
+	// the path to a probe server, "gateway external" for the external
+	// address reported by the gateway, or "gateway mapping" for the
+	// external address of a mapping the gateway granted.
+	Source string
+	IP     net.IP
+}
+
+// String returns the address and where it was seen.
+func (o *AddressObservation) String() string {
+	return fmt.Sprintf("%s (%s)", o.IP, o.Source)
+}
+
+// AnalysisEvidence holds the Evidence for each conclusion of an
+// Analysis. Fields have the same meaning as the Analysis fields of
+// the same name.
+type AnalysisEvidence struct {
+	NoData                     *Evidence `json:"noData"`
+	NoNAT                      *Evidence `json:"noNAT"`
+	MappingVariesByDestIP      *Evidence `json:"mappingVariesByDestIP"`
+	MappingVariesByDestPort    *Evidence `json:"mappingVariesByDestPort"`
+	FirewallEnforcesDestIP     *Evidence `json:"firewallEnforcesDestIP"`
+	FirewallEnforcesDestPort   *Evidence `json:"firewallEnforcesDestPort"`
+	UnsolicitedInbound         *Evidence `json:"unsolicitedInbound"`
+	ThirdPartyInbound          *Evidence `json:"thirdPartyInbound"`
+	MappingPreservesSourcePort *Evidence `json:"mappingPreservesSourcePort"`
+	MappingSequential          *Evidence `json:"mappingSequential"`
+	MultiplePublicIPs          *Evidence `json:"multiplePublicIPs"`
+	FilteredEgress             *Evidence `json:"filteredEgress"`
+	CGNAT                      *Evidence `json:"cgnat"`
+	DoubleNAT                  *Evidence `json:"doubleNAT"`
+	PortMapping                *Evidence `json:"portMapping"`
+}
+
+// confidence scores a conclusion drawn from absence: from agree
+// observations that could have disproved it and didn't, weighed
+// against disagree ones that point the other way without disproving
+// it, like packet loss. Without disagreement, that's n/(n+1) for n
+// observations, which approaches certainty as they add up but never
+// reaches it.
+//
+// Conclusions proven by a counterexample, such as one response
+// proving that there is data, are certain instead, see proven. With
+// no observations at all, conclusions are unknown.
+func confidence(agree, disagree int) float64 {
+	return float64(agree) / float64(agree+disagree+1)
+}
+
+// scored returns e with its confidence for a conclusion drawn from
+// absence, or marked unknown if there are no observations.
+func (e *Evidence) scored(agree, disagree int) *Evidence {
+	e.Unknown = agree+disagree == 0
+	e.Confidence = confidence(agree, disagree)
+	return e
+}
+
+// proven returns e with certain confidence, for a conclusion that
+// its supporting observations prove.
+func (e *Evidence) proven() *Evidence {
+	e.Unknown = false
+	e.Confidence = 1
+	return e
+}
+
+// unknownEvidence is the evidence for a conclusion that has no
+// observations to go on.
+func unknownEvidence() *Evidence {
+	return &Evidence{Unknown: true}
+}
+
+func mappingEvidence(supporting, contradicting []*MappingProbe) *Evidence {
+	e := &Evidence{
+		SupportingMappings:    supporting,
+		ContradictingMappings: contradicting,
+	}
+	return e.scored(len(supporting), len(contradicting))
+}
+
+func receptionEvidence(supporting, contradicting []*net.UDPAddr) *Evidence {
+	e := &Evidence{
+		SupportingReceptions:    supporting,
+		ContradictingReceptions: contradicting,
+	}
+	return e.scored(len(supporting), len(contradicting))
+}
+
+func addressEvidence(supporting, contradicting []*AddressObservation) *Evidence {
+	e := &Evidence{
+		SupportingAddresses:    supporting,
+		ContradictingAddresses: contradicting,
+	}
+	return e.scored(len(supporting), len(contradicting))
+}
+
+// Conclusion is one conclusion of an Analysis, with the evidence
+// behind it.
+type Conclusion struct {
+	// A short description of what was concluded about.
+	Name string
+	// The value of the corresponding Analysis field.
+	Verdict interface{}
+	// Nil if the analysis has no evidence for this conclusion.
+	Evidence *Evidence
+}
+
+// Conclusions returns the conclusions of the analysis, in the order
+// that Explain lists them.
+func (a *Analysis) Conclusions() []*Conclusion {
+	ev := a.Evidence
+	if ev == nil {
+		ev = &AnalysisEvidence{}
+	}
+	return []*Conclusion{
+		{"No data", a.NoData, ev.NoData},
+		{"No NAT", a.NoNAT, ev.NoNAT},
+		{"Mapping varies by destination IP", a.MappingVariesByDestIP, ev.MappingVariesByDestIP},
+		{"Mapping varies by destination port", a.MappingVariesByDestPort, ev.MappingVariesByDestPort},
+		{"Firewall enforces destination IP", a.firewallVerdict(a.FirewallEnforcesDestIP), ev.FirewallEnforcesDestIP},
+		{"Firewall enforces destination port", a.firewallVerdict(a.FirewallEnforcesDestPort), ev.FirewallEnforcesDestPort},
+		{"Unsolicited inbound traffic", a.UnsolicitedInbound, ev.UnsolicitedInbound},
+		{"Third-party inbound traffic", a.ThirdPartyInbound, ev.ThirdPartyInbound},
+		{"Mapping preserves source port", a.MappingPreservesSourcePort, ev.MappingPreservesSourcePort},
+		{"Mapping allocates ports sequentially", a.MappingSequential, ev.MappingSequential},
+		{"Multiple public IPs", a.MultiplePublicIPs, ev.MultiplePublicIPs},
+		{"Filtered egress ports", a.FilteredEgress, ev.FilteredEgress},
+		{"Carrier-grade NAT", a.CGNAT, ev.CGNAT},
+		{"Double NAT", a.DoubleNAT, ev.DoubleNAT},
+		{"Port mapping protocol", a.PortMapping, ev.PortMapping},
+	}
+}
+
+// firewallVerdict returns v, or "unknown" if the firewall probe
+// didn't work.
+func (a *Analysis) firewallVerdict(v bool) interface{} {
+	if a.FirewallUntested {
+		return "unknown"
+	}
+	return v
+}
+
+// Explain returns a human-readable description of each conclusion in
+// the analysis, along with the evidence and confidence behind it.
+func (a *Analysis) Explain() string {
+	if a.Evidence == nil {
+		return "No evidence available for this analysis."
+	}
+
+	var b bytes.Buffer
+	for _, c := range a.Conclusions() {
+		e := c.Evidence
+		if e == nil {
+			fmt.Fprintf(&b, "%s: %v (no evidence)\n", c.Name, c.Verdict)
+			continue
+		}
+		if e.Unknown {
+			fmt.Fprintf(&b, "%s: %v (unknown, no observations)\n", c.Name, c.Verdict)
+		} else {
+			fmt.Fprintf(&b, "%s: %v (confidence %.0f%%)\n", c.Name, c.Verdict, e.Confidence*100)
+		}
+		writeMappings(&b, "Supporting mapping probes", e.SupportingMappings)
+		writeMappings(&b, "Contradicting mapping probes", e.ContradictingMappings)
+		writeReceptions(&b, "Supporting firewall receptions", e.SupportingReceptions)
+		writeReceptions(&b, "Contradicting firewall receptions", e.ContradictingReceptions)
+		writeAddresses(&b, "Supporting addresses", e.SupportingAddresses)
+		writeAddresses(&b, "Contradicting addresses", e.ContradictingAddresses)
+	}
+
+	return b.String()
+}
+
+func writeMappings(b *bytes.Buffer, title string, probes []*MappingProbe) {
+	if len(probes) == 0 {
+		return
+	}
+	fmt.Fprintf(b, "    %s:\n", title)
+	for _, probe := range probes {
+		fmt.Fprintf(b, "        %s\n", probe)
+	}
+}
+
+func writeReceptions(b *bytes.Buffer, title string, addrs []*net.UDPAddr) {
+	if len(addrs) == 0 {
+		return
+	}
+	fmt.Fprintf(b, "    %s:\n", title)
+	for _, addr := range addrs {
+		fmt.Fprintf(b, "        %s\n", addr)
+	}
+}
+
+func writeAddresses(b *bytes.Buffer, title string, addrs []*AddressObservation) {
+	if len(addrs) == 0 {
+		return
+	}
+	fmt.Fprintf(b, "    %s:\n", title)
+	for _, o := range addrs {
+		fmt.Fprintf(b, "        %s\n", o)
+	}
+}
+
+func (e *Evidence) anonymizeWith(a *Anonymizer) {
+	for _, probes := range [][]*MappingProbe{e.SupportingMappings, e.ContradictingMappings} {
+		for _, probe := range probes {
+			a.udpAddr(probe.Local)
+			a.udpAddr(probe.Mapped)
+			a.udpAddr(probe.Remote)
+		}
+	}
+	for _, addrs := range [][]*net.UDPAddr{e.SupportingReceptions, e.ContradictingReceptions} {
+		for _, addr := range addrs {
+			a.udpAddr(addr)
+		}
+	}
+	for _, obs := range [][]*AddressObservation{e.SupportingAddresses, e.ContradictingAddresses} {
+		for _, o := range obs {
+			o.IP = a.IP(o.IP)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package client
+
+import (
+	"net"
+	"testing"
+)
+
+func TestScored(t *testing.T) {
+	tests := []struct {
+		agree, disagree int
+		want            float64
+		unknown         bool
+	}{
+		{0, 0, 0, true},
+		{1, 0, 0.5, false},
+		{9, 0, 0.9, false},
+		{0, 1, 0, false},
+		{1, 1, 1.0 / 3, false},
+	}
+	for _, test := range tests {
+		ev := (&Evidence{}).scored(test.agree, test.disagree)
+		if ev.Confidence != test.want || ev.Unknown != test.unknown {
+			t.Errorf("scored(%d, %d) = (%v, unknown=%v), want (%v, unknown=%v)", test.agree, test.disagree, ev.Confidence, ev.Unknown, test.want, test.unknown)
+		}
+	}
+}
+
+// checkEvidence checks a conclusion and the confidence of its evidence.
+func checkEvidence(t *testing.T, desc string, got, want bool, ev *Evidence, confidence float64, unknown bool) {
+	t.Helper()
+	if got != want {
+		t.Errorf("%s: verdict %v, want %v", desc, got, want)
+	}
+	if ev.Confidence != confidence || ev.Unknown != unknown {
+		t.Errorf("%s: confidence %v (unknown=%v), want %v (unknown=%v)", desc, ev.Confidence, ev.Unknown, confidence, unknown)
+	}
+}
+
+func TestNoDataConfidence(t *testing.T) {
+	var (
+		response = &MappingProbe{Local: mustUDPAddr("192.168.1.10:5000"), Mapped: mustUDPAddr("198.51.100.7:6000"), Remote: mustUDPAddr("203.0.113.1:3478")}
+		timeout  = &MappingProbe{Local: mustUDPAddr("192.168.1.10:5000"), Remote: mustUDPAddr("203.0.113.1:4000"), Timeout: true}
+	)
+	tests := []struct {
+		desc       string
+		probes     []*MappingProbe
+		want       bool
+		confidence float64
+		unknown    bool
+	}{
+		{"no probes", nil, true, 0, true},
+		{"one timeout", []*MappingProbe{timeout}, true, 0.5, false},
+		{"three timeouts", []*MappingProbe{timeout, timeout, timeout}, true, 0.75, false},
+		{"one response", []*MappingProbe{response}, false, 1, false},
+		{"response and timeouts", []*MappingProbe{timeout, response, timeout}, false, 1, false},
+	}
+	for _, test := range tests {
+		got, ev := noData(&Result{MappingProbes: test.probes})
+		checkEvidence(t, test.desc, got, test.want, ev, test.confidence, test.unknown)
+	}
+}
+
+func TestMultiplePublicIPsConfidence(t *testing.T) {
+	probe := func(mapped string) *MappingProbe {
+		return &MappingProbe{Local: mustUDPAddr("192.168.1.10:5000"), Mapped: mustUDPAddr(mapped), Remote: mustUDPAddr("203.0.113.1:3478")}
+	}
+	tests := []struct {
+		desc       string
+		probes     []*MappingProbe
+		want       bool
+		confidence float64
+		unknown    bool
+	}{
+		{"no probes", nil, false, 0, true},
+		{"one IP once", []*MappingProbe{probe("198.51.100.7:6000")}, false, 0.5, false},
+		{"one IP thrice", []*MappingProbe{probe("198.51.100.7:6000"), probe("198.51.100.7:6001"), probe("198.51.100.7:6002")}, false, 0.75, false},
+		{"two IPs", []*MappingProbe{probe("198.51.100.7:6000"), probe("198.51.100.8:6001")}, true, 1, false},
+	}
+	for _, test := range tests {
+		got, ev := multiplePublicIPs(&Result{MappingProbes: test.probes})
+		checkEvidence(t, test.desc, got, test.want, ev, test.confidence, test.unknown)
+	}
+}
+
+func TestFirewallEnforcesDestIPConfidence(t *testing.T) {
+	control := &FirewallOutcome{Sent: 10, Received: 10, From: []*net.UDPAddr{mustUDPAddr("203.0.113.1:3478")}}
+	probes := func(outcomes ...*FirewallOutcome) *FirewallProbe {
+		return &FirewallProbe{
+			Local:  mustUDPAddr("192.168.1.10:5002"),
+			Remote: mustUDPAddr("203.0.113.1:3478"),
+			Matrix: outcomes,
+		}
+	}
+	tests := []struct {
+		desc       string
+		probes     *FirewallProbe
+		want       bool
+		confidence float64
+		unknown    bool
+	}{
+		{"no firewall probe", nil, false, 0, true},
+		{"no control response", probes(&FirewallOutcome{Sent: 10}, &FirewallOutcome{VaryAddr: true, Sent: 10}), false, 0, true},
+		{"nothing sent", probes(control, &FirewallOutcome{VaryAddr: true}), false, 0, true},
+		{"one unanswered", probes(control, &FirewallOutcome{VaryAddr: true, Sent: 1}), true, 0.5, false},
+		{"nine unanswered", probes(control, &FirewallOutcome{VaryAddr: true, Sent: 9}), true, 0.9, false},
+		{"one through", probes(control, &FirewallOutcome{VaryAddr: true, Sent: 9, Received: 1, From: []*net.UDPAddr{mustUDPAddr("203.0.113.2:3478")}}), false, 1, false},
+	}
+	for _, test := range tests {
+		got, ev := firewallEnforcesDestIP(&Result{FirewallProbes: test.probes})
+		checkEvidence(t, test.desc, got, test.want, ev, test.confidence, test.unknown)
+	}
+}
+
+func TestPortMappingConfidence(t *testing.T) {
+	tests := []struct {
+		desc       string
+		gateway    *GatewayProbe
+		want       string
+		confidence float64
+		unknown    bool
+	}{
+		{"no gateway", nil, "", 0, true},
+		{"silent gateway", &GatewayProbe{IP: net.ParseIP("192.168.1.1")}, "", 2.0 / 3, false},
+		{"refused", &GatewayProbe{IP: net.ParseIP("192.168.1.1"), NATPMP: true}, "", 1, false},
+		{"granted", &GatewayProbe{IP: net.ParseIP("192.168.1.1"), PCP: true, Mapping: &GatewayMapping{Protocol: "pcp", External: mustUDPAddr("198.51.100.7:5003")}}, "pcp", 1, false},
+	}
+	for _, test := range tests {
+		got, ev := portMapping(&Result{Gateway: test.gateway})
+		if got != test.want {
+			t.Errorf("%s: protocol %q, want %q", test.desc, got, test.want)
+		}
+		checkEvidence(t, test.desc, true, true, ev, test.confidence, test.unknown)
+	}
+}
@@ -0,0 +1,354 @@
+package client
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"go.universe.tf/natprobe/internal"
+)
+
+// firewallRequests are the probe flags for each way the firewall
+// probe asks the server to respond: from the same or a different
+// address, and the same or a different port, or from sources the
+// client never sent to.
+var firewallRequests = []byte{
+	0,
+	internal.ProbeFlagVaryAddr,
+	internal.ProbeFlagVaryPort,
+	internal.ProbeFlagVaryAddr | internal.ProbeFlagVaryPort,
+	internal.ProbeFlagVaryPort | internal.ProbeFlagFreshPort,
+	internal.ProbeFlagVaryAddr | internal.ProbeFlagVaryPort | internal.ProbeFlagFreshPort,
+	internal.ProbeFlagVaryAddr | internal.ProbeFlagVaryPort | internal.ProbeFlagFreshPort | internal.ProbeFlagFreshAddr,
+}
+
+// firewallFreshInterval is the shortest time between two probes
+// asking for a response from a fresh source. Servers open a socket for
+// each of those, and rate-limit them per client.
+const firewallFreshInterval = 500 * time.Millisecond
+
+// firewallRequestBits is the number of transaction ID bits that hold
+// an index into firewallRequests.
+const firewallRequestBits = 3
+
+// firewallMatrix keeps track of the transaction IDs sent by the
+// firewall probe, and tallies outcomes per response combination and
+// for the relayed third-party probe.
+//
+// Transaction IDs are a random base plus a sequence number, with the
+// combination in the low bits, so responses can be matched back to
+// their request without remembering every ID sent.
+type firewallMatrix struct {
+	base uint64
+	// The probed address.
+	dest *net.UDPAddr
+
+	mu       sync.Mutex
+	seq      uint64
+	outcomes []*FirewallOutcome
+	seen     []map[string]bool
+	// The relay experiment uses base as its nonce, and relayCookie
+	// once the server handed it out.
+	thirdParty     ThirdPartyProbe
+	thirdPartySeen map[string]bool
+	relayCookie    uint64
+}
+
+func newFirewallMatrix(dest *net.UDPAddr) (*firewallMatrix, error) {
+	var bs [8]byte
+	if _, err := rand.Read(bs[:]); err != nil {
+		return nil, err
+	}
+	ret := &firewallMatrix{
+		base:           binary.BigEndian.Uint64(bs[:]),
+		dest:           dest,
+		thirdPartySeen: map[string]bool{},
+	}
+	for _, flags := range firewallRequests {
+		ret.outcomes = append(ret.outcomes, &FirewallOutcome{
+			VaryAddr:  flags&internal.ProbeFlagVaryAddr != 0,
+			VaryPort:  flags&internal.ProbeFlagVaryPort != 0,
+			FreshPort: flags&internal.ProbeFlagFreshPort != 0,
+			FreshAddr: flags&internal.ProbeFlagFreshAddr != 0,
+		})
+		ret.seen = append(ret.seen, map[string]bool{})
+	}
+	return ret, nil
+}
+
+// next returns a fresh transaction ID for a probe requesting combo.
+func (m *firewallMatrix) next(combo int) uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ret := m.base + (m.seq<<firewallRequestBits | uint64(combo))
+	m.seq++
+	return ret
+}
+
+// sent records a successful transmission of a probe requesting combo.
+func (m *firewallMatrix) sent(combo int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.outcomes[combo].Sent++
+}
+
+// received records a response with transaction ID txid from addr. It
+// returns false if txid isn't one of ours, and whether the response
+// came from a fresh source.
+func (m *firewallMatrix) received(txid uint64, from *net.UDPAddr) (fresh, ok bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	off := txid - m.base
+	if off>>firewallRequestBits >= m.seq {
+		return false, false
+	}
+	combo := int(off & (1<<firewallRequestBits - 1))
+	if combo >= len(m.outcomes) {
+		return false, false
+	}
+	o := m.outcomes[combo]
+	if o.FreshPort && from.IP.Equal(m.dest.IP) && from.Port == m.dest.Port {
+		// The server can't respond from a fresh source, and says so
+		// by responding from the probed address.
+		o.Unsupported++
+		return false, true
+	}
+	o.Received++
+	if !m.seen[combo][from.String()] {
+		o.From = append(o.From, copyUDPAddr(from))
+		m.seen[combo][from.String()] = true
+	}
+	return o.FreshPort, true
+}
+
+// relaySent records a successful transmission of a relay request.
+func (m *firewallMatrix) relaySent() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.thirdParty.Sent++
+}
+
+// relayRequest returns the relay request to send, with the server's
+// cookie if it has been received.
+func (m *firewallMatrix) relayRequest() []byte {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return internal.MarshalMessage(&internal.RelayRequest{Nonce: m.base, Cookie: m.relayCookie})
+}
+
+// relayMessage records msg, received from addr, if it's part of the
+// relay experiment. newCookie is set if msg carried the server's
+// cookie for the first time.
+func (m *firewallMatrix) relayMessage(msg internal.Message, addr *net.UDPAddr) (ok, newCookie bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	switch msg := msg.(type) {
+	case *internal.RelayReply:
+		if msg.Nonce != m.base {
+			return false, false
+		}
+		m.thirdParty.Replies++
+		m.thirdParty.Peers = int(msg.Peers)
+		if msg.Cookie != 0 && m.relayCookie == 0 {
+			m.relayCookie = msg.Cookie
+			newCookie = true
+		}
+	case *internal.RelayProbe:
+		if msg.Nonce != m.base {
+			return false, false
+		}
+		m.thirdParty.Received++
+		if !m.thirdPartySeen[addr.String()] {
+			m.thirdParty.From = append(m.thirdParty.From, copyUDPAddr(addr))
+			m.thirdPartySeen[addr.String()] = true
+		}
+	default:
+		return false, false
+	}
+	return true, newCookie
+}
+
+func (m *firewallMatrix) matrix() []*FirewallOutcome {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ret := make([]*FirewallOutcome, 0, len(m.outcomes))
+	for _, o := range m.outcomes {
+		c := *o
+		ret = append(ret, &c)
+	}
+	return ret
+}
+
+func (m *firewallMatrix) relay() *ThirdPartyProbe {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ret := m.thirdParty
+	return &ret
+}
+
+func probeFirewall(ctx context.Context, workingAddr chan *net.UDPAddr, duration time.Duration, txInterval time.Duration, rep *reporter) (*FirewallProbe, error) {
+	var dest *net.UDPAddr
+	select {
+	case dest = <-workingAddr:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if dest == nil {
+		return nil, fmt.Errorf("%w: no server responded to mapping probes, can't probe firewall", ErrNoWorkingServer)
+	}
+	rep.notify(&Event{Type: EventPhaseStarted, Phase: PhaseFirewall})
+	defer rep.notify(&Event{Type: EventPhaseFinished, Phase: PhaseFirewall})
+
+	matrix, err := newFirewallMatrix(dest)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		return nil, &SocketError{"listen", err}
+	}
+	defer conn.Close()
+	local := copyUDPAddr(conn.LocalAddr().(*net.UDPAddr))
+	rep.notify(&Event{Type: EventSocketOpened, Phase: PhaseFirewall, Local: local})
+
+	ctx, cancel := context.WithTimeout(ctx, duration)
+	defer cancel()
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		panic("deadline unexpectedly not set in context")
+	}
+	if err = conn.SetReadDeadline(deadline); err != nil {
+		return nil, &SocketError{"set deadline", err}
+	}
+	defer cancelReads(ctx, conn)()
+
+	txDone := make(chan struct{})
+	go func() {
+		defer close(txDone)
+		transmitFirewall(ctx, conn, dest, txInterval, matrix, func(err error) {
+			rep.notify(&Event{Type: EventPacketSent, Phase: PhaseFirewall, Local: local, Remote: dest, Err: err})
+		})
+	}()
+
+	var (
+		ret = FirewallProbe{
+			Local:  local,
+			Remote: copyUDPAddr(dest),
+		}
+		buf  [1500]byte
+		seen = map[string]bool{}
+	)
+	// The matrix must only be read once the transmitter is done with
+	// it.
+	finish := func(err error) (*FirewallProbe, error) {
+		cancel()
+		<-txDone
+		ret.Matrix = matrix.matrix()
+		ret.ThirdParty = matrix.relay()
+		return &ret, err
+	}
+	for {
+		n, addr, err := conn.ReadFromUDP(buf[:])
+		if err != nil {
+			if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+				return finish(nil)
+			}
+			return finish(&SocketError{"read", err})
+		}
+
+		if internal.IsMessage(buf[:n]) {
+			msg, err := internal.ParseMessage(buf[:n])
+			if err != nil {
+				continue
+			}
+			ok, newCookie := matrix.relayMessage(msg, addr)
+			if !ok {
+				continue
+			}
+			rep.notify(&Event{Type: EventResponseReceived, Phase: PhaseFirewall, Local: local, Remote: copyUDPAddr(addr)})
+			if newCookie {
+				// The server only relays requests with its cookie,
+				// don't wait for the next transmission to send one.
+				_, err := conn.WriteToUDP(matrix.relayRequest(), dest)
+				if err == nil {
+					matrix.relaySent()
+				}
+				rep.notify(&Event{Type: EventPacketSent, Phase: PhaseFirewall, Local: local, Remote: dest, Err: err})
+			}
+			continue
+		}
+
+		_, txid, hasTxID, ok := internal.ParseResponse(buf[:n])
+		if !ok {
+			continue
+		}
+		fresh := false
+		if hasTxID {
+			if fresh, ok = matrix.received(txid, addr); !ok {
+				continue
+			}
+		}
+		rep.notify(&Event{Type: EventResponseReceived, Phase: PhaseFirewall, Local: local, Remote: copyUDPAddr(addr)})
+
+		// Every fresh response comes from a different port, they're
+		// only recorded in the matrix.
+		if !fresh && !seen[addr.String()] {
+			ret.Received = append(ret.Received, addr)
+			seen[addr.String()] = true
+		}
+	}
+}
+
+// transmitFirewall sends a probe for each of firewallRequests and a
+// relay request from conn to dest every txInterval until ctx is done,
+// recording successful sends in matrix. Probes asking for a fresh
+// source go out at most every firewallFreshInterval. If sent is set,
+// it is called after each attempt to send a packet.
+func transmitFirewall(ctx context.Context, conn *net.UDPConn, dest *net.UDPAddr, txInterval time.Duration, matrix *firewallMatrix, sent func(err error)) {
+	var (
+		req       [internal.ProbeLen]byte
+		lastFresh time.Time
+	)
+	for {
+		fresh := time.Since(lastFresh) >= firewallFreshInterval
+		if fresh {
+			lastFresh = time.Now()
+		}
+
+		_, err := conn.WriteToUDP(matrix.relayRequest(), dest)
+		if err == nil {
+			matrix.relaySent()
+		}
+		if sent != nil {
+			sent(err)
+		}
+
+		for combo, flags := range firewallRequests {
+			if flags&internal.ProbeFlagFreshPort != 0 && !fresh {
+				continue
+			}
+			req[0] = flags
+			internal.SetProbeTxID(req[:], matrix.next(combo))
+			_, err := conn.WriteToUDP(req[:], dest)
+			if err == nil {
+				matrix.sent(combo)
+			}
+			if sent != nil {
+				sent(err)
+			}
+		}
+		timer := time.NewTimer(txInterval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package client
+
+import (
+	"net"
+	"testing"
+
+	"go.universe.tf/natprobe/internal"
+)
+
+// firewallSource returns the address that a server probed on
+// 203.0.113.1:3478 responds from when asked for flags.
+func firewallSource(flags byte) *net.UDPAddr {
+	ip, port := "203.0.113.1", 3478
+	if flags&internal.ProbeFlagVaryAddr != 0 {
+		ip = "203.0.113.2"
+	}
+	if flags&internal.ProbeFlagVaryPort != 0 {
+		port = 4000
+	}
+	if flags&internal.ProbeFlagFreshPort != 0 {
+		port = 50000
+	}
+	if flags&internal.ProbeFlagFreshAddr != 0 {
+		ip = "203.0.113.3"
+	}
+	return &net.UDPAddr{IP: net.ParseIP(ip), Port: port}
+}
+
+func TestFirewallMatrix(t *testing.T) {
+	dest := mustUDPAddr("203.0.113.1:3478")
+	for combo, flags := range firewallRequests {
+		fresh := flags&internal.ProbeFlagFreshPort != 0
+		tests := []struct {
+			desc            string
+			from            *net.UDPAddr
+			wantReceived    int
+			wantUnsupported int
+		}{
+			{"requested source", firewallSource(flags), 1, 0},
+			// Servers that can't respond from fresh sources respond
+			// from the probed address instead.
+			{"probed address", dest, 1, 0},
+		}
+		if fresh {
+			tests[1].wantReceived, tests[1].wantUnsupported = 0, 1
+		}
+
+		for _, test := range tests {
+			m, err := newFirewallMatrix(dest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			txid := m.next(combo)
+			m.sent(combo)
+			gotFresh, ok := m.received(txid, test.from)
+			if !ok {
+				t.Errorf("combo %d, %s: response not recognized", combo, test.desc)
+				continue
+			}
+			o := m.matrix()[combo]
+			if o.Sent != 1 || o.Received != test.wantReceived || o.Unsupported != test.wantUnsupported {
+				t.Errorf("combo %d, %s: sent %d, received %d, unsupported %d, want 1, %d, %d", combo, test.desc, o.Sent, o.Received, o.Unsupported, test.wantReceived, test.wantUnsupported)
+			}
+			if gotFresh != (fresh && test.wantReceived > 0) {
+				t.Errorf("combo %d, %s: fresh=%v, want %v", combo, test.desc, gotFresh, fresh && test.wantReceived > 0)
+			}
+			if o.VaryAddr != (flags&internal.ProbeFlagVaryAddr != 0) || o.VaryPort != (flags&internal.ProbeFlagVaryPort != 0) || o.FreshPort != fresh || o.FreshAddr != (flags&internal.ProbeFlagFreshAddr != 0) {
+				t.Errorf("combo %d: outcome %+v doesn't match request flags %#x", combo, o, flags)
+			}
+		}
+	}
+}
+
+func TestFirewallMatrixUnknownTxID(t *testing.T) {
+	m, err := newFirewallMatrix(mustUDPAddr("203.0.113.1:3478"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.next(0)
+	from := mustUDPAddr("203.0.113.1:3478")
+	for _, txid := range []uint64{
+		// Not sent yet.
+		m.base + 1<<firewallRequestBits,
+		// Not a combination.
+		m.base + uint64(len(firewallRequests)),
+		m.base - 1,
+	} {
+		if _, ok := m.received(txid, from); ok {
+			t.Errorf("received(%#x) accepted a transaction ID that wasn't sent", txid)
+		}
+	}
+}
+
+func TestFilteringMatrix(t *testing.T) {
+	const (
+		control byte = 0
+		addr    byte = internal.ProbeFlagVaryAddr
+		port    byte = internal.ProbeFlagVaryPort
+		both    byte = internal.ProbeFlagVaryAddr | internal.ProbeFlagVaryPort
+		fresh   byte = internal.ProbeFlagVaryPort | internal.ProbeFlagFreshPort
+	)
+	tests := []struct {
+		desc        string
+		through     []byte
+		want        Behavior
+		unsolicited InboundVerdict
+	}{
+		{"nothing", nil, UnknownBehavior, InboundUntested},
+		{"control only", []byte{control}, AddressAndPortDependent, InboundBlocked},
+		{"port varied", []byte{control, port}, AddressDependent, InboundBlocked},
+		{"address varied", []byte{control, addr}, PortDependent, InboundBlocked},
+		{"all but fresh", []byte{control, addr, port, both}, EndpointIndependent, InboundBlocked},
+		{"fresh port", []byte{control, addr, port, both, fresh}, EndpointIndependent, InboundAllowed},
+		// Without the control, the other responses say nothing.
+		{"varied without control", []byte{addr, port, both}, UnknownBehavior, InboundUntested},
+	}
+	for _, test := range tests {
+		through := map[byte]bool{}
+		for _, flags := range test.through {
+			through[flags] = true
+		}
+		p := &FirewallProbe{
+			Local:  mustUDPAddr("192.168.1.10:5000"),
+			Remote: mustUDPAddr("203.0.113.1:3478"),
+		}
+		for _, flags := range firewallRequests {
+			o := &FirewallOutcome{
+				VaryAddr:  flags&internal.ProbeFlagVaryAddr != 0,
+				VaryPort:  flags&internal.ProbeFlagVaryPort != 0,
+				FreshPort: flags&internal.ProbeFlagFreshPort != 0,
+				FreshAddr: flags&internal.ProbeFlagFreshAddr != 0,
+				Sent:      10,
+			}
+			if through[flags] {
+				o.Received = 10
+				o.From = []*net.UDPAddr{firewallSource(flags)}
+				if !o.FreshPort {
+					p.Received = append(p.Received, firewallSource(flags))
+				}
+			}
+			p.Matrix = append(p.Matrix, o)
+		}
+
+		a := (&Result{FirewallProbes: p}).Analyze()
+		if got := a.FilteringBehavior(); got != test.want {
+			t.Errorf("%s: filtering is %s, want %s", test.desc, got, test.want)
+		}
+		if a.UnsolicitedInbound != test.unsolicited {
+			t.Errorf("%s: unsolicited inbound is %s, want %s", test.desc, a.UnsolicitedInbound, test.unsolicited)
+		}
+	}
+}
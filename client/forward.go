@@ -0,0 +1,416 @@
+package client
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.universe.tf/natprobe/internal"
+)
+
+// ForwardOptions configures a port forwarding check. All zero values
+// except Port are replaced with sensible defaults.
+type ForwardOptions struct {
+	// The host:port of the probe server to use.
+	Server string
+
+	// The public port that should be forwarded to this machine.
+	Port int
+	// The local port the forward should deliver to. Defaults to Port.
+	LocalPort int
+
+	// The number of probes to ask the server to send.
+	Packets int
+	// How frequently to send requests to the server. Servers send at
+	// most one probe to a client IP every 250ms.
+	TransmitInterval time.Duration
+	// How long to spend getting a cookie from the server, and then
+	// how long to wait for probes to arrive.
+	Duration time.Duration
+}
+
+func (o *ForwardOptions) addDefaults() {
+	if o.Server == "" {
+		o.Server = DefaultServer
+	}
+	if o.LocalPort == 0 {
+		o.LocalPort = o.Port
+	}
+	if o.Packets == 0 {
+		o.Packets = 5
+	}
+	if o.TransmitInterval == 0 {
+		o.TransmitInterval = 300 * time.Millisecond
+	}
+	if o.Duration == 0 {
+		o.Duration = 3 * time.Second
+	}
+}
+
+// ForwardResult is the outcome of a port forwarding check.
+type ForwardResult struct {
+	// The public address the server sent probes to.
+	Target *net.UDPAddr
+	// The local port the forward should deliver to.
+	LocalPort int
+	// The local ports that listened for probes: LocalPort, and the
+	// public port if it's different and was available, to catch
+	// forwards to the wrong local port.
+	Listened []int
+	// The number of probes the server sent.
+	PacketsSent int
+	// Probes that arrived, ordered by sequence number.
+	Hits []*ForwardHit
+	// At least one probe arrived.
+	Arrived bool
+	// At least one probe arrived on LocalPort.
+	ArrivedOnLocalPort bool
+	// Every probe that arrived came from the port the server sent it
+	// from. False if none arrived.
+	SourcePortPreserved bool
+}
+
+// ForwardHit is a probe that arrived on a local port.
+type ForwardHit struct {
+	// The probe's sequence number, starting at 1.
+	Seq int
+	// The socket that received the probe.
+	Local *net.UDPAddr
+	// Where the probe appeared to come from.
+	From *net.UDPAddr
+	// The port the server sent the probe from.
+	SourcePort int
+}
+
+// String returns a human-readable description of the result.
+func (r *ForwardResult) String() string {
+	var ret []string
+	switch {
+	case r.ArrivedOnLocalPort:
+		ret = append(ret, fmt.Sprintf("Port forward works: %d of %d probes sent to %s arrived on local port %d.", len(r.Hits), r.PacketsSent, r.Target, r.LocalPort))
+	case r.Arrived:
+		ret = append(ret, fmt.Sprintf("Port forward delivers to the wrong local port: probes sent to %s arrived on local port %d, not %d.", r.Target, r.Hits[0].Local.Port, r.LocalPort))
+	default:
+		ret = append(ret, fmt.Sprintf("Port forward doesn't work: none of %d probes sent to %s arrived.", r.PacketsSent, r.Target))
+	}
+	if r.Arrived {
+		if r.SourcePortPreserved {
+			ret = append(ret, "    Probes kept their source port.")
+		} else {
+			ret = append(ret, "    Probes had their source port rewritten on the way.")
+		}
+	}
+	for _, hit := range r.Hits {
+		ret = append(ret, fmt.Sprintf("    Probe %d from %s (sent from port %d) arrived on %s", hit.Seq, hit.From, hit.SourcePort, hit.Local))
+	}
+	return strings.Join(ret, "\n")
+}
+
+// CheckForward checks that a public port is forwarded to this
+// machine, as a port forward or DMZ host on the router would: it
+// listens on the local port, asks the server to send probes to the
+// public port on this machine's public IP, and records which arrive.
+//
+// The server sends probes from ports the client never contacted, so
+// only a forward, not an existing mapping, can let them in.
+func CheckForward(ctx context.Context, opts *ForwardOptions) (*ForwardResult, error) {
+	if opts == nil {
+		opts = &ForwardOptions{}
+	}
+	opts.addDefaults()
+	if opts.Port <= 0 || opts.Port > 65535 {
+		return nil, fmt.Errorf("invalid public port %d", opts.Port)
+	}
+	if opts.LocalPort <= 0 || opts.LocalPort > 65535 {
+		return nil, fmt.Errorf("invalid local port %d", opts.LocalPort)
+	}
+	if opts.Packets > 65535 {
+		return nil, fmt.Errorf("can't send more than 65535 probes, got %d", opts.Packets)
+	}
+
+	server, err := resolveServer(ctx, opts.Server, opts.Duration)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := &ForwardResult{
+		LocalPort: opts.LocalPort,
+	}
+	var listeners []*net.UDPConn
+	defer func() {
+		for _, conn := range listeners {
+			conn.Close()
+		}
+	}()
+	for _, port := range []int{opts.LocalPort, opts.Port} {
+		if len(ret.Listened) > 0 && port == ret.Listened[0] {
+			continue
+		}
+		conn, err := net.ListenUDP("udp4", &net.UDPAddr{Port: port})
+		if err != nil {
+			if port == opts.LocalPort {
+				return nil, &SocketError{"listen", err}
+			}
+			// The public port is only a guess at a misconfiguration,
+			// it's fine if something else is using it.
+			continue
+		}
+		listeners = append(listeners, conn)
+		ret.Listened = append(ret.Listened, port)
+	}
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		return nil, &SocketError{"listen", err}
+	}
+	defer conn.Close()
+
+	var nonce [8]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nil, err
+	}
+	req := &internal.ForwardRequest{
+		Nonce: binary.BigEndian.Uint64(nonce[:]),
+		Port:  uint16(opts.Port),
+	}
+
+	reply, err := requestForwardCookie(ctx, conn, server, req, opts)
+	if err != nil {
+		return nil, err
+	}
+	req.Cookie = reply.Cookie
+	ret.Target = &net.UDPAddr{IP: reply.Mapped.IP, Port: opts.Port}
+
+	var (
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		deadline = time.Now().Add(opts.Duration)
+		sent     = map[uint16]bool{}
+	)
+	for _, l := range listeners {
+		wg.Add(1)
+		go func(l *net.UDPConn) {
+			defer wg.Done()
+			hits := receiveForward(l, req.Nonce, deadline)
+			mu.Lock()
+			defer mu.Unlock()
+			ret.Hits = append(ret.Hits, hits...)
+		}(l)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for _, seq := range receiveForwardReplies(conn, server, req.Nonce, deadline) {
+			mu.Lock()
+			sent[seq] = true
+			mu.Unlock()
+		}
+	}()
+
+	for seq := 1; seq <= opts.Packets && ctx.Err() == nil && time.Now().Before(deadline); seq++ {
+		req.Seq = uint16(seq)
+		conn.WriteToUDP(internal.MarshalMessage(req), server)
+		select {
+		case <-ctx.Done():
+		case <-time.After(opts.TransmitInterval):
+		}
+	}
+	wg.Wait()
+
+	ret.PacketsSent = len(sent)
+	sort.Slice(ret.Hits, func(i, j int) bool { return ret.Hits[i].Seq < ret.Hits[j].Seq })
+	ret.Arrived = len(ret.Hits) > 0
+	ret.SourcePortPreserved = ret.Arrived
+	for _, hit := range ret.Hits {
+		if hit.Local.Port == opts.LocalPort {
+			ret.ArrivedOnLocalPort = true
+		}
+		if hit.From.Port != hit.SourcePort {
+			ret.SourcePortPreserved = false
+		}
+	}
+
+	return ret, nil
+}
+
+// requestForwardCookie gets the cookie for req from server.
+func requestForwardCookie(ctx context.Context, conn *net.UDPConn, server *net.UDPAddr, req *internal.ForwardRequest, opts *ForwardOptions) (*internal.ForwardReply, error) {
+	ctx, cancel := context.WithTimeout(ctx, opts.Duration)
+	defer cancel()
+
+	var reply *internal.ForwardReply
+	pkt := internal.MarshalMessage(req)
+	err := exchangeMessages(ctx, conn, opts.TransmitInterval,
+		func() {
+			conn.WriteToUDP(pkt, server)
+		},
+		func(addr *net.UDPAddr, msg internal.Message) bool {
+			r, ok := msg.(*internal.ForwardReply)
+			if !ok || r.Nonce != req.Nonce || !addr.IP.Equal(server.IP) {
+				return false
+			}
+			reply = r
+			return true
+		})
+	switch {
+	case err == context.DeadlineExceeded:
+		return nil, errors.New("no reply from server to forward request")
+	case err != nil:
+		return nil, err
+	case reply.Mapped == nil:
+		return nil, errors.New("server did not report this machine's public IP")
+	}
+	return reply, nil
+}
+
+// receiveForwardReplies returns the sequence numbers of requests that
+// server reports sending a probe for, until deadline.
+func receiveForwardReplies(conn *net.UDPConn, server *net.UDPAddr, nonce uint64, deadline time.Time) []uint16 {
+	if err := conn.SetReadDeadline(deadline); err != nil {
+		return nil
+	}
+
+	var (
+		ret []uint16
+		buf [1500]byte
+	)
+	for {
+		n, addr, err := conn.ReadFromUDP(buf[:])
+		if err != nil {
+			return ret
+		}
+		msg, err := internal.ParseMessage(buf[:n])
+		if err != nil {
+			continue
+		}
+		if r, ok := msg.(*internal.ForwardReply); ok && r.Nonce == nonce && r.Sent && addr.IP.Equal(server.IP) {
+			ret = append(ret, r.Seq)
+		}
+	}
+}
+
+// receiveForward returns the probes with nonce that arrive on conn
+// before deadline. It doesn't check where they come from, since the
+// point is to see what the router does to them.
+func receiveForward(conn *net.UDPConn, nonce uint64, deadline time.Time) []*ForwardHit {
+	if err := conn.SetReadDeadline(deadline); err != nil {
+		return nil
+	}
+
+	var (
+		ret  []*ForwardHit
+		seen = map[uint16]bool{}
+		buf  [1500]byte
+	)
+	local := copyUDPAddr(conn.LocalAddr().(*net.UDPAddr))
+	for {
+		n, addr, err := conn.ReadFromUDP(buf[:])
+		if err != nil {
+			return ret
+		}
+		msg, err := internal.ParseMessage(buf[:n])
+		if err != nil {
+			continue
+		}
+		probe, ok := msg.(*internal.ForwardProbe)
+		if !ok || probe.Nonce != nonce || seen[probe.Seq] {
+			continue
+		}
+		seen[probe.Seq] = true
+		ret = append(ret, &ForwardHit{
+			Seq:        int(probe.Seq),
+			Local:      local,
+			From:       copyUDPAddr(addr),
+			SourcePort: int(probe.SourcePort),
+		})
+	}
+}
+
+type jsonForwardResult struct {
+	header
+	Target              udpAddr       `json:"target"`
+	LocalPort           int           `json:"localPort"`
+	Listened            []int         `json:"listened"`
+	PacketsSent         int           `json:"packetsSent"`
+	Hits                []*ForwardHit `json:"hits"`
+	Arrived             bool          `json:"arrived"`
+	ArrivedOnLocalPort  bool          `json:"arrivedOnLocalPort"`
+	SourcePortPreserved bool          `json:"sourcePortPreserved"`
+}
+
+// MarshalJSON implements json.Marshaler.
+func (r ForwardResult) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonForwardResult{
+		header:              header{SchemaVersion, kindForward},
+		Target:              udpAddr{r.Target},
+		LocalPort:           r.LocalPort,
+		Listened:            r.Listened,
+		PacketsSent:         r.PacketsSent,
+		Hits:                r.Hits,
+		Arrived:             r.Arrived,
+		ArrivedOnLocalPort:  r.ArrivedOnLocalPort,
+		SourcePortPreserved: r.SourcePortPreserved,
+	})
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (r *ForwardResult) UnmarshalJSON(bs []byte) error {
+	var j jsonForwardResult
+	if err := json.Unmarshal(bs, &j); err != nil {
+		return err
+	}
+	if err := j.check(kindForward); err != nil {
+		return err
+	}
+	*r = ForwardResult{
+		Target:              j.Target.UDPAddr,
+		LocalPort:           j.LocalPort,
+		Listened:            j.Listened,
+		PacketsSent:         j.PacketsSent,
+		Hits:                j.Hits,
+		Arrived:             j.Arrived,
+		ArrivedOnLocalPort:  j.ArrivedOnLocalPort,
+		SourcePortPreserved: j.SourcePortPreserved,
+	}
+	return nil
+}
+
+type jsonForwardHit struct {
+	Seq        int     `json:"seq"`
+	Local      udpAddr `json:"local"`
+	From       udpAddr `json:"from"`
+	SourcePort int     `json:"sourcePort"`
+}
+
+// MarshalJSON implements json.Marshaler.
+func (h ForwardHit) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonForwardHit{
+		Seq:        h.Seq,
+		Local:      udpAddr{h.Local},
+		From:       udpAddr{h.From},
+		SourcePort: h.SourcePort,
+	})
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (h *ForwardHit) UnmarshalJSON(bs []byte) error {
+	var j jsonForwardHit
+	if err := json.Unmarshal(bs, &j); err != nil {
+		return err
+	}
+	*h = ForwardHit{
+		Seq:        j.Seq,
+		Local:      j.Local.UDPAddr,
+		From:       j.From.UDPAddr,
+		SourcePort: j.SourcePort,
+	}
+	return nil
+}
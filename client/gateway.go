@@ -0,0 +1,329 @@
+package client
+
+import (
+	"context"
+	"crypto/rand"
+	"net"
+	"strings"
+	"time"
+
+	"go.universe.tf/natprobe/internal"
+)
+
+// portMapInitialInterval is the first retransmission interval for
+// NAT-PMP and PCP requests, which doubles after every attempt.
+const portMapInitialInterval = 250 * time.Millisecond
+
+// gatewayMappingLifetime is how long the gateway probe asks its
+// temporary mapping to last. The probe deletes it once done anyway.
+const gatewayMappingLifetime = time.Minute
+
+// probeGateway queries gw, or the default gateway if gw is nil, over
+// NAT-PMP and PCP on port. It asks for the gateway's external address and for
+// a temporary UDP mapping, then once workingAddr delivers a probe
+// server that answered, checks what that server sees of traffic from
+// the mapping. Each exchange with the gateway or the server takes at
+// most duration.
+func probeGateway(ctx context.Context, gw net.IP, port int, duration time.Duration, workingAddr <-chan *net.UDPAddr, rep *reporter) (ret *GatewayProbe, err error) {
+	rep.notify(&Event{Type: EventPhaseStarted, Phase: PhaseGateway})
+	defer func() {
+		rep.notify(&Event{Type: EventPhaseFinished, Phase: PhaseGateway, Err: err})
+	}()
+
+	if gw == nil {
+		if gw, err = defaultGateway(); err != nil {
+			return nil, err
+		}
+	}
+	ret = &GatewayProbe{IP: gw}
+	server := &net.UDPAddr{IP: gw, Port: port}
+	local, err := sourceIP(gw)
+	if err != nil {
+		return ret, err
+	}
+
+	if err := queryExternalAddr(ctx, ret, server, local, duration, rep); err != nil {
+		return ret, err
+	}
+	conn, del, err := requestMapping(ctx, ret, server, local, duration, rep)
+	if err != nil || conn == nil {
+		return ret, err
+	}
+	defer conn.Close()
+	// Best effort, the mapping expires soon anyway.
+	defer conn.WriteToUDP(del, server)
+
+	var dest *net.UDPAddr
+	select {
+	case dest = <-workingAddr:
+	case <-ctx.Done():
+	}
+	if dest == nil {
+		return ret, nil
+	}
+	ret.Mapping.Observed, err = observeMapping(ctx, conn, dest, duration, rep)
+	return ret, err
+}
+
+// queryExternalAddr asks the gateway's port mapping server for its
+// external address over NAT-PMP, and records the outcome in gw. PCP has no such request,
+// but PCP-only gateways still say that they don't speak NAT-PMP.
+func queryExternalAddr(ctx context.Context, gw *GatewayProbe, server *net.UDPAddr, local net.IP, duration time.Duration, rep *reporter) error {
+	conn, err := listenPortMap(local, rep)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	req := internal.MarshalNATPMPRequest(&internal.NATPMPRequest{Op: internal.NATPMPOpExternalAddr})
+	resp, err := portMapRequest(ctx, conn, server, req, duration, rep)
+	if err != nil || resp == nil {
+		return err
+	}
+	if resp[0] == internal.PCPVersion {
+		gw.PCP = true
+		return nil
+	}
+	r, err := internal.ParseNATPMPResponse(resp)
+	if err != nil {
+		return nil
+	}
+	gw.NATPMP = true
+	if r.Result == internal.PortMapSuccess {
+		gw.ExternalIP = r.ExternalIP
+	}
+	return nil
+}
+
+// requestMapping asks the gateway's port mapping server for a
+// temporary mapping over PCP, falling back to NAT-PMP, and records the
+// outcome in gw. If the gateway granted a mapping, it returns the
+// socket the mapping is for, and the request that deletes the mapping.
+func requestMapping(ctx context.Context, gw *GatewayProbe, server *net.UDPAddr, local net.IP, duration time.Duration, rep *reporter) (conn *net.UDPConn, del []byte, err error) {
+	var errs []string
+	defer func() {
+		if gw.Mapping == nil && len(errs) > 0 {
+			gw.MappingError = strings.Join(errs, ", ")
+		}
+	}()
+
+	conn, err = listenPortMap(local, rep)
+	if err != nil {
+		return nil, nil, err
+	}
+	laddr := copyUDPAddr(conn.LocalAddr().(*net.UDPAddr))
+	pcp := &internal.PCPRequest{
+		Op:       internal.PCPOpMap,
+		Lifetime: uint32(gatewayMappingLifetime / time.Second),
+		ClientIP: local,
+		Map: &internal.PCPMap{
+			Protocol:     internal.PCPProtoUDP,
+			InternalPort: uint16(laddr.Port),
+		},
+	}
+	if _, err := rand.Read(pcp.Map.Nonce[:]); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	resp, err := portMapRequest(ctx, conn, server, internal.MarshalPCPRequest(pcp), duration, rep)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	switch {
+	case resp == nil:
+	case resp[0] == internal.NATPMPVersion:
+		// A NAT-PMP gateway saying it doesn't speak PCP.
+		gw.NATPMP = true
+	default:
+		r, err := internal.ParsePCPResponse(resp)
+		if err != nil || r.Map == nil || r.Map.Nonce != pcp.Map.Nonce {
+			break
+		}
+		gw.PCP = true
+		if r.Result != internal.PortMapSuccess {
+			errs = append(errs, "pcp: "+internal.PCPResultName(r.Result))
+			break
+		}
+		gw.Mapping = &GatewayMapping{
+			Protocol: "pcp",
+			Local:    laddr,
+			External: &net.UDPAddr{IP: r.Map.ExternalIP, Port: int(r.Map.ExternalPort)},
+			Lifetime: time.Duration(r.Lifetime) * time.Second,
+		}
+		if gw.ExternalIP == nil {
+			gw.ExternalIP = r.Map.ExternalIP
+		}
+		pcp.Lifetime = 0
+		return conn, internal.MarshalPCPRequest(pcp), nil
+	}
+	conn.Close()
+	if !gw.NATPMP {
+		return nil, nil, nil
+	}
+
+	// Late PCP responses would be mistaken for NAT-PMP ones on the
+	// same socket.
+	conn, err = listenPortMap(local, rep)
+	if err != nil {
+		return nil, nil, err
+	}
+	laddr = copyUDPAddr(conn.LocalAddr().(*net.UDPAddr))
+	natpmp := &internal.NATPMPRequest{
+		Op:           internal.NATPMPOpMapUDP,
+		InternalPort: uint16(laddr.Port),
+		Lifetime:     uint32(gatewayMappingLifetime / time.Second),
+	}
+	resp, err = portMapRequest(ctx, conn, server, internal.MarshalNATPMPRequest(natpmp), duration, rep)
+	if err != nil || resp == nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	r, err := internal.ParseNATPMPResponse(resp)
+	switch {
+	case err != nil:
+	case r.Result != internal.PortMapSuccess:
+		errs = append(errs, "nat-pmp: "+internal.NATPMPResultName(r.Result))
+	case r.InternalPort == natpmp.InternalPort:
+		gw.Mapping = &GatewayMapping{
+			Protocol: "nat-pmp",
+			Local:    laddr,
+			External: &net.UDPAddr{IP: gw.ExternalIP, Port: int(r.ExternalPort)},
+			Lifetime: time.Duration(r.Lifetime) * time.Second,
+		}
+		natpmp.Lifetime = 0
+		return conn, internal.MarshalNATPMPRequest(natpmp), nil
+	}
+	conn.Close()
+	return nil, nil, nil
+}
+
+// observeMapping sends probes from conn to dest until dest answers,
+// and returns the mapped address it reports. It returns nil if dest
+// didn't answer within duration.
+func observeMapping(ctx context.Context, conn *net.UDPConn, dest *net.UDPAddr, duration time.Duration, rep *reporter) (*net.UDPAddr, error) {
+	local := copyUDPAddr(conn.LocalAddr().(*net.UDPAddr))
+	ctx, cancel := context.WithTimeout(ctx, duration)
+	defer cancel()
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		panic("deadline unexpectedly not set in context")
+	}
+	if err := conn.SetReadDeadline(deadline); err != nil {
+		return nil, &SocketError{"set deadline", err}
+	}
+	defer cancelReads(ctx, conn)()
+
+	txDone := make(chan struct{})
+	go func() {
+		defer close(txDone)
+		transmit(ctx, conn, []*net.UDPAddr{dest}, portMapInitialInterval, func(dest *net.UDPAddr, err error) {
+			rep.notify(&Event{Type: EventPacketSent, Phase: PhaseGateway, Local: local, Remote: dest, Err: err})
+		})
+	}()
+	defer func() {
+		cancel()
+		<-txDone
+	}()
+
+	var buf [1500]byte
+	for {
+		n, addr, err := conn.ReadFromUDP(buf[:])
+		if err != nil {
+			if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+				return nil, nil
+			}
+			return nil, &SocketError{"read", err}
+		}
+		if !addr.IP.Equal(dest.IP) || addr.Port != dest.Port {
+			continue
+		}
+		if mapped, _, _, ok := internal.ParseResponse(buf[:n]); ok {
+			rep.notify(&Event{Type: EventResponseReceived, Phase: PhaseGateway, Local: local, Remote: copyUDPAddr(addr), Mapped: copyUDPAddr(mapped)})
+			return copyUDPAddr(mapped), nil
+		}
+	}
+}
+
+// sourceIP returns the local IP that packets to ip are sent from.
+// Port mapping requests have to come from it, since PCP requests
+// carry it and mappings are for it.
+func sourceIP(ip net.IP) (net.IP, error) {
+	conn, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: ip, Port: internal.PortMapPort})
+	if err != nil {
+		return nil, &SocketError{"dial", err}
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP, nil
+}
+
+func listenPortMap(local net.IP, rep *reporter) (*net.UDPConn, error) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: local})
+	if err != nil {
+		return nil, &SocketError{"listen", err}
+	}
+	rep.notify(&Event{Type: EventSocketOpened, Phase: PhaseGateway, Local: copyUDPAddr(conn.LocalAddr().(*net.UDPAddr))})
+	return conn, nil
+}
+
+// portMapRequest sends req to the port mapping server dest from conn,
+// retrying as RFC 6886 and RFC 6887 say for up to duration, and
+// returns the first response with the matching opcode, of either
+// protocol. It returns a nil response if dest never answered.
+func portMapRequest(ctx context.Context, conn *net.UDPConn, dest *net.UDPAddr, req []byte, duration time.Duration, rep *reporter) ([]byte, error) {
+	local := copyUDPAddr(conn.LocalAddr().(*net.UDPAddr))
+
+	ctx, cancel := context.WithTimeout(ctx, duration)
+	defer cancel()
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		panic("deadline unexpectedly not set in context")
+	}
+	if err := conn.SetReadDeadline(deadline); err != nil {
+		return nil, &SocketError{"set deadline", err}
+	}
+	defer cancelReads(ctx, conn)()
+
+	txDone := make(chan struct{})
+	go func() {
+		defer close(txDone)
+		interval := portMapInitialInterval
+		for {
+			_, err := conn.WriteToUDP(req, dest)
+			rep.notify(&Event{Type: EventPacketSent, Phase: PhaseGateway, Local: local, Remote: dest, Err: err})
+			timer := time.NewTimer(interval)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+			interval *= 2
+		}
+	}()
+	defer func() {
+		cancel()
+		<-txDone
+	}()
+
+	var buf [1100]byte
+	for {
+		n, addr, err := conn.ReadFromUDP(buf[:])
+		if err != nil {
+			if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+				return nil, nil
+			}
+			return nil, &SocketError{"read", err}
+		}
+		if !addr.IP.Equal(dest.IP) || addr.Port != dest.Port {
+			continue
+		}
+		if n < 4 || buf[1] != req[1]|internal.OpResponse {
+			continue
+		}
+		rep.notify(&Event{Type: EventResponseReceived, Phase: PhaseGateway, Local: local, Remote: copyUDPAddr(addr)})
+		return append([]byte(nil), buf[:n]...), nil
+	}
+}
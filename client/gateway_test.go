@@ -0,0 +1,119 @@
+package client
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	logrtesting "github.com/go-logr/logr/testing"
+	"go.universe.tf/natprobe/internal"
+)
+
+// portMapServer runs s on 127.0.0.1, until the returned socket is
+// closed.
+func portMapServer(t *testing.T, s *internal.PortMapServer) *net.UDPConn {
+	t.Helper()
+	conn := blackhole(t)
+	s.Logger = logrtesting.NullLogger{}
+	s.Start = time.Now()
+	s.MaxLifetime = time.Hour
+	go s.Serve(conn)
+	return conn
+}
+
+func TestProbeGateway(t *testing.T) {
+	server := loopbackServer(t)
+	defer server.Close()
+	external := net.IPv4(203, 0, 113, 1).To4()
+
+	tests := []struct {
+		desc string
+		// nil for no gateway.
+		gw           *internal.PortMapServer
+		wantPCP      bool
+		wantNATPMP   bool
+		wantProtocol string
+		wantError    string
+	}{
+		{"pcp", &internal.PortMapServer{ExternalIP: external, PCP: true, NATPMP: true, PortOffset: 1}, true, true, "pcp", ""},
+		{"pcp only", &internal.PortMapServer{ExternalIP: external, PCP: true, PortOffset: 1}, true, false, "pcp", ""},
+		{"nat-pmp fallback", &internal.PortMapServer{ExternalIP: external, NATPMP: true, PortOffset: 1}, false, true, "nat-pmp", ""},
+		{"refused", &internal.PortMapServer{ExternalIP: external, PCP: true, NATPMP: true, Refuse: true}, true, true, "", "pcp: NOT_AUTHORIZED, nat-pmp: NOT_AUTHORIZED"},
+		{"no gateway", nil, false, false, "", ""},
+	}
+	for _, test := range tests {
+		var conn *net.UDPConn
+		if test.gw != nil {
+			conn = portMapServer(t, test.gw)
+		} else {
+			conn = blackhole(t)
+		}
+		working := make(chan *net.UDPAddr, 1)
+		working <- server.LocalAddr().(*net.UDPAddr)
+
+		gw, err := probeGateway(context.Background(), net.IPv4(127, 0, 0, 1), conn.LocalAddr().(*net.UDPAddr).Port, 300*time.Millisecond, working, nil)
+		conn.Close()
+		if err != nil {
+			t.Errorf("%s: probeGateway: %s", test.desc, err)
+			continue
+		}
+		if gw.PCP != test.wantPCP || gw.NATPMP != test.wantNATPMP {
+			t.Errorf("%s: gateway speaks PCP=%v, NAT-PMP=%v, want %v, %v", test.desc, gw.PCP, gw.NATPMP, test.wantPCP, test.wantNATPMP)
+		}
+		if gw.MappingError != test.wantError {
+			t.Errorf("%s: mapping error %q, want %q", test.desc, gw.MappingError, test.wantError)
+		}
+
+		if test.wantProtocol == "" {
+			if gw.Mapping != nil {
+				t.Errorf("%s: gateway granted mapping %s, want none", test.desc, gw.Mapping)
+			}
+			continue
+		}
+		if gw.Mapping == nil {
+			t.Errorf("%s: gateway granted no mapping", test.desc)
+			continue
+		}
+		m := gw.Mapping
+		if m.Protocol != test.wantProtocol {
+			t.Errorf("%s: mapping made over %s, want %s", test.desc, m.Protocol, test.wantProtocol)
+		}
+		if !gw.ExternalIP.Equal(external) || !m.External.IP.Equal(external) || m.External.Port != m.Local.Port+1 {
+			t.Errorf("%s: gateway reported external IP %s and mapped %s to %s, want %s and port %d", test.desc, gw.ExternalIP, m.Local, m.External, external, m.Local.Port+1)
+		}
+		// The stand-in forwards nothing, so the probe server sees the
+		// local socket itself.
+		if m.Observed == nil || m.Observed.Port != m.Local.Port {
+			t.Errorf("%s: probe server observed the mapping as %s, want port %d", test.desc, m.Observed, m.Local.Port)
+		}
+	}
+}
+
+func TestProbeGatewayPort(t *testing.T) {
+	server := loopbackServer(t)
+	defer server.Close()
+	gw := portMapServer(t, &internal.PortMapServer{ExternalIP: net.IPv4(203, 0, 113, 1).To4(), PCP: true})
+	defer gw.Close()
+
+	res, err := Probe(context.Background(), &Options{
+		ServerAddrs:      []string{"127.0.0.1"},
+		Ports:            []int{server.LocalAddr().(*net.UDPAddr).Port},
+		MappingDuration:  300 * time.Millisecond,
+		FirewallDuration: 300 * time.Millisecond,
+		PathMaxHops:      1,
+		PathDuration:     100 * time.Millisecond,
+		Gateway:          net.IPv4(127, 0, 0, 1),
+		GatewayPort:      gw.LocalAddr().(*net.UDPAddr).Port,
+		GatewayDuration:  300 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("Probe: %s", err)
+	}
+	if res.Gateway == nil || res.Gateway.Mapping == nil {
+		t.Fatalf("Probe got no mapping from the gateway on port %d: %s", gw.LocalAddr().(*net.UDPAddr).Port, res.Gateway)
+	}
+	if res.Metadata.Options.GatewayPort != gw.LocalAddr().(*net.UDPAddr).Port {
+		t.Errorf("result records gateway port %d, want %d", res.Metadata.Options.GatewayPort, gw.LocalAddr().(*net.UDPAddr).Port)
+	}
+}
@@ -0,0 +1,334 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"go.universe.tf/natprobe/internal"
+)
+
+// PunchOptions configures a hole punching test. All zero values are
+// replaced with sensible defaults, except Session which must be set.
+type PunchOptions struct {
+	// The host:port of the probe server to use for rendezvous. If
+	// empty, a server with CapabilityRendezvous is found with
+	// Discover.
+	Server string
+	// Configures discovery, when Server is empty.
+	Discovery *DiscoveryOptions
+	// The session code shared with the peer. Both peers must use the
+	// same code and the same server.
+	Session string
+
+	// How long to wait for the peer to join the session.
+	RendezvousTimeout time.Duration
+	// How long to try punching once the peer's address is known.
+	PunchDuration time.Duration
+	// How frequently to send rendezvous and punch packets.
+	TransmitInterval time.Duration
+}
+
+func (o *PunchOptions) addDefaults() {
+	if o.RendezvousTimeout == 0 {
+		o.RendezvousTimeout = time.Minute
+	}
+	if o.PunchDuration == 0 {
+		o.PunchDuration = 10 * time.Second
+	}
+	if o.TransmitInterval == 0 {
+		o.TransmitInterval = 100 * time.Millisecond
+	}
+}
+
+// How long to keep acknowledging the peer's punches after connecting,
+// so that the peer also learns that the connection works.
+const punchLinger = time.Second
+
+// PunchResult is the outcome of a hole punching test.
+type PunchResult struct {
+	// Packets made it through both NATs in both directions.
+	Success bool
+	// The local socket address.
+	Local *net.UDPAddr
+	// The local socket's address as seen by the rendezvous server.
+	Mapped *net.UDPAddr
+	// The peer's address as seen by the rendezvous server.
+	PeerMapped *net.UDPAddr
+	// The peer's LAN address, as reported by the peer.
+	PeerLocal *net.UDPAddr
+	// The peer address that packets were received from, nil if no
+	// packets from the peer made it through.
+	Remote *net.UDPAddr
+	// The time from learning the peer's address to connecting. Zero
+	// if Success is false.
+	TimeToConnect time.Duration
+}
+
+// String returns a human-readable description of the result.
+func (r *PunchResult) String() string {
+	var ret []string
+	if r.Success {
+		ret = append(ret, fmt.Sprintf("Hole punching succeeded after %s.", r.TimeToConnect))
+	} else if r.Remote != nil {
+		ret = append(ret, "Hole punching failed: packets from the peer got through, but the peer never confirmed receiving ours.")
+	} else {
+		ret = append(ret, "Hole punching failed: no packets from the peer got through.")
+	}
+	ret = append(ret,
+		fmt.Sprintf("    Local address: %s", r.Local),
+		fmt.Sprintf("    Mapped address: %s", r.Mapped),
+		fmt.Sprintf("    Peer mapped address: %s", r.PeerMapped),
+		fmt.Sprintf("    Peer LAN address: %s", r.PeerLocal),
+	)
+	if r.Remote != nil {
+		ret = append(ret, fmt.Sprintf("    Working address pair: %s <-> %s", r.Local, r.Remote))
+	}
+	return strings.Join(ret, "\n")
+}
+
+// Punch meets a peer through a probe server's rendezvous service,
+// then attempts simultaneous UDP hole punching with that peer.
+//
+// An error is returned if the test could not be carried out, for
+// example because the peer never showed up. Failure to punch through
+// is reported in the returned PunchResult.
+func Punch(ctx context.Context, opts *PunchOptions) (*PunchResult, error) {
+	if opts == nil {
+		opts = &PunchOptions{}
+	}
+	opts.addDefaults()
+	if opts.Session == "" {
+		return nil, errors.New("no session code given")
+	}
+	if len(opts.Session) > internal.MaxSessionLen {
+		return nil, fmt.Errorf("session code is longer than %d bytes", internal.MaxSessionLen)
+	}
+	if opts.Server == "" {
+		addr, err := discoverServer(ctx, opts.Discovery, CapabilityRendezvous)
+		if err != nil {
+			return nil, err
+		}
+		opts.Server = addr
+	}
+
+	server, err := resolveServer(ctx, opts.Server, opts.RendezvousTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	ret := &PunchResult{
+		Local: lanAddr(server, conn.LocalAddr().(*net.UDPAddr).Port),
+	}
+
+	// Rendezvous: tell the server about ourselves until it tells us
+	// about our peer.
+	rctx, cancel := context.WithTimeout(ctx, opts.RendezvousTimeout)
+	defer cancel()
+	// The server only pairs us up once we repeat the cookie it
+	// answers our first request with.
+	join := &internal.Rendezvous{Session: opts.Session, Local: ret.Local}
+	err = exchangeMessages(rctx, conn, opts.TransmitInterval,
+		func() {
+			conn.WriteToUDP(internal.MarshalMessage(join), server)
+		},
+		func(addr *net.UDPAddr, msg internal.Message) bool {
+			if !addr.IP.Equal(server.IP) {
+				return false
+			}
+			switch m := msg.(type) {
+			case *internal.RendezvousReply:
+				if m.Session == opts.Session && join.Cookie != m.Cookie {
+					join.Cookie = m.Cookie
+					conn.WriteToUDP(internal.MarshalMessage(join), server)
+				}
+			case *internal.Peer:
+				if m.Session == opts.Session {
+					ret.Mapped, ret.PeerMapped, ret.PeerLocal = m.Mapped, m.PeerMapped, m.PeerLocal
+					return true
+				}
+			}
+			return false
+		})
+	switch {
+	case err == context.DeadlineExceeded && ctx.Err() == nil:
+		return nil, fmt.Errorf("peer did not join session %q within %s", opts.Session, opts.RendezvousTimeout)
+	case err != nil:
+		return nil, err
+	}
+
+	// Punch: send to all of the peer's candidate addresses until we
+	// hear from the peer, then until the peer says it heard from us.
+	candidates := []*net.UDPAddr{ret.PeerMapped}
+	if ret.PeerLocal != nil && ret.PeerLocal.String() != ret.PeerMapped.String() {
+		candidates = append(candidates, ret.PeerLocal)
+	}
+
+	start := time.Now()
+	pctx, cancel := context.WithTimeout(ctx, opts.PunchDuration)
+	defer cancel()
+	send := func() {
+		punch := internal.MarshalMessage(&internal.Punch{Session: opts.Session, Ack: ret.Remote != nil})
+		for _, dest := range candidates {
+			conn.WriteToUDP(punch, dest)
+		}
+	}
+	err = exchangeMessages(pctx, conn, opts.TransmitInterval, send, func(addr *net.UDPAddr, msg internal.Message) bool {
+		punch, ok := msg.(*internal.Punch)
+		if !ok || punch.Session != opts.Session {
+			return false
+		}
+		if ret.Remote == nil {
+			ret.Remote = copyUDPAddr(addr)
+		}
+		return punch.Ack
+	})
+	switch {
+	case err == context.DeadlineExceeded && ctx.Err() == nil:
+		return ret, nil
+	case err != nil:
+		return nil, err
+	}
+	ret.Success = true
+	ret.TimeToConnect = time.Since(start)
+
+	// The peer may not have seen our acknowledgement yet, keep
+	// sending it for a little while.
+	lctx, cancel := context.WithTimeout(ctx, punchLinger)
+	defer cancel()
+	exchangeMessages(lctx, conn, opts.TransmitInterval, send, func(*net.UDPAddr, internal.Message) bool { return false })
+
+	return ret, nil
+}
+
+// exchangeMessages calls send every txInterval, and passes every
+// control message received on conn to recv, until recv returns true
+// or ctx is done.
+func exchangeMessages(ctx context.Context, conn *net.UDPConn, txInterval time.Duration, send func(), recv func(*net.UDPAddr, internal.Message) bool) error {
+	var (
+		buf    [1500]byte
+		nextTx time.Time
+	)
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		now := time.Now()
+		if !now.Before(nextTx) {
+			send()
+			nextTx = now.Add(txInterval)
+		}
+		deadline := nextTx
+		if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+			deadline = d
+		}
+		if err := conn.SetReadDeadline(deadline); err != nil {
+			return err
+		}
+
+		n, addr, err := conn.ReadFromUDP(buf[:])
+		if err != nil {
+			if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+				continue
+			}
+			return err
+		}
+		msg, err := internal.ParseMessage(buf[:n])
+		if err != nil {
+			continue
+		}
+		if recv(addr, msg) {
+			return nil
+		}
+	}
+}
+
+// resolveServer resolves a host:port string to an IPv4 UDP address.
+func resolveServer(ctx context.Context, hostport string, timeout time.Duration) (*net.UDPAddr, error) {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return nil, err
+	}
+	portNum, err := net.LookupPort("udp", port)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := resolveServerAddrs(ctx, net.DefaultResolver, []string{host}, timeout, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &net.UDPAddr{IP: ips[0], Port: portNum}, nil
+}
+
+// lanAddr returns the LAN address that a socket bound to the wildcard
+// address and port uses to talk to dest.
+func lanAddr(dest *net.UDPAddr, port int) *net.UDPAddr {
+	// Connecting a UDP socket sends no packets, but makes the kernel
+	// pick the source IP it would use.
+	conn, err := net.DialUDP("udp4", nil, dest)
+	if err != nil {
+		return nil
+	}
+	defer conn.Close()
+	return &net.UDPAddr{
+		IP:   conn.LocalAddr().(*net.UDPAddr).IP,
+		Port: port,
+	}
+}
+
+type jsonPunchResult struct {
+	header
+	Success       bool     `json:"success"`
+	Local         udpAddr  `json:"local"`
+	Mapped        udpAddr  `json:"mapped"`
+	PeerMapped    udpAddr  `json:"peerMapped"`
+	PeerLocal     udpAddr  `json:"peerLocal"`
+	Remote        udpAddr  `json:"remote"`
+	TimeToConnect duration `json:"timeToConnect"`
+}
+
+// MarshalJSON implements json.Marshaler.
+func (r PunchResult) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonPunchResult{
+		header:        header{SchemaVersion, kindPunch},
+		Success:       r.Success,
+		Local:         udpAddr{r.Local},
+		Mapped:        udpAddr{r.Mapped},
+		PeerMapped:    udpAddr{r.PeerMapped},
+		PeerLocal:     udpAddr{r.PeerLocal},
+		Remote:        udpAddr{r.Remote},
+		TimeToConnect: duration(r.TimeToConnect),
+	})
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (r *PunchResult) UnmarshalJSON(bs []byte) error {
+	var j jsonPunchResult
+	if err := json.Unmarshal(bs, &j); err != nil {
+		return err
+	}
+	if err := j.check(kindPunch); err != nil {
+		return err
+	}
+	*r = PunchResult{
+		Success:       j.Success,
+		Local:         j.Local.UDPAddr,
+		Mapped:        j.Mapped.UDPAddr,
+		PeerMapped:    j.PeerMapped.UDPAddr,
+		PeerLocal:     j.PeerLocal.UDPAddr,
+		Remote:        j.Remote.UDPAddr,
+		TimeToConnect: time.Duration(j.TimeToConnect),
+	}
+	return nil
+}
@@ -0,0 +1,999 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SchemaVersion is the version of the JSON encoding of the documents
+// that this package produces, such as Result, Analysis, Diff and
+// Prediction. It is bumped whenever the encoding changes in a way that
+// older decoders cannot handle. The schema itself is published in
+// schema.json.
+//
+// The decoders reject documents of the wrong kind or without a schema
+// version, except for results and analyses written before versioning,
+// which have neither version nor kind. Those are decoded as version 0
+// and migrated.
+const SchemaVersion = 1
+
+// Values of the "kind" field in JSON documents.
+const (
+	kindResult     = "result"
+	kindAnalysis   = "analysis"
+	kindDiff       = "diff"
+	kindPrediction = "prediction"
+	kindPunch      = "punch"
+	kindSpray      = "spray"
+	kindForward    = "forward"
+	kindDirectory  = "directory"
+	kindSubmission = "submission"
+)
+
+const modulePath = "go.universe.tf/natprobe"
+
+// Metadata describes how a Result was obtained.
+type Metadata struct {
+	// The version of the natprobe module that ran the probe.
+	ToolVersion string
+	// When the probe started.
+	Started time.Time
+	// How long the probe took.
+	Duration time.Duration
+	// The options used for the probe, with defaults filled in.
+	Options *Options
+}
+
+func toolVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	if info.Main.Path == modulePath {
+		return info.Main.Version
+	}
+	for _, dep := range info.Deps {
+		if dep.Path == modulePath {
+			return dep.Version
+		}
+	}
+	return "unknown"
+}
+
+// header is the part of the JSON encoding common to all documents.
+type header struct {
+	SchemaVersion int    `json:"schemaVersion"`
+	Kind          string `json:"kind"`
+}
+
+// legacy reports whether h is the header of a document from before
+// schema versioning.
+func (h header) legacy() bool {
+	return h.SchemaVersion == 0 && h.Kind == ""
+}
+
+func (h header) check(kind string) error {
+	switch {
+	case h.SchemaVersion <= 0:
+		return fmt.Errorf("document has no schema version, want a %s document with schema version %d", kind, SchemaVersion)
+	case h.SchemaVersion > SchemaVersion:
+		return fmt.Errorf("unsupported schema version %d, this version of natprobe supports up to %d", h.SchemaVersion, SchemaVersion)
+	case h.Kind == "":
+		return fmt.Errorf("document has no kind, want %q", kind)
+	case h.Kind != kind:
+		return fmt.Errorf("document kind is %q, want %q", h.Kind, kind)
+	}
+	return nil
+}
+
+// DocumentKind returns the kind of the JSON document bs, e.g. "result"
+// or "analysis". For documents from before schema versioning, which
+// have no kind, it infers the kind from their fields, and returns ""
+// if it can't tell.
+func DocumentKind(bs []byte) (string, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(bs, &fields); err != nil {
+		return "", err
+	}
+	var h header
+	if err := json.Unmarshal(bs, &h); err != nil {
+		return "", err
+	}
+	switch {
+	case !h.legacy():
+		return h.Kind, nil
+	case fields["MappingProbes"] != nil:
+		return kindResult, nil
+	case fields["NoData"] != nil:
+		return kindAnalysis, nil
+	default:
+		return "", nil
+	}
+}
+
+type jsonResult struct {
+	header
+	Metadata       *Metadata        `json:"metadata,omitempty"`
+	LocalIPs       []net.IP         `json:"localIPs"`
+	EgressIP       net.IP           `json:"egressIP,omitempty"`
+	Selection      *ServerSelection `json:"selection,omitempty"`
+	MappingProbes  []*MappingProbe  `json:"mappingProbes"`
+	FirewallProbes *FirewallProbe   `json:"firewallProbes"`
+	ServerStats    []*ServerStats   `json:"serverStats,omitempty"`
+	Path           *PathProbe       `json:"path,omitempty"`
+	Gateway        *GatewayProbe    `json:"gateway,omitempty"`
+}
+
+// MarshalJSON implements json.Marshaler.
+func (r Result) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonResult{
+		header:         header{SchemaVersion, kindResult},
+		Metadata:       r.Metadata,
+		LocalIPs:       r.LocalIPs,
+		EgressIP:       r.EgressIP,
+		Selection:      r.Selection,
+		MappingProbes:  r.MappingProbes,
+		FirewallProbes: r.FirewallProbes,
+		ServerStats:    r.ServerStats,
+		Path:           r.Path,
+		Gateway:        r.Gateway,
+	})
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (r *Result) UnmarshalJSON(bs []byte) error {
+	var h header
+	if err := json.Unmarshal(bs, &h); err != nil {
+		return err
+	}
+	if h.legacy() {
+		return r.unmarshalLegacy(bs)
+	}
+
+	var j jsonResult
+	if err := json.Unmarshal(bs, &j); err != nil {
+		return err
+	}
+	if err := j.check(kindResult); err != nil {
+		return err
+	}
+	*r = Result{
+		Metadata:       j.Metadata,
+		LocalIPs:       j.LocalIPs,
+		EgressIP:       j.EgressIP,
+		Selection:      j.Selection,
+		MappingProbes:  j.MappingProbes,
+		FirewallProbes: j.FirewallProbes,
+		ServerStats:    j.ServerStats,
+		Path:           j.Path,
+		Gateway:        j.Gateway,
+	}
+	return nil
+}
+
+// legacyResult is the version 0 encoding of Result: Go's default
+// encoding of the structs of the time.
+type legacyResult struct {
+	LocalIPs      []net.IP
+	MappingProbes []*struct {
+		Local, Mapped, Remote *net.UDPAddr
+		Timeout               bool
+	}
+	FirewallProbes *struct {
+		Local, Remote *net.UDPAddr
+		Received      []*net.UDPAddr
+	}
+}
+
+func (r *Result) unmarshalLegacy(bs []byte) error {
+	var j legacyResult
+	if err := json.Unmarshal(bs, &j); err != nil {
+		return fmt.Errorf("decoding version 0 result: %w", err)
+	}
+	*r = Result{
+		LocalIPs: j.LocalIPs,
+	}
+	for _, p := range j.MappingProbes {
+		r.MappingProbes = append(r.MappingProbes, &MappingProbe{
+			Local:   p.Local,
+			Mapped:  p.Mapped,
+			Remote:  p.Remote,
+			Timeout: p.Timeout,
+		})
+	}
+	// Without a matrix, the analysis falls back to the addresses that
+	// responses came from.
+	if p := j.FirewallProbes; p != nil {
+		r.FirewallProbes = &FirewallProbe{
+			Local:    p.Local,
+			Remote:   p.Remote,
+			Received: p.Received,
+		}
+	}
+	return nil
+}
+
+type jsonMetadata struct {
+	ToolVersion string    `json:"toolVersion"`
+	Started     time.Time `json:"started"`
+	Duration    duration  `json:"duration"`
+	Options     *Options  `json:"options,omitempty"`
+}
+
+// MarshalJSON implements json.Marshaler.
+func (m Metadata) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonMetadata{
+		ToolVersion: m.ToolVersion,
+		Started:     m.Started,
+		Duration:    duration(m.Duration),
+		Options:     m.Options,
+	})
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (m *Metadata) UnmarshalJSON(bs []byte) error {
+	var j jsonMetadata
+	if err := json.Unmarshal(bs, &j); err != nil {
+		return err
+	}
+	*m = Metadata{
+		ToolVersion: j.ToolVersion,
+		Started:     j.Started,
+		Duration:    time.Duration(j.Duration),
+		Options:     j.Options,
+	}
+	return nil
+}
+
+type jsonOptions struct {
+	ServerAddrs              []string `json:"serverAddrs"`
+	Ports                    []int    `json:"ports"`
+	ResolveDuration          duration `json:"resolveDuration"`
+	DisableSelection         bool     `json:"disableSelection,omitempty"`
+	SelectionDuration        duration `json:"selectionDuration"`
+	MappingDuration          duration `json:"mappingDuration"`
+	MappingTransmitInterval  duration `json:"mappingTransmitInterval"`
+	MappingSockets           int      `json:"mappingSockets"`
+	FirewallDuration         duration `json:"firewallDuration"`
+	FirewallTransmitInterval duration `json:"firewallTransmitInterval"`
+	PathMaxHops              int      `json:"pathMaxHops,omitempty"`
+	PathDuration             duration `json:"pathDuration,omitempty"`
+	Gateway                  net.IP   `json:"gateway,omitempty"`
+	GatewayPort              int      `json:"gatewayPort,omitempty"`
+	GatewayDuration          duration `json:"gatewayDuration,omitempty"`
+}
+
+// MarshalJSON implements json.Marshaler.
+func (o Options) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonOptions{
+		ServerAddrs:              o.ServerAddrs,
+		Ports:                    o.Ports,
+		ResolveDuration:          duration(o.ResolveDuration),
+		DisableSelection:         o.DisableSelection,
+		SelectionDuration:        duration(o.SelectionDuration),
+		MappingDuration:          duration(o.MappingDuration),
+		MappingTransmitInterval:  duration(o.MappingTransmitInterval),
+		MappingSockets:           o.MappingSockets,
+		FirewallDuration:         duration(o.FirewallDuration),
+		FirewallTransmitInterval: duration(o.FirewallTransmitInterval),
+		PathMaxHops:              o.PathMaxHops,
+		PathDuration:             duration(o.PathDuration),
+		Gateway:                  o.Gateway,
+		GatewayPort:              o.GatewayPort,
+		GatewayDuration:          duration(o.GatewayDuration),
+	})
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (o *Options) UnmarshalJSON(bs []byte) error {
+	var j jsonOptions
+	if err := json.Unmarshal(bs, &j); err != nil {
+		return err
+	}
+	*o = Options{
+		ServerAddrs:              j.ServerAddrs,
+		Ports:                    j.Ports,
+		ResolveDuration:          time.Duration(j.ResolveDuration),
+		DisableSelection:         j.DisableSelection,
+		SelectionDuration:        time.Duration(j.SelectionDuration),
+		MappingDuration:          time.Duration(j.MappingDuration),
+		MappingTransmitInterval:  time.Duration(j.MappingTransmitInterval),
+		MappingSockets:           j.MappingSockets,
+		FirewallDuration:         time.Duration(j.FirewallDuration),
+		FirewallTransmitInterval: time.Duration(j.FirewallTransmitInterval),
+		PathMaxHops:              j.PathMaxHops,
+		PathDuration:             time.Duration(j.PathDuration),
+		Gateway:                  j.Gateway,
+		GatewayPort:              j.GatewayPort,
+		GatewayDuration:          time.Duration(j.GatewayDuration),
+	}
+	return nil
+}
+
+type jsonMappingProbe struct {
+	Local   udpAddr `json:"local"`
+	Mapped  udpAddr `json:"mapped"`
+	Remote  udpAddr `json:"remote"`
+	Timeout bool    `json:"timeout"`
+}
+
+// MarshalJSON implements json.Marshaler.
+func (p MappingProbe) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonMappingProbe{
+		Local:   udpAddr{p.Local},
+		Mapped:  udpAddr{p.Mapped},
+		Remote:  udpAddr{p.Remote},
+		Timeout: p.Timeout,
+	})
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (p *MappingProbe) UnmarshalJSON(bs []byte) error {
+	var j jsonMappingProbe
+	if err := json.Unmarshal(bs, &j); err != nil {
+		return err
+	}
+	*p = MappingProbe{
+		Local:   j.Local.UDPAddr,
+		Mapped:  j.Mapped.UDPAddr,
+		Remote:  j.Remote.UDPAddr,
+		Timeout: j.Timeout,
+	}
+	return nil
+}
+
+type jsonFirewallProbe struct {
+	Local      udpAddr            `json:"local"`
+	Remote     udpAddr            `json:"remote"`
+	Received   []udpAddr          `json:"received"`
+	Matrix     []*FirewallOutcome `json:"matrix,omitempty"`
+	ThirdParty *ThirdPartyProbe   `json:"thirdParty,omitempty"`
+}
+
+// MarshalJSON implements json.Marshaler.
+func (p FirewallProbe) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonFirewallProbe{
+		Local:      udpAddr{p.Local},
+		Remote:     udpAddr{p.Remote},
+		Received:   toUDPAddrs(p.Received),
+		Matrix:     p.Matrix,
+		ThirdParty: p.ThirdParty,
+	})
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (p *FirewallProbe) UnmarshalJSON(bs []byte) error {
+	var j jsonFirewallProbe
+	if err := json.Unmarshal(bs, &j); err != nil {
+		return err
+	}
+	*p = FirewallProbe{
+		Local:      j.Local.UDPAddr,
+		Remote:     j.Remote.UDPAddr,
+		Received:   fromUDPAddrs(j.Received),
+		Matrix:     j.Matrix,
+		ThirdParty: j.ThirdParty,
+	}
+	return nil
+}
+
+type jsonThirdPartyProbe struct {
+	Sent     int       `json:"sent"`
+	Replies  int       `json:"replies"`
+	Peers    int       `json:"peers"`
+	Received int       `json:"received"`
+	From     []udpAddr `json:"from"`
+}
+
+// MarshalJSON implements json.Marshaler.
+func (p ThirdPartyProbe) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonThirdPartyProbe{
+		Sent:     p.Sent,
+		Replies:  p.Replies,
+		Peers:    p.Peers,
+		Received: p.Received,
+		From:     toUDPAddrs(p.From),
+	})
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (p *ThirdPartyProbe) UnmarshalJSON(bs []byte) error {
+	var j jsonThirdPartyProbe
+	if err := json.Unmarshal(bs, &j); err != nil {
+		return err
+	}
+	*p = ThirdPartyProbe{
+		Sent:     j.Sent,
+		Replies:  j.Replies,
+		Peers:    j.Peers,
+		Received: j.Received,
+		From:     fromUDPAddrs(j.From),
+	}
+	return nil
+}
+
+type jsonFirewallOutcome struct {
+	VaryAddr    bool      `json:"varyAddr"`
+	VaryPort    bool      `json:"varyPort"`
+	FreshPort   bool      `json:"freshPort,omitempty"`
+	FreshAddr   bool      `json:"freshAddr,omitempty"`
+	Sent        int       `json:"sent"`
+	Received    int       `json:"received"`
+	Unsupported int       `json:"unsupported,omitempty"`
+	From        []udpAddr `json:"from"`
+}
+
+// MarshalJSON implements json.Marshaler.
+func (o FirewallOutcome) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonFirewallOutcome{
+		VaryAddr:    o.VaryAddr,
+		VaryPort:    o.VaryPort,
+		FreshPort:   o.FreshPort,
+		FreshAddr:   o.FreshAddr,
+		Sent:        o.Sent,
+		Received:    o.Received,
+		Unsupported: o.Unsupported,
+		From:        toUDPAddrs(o.From),
+	})
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (o *FirewallOutcome) UnmarshalJSON(bs []byte) error {
+	var j jsonFirewallOutcome
+	if err := json.Unmarshal(bs, &j); err != nil {
+		return err
+	}
+	*o = FirewallOutcome{
+		VaryAddr:    j.VaryAddr,
+		VaryPort:    j.VaryPort,
+		FreshPort:   j.FreshPort,
+		FreshAddr:   j.FreshAddr,
+		Sent:        j.Sent,
+		Received:    j.Received,
+		Unsupported: j.Unsupported,
+		From:        fromUDPAddrs(j.From),
+	}
+	return nil
+}
+
+type jsonPathProbe struct {
+	Remote  udpAddr `json:"remote"`
+	Hops    []*Hop  `json:"hops"`
+	Reached bool    `json:"reached"`
+}
+
+// MarshalJSON implements json.Marshaler.
+func (p PathProbe) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonPathProbe{
+		Remote:  udpAddr{p.Remote},
+		Hops:    p.Hops,
+		Reached: p.Reached,
+	})
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (p *PathProbe) UnmarshalJSON(bs []byte) error {
+	var j jsonPathProbe
+	if err := json.Unmarshal(bs, &j); err != nil {
+		return err
+	}
+	*p = PathProbe{
+		Remote:  j.Remote.UDPAddr,
+		Hops:    j.Hops,
+		Reached: j.Reached,
+	}
+	return nil
+}
+
+type jsonHop struct {
+	TTL int        `json:"ttl"`
+	IP  optionalIP `json:"ip"`
+}
+
+// MarshalJSON implements json.Marshaler.
+func (h Hop) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonHop{
+		TTL: h.TTL,
+		IP:  optionalIP{h.IP},
+	})
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (h *Hop) UnmarshalJSON(bs []byte) error {
+	var j jsonHop
+	if err := json.Unmarshal(bs, &j); err != nil {
+		return err
+	}
+	*h = Hop{
+		TTL: j.TTL,
+		IP:  j.IP.IP,
+	}
+	return nil
+}
+
+type jsonGatewayProbe struct {
+	IP           net.IP          `json:"ip"`
+	NATPMP       bool            `json:"natpmp"`
+	PCP          bool            `json:"pcp"`
+	ExternalIP   optionalIP      `json:"externalIP"`
+	Mapping      *GatewayMapping `json:"mapping,omitempty"`
+	MappingError string          `json:"mappingError,omitempty"`
+}
+
+// MarshalJSON implements json.Marshaler.
+func (p GatewayProbe) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonGatewayProbe{
+		IP:           p.IP,
+		NATPMP:       p.NATPMP,
+		PCP:          p.PCP,
+		ExternalIP:   optionalIP{p.ExternalIP},
+		Mapping:      p.Mapping,
+		MappingError: p.MappingError,
+	})
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (p *GatewayProbe) UnmarshalJSON(bs []byte) error {
+	var j jsonGatewayProbe
+	if err := json.Unmarshal(bs, &j); err != nil {
+		return err
+	}
+	*p = GatewayProbe{
+		IP:           j.IP,
+		NATPMP:       j.NATPMP,
+		PCP:          j.PCP,
+		ExternalIP:   j.ExternalIP.IP,
+		Mapping:      j.Mapping,
+		MappingError: j.MappingError,
+	}
+	return nil
+}
+
+// jsonGatewayMapping splits the external address, whose IP may be
+// unknown.
+type jsonGatewayMapping struct {
+	Protocol     string     `json:"protocol"`
+	Local        udpAddr    `json:"local"`
+	ExternalIP   optionalIP `json:"externalIP"`
+	ExternalPort int        `json:"externalPort"`
+	Lifetime     duration   `json:"lifetime"`
+	Observed     udpAddr    `json:"observed"`
+}
+
+// MarshalJSON implements json.Marshaler.
+func (m GatewayMapping) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonGatewayMapping{
+		Protocol:     m.Protocol,
+		Local:        udpAddr{m.Local},
+		ExternalIP:   optionalIP{m.External.IP},
+		ExternalPort: m.External.Port,
+		Lifetime:     duration(m.Lifetime),
+		Observed:     udpAddr{m.Observed},
+	})
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (m *GatewayMapping) UnmarshalJSON(bs []byte) error {
+	var j jsonGatewayMapping
+	if err := json.Unmarshal(bs, &j); err != nil {
+		return err
+	}
+	*m = GatewayMapping{
+		Protocol: j.Protocol,
+		Local:    j.Local.UDPAddr,
+		External: &net.UDPAddr{IP: j.ExternalIP.IP, Port: j.ExternalPort},
+		Lifetime: time.Duration(j.Lifetime),
+		Observed: j.Observed.UDPAddr,
+	}
+	return nil
+}
+
+// MarshalJSON implements json.Marshaler.
+func (v InboundVerdict) MarshalJSON() ([]byte, error) {
+	return json.Marshal(v.String())
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (v *InboundVerdict) UnmarshalJSON(bs []byte) error {
+	var s string
+	if err := json.Unmarshal(bs, &s); err != nil {
+		return err
+	}
+	for _, verdict := range []InboundVerdict{InboundUntested, InboundAllowed, InboundBlocked} {
+		if s == verdict.String() {
+			*v = verdict
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown inbound verdict %q", s)
+}
+
+type jsonServerStats struct {
+	Remote   udpAddr  `json:"remote"`
+	Sent     int      `json:"sent"`
+	Received int      `json:"received"`
+	RTT      duration `json:"rtt"`
+}
+
+// MarshalJSON implements json.Marshaler.
+func (s ServerStats) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonServerStats{
+		Remote:   udpAddr{s.Remote},
+		Sent:     s.Sent,
+		Received: s.Received,
+		RTT:      duration(s.RTT),
+	})
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (s *ServerStats) UnmarshalJSON(bs []byte) error {
+	var j jsonServerStats
+	if err := json.Unmarshal(bs, &j); err != nil {
+		return err
+	}
+	*s = ServerStats{
+		Remote:   j.Remote.UDPAddr,
+		Sent:     j.Sent,
+		Received: j.Received,
+		RTT:      time.Duration(j.RTT),
+	}
+	return nil
+}
+
+type jsonServerSelection struct {
+	Candidates []*jsonCandidate `json:"candidates"`
+	Selected   []net.IP         `json:"selected"`
+}
+
+type jsonCandidate struct {
+	IP        net.IP   `json:"ip"`
+	Reachable bool     `json:"reachable"`
+	RTT       duration `json:"rtt"`
+}
+
+// MarshalJSON implements json.Marshaler.
+func (s ServerSelection) MarshalJSON() ([]byte, error) {
+	j := jsonServerSelection{
+		Selected: s.Selected,
+	}
+	for _, c := range s.Candidates {
+		j.Candidates = append(j.Candidates, &jsonCandidate{c.IP, c.Reachable, duration(c.RTT)})
+	}
+	return json.Marshal(j)
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (s *ServerSelection) UnmarshalJSON(bs []byte) error {
+	var j jsonServerSelection
+	if err := json.Unmarshal(bs, &j); err != nil {
+		return err
+	}
+	*s = ServerSelection{
+		Selected: j.Selected,
+	}
+	for _, c := range j.Candidates {
+		s.Candidates = append(s.Candidates, &Candidate{c.IP, c.Reachable, time.Duration(c.RTT)})
+	}
+	return nil
+}
+
+type jsonAnalysis struct {
+	header
+	Metadata                   *Metadata         `json:"metadata,omitempty"`
+	NoData                     bool              `json:"noData"`
+	NoNAT                      bool              `json:"noNAT"`
+	MappingVariesByDestIP      bool              `json:"mappingVariesByDestIP"`
+	MappingVariesByDestPort    bool              `json:"mappingVariesByDestPort"`
+	FirewallEnforcesDestIP     bool              `json:"firewallEnforcesDestIP"`
+	FirewallEnforcesDestPort   bool              `json:"firewallEnforcesDestPort"`
+	FirewallUntested           bool              `json:"firewallUntested"`
+	UnsolicitedInbound         InboundVerdict    `json:"unsolicitedInbound"`
+	ThirdPartyInbound          InboundVerdict    `json:"thirdPartyInbound"`
+	MappingPreservesSourcePort bool              `json:"mappingPreservesSourcePort"`
+	MappingSequential          bool              `json:"mappingSequential"`
+	MultiplePublicIPs          bool              `json:"multiplePublicIPs"`
+	FilteredEgress             []int             `json:"filteredEgress"`
+	PublicIPs                  []net.IP          `json:"publicIPs"`
+	CGNAT                      bool              `json:"cgnat"`
+	DoubleNAT                  bool              `json:"doubleNAT"`
+	PortMapping                string            `json:"portMapping"`
+	Evidence                   *AnalysisEvidence `json:"evidence,omitempty"`
+}
+
+// MarshalJSON implements json.Marshaler.
+func (a Analysis) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonAnalysis{
+		header:                     header{SchemaVersion, kindAnalysis},
+		Metadata:                   a.Metadata,
+		NoData:                     a.NoData,
+		NoNAT:                      a.NoNAT,
+		MappingVariesByDestIP:      a.MappingVariesByDestIP,
+		MappingVariesByDestPort:    a.MappingVariesByDestPort,
+		FirewallEnforcesDestIP:     a.FirewallEnforcesDestIP,
+		FirewallEnforcesDestPort:   a.FirewallEnforcesDestPort,
+		FirewallUntested:           a.FirewallUntested,
+		UnsolicitedInbound:         a.UnsolicitedInbound,
+		ThirdPartyInbound:          a.ThirdPartyInbound,
+		MappingPreservesSourcePort: a.MappingPreservesSourcePort,
+		MappingSequential:          a.MappingSequential,
+		MultiplePublicIPs:          a.MultiplePublicIPs,
+		FilteredEgress:             a.FilteredEgress,
+		PublicIPs:                  a.PublicIPs,
+		CGNAT:                      a.CGNAT,
+		DoubleNAT:                  a.DoubleNAT,
+		PortMapping:                a.PortMapping,
+		Evidence:                   a.Evidence,
+	})
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (a *Analysis) UnmarshalJSON(bs []byte) error {
+	var h header
+	if err := json.Unmarshal(bs, &h); err != nil {
+		return err
+	}
+	if h.legacy() {
+		return a.unmarshalLegacy(bs)
+	}
+
+	var j jsonAnalysis
+	if err := json.Unmarshal(bs, &j); err != nil {
+		return err
+	}
+	if err := j.check(kindAnalysis); err != nil {
+		return err
+	}
+	*a = Analysis{
+		Metadata:                   j.Metadata,
+		NoData:                     j.NoData,
+		NoNAT:                      j.NoNAT,
+		MappingVariesByDestIP:      j.MappingVariesByDestIP,
+		MappingVariesByDestPort:    j.MappingVariesByDestPort,
+		FirewallEnforcesDestIP:     j.FirewallEnforcesDestIP,
+		FirewallEnforcesDestPort:   j.FirewallEnforcesDestPort,
+		FirewallUntested:           j.FirewallUntested,
+		UnsolicitedInbound:         j.UnsolicitedInbound,
+		ThirdPartyInbound:          j.ThirdPartyInbound,
+		MappingPreservesSourcePort: j.MappingPreservesSourcePort,
+		MappingSequential:          j.MappingSequential,
+		MultiplePublicIPs:          j.MultiplePublicIPs,
+		FilteredEgress:             j.FilteredEgress,
+		PublicIPs:                  j.PublicIPs,
+		CGNAT:                      j.CGNAT,
+		DoubleNAT:                  j.DoubleNAT,
+		PortMapping:                j.PortMapping,
+		Evidence:                   j.Evidence,
+	}
+	return nil
+}
+
+// legacyAnalysis is the version 0 encoding of Analysis.
+type legacyAnalysis struct {
+	NoData                     bool
+	NoNAT                      bool
+	MappingVariesByDestIP      bool
+	MappingVariesByDestPort    bool
+	FirewallEnforcesDestIP     bool
+	FirewallEnforcesDestPort   bool
+	MappingPreservesSourcePort bool
+	MultiplePublicIPs          bool
+	FilteredEgress             []int
+}
+
+func (a *Analysis) unmarshalLegacy(bs []byte) error {
+	var j legacyAnalysis
+	if err := json.Unmarshal(bs, &j); err != nil {
+		return fmt.Errorf("decoding version 0 analysis: %w", err)
+	}
+	// Version 0 had none of the other conclusions, they keep their
+	// zero values: untested inbound traffic, and no sequential
+	// allocation, CGNAT, double NAT or port mapping.
+	*a = Analysis{
+		NoData:                     j.NoData,
+		NoNAT:                      j.NoNAT,
+		MappingVariesByDestIP:      j.MappingVariesByDestIP,
+		MappingVariesByDestPort:    j.MappingVariesByDestPort,
+		FirewallEnforcesDestIP:     j.FirewallEnforcesDestIP,
+		FirewallEnforcesDestPort:   j.FirewallEnforcesDestPort,
+		MappingPreservesSourcePort: j.MappingPreservesSourcePort,
+		MultiplePublicIPs:          j.MultiplePublicIPs,
+		FilteredEgress:             j.FilteredEgress,
+	}
+	return nil
+}
+
+type jsonEvidence struct {
+	Unknown                 bool                  `json:"unknown,omitempty"`
+	Confidence              float64               `json:"confidence"`
+	SupportingMappings      []*MappingProbe       `json:"supportingMappings,omitempty"`
+	ContradictingMappings   []*MappingProbe       `json:"contradictingMappings,omitempty"`
+	SupportingReceptions    []udpAddr             `json:"supportingReceptions,omitempty"`
+	ContradictingReceptions []udpAddr             `json:"contradictingReceptions,omitempty"`
+	SupportingAddresses     []*AddressObservation `json:"supportingAddresses,omitempty"`
+	ContradictingAddresses  []*AddressObservation `json:"contradictingAddresses,omitempty"`
+}
+
+// MarshalJSON implements json.Marshaler.
+func (e Evidence) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonEvidence{
+		Unknown:                 e.Unknown,
+		Confidence:              e.Confidence,
+		SupportingMappings:      e.SupportingMappings,
+		ContradictingMappings:   e.ContradictingMappings,
+		SupportingReceptions:    toUDPAddrs(e.SupportingReceptions),
+		ContradictingReceptions: toUDPAddrs(e.ContradictingReceptions),
+		SupportingAddresses:     e.SupportingAddresses,
+		ContradictingAddresses:  e.ContradictingAddresses,
+	})
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (e *Evidence) UnmarshalJSON(bs []byte) error {
+	var j jsonEvidence
+	if err := json.Unmarshal(bs, &j); err != nil {
+		return err
+	}
+	*e = Evidence{
+		Unknown:                 j.Unknown,
+		Confidence:              j.Confidence,
+		SupportingMappings:      j.SupportingMappings,
+		ContradictingMappings:   j.ContradictingMappings,
+		SupportingReceptions:    fromUDPAddrs(j.SupportingReceptions),
+		ContradictingReceptions: fromUDPAddrs(j.ContradictingReceptions),
+		SupportingAddresses:     j.SupportingAddresses,
+		ContradictingAddresses:  j.ContradictingAddresses,
+	}
+	return nil
+}
+
+type jsonAddressObservation struct {
+	Source string `json:"source"`
+	IP     net.IP `json:"ip"`
+}
+
+// MarshalJSON implements json.Marshaler.
+func (o AddressObservation) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonAddressObservation{
+		Source: o.Source,
+		IP:     o.IP,
+	})
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (o *AddressObservation) UnmarshalJSON(bs []byte) error {
+	var j jsonAddressObservation
+	if err := json.Unmarshal(bs, &j); err != nil {
+		return err
+	}
+	*o = AddressObservation{
+		Source: j.Source,
+		IP:     j.IP,
+	}
+	return nil
+}
+
+// udpAddr is a *net.UDPAddr that encodes to JSON as an "ip:port"
+// string.
+type udpAddr struct {
+	*net.UDPAddr
+}
+
+func (a udpAddr) MarshalJSON() ([]byte, error) {
+	if a.UDPAddr == nil {
+		return []byte("null"), nil
+	}
+	return json.Marshal(a.UDPAddr.String())
+}
+
+func (a *udpAddr) UnmarshalJSON(bs []byte) error {
+	if string(bs) == "null" {
+		a.UDPAddr = nil
+		return nil
+	}
+
+	var s string
+	if err := json.Unmarshal(bs, &s); err != nil {
+		return err
+	}
+	addr, err := parseUDPAddr(s)
+	if err != nil {
+		return err
+	}
+	a.UDPAddr = addr
+	return nil
+}
+
+// optionalIP is a net.IP that encodes to JSON as null when nil,
+// rather than as an empty string.
+type optionalIP struct {
+	net.IP
+}
+
+func (ip optionalIP) MarshalJSON() ([]byte, error) {
+	if ip.IP == nil {
+		return []byte("null"), nil
+	}
+	return json.Marshal(ip.IP)
+}
+
+func (ip *optionalIP) UnmarshalJSON(bs []byte) error {
+	if string(bs) == "null" {
+		ip.IP = nil
+		return nil
+	}
+	// Older encoders wrote nil IPs as empty strings, which net.IP
+	// decodes to nil.
+	return json.Unmarshal(bs, &ip.IP)
+}
+
+// parseUDPAddr parses an "ip:port" string without resolving names.
+func parseUDPAddr(s string) (*net.UDPAddr, error) {
+	host, portStr, err := net.SplitHostPort(s)
+	if err != nil {
+		return nil, err
+	}
+	var zone string
+	if i := strings.LastIndexByte(host, '%'); i >= 0 {
+		host, zone = host[:i], host[i+1:]
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IP address %q in %q", host, s)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 0 || port > 65535 {
+		return nil, fmt.Errorf("invalid port %q in %q", portStr, s)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	return &net.UDPAddr{IP: ip, Port: port, Zone: zone}, nil
+}
+
+func toUDPAddrs(addrs []*net.UDPAddr) []udpAddr {
+	if addrs == nil {
+		return nil
+	}
+	ret := make([]udpAddr, 0, len(addrs))
+	for _, addr := range addrs {
+		ret = append(ret, udpAddr{addr})
+	}
+	return ret
+}
+
+func fromUDPAddrs(addrs []udpAddr) []*net.UDPAddr {
+	if addrs == nil {
+		return nil
+	}
+	ret := make([]*net.UDPAddr, 0, len(addrs))
+	for _, addr := range addrs {
+		ret = append(ret, addr.UDPAddr)
+	}
+	return ret
+}
+
+// duration is a time.Duration that encodes to JSON as a Go duration
+// string, e.g. "1.5s".
+type duration time.Duration
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *duration) UnmarshalJSON(bs []byte) error {
+	var s string
+	if err := json.Unmarshal(bs, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
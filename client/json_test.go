@@ -0,0 +1,335 @@
+package client
+
+import (
+	"encoding/json"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func mustUDPAddr(s string) *net.UDPAddr {
+	ret, err := parseUDPAddr(s)
+	if err != nil {
+		panic(err)
+	}
+	return ret
+}
+
+// testResult returns a Result with every field set, from a client
+// behind an endpoint-dependent NAT with an address-dependent
+// firewall.
+func testResult() *Result {
+	return &Result{
+		Metadata: &Metadata{
+			ToolVersion: "v1.2.3",
+			Started:     time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+			Duration:    7 * time.Second,
+			Options: &Options{
+				ServerAddrs:              []string{"203.0.113.1", "203.0.113.2"},
+				Ports:                    []int{3478, 4000},
+				ResolveDuration:          3 * time.Second,
+				SelectionDuration:        time.Second,
+				MappingDuration:          3 * time.Second,
+				MappingTransmitInterval:  200 * time.Millisecond,
+				MappingSockets:           2,
+				FirewallDuration:         3 * time.Second,
+				FirewallTransmitInterval: 50 * time.Millisecond,
+				PathMaxHops:              8,
+				PathDuration:             time.Second,
+				Gateway:                  net.ParseIP("192.168.1.1"),
+				GatewayDuration:          time.Second,
+			},
+		},
+		LocalIPs: []net.IP{net.ParseIP("192.168.1.10")},
+		EgressIP: net.ParseIP("192.168.1.10"),
+		Selection: &ServerSelection{
+			Candidates: []*Candidate{
+				{IP: net.ParseIP("203.0.113.1"), Reachable: true, RTT: 20 * time.Millisecond},
+				{IP: net.ParseIP("203.0.113.2"), Reachable: true, RTT: 30 * time.Millisecond},
+				{IP: net.ParseIP("203.0.113.3")},
+			},
+			Selected: []net.IP{net.ParseIP("203.0.113.1"), net.ParseIP("203.0.113.2")},
+		},
+		MappingProbes: []*MappingProbe{
+			{Local: mustUDPAddr("192.168.1.10:5000"), Mapped: mustUDPAddr("198.51.100.7:6000"), Remote: mustUDPAddr("203.0.113.1:3478")},
+			{Local: mustUDPAddr("192.168.1.10:5000"), Mapped: mustUDPAddr("198.51.100.7:6001"), Remote: mustUDPAddr("203.0.113.1:4000")},
+			{Local: mustUDPAddr("192.168.1.10:5000"), Mapped: mustUDPAddr("198.51.100.7:6002"), Remote: mustUDPAddr("203.0.113.2:3478")},
+			{Local: mustUDPAddr("192.168.1.10:5001"), Remote: mustUDPAddr("203.0.113.2:4000"), Timeout: true},
+		},
+		FirewallProbes: &FirewallProbe{
+			Local:    mustUDPAddr("192.168.1.10:5002"),
+			Remote:   mustUDPAddr("203.0.113.1:3478"),
+			Received: []*net.UDPAddr{mustUDPAddr("203.0.113.1:3478"), mustUDPAddr("203.0.113.1:4000")},
+			Matrix: []*FirewallOutcome{
+				{Sent: 10, Received: 9, From: []*net.UDPAddr{mustUDPAddr("203.0.113.1:3478")}},
+				{VaryPort: true, Sent: 10, Received: 8, From: []*net.UDPAddr{mustUDPAddr("203.0.113.1:4000")}},
+				{VaryAddr: true, Sent: 10},
+				{VaryAddr: true, VaryPort: true, Sent: 10},
+				{FreshPort: true, Sent: 5, Unsupported: 1},
+				{FreshPort: true, FreshAddr: true, Sent: 5},
+			},
+			ThirdParty: &ThirdPartyProbe{Sent: 20, Replies: 19, Peers: 1},
+		},
+		ServerStats: []*ServerStats{
+			{Remote: mustUDPAddr("203.0.113.1:3478"), Sent: 30, Received: 29, RTT: 21 * time.Millisecond},
+			{Remote: mustUDPAddr("203.0.113.2:4000"), Sent: 30},
+		},
+		Path: &PathProbe{
+			Remote: mustUDPAddr("203.0.113.1:3478"),
+			Hops: []*Hop{
+				{TTL: 1, IP: net.ParseIP("192.168.1.1")},
+				{TTL: 2},
+				{TTL: 3, IP: net.ParseIP("100.64.0.1")},
+			},
+			Reached: true,
+		},
+		Gateway: &GatewayProbe{
+			IP:         net.ParseIP("192.168.1.1"),
+			PCP:        true,
+			ExternalIP: net.ParseIP("100.64.3.4"),
+			Mapping: &GatewayMapping{
+				Protocol: "pcp",
+				Local:    mustUDPAddr("192.168.1.10:5003"),
+				External: mustUDPAddr("100.64.3.4:5003"),
+				Lifetime: time.Minute,
+				Observed: mustUDPAddr("198.51.100.7:6003"),
+			},
+		},
+	}
+}
+
+// roundTrip marshals in, unmarshals it into out, and checks that
+// nothing was lost on the way.
+func roundTrip(t *testing.T, in, out interface{}) {
+	t.Helper()
+	bs, err := json.Marshal(in)
+	if err != nil {
+		t.Fatalf("marshaling %T: %s", in, err)
+	}
+	if err := json.Unmarshal(bs, out); err != nil {
+		t.Fatalf("unmarshaling %T: %s\n%s", in, err, bs)
+	}
+	// IPv4 addresses decode in their 16-byte form, which is equal but
+	// not deeply equal to the 4-byte form.
+	canonicalIPs(reflect.ValueOf(in))
+	canonicalIPs(reflect.ValueOf(out))
+	if !reflect.DeepEqual(in, out) {
+		again, _ := json.Marshal(out)
+		t.Fatalf("%T changed in round trip:\nbefore: %s\nafter:  %s", in, bs, again)
+	}
+}
+
+var ipType = reflect.TypeOf(net.IP(nil))
+
+// canonicalIPs converts all the net.IPs reachable from v to their
+// 16-byte form.
+func canonicalIPs(v reflect.Value) {
+	switch {
+	case v.Type() == ipType:
+		if !v.IsNil() && v.CanSet() {
+			v.Set(reflect.ValueOf(v.Interface().(net.IP).To16()))
+		}
+	case v.Kind() == reflect.Ptr:
+		if !v.IsNil() {
+			canonicalIPs(v.Elem())
+		}
+	case v.Kind() == reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			canonicalIPs(v.Index(i))
+		}
+	case v.Kind() == reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).PkgPath == "" {
+				canonicalIPs(v.Field(i))
+			}
+		}
+	}
+}
+
+func TestResultRoundTrip(t *testing.T) {
+	roundTrip(t, testResult(), &Result{})
+}
+
+func TestAnalysisRoundTrip(t *testing.T) {
+	a := testResult().Analyze()
+	if !a.MappingVariesByDestIP || !a.FirewallEnforcesDestIP || !a.CGNAT {
+		t.Fatalf("test result analyzed as %+v, want endpoint-dependent mapping, address-dependent filtering and CGNAT", a)
+	}
+	roundTrip(t, a, &Analysis{})
+}
+
+func TestDiffRoundTrip(t *testing.T) {
+	before := &Analysis{MappingPreservesSourcePort: true}
+	d := Compare(before, testResult().Analyze())
+	if len(d.Changes) == 0 {
+		t.Fatal("Compare found no changes")
+	}
+	roundTrip(t, d, &Diff{})
+}
+
+func TestPredictionRoundTrip(t *testing.T) {
+	a := testResult().Analyze()
+	p := Predict(a, a)
+	if len(p.Reasons) == 0 {
+		t.Fatal("Predict gave no reasons")
+	}
+	roundTrip(t, p, &Prediction{})
+}
+
+func TestRejectUnversioned(t *testing.T) {
+	docs := []interface{}{testResult(), testResult().Analyze(), Compare(&Analysis{}, testResult().Analyze()), Predict(&Analysis{}, &Analysis{})}
+	outs := []interface{}{&Result{}, &Analysis{}, &Diff{}, &Prediction{}}
+	for i, doc := range docs {
+		bs, err := json.Marshal(doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(bs, &fields); err != nil {
+			t.Fatal(err)
+		}
+
+		tests := []struct {
+			desc   string
+			modify func()
+			want   string
+		}{
+			{"unversioned", func() { delete(fields, "schemaVersion") }, "no schema version"},
+			{"future version", func() { fields["schemaVersion"] = json.RawMessage("99") }, "unsupported schema version"},
+			{"no kind", func() { delete(fields, "kind") }, "no kind"},
+			{"wrong kind", func() { fields["kind"] = json.RawMessage(`"spray"`) }, "document kind"},
+		}
+		for _, test := range tests {
+			orig := map[string]json.RawMessage{}
+			for k, v := range fields {
+				orig[k] = v
+			}
+			test.modify()
+			bad, err := json.Marshal(fields)
+			fields = orig
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = json.Unmarshal(bad, outs[i])
+			if err == nil {
+				t.Errorf("%T: %s document was accepted", doc, test.desc)
+			} else if !strings.Contains(err.Error(), test.want) {
+				t.Errorf("%T: %s document rejected with %q, want error containing %q", doc, test.desc, err, test.want)
+			}
+		}
+	}
+}
+
+// Written by natprobe before schema versioning, trimmed.
+const (
+	legacyResultJSON = `{
+  "LocalIPs": ["192.168.1.10"],
+  "MappingProbes": [
+    {
+      "Local": {"IP": "192.168.1.10", "Port": 5000, "Zone": ""},
+      "Mapped": {"IP": "198.51.100.7", "Port": 6000, "Zone": ""},
+      "Remote": {"IP": "203.0.113.1", "Port": 3478, "Zone": ""},
+      "Timeout": false
+    },
+    {
+      "Local": {"IP": "192.168.1.10", "Port": 5000, "Zone": ""},
+      "Mapped": null,
+      "Remote": {"IP": "203.0.113.2", "Port": 3478, "Zone": ""},
+      "Timeout": true
+    }
+  ],
+  "FirewallProbes": {
+    "Local": {"IP": "192.168.1.10", "Port": 5001, "Zone": ""},
+    "Remote": {"IP": "203.0.113.1", "Port": 3478, "Zone": ""},
+    "Received": [{"IP": "203.0.113.1", "Port": 3478, "Zone": ""}]
+  }
+}`
+	legacyAnalysisJSON = `{
+  "NoData": false,
+  "NoNAT": false,
+  "MappingVariesByDestIP": false,
+  "MappingVariesByDestPort": false,
+  "FirewallEnforcesDestIP": true,
+  "FirewallEnforcesDestPort": true,
+  "MappingPreservesSourcePort": false,
+  "MultiplePublicIPs": false,
+  "FilteredEgress": [4000]
+}`
+)
+
+func TestDecodeLegacyResult(t *testing.T) {
+	if kind, err := DocumentKind([]byte(legacyResultJSON)); err != nil || kind != kindResult {
+		t.Errorf("DocumentKind(legacy result) = %q, %v, want %q", kind, err, kindResult)
+	}
+
+	var r Result
+	if err := json.Unmarshal([]byte(legacyResultJSON), &r); err != nil {
+		t.Fatalf("decoding legacy result: %s", err)
+	}
+	want := &Result{
+		LocalIPs: []net.IP{net.ParseIP("192.168.1.10")},
+		MappingProbes: []*MappingProbe{
+			{Local: mustUDPAddr("192.168.1.10:5000"), Mapped: mustUDPAddr("198.51.100.7:6000"), Remote: mustUDPAddr("203.0.113.1:3478")},
+			{Local: mustUDPAddr("192.168.1.10:5000"), Remote: mustUDPAddr("203.0.113.2:3478"), Timeout: true},
+		},
+		FirewallProbes: &FirewallProbe{
+			Local:    mustUDPAddr("192.168.1.10:5001"),
+			Remote:   mustUDPAddr("203.0.113.1:3478"),
+			Received: []*net.UDPAddr{mustUDPAddr("203.0.113.1:3478")},
+		},
+	}
+	canonicalIPs(reflect.ValueOf(&r))
+	canonicalIPs(reflect.ValueOf(want))
+	if !reflect.DeepEqual(&r, want) {
+		t.Errorf("legacy result decoded as %+v, want %+v", r, want)
+	}
+
+	// The migrated result analyzes, and encodes as the current version.
+	if a := r.Analyze(); a.NoData || !a.FirewallEnforcesDestIP {
+		t.Errorf("legacy result analyzed as %+v, want data and a firewall enforcing the destination IP", a)
+	}
+	roundTrip(t, &r, &Result{})
+}
+
+func TestDecodeLegacyAnalysis(t *testing.T) {
+	if kind, err := DocumentKind([]byte(legacyAnalysisJSON)); err != nil || kind != kindAnalysis {
+		t.Errorf("DocumentKind(legacy analysis) = %q, %v, want %q", kind, err, kindAnalysis)
+	}
+
+	var a Analysis
+	if err := json.Unmarshal([]byte(legacyAnalysisJSON), &a); err != nil {
+		t.Fatalf("decoding legacy analysis: %s", err)
+	}
+	want := Analysis{
+		FirewallEnforcesDestIP:   true,
+		FirewallEnforcesDestPort: true,
+		FilteredEgress:           []int{4000},
+	}
+	if !reflect.DeepEqual(a, want) {
+		t.Errorf("legacy analysis decoded as %+v, want %+v", a, want)
+	}
+}
+
+func TestDocumentKind(t *testing.T) {
+	tests := []struct {
+		doc  string
+		want string
+	}{
+		{`{"schemaVersion": 1, "kind": "diff"}`, kindDiff},
+		{`{"schemaVersion": 1}`, ""},
+		{`{"Foo": 1}`, ""},
+	}
+	for _, test := range tests {
+		got, err := DocumentKind([]byte(test.doc))
+		if err != nil {
+			t.Errorf("DocumentKind(%s): %s", test.doc, err)
+		} else if got != test.want {
+			t.Errorf("DocumentKind(%s) = %q, want %q", test.doc, got, test.want)
+		}
+	}
+	if _, err := DocumentKind([]byte(`[1, 2]`)); err == nil {
+		t.Error("DocumentKind accepted a non-object document")
+	}
+}
@@ -0,0 +1,234 @@
+package client
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	"go.universe.tf/natprobe/internal"
+)
+
+// Observer receives events as a probe progresses. Observe is called
+// synchronously from the probe's goroutines, possibly concurrently,
+// so it must be safe for concurrent use and should return quickly.
+type Observer interface {
+	Observe(*Event)
+}
+
+// ObserverFunc adapts a function into an Observer.
+type ObserverFunc func(*Event)
+
+// Observe implements Observer.
+func (f ObserverFunc) Observe(e *Event) { f(e) }
+
+// Phase is a phase of a probe.
+type Phase int
+
+const (
+	// Resolving probe server names.
+	PhaseResolve Phase = iota
+	// Probing the NAT's mapping behavior.
+	PhaseMapping
+	// Probing the firewall's filtering behavior.
+	PhaseFirewall
+	// Pinging probe servers to select the closest ones.
+	PhaseSelect
+	// Finding the routers between the client and a probe server.
+	PhasePath
+	// Querying the client's gateway.
+	PhaseGateway
+)
+
+func (p Phase) String() string {
+	switch p {
+	case PhaseResolve:
+		return "resolve"
+	case PhaseMapping:
+		return "mapping"
+	case PhaseFirewall:
+		return "firewall"
+	case PhaseSelect:
+		return "select"
+	case PhasePath:
+		return "path"
+	case PhaseGateway:
+		return "gateway"
+	default:
+		return fmt.Sprintf("Phase(%d)", int(p))
+	}
+}
+
+// EventType identifies what an Event reports.
+type EventType int
+
+const (
+	// A probe phase started.
+	EventPhaseStarted EventType = iota
+	// A probe phase finished.
+	EventPhaseFinished
+	// A probe server name was resolved. Name and IPs are set, or Err
+	// if resolution failed.
+	EventResolved
+	// A socket was opened. Local is set.
+	EventSocketOpened
+	// A probe packet was sent. Local and Remote are set, and Err if
+	// sending failed.
+	EventPacketSent
+	// A response was received. Local and Remote are set, and Mapped
+	// for mapping responses.
+	EventResponseReceived
+	// A probe server address never responded on a socket. Local and
+	// Remote are set.
+	EventTimeout
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventPhaseStarted:
+		return "phase-started"
+	case EventPhaseFinished:
+		return "phase-finished"
+	case EventResolved:
+		return "resolved"
+	case EventSocketOpened:
+		return "socket-opened"
+	case EventPacketSent:
+		return "packet-sent"
+	case EventResponseReceived:
+		return "response-received"
+	case EventTimeout:
+		return "timeout"
+	default:
+		return fmt.Sprintf("EventType(%d)", int(t))
+	}
+}
+
+// Event is something that happened during a probe. Which fields are
+// set depends on Type.
+type Event struct {
+	Type  EventType
+	Time  time.Time
+	Phase Phase
+
+	// The probe server name that was resolved.
+	Name string
+	// The IPs that Name resolved to.
+	IPs []net.IP
+
+	// The local socket.
+	Local *net.UDPAddr
+	// The destination of a sent packet, or the source of a received
+	// one.
+	Remote *net.UDPAddr
+	// The mapped address reported in a mapping response.
+	Mapped *net.UDPAddr
+
+	Err error
+}
+
+// String returns a one-line description of the event.
+func (e *Event) String() string {
+	ret := []string{e.Time.Format("15:04:05.000"), e.Phase.String(), e.Type.String()}
+	if e.Name != "" {
+		ret = append(ret, "name="+e.Name)
+	}
+	if len(e.IPs) > 0 {
+		var ips []string
+		for _, ip := range e.IPs {
+			ips = append(ips, ip.String())
+		}
+		ret = append(ret, "ips="+strings.Join(ips, ","))
+	}
+	if e.Local != nil {
+		ret = append(ret, "local="+e.Local.String())
+	}
+	if e.Remote != nil {
+		ret = append(ret, "remote="+e.Remote.String())
+	}
+	if e.Mapped != nil {
+		ret = append(ret, "mapped="+e.Mapped.String())
+	}
+	if e.Err != nil {
+		ret = append(ret, "err="+e.Err.Error())
+	}
+	return strings.Join(ret, " ")
+}
+
+// reporter passes probe events to the Observer and Logger from
+// Options. A nil reporter discards events.
+type reporter struct {
+	obs    Observer
+	logger logr.Logger
+}
+
+func newReporter(opts *Options) *reporter {
+	ret := &reporter{
+		obs:    opts.Observer,
+		logger: opts.Logger,
+	}
+	if ret.logger == nil {
+		ret.logger = internal.DiscardLogger()
+	}
+	return ret
+}
+
+// notify timestamps e, logs it and passes it to the observer.
+func (r *reporter) notify(e *Event) {
+	if r == nil {
+		return
+	}
+	e.Time = time.Now()
+	r.log(e)
+	if r.obs != nil {
+		r.obs.Observe(e)
+	}
+}
+
+// log logs e. Phase-level events are logged at verbosity 1, and
+// per-packet events at verbosity 2.
+func (r *reporter) log(e *Event) {
+	kvs := []interface{}{"phase", e.Phase.String()}
+	if e.Local != nil {
+		kvs = append(kvs, "local-addr", e.Local.String())
+	}
+	if e.Remote != nil {
+		kvs = append(kvs, "remote-addr", e.Remote.String())
+	}
+
+	switch e.Type {
+	case EventPhaseStarted:
+		r.logger.V(1).Info("Starting probe phase", kvs...)
+	case EventPhaseFinished:
+		if e.Err != nil {
+			kvs = append(kvs, "err", e.Err.Error())
+		}
+		r.logger.V(1).Info("Finished probe phase", kvs...)
+	case EventResolved:
+		if e.Err != nil {
+			// Not an error, the probe carries on with the other
+			// servers.
+			r.logger.Info("Failed to resolve probe server", "name", e.Name, "err", e.Err.Error())
+		} else {
+			r.logger.V(1).Info("Resolved probe server", "name", e.Name, "ips", fmt.Sprint(e.IPs))
+		}
+	case EventSocketOpened:
+		r.logger.V(2).Info("Opened socket", kvs...)
+	case EventPacketSent:
+		// Write errors are expected when egress is filtered by a
+		// local firewall, the analysis reports that separately.
+		if e.Err != nil {
+			r.logger.V(1).Info("Failed to send probe packet", append(kvs, "err", e.Err.Error())...)
+		} else {
+			r.logger.V(2).Info("Sent probe packet", kvs...)
+		}
+	case EventResponseReceived:
+		if e.Mapped != nil {
+			kvs = append(kvs, "mapped-addr", e.Mapped.String())
+		}
+		r.logger.V(2).Info("Received response", kvs...)
+	case EventTimeout:
+		r.logger.V(1).Info("No response from probe server", kvs...)
+	}
+}
@@ -0,0 +1,149 @@
+package client
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestObserver(t *testing.T) {
+	server := loopbackServer(t)
+	defer server.Close()
+	silent := blackhole(t)
+	defer silent.Close()
+	serverPort := server.LocalAddr().(*net.UDPAddr).Port
+	silentPort := silent.LocalAddr().(*net.UDPAddr).Port
+
+	var (
+		mu     sync.Mutex
+		events []*Event
+	)
+	res, err := Probe(context.Background(), &Options{
+		ServerAddrs: []string{"probe.example."},
+		Resolver: &stubResolver{hosts: map[string][]net.IP{
+			"probe.example.": {net.IPv4(127, 0, 0, 1)},
+		}},
+		Ports:            []int{serverPort, silentPort},
+		MappingSockets:   2,
+		ResolveDuration:  time.Second,
+		MappingDuration:  300 * time.Millisecond,
+		FirewallDuration: 300 * time.Millisecond,
+		PathMaxHops:      1,
+		PathDuration:     100 * time.Millisecond,
+		Gateway:          net.IPv4(127, 0, 0, 1),
+		GatewayDuration:  100 * time.Millisecond,
+		Observer: ObserverFunc(func(e *Event) {
+			mu.Lock()
+			defer mu.Unlock()
+			events = append(events, e)
+		}),
+	})
+	if err != nil {
+		t.Fatalf("Probe: %s", err)
+	}
+	// Events are only delivered during Probe.
+	mu.Lock()
+	defer mu.Unlock()
+
+	var (
+		// Phases in the order they started, and whether they
+		// finished.
+		phases   []Phase
+		finished = map[Phase]bool{}
+		resolved bool
+		// Mapping sockets, and their events by type.
+		sockets  = map[string]bool{}
+		byType   = map[EventType]int{}
+		timeouts = 0
+	)
+	for _, e := range events {
+		if e.Time.IsZero() {
+			t.Errorf("event %s has no timestamp", e)
+		}
+		switch e.Type {
+		case EventPhaseStarted:
+			for _, p := range phases {
+				if p == e.Phase {
+					t.Errorf("phase %s started twice", e.Phase)
+				}
+			}
+			phases = append(phases, e.Phase)
+		case EventPhaseFinished:
+			if finished[e.Phase] {
+				t.Errorf("phase %s finished twice", e.Phase)
+			}
+			finished[e.Phase] = true
+		case EventResolved:
+			if e.Name != "probe.example." || len(e.IPs) != 1 || !e.IPs[0].Equal(net.IPv4(127, 0, 0, 1)) || e.Err != nil {
+				t.Errorf("unexpected resolution: %s", e)
+			}
+			resolved = true
+		}
+		if e.Type != EventPhaseStarted && e.Type != EventPhaseFinished {
+			started := false
+			for _, p := range phases {
+				started = started || p == e.Phase
+			}
+			if !started || finished[e.Phase] {
+				t.Errorf("event %s arrived outside of its phase", e)
+			}
+		}
+
+		if e.Phase != PhaseMapping {
+			continue
+		}
+		byType[e.Type]++
+		switch e.Type {
+		case EventSocketOpened:
+			sockets[e.Local.String()] = true
+		case EventPacketSent, EventResponseReceived, EventTimeout:
+			if !sockets[e.Local.String()] {
+				t.Errorf("event %s is for a socket that wasn't opened", e)
+			}
+		}
+		switch {
+		case e.Type == EventResponseReceived && (e.Remote.Port != serverPort || e.Mapped == nil):
+			t.Errorf("unexpected mapping response: %s", e)
+		case e.Type == EventTimeout && e.Remote.Port != silentPort:
+			t.Errorf("unexpected mapping timeout: %s", e)
+		case e.Type == EventTimeout:
+			timeouts++
+		}
+	}
+
+	// The gateway phase runs alongside the others.
+	order := map[Phase]int{}
+	for i, p := range phases {
+		order[p] = i + 1
+	}
+	if order[PhaseResolve] == 0 || order[PhaseResolve] > order[PhaseMapping] || order[PhaseMapping] > order[PhaseFirewall] {
+		t.Errorf("phases started in order %v, want resolve, then mapping, then firewall", phases)
+	}
+	for _, p := range phases {
+		if !finished[p] {
+			t.Errorf("phase %s started but didn't finish", p)
+		}
+	}
+	if !resolved {
+		t.Error("no resolution event")
+	}
+	if len(sockets) != 2 {
+		t.Errorf("observed %d mapping sockets, want 2", len(sockets))
+	}
+	if byType[EventPacketSent] < 4 || byType[EventResponseReceived] < 2 {
+		t.Errorf("observed %d packets sent and %d responses during mapping, want at least 4 and 2", byType[EventPacketSent], byType[EventResponseReceived])
+	}
+	// Each socket times out on the silent port, as recorded in the
+	// result.
+	want := 0
+	for _, p := range res.MappingProbes {
+		if p.Timeout {
+			want++
+		}
+	}
+	if timeouts != 2 || want != 2 {
+		t.Errorf("observed %d mapping timeouts, result has %d, want 2", timeouts, want)
+	}
+}
@@ -0,0 +1,66 @@
+package client
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// pathAttempts is how many probes are sent for each TTL during the
+// path probe, if nothing answers.
+const pathAttempts = 3
+
+// probePath finds the routers between the client and dest, by probing
+// every TTL up to maxHops at once for the given duration.
+func probePath(ctx context.Context, dest *net.UDPAddr, maxHops int, duration time.Duration, rep *reporter) (*PathProbe, error) {
+	rep.notify(&Event{Type: EventPhaseStarted, Phase: PhasePath})
+	ctx, cancel := context.WithTimeout(ctx, duration)
+	defer cancel()
+
+	type result struct {
+		ttl     int
+		hop     net.IP
+		reached bool
+		err     error
+	}
+	done := make(chan result)
+	for ttl := 1; ttl <= maxHops; ttl++ {
+		go func(ttl int) {
+			hop, reached, err := traceHop(ctx, dest, ttl, duration/pathAttempts, rep)
+			done <- result{ttl, hop, reached, err}
+		}(ttl)
+	}
+
+	var (
+		hops = make([]*Hop, maxHops)
+		// The lowest TTL that reached dest, TTLs past it are
+		// redundant.
+		reachedTTL = maxHops + 1
+		err        error
+	)
+	for i := 0; i < maxHops; i++ {
+		res := <-done
+		if res.err != nil && err == nil {
+			err = res.err
+		}
+		hops[res.ttl-1] = &Hop{TTL: res.ttl, IP: res.hop}
+		if res.reached && res.ttl < reachedTTL {
+			reachedTTL = res.ttl
+		}
+	}
+	rep.notify(&Event{Type: EventPhaseFinished, Phase: PhasePath, Err: err})
+	if err != nil {
+		return nil, err
+	}
+
+	ret := &PathProbe{
+		Remote:  copyUDPAddr(dest),
+		Reached: reachedTTL <= maxHops,
+	}
+	if ret.Reached {
+		ret.Hops = hops[:reachedTTL-1]
+	} else {
+		ret.Hops = hops
+	}
+	return ret, nil
+}
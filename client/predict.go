@@ -0,0 +1,252 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Technique is a way of establishing direct UDP connectivity between
+// two peers.
+type Technique int
+
+const (
+	// One peer accepts unsolicited traffic on a known address, so
+	// the other can simply send to it.
+	Direct Technique = iota
+	// Both peers send to each other's mapped address at the same
+	// time, so that each NAT sees the other's packets as replies.
+	HolePunching
+	// Like HolePunching, but a peer guesses the mapping its partner's
+	// NAT will allocate, because the NAT allocates a new mapping per
+	// destination in a predictable way.
+	PortPrediction
+	// One peer opens many mappings and the other sprays packets at
+	// random ports until one lands on a mapping, relying on the
+	// birthday paradox to keep the number of packets manageable.
+	BirthdaySpraying
+	// Direct connectivity is unlikely, traffic must go through a
+	// relay.
+	Relay
+)
+
+func (t Technique) String() string {
+	switch t {
+	case Direct:
+		return "direct"
+	case HolePunching:
+		return "hole-punching"
+	case PortPrediction:
+		return "port-prediction"
+	case BirthdaySpraying:
+		return "birthday-spraying"
+	case Relay:
+		return "relay"
+	default:
+		return fmt.Sprintf("Technique(%d)", int(t))
+	}
+}
+
+func parseTechnique(s string) (Technique, error) {
+	for t := Direct; t <= Relay; t++ {
+		if t.String() == s {
+			return t, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown technique %q", s)
+}
+
+// Prediction is the predicted outcome of connecting two peers with
+// direct UDP.
+type Prediction struct {
+	// Direct UDP connectivity is expected to be possible.
+	Possible bool
+	// The simplest technique expected to establish connectivity.
+	Technique Technique
+	// Human-readable explanation of how the prediction was reached.
+	Reasons []string
+}
+
+// String returns a human-readable description of the prediction.
+func (p *Prediction) String() string {
+	var verdict string
+	if p.Possible {
+		verdict = fmt.Sprintf("Direct UDP connectivity should be possible using %s.", p.Technique)
+	} else {
+		verdict = "Direct UDP connectivity is unlikely, a relay is required."
+	}
+	ret := []string{verdict}
+	for _, r := range p.Reasons {
+		ret = append(ret, "    "+r)
+	}
+	return strings.Join(ret, "\n")
+}
+
+// peerNAT is the traversal-relevant summary of one peer's Analysis.
+type peerNAT struct {
+	name string
+	a    *Analysis
+}
+
+// open reports whether the peer accepts unsolicited traffic on its
+// own address.
+func (p peerNAT) open() bool {
+	return p.a.NoNAT && p.a.FilteringBehavior() == EndpointIndependent
+}
+
+// stable reports whether the peer's mapping is the same for all
+// destinations, so that the address observed by a rendezvous server
+// is also the address the other peer must use.
+func (p peerNAT) stable() bool {
+	return p.a.NoNAT || p.a.MappingBehavior() == EndpointIndependent
+}
+
+// predictable reports whether a destination-dependent mapping can be
+// guessed, from the LAN port or from the previous mappings.
+func (p peerNAT) predictable() bool {
+	return (p.a.MappingPreservesSourcePort || p.a.MappingSequential) && !p.a.MultiplePublicIPs
+}
+
+// allocation describes how a predictable peer's NAT picks ports.
+func (p peerNAT) allocation() string {
+	if p.a.MappingPreservesSourcePort {
+		return "preserves source ports"
+	}
+	return "allocates ports sequentially"
+}
+
+// acceptsAnyPort reports whether the peer's firewall lets in traffic
+// from a port it hasn't sent to, on a host it has sent to.
+func (p peerNAT) acceptsAnyPort() bool {
+	return p.a.NoNAT || (!p.a.FirewallUntested && !p.a.FirewallEnforcesDestPort)
+}
+
+// Predict predicts whether two peers, whose NATs are described by a
+// and b, can establish direct UDP connectivity, and with which
+// technique.
+func Predict(a, b *Analysis) *Prediction {
+	var (
+		p     = &predictor{}
+		peerA = peerNAT{"A", a}
+		peerB = peerNAT{"B", b}
+	)
+
+	for _, peer := range []peerNAT{peerA, peerB} {
+		if peer.a.NoData {
+			p.reason("Peer %s's probe got no data, so its NAT behavior is unknown.", peer.name)
+			return p.verdict(Relay)
+		}
+	}
+
+	for _, peer := range []peerNAT{peerA, peerB} {
+		if peer.open() {
+			p.reason("Peer %s has no NAT and no inbound filtering, the other peer can send to it directly.", peer.name)
+			return p.verdict(Direct)
+		}
+	}
+
+	switch {
+	case peerA.stable() && peerB.stable():
+		p.reason("Both peers keep the same mapping for all destinations, so the addresses learned from a rendezvous server are the ones to punch.")
+		return p.verdict(HolePunching)
+	case peerA.stable():
+		return p.oneStable(peerA, peerB)
+	case peerB.stable():
+		return p.oneStable(peerB, peerA)
+	}
+
+	p.reason("Both peers allocate a new mapping for each destination (%s and %s mapping).", a.MappingBehavior(), b.MappingBehavior())
+	switch {
+	case peerA.predictable() && peerB.predictable():
+		p.reason("Peer A's NAT %s and peer B's NAT %s, so each peer can predict the other's mapping.", peerA.allocation(), peerB.allocation())
+		return p.verdict(PortPrediction)
+	case peerA.predictable() && peerA.acceptsAnyPort():
+		p.reason("Peer A's NAT %s and doesn't filter by source port, so peer B can target A's predicted mapping and A accepts B's unpredictable one.", peerA.allocation())
+		return p.verdict(PortPrediction)
+	case peerB.predictable() && peerB.acceptsAnyPort():
+		p.reason("Peer B's NAT %s and doesn't filter by source port, so peer A can target B's predicted mapping and B accepts A's unpredictable one.", peerB.allocation())
+		return p.verdict(PortPrediction)
+	}
+	p.reason("Neither peer's mapping can be predicted well enough for the other to hit it.")
+	return p.verdict(Relay)
+}
+
+// predictor accumulates the reasoning behind a Prediction.
+type predictor struct {
+	ret Prediction
+}
+
+func (p *predictor) reason(format string, args ...interface{}) {
+	p.ret.Reasons = append(p.ret.Reasons, fmt.Sprintf(format, args...))
+}
+
+func (p *predictor) verdict(t Technique) *Prediction {
+	p.ret.Technique = t
+	p.ret.Possible = t != Relay
+	return &p.ret
+}
+
+// oneStable predicts connectivity when stable has a
+// destination-independent mapping and other doesn't.
+func (p *predictor) oneStable(stable, other peerNAT) *Prediction {
+	p.reason("Peer %s keeps the same mapping for all destinations, but peer %s allocates a new mapping for each destination (%s mapping).", stable.name, other.name, other.a.MappingBehavior())
+
+	switch {
+	case stable.acceptsAnyPort() && (!other.a.MultiplePublicIPs || stable.a.FilteringBehavior() == EndpointIndependent):
+		p.reason("Peer %s's firewall doesn't filter by source port (%s filtering), so it accepts packets from whichever new mapping peer %s's NAT allocates.", stable.name, stable.a.FilteringBehavior(), other.name)
+		return p.verdict(HolePunching)
+	case stable.acceptsAnyPort():
+		p.reason("Peer %s's firewall only accepts packets from hosts it has sent to (%s filtering), and peer %s's NAT uses multiple public IPs, so it must find peer %s's new mapping.", stable.name, stable.a.FilteringBehavior(), other.name, other.name)
+	default:
+		p.reason("Peer %s's firewall only accepts packets from ports it has sent to (%s filtering), so it must find peer %s's new mapping.", stable.name, stable.a.FilteringBehavior(), other.name)
+	}
+
+	if other.predictable() {
+		p.reason("Peer %s's NAT %s, so its new mapping can be predicted.", other.name, other.allocation())
+		return p.verdict(PortPrediction)
+	}
+	if other.a.MultiplePublicIPs {
+		p.reason("Peer %s's NAT uses multiple public IPs, so there is no single address to spray.", other.name)
+		return p.verdict(Relay)
+	}
+	p.reason("Peer %s's NAT randomizes ports, but peer %s's stable mapping lets %s open many mappings towards it while %s sprays random ports on %s's public IP.", other.name, stable.name, other.name, stable.name, other.name)
+	return p.verdict(BirthdaySpraying)
+}
+
+type jsonPrediction struct {
+	header
+	Possible  bool     `json:"possible"`
+	Technique string   `json:"technique"`
+	Reasons   []string `json:"reasons"`
+}
+
+// MarshalJSON implements json.Marshaler.
+func (p Prediction) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonPrediction{
+		header:    header{SchemaVersion, kindPrediction},
+		Possible:  p.Possible,
+		Technique: p.Technique.String(),
+		Reasons:   p.Reasons,
+	})
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (p *Prediction) UnmarshalJSON(bs []byte) error {
+	var j jsonPrediction
+	if err := json.Unmarshal(bs, &j); err != nil {
+		return err
+	}
+	if err := j.check(kindPrediction); err != nil {
+		return err
+	}
+	t, err := parseTechnique(j.Technique)
+	if err != nil {
+		return err
+	}
+	*p = Prediction{
+		Possible:  j.Possible,
+		Technique: t,
+		Reasons:   j.Reasons,
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+package client
+
+import (
+	"fmt"
+	"testing"
+)
+
+// mappingResult returns a Result whose mapping probes come from
+// 192.168.1.10 and were mapped to 198.51.100.7. Each probe is given as
+// a LAN port, a public port and the probed server address.
+func mappingResult(probes ...interface{}) *Result {
+	ret := &Result{}
+	for i := 0; i < len(probes); i += 3 {
+		ret.MappingProbes = append(ret.MappingProbes, &MappingProbe{
+			Local:  mustUDPAddr(fmt.Sprintf("192.168.1.10:%d", probes[i])),
+			Mapped: mustUDPAddr(fmt.Sprintf("198.51.100.7:%d", probes[i+1])),
+			Remote: mustUDPAddr(probes[i+2].(string)),
+		})
+	}
+	return ret
+}
+
+func TestPortPrediction(t *testing.T) {
+	const (
+		a1 = "203.0.113.1:3478"
+		a2 = "203.0.113.1:4000"
+		b1 = "203.0.113.2:3478"
+		b2 = "203.0.113.2:4000"
+	)
+	// stable has an endpoint-independent mapping, but a firewall that
+	// only lets in the exact ip:port it sent to, so it must find the
+	// other peer's new mapping.
+	stable := &Analysis{FirewallEnforcesDestIP: true, FirewallEnforcesDestPort: true}
+
+	tests := []struct {
+		desc           string
+		r              *Result
+		wantPreserved  bool
+		wantSequential bool
+		// Techniques to reach a peer with stable's NAT, and a peer
+		// with the same NAT.
+		withStable, withSelf Technique
+	}{
+		{
+			desc: "preserved",
+			r: mappingResult(
+				5000, 5000, a1,
+				5000, 31337, b1,
+				5001, 5001, a1,
+				5002, 5002, a1,
+				5003, 5003, a1,
+				5004, 5004, a1,
+			),
+			wantPreserved: true,
+			withStable:    PortPrediction,
+			withSelf:      PortPrediction,
+		},
+		{
+			desc: "sequential",
+			r: mappingResult(
+				5000, 40001, a1,
+				5000, 40002, a2,
+				5000, 40003, b1,
+				5000, 40004, b2,
+			),
+			wantSequential: true,
+			withStable:     PortPrediction,
+			withSelf:       PortPrediction,
+		},
+		{
+			desc: "sequential, interleaved with other hosts",
+			r: mappingResult(
+				5000, 40001, a1,
+				5000, 40003, a2,
+				5000, 40009, b1,
+				5000, 40010, b2,
+				5001, 40020, a1,
+			),
+			wantSequential: true,
+			withStable:     PortPrediction,
+			withSelf:       PortPrediction,
+		},
+		{
+			desc: "random",
+			r: mappingResult(
+				5000, 40001, a1,
+				5000, 13377, a2,
+				5000, 52011, b1,
+				5000, 27000, b2,
+			),
+			withStable: BirthdaySpraying,
+			withSelf:   Relay,
+		},
+		{
+			desc: "mostly random",
+			r: mappingResult(
+				5000, 40001, a1,
+				5000, 40002, a2,
+				5000, 13377, b1,
+				5000, 52011, b2,
+				5001, 27000, a1,
+			),
+			withStable: BirthdaySpraying,
+			withSelf:   Relay,
+		},
+		{
+			desc: "too few mappings to tell",
+			r: mappingResult(
+				5000, 40001, a1,
+				5000, 40002, b1,
+			),
+			withStable: BirthdaySpraying,
+			withSelf:   Relay,
+		},
+	}
+	for _, test := range tests {
+		a := test.r.Analyze()
+		if a.MappingBehavior() == EndpointIndependent {
+			t.Fatalf("%s: test mappings are endpoint-independent", test.desc)
+		}
+		if a.MappingPreservesSourcePort != test.wantPreserved {
+			t.Errorf("%s: MappingPreservesSourcePort = %v, want %v", test.desc, a.MappingPreservesSourcePort, test.wantPreserved)
+		}
+		if a.MappingSequential != test.wantSequential {
+			t.Errorf("%s: MappingSequential = %v, want %v", test.desc, a.MappingSequential, test.wantSequential)
+		}
+		if p := Predict(stable, a); p.Technique != test.withStable {
+			t.Errorf("%s: with a stable peer, predicted %s, want %s\n%s", test.desc, p.Technique, test.withStable, p)
+		}
+		if p := Predict(a, a); p.Technique != test.withSelf {
+			t.Errorf("%s: with itself, predicted %s, want %s\n%s", test.desc, p.Technique, test.withSelf, p)
+		}
+	}
+}
+
+func TestMappingSequentialConfidence(t *testing.T) {
+	tests := []struct {
+		desc       string
+		r          *Result
+		want       bool
+		confidence float64
+		unknown    bool
+	}{
+		{"no mappings", &Result{}, false, 0, true},
+		{"preserved ports only", mappingResult(5000, 5000, "203.0.113.1:3478", 5001, 5001, "203.0.113.1:3478", 5002, 5002, "203.0.113.1:3478"), false, 0, true},
+		// Two probes share the 40002 mapping.
+		{"all sequential", mappingResult(5000, 40001, "203.0.113.1:3478", 5000, 40002, "203.0.113.1:4000", 5000, 40002, "203.0.113.1:4000", 5000, 40003, "203.0.113.2:3478"), true, 0.8, false},
+		{"all random", mappingResult(5000, 40001, "203.0.113.1:3478", 5000, 13377, "203.0.113.1:4000", 5000, 52011, "203.0.113.2:3478"), false, 0.75, false},
+	}
+	for _, test := range tests {
+		got, ev := mappingSequential(test.r)
+		checkEvidence(t, test.desc, got, test.want, ev, test.confidence, test.unknown)
+	}
+}
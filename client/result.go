@@ -2,18 +2,39 @@ package client
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"net"
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // Result is the raw, uninterpreted result of a probe.
 type Result struct {
-	LocalIPs       []net.IP
+	// How the probe was run. Nil for results saved by older versions
+	// of natprobe.
+	Metadata *Metadata
+
+	LocalIPs []net.IP
+	// The local IP that traffic to the probe servers leaves from. Nil
+	// if no server answered, and in results from older versions.
+	EgressIP net.IP
+	// How the probed servers were selected. Nil if all resolved
+	// probe server IPs were probed.
+	Selection      *ServerSelection
 	MappingProbes  []*MappingProbe
 	FirewallProbes *FirewallProbe
+	// Traffic statistics for each probe server address, from the
+	// mapping phase.
+	ServerStats []*ServerStats
+	// The routers between the client and a probe server. Nil if the
+	// path wasn't probed.
+	Path *PathProbe
+	// What the client's gateway reports about itself. Nil if no
+	// gateway was found.
+	Gateway *GatewayProbe
 }
 
 // MappingProbe is the outcome of a single NAT mapping discovery attempt.
@@ -28,11 +49,228 @@ func (p MappingProbe) key() string {
 	return fmt.Sprintf("%s %s %s %t", p.Local, p.Mapped, p.Remote, p.Timeout)
 }
 
+// String returns a one-line description of the probe.
+func (p *MappingProbe) String() string {
+	if p.Timeout {
+		return fmt.Sprintf("%s -> ??? -> %s (timeout)", p.Local, p.Remote)
+	}
+	return fmt.Sprintf("%s -> %s -> %s", p.Local, p.Mapped, p.Remote)
+}
+
 // FirewallProbe is the outcome of a firewall state probe.
 type FirewallProbe struct {
-	Local    *net.UDPAddr
-	Remote   *net.UDPAddr
+	Local  *net.UDPAddr
+	Remote *net.UDPAddr
+	// The distinct addresses responses came from, except for
+	// responses from fresh sources, which are only in Matrix.
 	Received []*net.UDPAddr
+	// The outcome of each way the probe asked the server to respond:
+	// from the probed address, from a different IP, port or both, or
+	// from fresh sources that the client never sent to. Nil in
+	// results from older versions, which only recorded Received.
+	Matrix []*FirewallOutcome
+	// The outcome of asking the server to have its peers send packets
+	// to the client. Nil in results from older versions.
+	ThirdParty *ThirdPartyProbe
+}
+
+// ThirdPartyProbe is the outcome of asking the probed server to relay
+// packets to the client through its peer servers, which the client
+// never sent to.
+type ThirdPartyProbe struct {
+	// Relay requests sent, and replies received from the server.
+	// Older servers don't reply.
+	Sent    int
+	Replies int
+	// The number of peers the server relays through. If zero, the
+	// server can't run the experiment.
+	Peers int
+	// Packets received from peers.
+	Received int
+	// The distinct addresses peer packets came from.
+	From []*net.UDPAddr
+}
+
+// String returns a one-line description of the probe.
+func (p *ThirdPartyProbe) String() string {
+	if p.Replies == 0 || p.Peers == 0 {
+		return fmt.Sprintf("third-party relay: sent %d, unsupported by server", p.Sent)
+	}
+	return fmt.Sprintf("third-party relay: %d peers, sent %d, received %d", p.Peers, p.Sent, p.Received)
+}
+
+// FirewallOutcome is what happened to firewall probes asking the
+// server to respond from the probed address and port, or a different
+// one.
+type FirewallOutcome struct {
+	// Whether the server was asked to respond from a different IP.
+	VaryAddr bool
+	// Whether the server was asked to respond from a different port.
+	VaryPort bool
+	// Whether the server was asked to respond from a freshly opened
+	// port, and from an IP it doesn't probe on. The client never sent
+	// to either.
+	FreshPort bool
+	FreshAddr bool
+	// Probes sent, and responses received.
+	Sent     int
+	Received int
+	// Responses to FreshPort requests that came from the probed
+	// address, meaning the server couldn't honor the request. They
+	// aren't counted in Received.
+	Unsupported int
+	// The distinct addresses responses came from.
+	From []*net.UDPAddr
+}
+
+// String returns a one-line description of the outcome.
+func (o *FirewallOutcome) String() string {
+	ret := fmt.Sprintf("%s: sent %d, received %d", o.Combination(), o.Sent, o.Received)
+	if o.Unsupported > 0 {
+		ret += " (unsupported by server)"
+	}
+	return ret
+}
+
+// Combination describes the response the probes asked for, e.g. "same
+// addr, other port".
+func (o *FirewallOutcome) Combination() string {
+	addr, port := "same addr", "same port"
+	switch {
+	case o.FreshAddr:
+		addr = "fresh addr"
+	case o.VaryAddr:
+		addr = "other addr"
+	}
+	switch {
+	case o.FreshPort:
+		port = "fresh port"
+	case o.VaryPort:
+		port = "other port"
+	}
+	return addr + ", " + port
+}
+
+// PathProbe is the outcome of sending probes with increasing TTLs to
+// a probe server, to find the routers in between.
+type PathProbe struct {
+	Remote *net.UDPAddr
+	// One hop per TTL, up to the first TTL that reached Remote.
+	Hops []*Hop
+	// Whether any probe reached Remote. If not, some hops past the
+	// last one in Hops went unprobed.
+	Reached bool
+}
+
+// String returns a one-line description of the probe.
+func (p *PathProbe) String() string {
+	var hops []string
+	for _, h := range p.Hops {
+		hops = append(hops, h.String())
+	}
+	if p.Reached {
+		hops = append(hops, p.Remote.String())
+	} else {
+		hops = append(hops, "...")
+	}
+	return "path: " + strings.Join(hops, " -> ")
+}
+
+// Hop is a router on the path to a probe server.
+type Hop struct {
+	TTL int
+	// The router that reported the probe's TTL running out. Nil if no
+	// router did, which many don't.
+	IP net.IP
+}
+
+// String returns the hop's IP, or "*" if it's unknown.
+func (h *Hop) String() string {
+	if h.IP == nil {
+		return "*"
+	}
+	return h.IP.String()
+}
+
+// GatewayProbe is the outcome of querying the client's gateway over
+// NAT-PMP (RFC 6886) and PCP (RFC 6887).
+type GatewayProbe struct {
+	IP net.IP
+	// Whether the gateway answered in either protocol, if only to say
+	// it doesn't support the other one.
+	NATPMP bool
+	PCP    bool
+	// The external address the gateway reported. Nil if it didn't
+	// answer, or had no external address to report.
+	ExternalIP net.IP
+	// The temporary mapping the gateway granted, if any.
+	Mapping *GatewayMapping
+	// Why the gateway refused a mapping, e.g. "pcp: NOT_AUTHORIZED".
+	MappingError string
+}
+
+// String returns a one-line description of the probe.
+func (p *GatewayProbe) String() string {
+	var protos []string
+	if p.PCP {
+		protos = append(protos, "pcp")
+	}
+	if p.NATPMP {
+		protos = append(protos, "nat-pmp")
+	}
+	if len(protos) == 0 {
+		return fmt.Sprintf("gateway %s: no port mapping protocol", p.IP)
+	}
+	ret := fmt.Sprintf("gateway %s (%s): ", p.IP, strings.Join(protos, ", "))
+	if p.ExternalIP == nil {
+		ret += "no external address reported"
+	} else {
+		ret += "external address " + p.ExternalIP.String()
+	}
+	switch {
+	case p.Mapping != nil:
+		ret += ", " + p.Mapping.String()
+	case p.MappingError != "":
+		ret += ", mapping refused (" + p.MappingError + ")"
+	}
+	return ret
+}
+
+// GatewayMapping is a temporary UDP mapping that the gateway granted.
+type GatewayMapping struct {
+	// "pcp" or "nat-pmp".
+	Protocol string
+	Local    *net.UDPAddr
+	// The mapping's external address, according to the gateway. The
+	// IP is nil if the gateway never reported it.
+	External *net.UDPAddr
+	Lifetime time.Duration
+	// The mapped address that a probe server saw for traffic from
+	// Local. Nil if no probe server answered.
+	Observed *net.UDPAddr
+}
+
+// Mismatch reports whether the probe server saw traffic from the
+// mapping come from somewhere other than the mapping's external
+// address, i.e. whether another NAT rewrote it further along.
+func (m *GatewayMapping) Mismatch() bool {
+	if m.Observed == nil || m.External.IP == nil {
+		return false
+	}
+	return !m.Observed.IP.Equal(m.External.IP) || m.Observed.Port != m.External.Port
+}
+
+// String returns a one-line description of the mapping.
+func (m *GatewayMapping) String() string {
+	ext := "?"
+	if m.External.IP != nil {
+		ext = m.External.IP.String()
+	}
+	ret := fmt.Sprintf("%s mapping %s -> %s for %s", m.Protocol, m.Local, net.JoinHostPort(ext, strconv.Itoa(m.External.Port)), m.Lifetime)
+	if m.Observed != nil {
+		ret += fmt.Sprintf(", seen as %s", m.Observed)
+	}
+	return ret
 }
 
 // String returns a human-readable description of the probe results.
@@ -47,14 +285,27 @@ func (r *Result) String() string {
 	for _, ip := range r.LocalIPs {
 		fmt.Fprintf(&b, "    %s\n", ip)
 	}
+	if r.EgressIP != nil {
+		fmt.Fprintf(&b, "Egress IP: %s\n", r.EgressIP)
+	}
+
+	if r.Selection != nil {
+		b.WriteString("Probe server selection:\n")
+		for _, c := range r.Selection.Candidates {
+			switch {
+			case !c.Reachable:
+				fmt.Fprintf(&b, "    %s: unreachable\n", c.IP)
+			case c.selected(r.Selection.Selected):
+				fmt.Fprintf(&b, "    %s: rtt %s (selected)\n", c.IP, c.RTT)
+			default:
+				fmt.Fprintf(&b, "    %s: rtt %s\n", c.IP, c.RTT)
+			}
+		}
+	}
 
 	b.WriteString("Mapping probes:\n")
 	for _, probe := range r.MappingProbes {
-		if probe.Timeout {
-			fmt.Fprintf(&b, "    %s -> ??? -> %s (timeout)\n", probe.Local, probe.Remote)
-		} else {
-			fmt.Fprintf(&b, "    %s -> %s -> %s\n", probe.Local, probe.Mapped, probe.Remote)
-		}
+		fmt.Fprintf(&b, "    %s\n", probe)
 	}
 
 	if r.FirewallProbes == nil {
@@ -64,102 +315,256 @@ func (r *Result) String() string {
 		for _, addr := range r.FirewallProbes.Received {
 			fmt.Fprintf(&b, "    %s\n", addr)
 		}
+		for _, o := range r.FirewallProbes.Matrix {
+			fmt.Fprintf(&b, "    %s\n", o)
+		}
+		if tp := r.FirewallProbes.ThirdParty; tp != nil {
+			fmt.Fprintf(&b, "    %s\n", tp)
+			for _, addr := range tp.From {
+				fmt.Fprintf(&b, "        from %s\n", addr)
+			}
+		}
 	}
 
-	return b.String()
-}
-
-// Anonymize replace all IP addresses in the results with generated IPs.
-func (r *Result) Anonymize() {
-	ips := map[string]net.IP{}
-	a, b := byte(1), byte(1)
-
-	anonymize := func(ip net.IP) net.IP {
-		if len(ip) == 0 || ip.IsUnspecified() {
-			// Nothing to anonymize.
-			return ip
+	if len(r.ServerStats) > 0 {
+		b.WriteString("Server statistics:\n")
+		for _, s := range r.ServerStats {
+			fmt.Fprintf(&b, "    %s: sent %d, received %d, rtt %s\n", s.Remote, s.Sent, s.Received, s.RTT)
 		}
+	}
 
-		if ret := ips[ip.String()]; ret != nil {
-			return ret
+	if r.Path != nil || r.Gateway != nil {
+		b.WriteString("Upstream network:\n")
+		if r.Path != nil {
+			fmt.Fprintf(&b, "    %s\n", r.Path)
 		}
-		ret := net.IPv4(a, a, b, b)
-		b++
-		if b == 0 {
-			a++
+		if r.Gateway != nil {
+			fmt.Fprintf(&b, "    %s\n", r.Gateway)
 		}
-		ips[ip.String()] = ret
-		return ret
 	}
 
+	return b.String()
+}
+
+// Anonymize replaces all IP addresses in the results with
+// pseudonyms, using an Anonymizer with a random key. Use AnonymizeWith
+// to get the same pseudonyms across runs.
+func (r *Result) Anonymize() error {
+	a, err := NewRandomAnonymizer()
+	if err != nil {
+		return err
+	}
+	r.AnonymizeWith(a)
+	return nil
+}
+
+// AnonymizeWith replaces all IP addresses in the results, and ports if
+// a.MaskPorts is set, with their pseudonyms from a.
+func (r *Result) AnonymizeWith(a *Anonymizer) {
+	r.Metadata.anonymizeWith(a)
 	for i, ip := range r.LocalIPs {
-		r.LocalIPs[i] = anonymize(ip)
+		r.LocalIPs[i] = a.IP(ip)
+	}
+	r.EgressIP = a.IP(r.EgressIP)
+	if r.Selection != nil {
+		for _, c := range r.Selection.Candidates {
+			c.IP = a.IP(c.IP)
+		}
+		for i, ip := range r.Selection.Selected {
+			r.Selection.Selected[i] = a.IP(ip)
+		}
 	}
 	for _, probe := range r.MappingProbes {
-		probe.Local.IP = anonymize(probe.Local.IP)
-		probe.Mapped.IP = anonymize(probe.Mapped.IP)
-		probe.Remote.IP = anonymize(probe.Remote.IP)
+		a.udpAddr(probe.Local)
+		// Nil for timed out probes.
+		a.udpAddr(probe.Mapped)
+		a.udpAddr(probe.Remote)
 	}
-	if r.FirewallProbes == nil {
+	if r.FirewallProbes != nil {
+		a.udpAddr(r.FirewallProbes.Local)
+		a.udpAddr(r.FirewallProbes.Remote)
+		for _, addr := range r.FirewallProbes.Received {
+			a.udpAddr(addr)
+		}
+		for _, o := range r.FirewallProbes.Matrix {
+			for _, addr := range o.From {
+				a.udpAddr(addr)
+			}
+		}
+		if tp := r.FirewallProbes.ThirdParty; tp != nil {
+			for _, addr := range tp.From {
+				a.udpAddr(addr)
+			}
+		}
+	}
+	for _, s := range r.ServerStats {
+		a.udpAddr(s.Remote)
+	}
+	if r.Path != nil {
+		a.udpAddr(r.Path.Remote)
+		// Nil for hops that didn't answer.
+		for _, h := range r.Path.Hops {
+			h.IP = a.IP(h.IP)
+		}
+	}
+	if r.Gateway != nil {
+		r.Gateway.IP = a.IP(r.Gateway.IP)
+		r.Gateway.ExternalIP = a.IP(r.Gateway.ExternalIP)
+		if m := r.Gateway.Mapping; m != nil {
+			a.udpAddr(m.Local)
+			a.udpAddr(m.External)
+			a.udpAddr(m.Observed)
+		}
+	}
+}
+
+// anonymizeWith replaces the server IPs and ports, and the gateway,
+// in the options that m records. Server names are left as they are.
+// The options may share slices with the ones passed to Probe, so the
+// replacements go in new slices.
+func (m *Metadata) anonymizeWith(a *Anonymizer) {
+	if m == nil || m.Options == nil {
 		return
 	}
-	r.FirewallProbes.Local.IP = anonymize(r.FirewallProbes.Local.IP)
-	r.FirewallProbes.Remote.IP = anonymize(r.FirewallProbes.Remote.IP)
-	for _, addr := range r.FirewallProbes.Received {
-		addr.IP = anonymize(addr.IP)
+	o := m.Options
+	var (
+		addrs []string
+		ports []int
+	)
+	for _, addr := range o.ServerAddrs {
+		if ip := net.ParseIP(addr); ip != nil {
+			addr = a.IP(ip).String()
+		}
+		addrs = append(addrs, addr)
+	}
+	for _, port := range o.Ports {
+		ports = append(ports, a.Port(port))
 	}
+	o.ServerAddrs, o.Ports = addrs, ports
+	o.Gateway = a.IP(o.Gateway)
+}
+
+// Anonymized returns a copy of the analysis with all IP addresses,
+// and ports if anon.MaskPorts is set, replaced with their pseudonyms
+// from anon. The conclusions are left as they are, so they still
+// reflect what anonymization hides, e.g. addresses in the shared
+// address space of carrier-grade NAT.
+//
+// Evidence shares probe data with the Result it was analyzed from, so
+// the copy is a deep one: anonymizing either doesn't affect the other.
+func (a *Analysis) Anonymized(anon *Anonymizer) (*Analysis, error) {
+	// Round-trip through JSON for a deep copy.
+	bs, err := json.Marshal(a)
+	if err != nil {
+		return nil, err
+	}
+	var ret Analysis
+	if err := json.Unmarshal(bs, &ret); err != nil {
+		return nil, err
+	}
+
+	ret.Metadata.anonymizeWith(anon)
+	for i, ip := range ret.PublicIPs {
+		ret.PublicIPs[i] = anon.IP(ip)
+	}
+	for i, port := range ret.FilteredEgress {
+		ret.FilteredEgress[i] = anon.Port(port)
+	}
+	for _, c := range ret.Conclusions() {
+		if c.Evidence != nil {
+			c.Evidence.anonymizeWith(anon)
+		}
+	}
+	return &ret, nil
 }
 
 // Analyze distills raw results into an Analysis.
 func (r *Result) Analyze() *Analysis {
-	return &Analysis{
-		NoData:                     noData(r),
-		NoNAT:                      noNAT(r),
-		MappingVariesByDestIP:      mappingVariesByDestIP(r),
-		MappingVariesByDestPort:    mappingVariesByDestPort(r),
-		FirewallEnforcesDestIP:     firewallEnforcesDestIP(r),
-		FirewallEnforcesDestPort:   firewallEnforcesDestPort(r),
-		MappingPreservesSourcePort: mappingPreservesSourcePort(r),
-		MultiplePublicIPs:          multiplePublicIPs(r),
-		FilteredEgress:             filteredEgress(r),
-	}
+	var (
+		ret = &Analysis{Metadata: r.Metadata}
+		ev  = &AnalysisEvidence{}
+	)
+	ret.NoData, ev.NoData = noData(r)
+	ret.NoNAT, ev.NoNAT = noNAT(r)
+	ret.MappingVariesByDestIP, ev.MappingVariesByDestIP = mappingVariesByDestIP(r)
+	ret.MappingVariesByDestPort, ev.MappingVariesByDestPort = mappingVariesByDestPort(r)
+	ret.FirewallEnforcesDestIP, ev.FirewallEnforcesDestIP = firewallEnforcesDestIP(r)
+	ret.FirewallEnforcesDestPort, ev.FirewallEnforcesDestPort = firewallEnforcesDestPort(r)
+	ret.FirewallUntested = firewallUntested(r)
+	ret.UnsolicitedInbound, ev.UnsolicitedInbound = unsolicitedInbound(r)
+	ret.ThirdPartyInbound, ev.ThirdPartyInbound = thirdPartyInbound(r)
+	ret.MappingPreservesSourcePort, ev.MappingPreservesSourcePort = mappingPreservesSourcePort(r)
+	ret.MappingSequential, ev.MappingSequential = mappingSequential(r)
+	ret.MultiplePublicIPs, ev.MultiplePublicIPs = multiplePublicIPs(r)
+	ret.FilteredEgress, ev.FilteredEgress = filteredEgress(r)
+	ret.CGNAT, ev.CGNAT = cgnat(r)
+	ret.DoubleNAT, ev.DoubleNAT = doubleNAT(r)
+	ret.PortMapping, ev.PortMapping = portMapping(r)
+	ret.PublicIPs = publicIPs(r)
+	ret.Evidence = ev
+	return ret
 }
 
-func noData(r *Result) bool {
-	if len(r.MappingProbes) == 0 {
-		return true
-	}
+func noData(r *Result) (bool, *Evidence) {
+	var responses, timeouts []*MappingProbe
 	for _, probe := range r.MappingProbes {
-		if !probe.Timeout {
-			return false
+		if probe.Timeout {
+			timeouts = append(timeouts, probe)
+		} else {
+			responses = append(responses, probe)
 		}
 	}
-	return true
+	if len(responses) > 0 {
+		// A single response is proof that we have data.
+		return false, mappingEvidence(responses, nil).proven()
+	}
+	return true, mappingEvidence(timeouts, nil)
 }
 
-func noNAT(r *Result) bool {
+func noNAT(r *Result) (bool, *Evidence) {
 	ips := map[string]bool{}
 	for _, ip := range r.LocalIPs {
 		ips[ip.String()] = true
 	}
+	var local, translated []*MappingProbe
 	for _, probe := range r.MappingProbes {
 		if probe.Timeout {
 			continue
 		}
-		if !ips[probe.Mapped.IP.String()] {
-			return false
+		if ips[probe.Mapped.IP.String()] {
+			local = append(local, probe)
+		} else {
+			translated = append(translated, probe)
 		}
 	}
 
-	return true
+	if len(translated) > 0 {
+		// A single translated mapping proves there's a NAT.
+		return false, mappingEvidence(translated, local).proven()
+	}
+	return true, mappingEvidence(local, nil)
+}
+
+func mappingVariesByDestIP(r *Result) (bool, *Evidence) {
+	return mappingVariesByDest(r, func(a, b *MappingProbe) bool {
+		return a.Remote.IP.Equal(b.Remote.IP)
+	})
+}
+
+func mappingVariesByDestPort(r *Result) (bool, *Evidence) {
+	return mappingVariesByDest(r, func(a, b *MappingProbe) bool {
+		return a.Remote.Port == b.Remote.Port
+	})
 }
 
-func mappingVariesByDestIP(r *Result) bool {
+// mappingVariesByDest compares the mapping of every response against
+// the first response received on the same local socket, skipping
+// responses whose destination is sameDest as that first response.
+func mappingVariesByDest(r *Result, sameDest func(a, b *MappingProbe) bool) (bool, *Evidence) {
 	var (
-		local      string
-		remoteIP   net.IP
-		mappedIP   net.IP
-		mappedPort int
+		local        string
+		base         *MappingProbe
+		same, varied evidenceSet
 	)
 
 	for _, probe := range r.MappingProbes {
@@ -168,152 +573,580 @@ func mappingVariesByDestIP(r *Result) bool {
 		}
 		if probe.Local.String() != local {
 			local = probe.Local.String()
-			remoteIP = probe.Remote.IP
-			mappedIP = probe.Mapped.IP
-			mappedPort = probe.Mapped.Port
+			base = probe
 			continue
 		}
-		if probe.Remote.IP.Equal(remoteIP) {
+		if sameDest(probe, base) {
 			continue
 		}
-		if !probe.Mapped.IP.Equal(mappedIP) || probe.Mapped.Port != mappedPort {
-			return true
+		if !probe.Mapped.IP.Equal(base.Mapped.IP) || probe.Mapped.Port != base.Mapped.Port {
+			varied.add(base, probe)
+		} else {
+			same.add(base, probe)
 		}
 	}
-	return false
+
+	if varied.comparisons > 0 {
+		// A single mapping that varied proves the dependency.
+		ev := &Evidence{
+			SupportingMappings:    varied.probes,
+			ContradictingMappings: same.probes,
+		}
+		return true, ev.proven()
+	}
+	ev := &Evidence{SupportingMappings: same.probes}
+	return false, ev.scored(same.comparisons, 0)
 }
 
-func mappingVariesByDestPort(r *Result) bool {
-	var (
-		local      string
-		remotePort int
-		mappedIP   net.IP
-		mappedPort int
-	)
+// evidenceSet accumulates pairwise comparisons between mapping
+// probes, listing each probe involved only once.
+type evidenceSet struct {
+	probes      []*MappingProbe
+	seen        map[*MappingProbe]bool
+	comparisons int
+}
 
-	for _, probe := range r.MappingProbes {
-		if probe.Timeout {
-			continue
-		}
-		if probe.Local.String() != local {
-			local = probe.Local.String()
-			remotePort = probe.Remote.Port
-			mappedIP = probe.Mapped.IP
-			mappedPort = probe.Mapped.Port
-			continue
-		}
-		if probe.Remote.Port == remotePort {
-			continue
-		}
-		if !probe.Mapped.IP.Equal(mappedIP) || probe.Mapped.Port != mappedPort {
-			return true
+func (s *evidenceSet) add(probes ...*MappingProbe) {
+	if s.seen == nil {
+		s.seen = map[*MappingProbe]bool{}
+	}
+	for _, probe := range probes {
+		if !s.seen[probe] {
+			s.probes = append(s.probes, probe)
+			s.seen[probe] = true
 		}
 	}
-	return false
+	s.comparisons++
 }
 
-func mappingVariesBy(r *Result, keyFunc func(*MappingProbe) string) bool {
+// firewallUntested reports whether the firewall probe got no
+// response even when it asked for one from the probed address. Then
+// the other responses are missing for unknown reasons, and say
+// nothing about the firewall.
+func firewallUntested(r *Result) bool {
+	if r.FirewallProbes == nil {
+		return true
+	}
+	if r.FirewallProbes.Matrix == nil {
+		// Older results only recorded Received.
+		return len(r.FirewallProbes.Received) == 0
+	}
+	return len(controlReceptions(r)) == 0
+}
+
+func firewallEnforcesDestIP(r *Result) (bool, *Evidence) {
+	return firewallEnforces(r, func(o *FirewallOutcome) bool { return o.VaryAddr }, func(from *net.UDPAddr) bool {
+		return !from.IP.Equal(r.FirewallProbes.Remote.IP)
+	})
+}
+
+func firewallEnforcesDestPort(r *Result) (bool, *Evidence) {
+	return firewallEnforces(r, func(o *FirewallOutcome) bool { return o.VaryPort }, func(from *net.UDPAddr) bool {
+		return from.Port != r.FirewallProbes.Remote.Port
+	})
+}
+
+// firewallEnforces reports whether the firewall blocked every response
+// to the combinations that vary, which ask for a response from a
+// source the client sent nothing to. Responses from fresh sources
+// don't count, unsolicitedInbound covers those. If the firewall probe
+// didn't work at all, the verdict is false and unknown.
+//
+// Results from older versions have no matrix, only the addresses that
+// responses came from, of which varied picks those that prove
+// the firewall doesn't enforce.
+func firewallEnforces(r *Result, varies func(*FirewallOutcome) bool, varied func(*net.UDPAddr) bool) (bool, *Evidence) {
+	if firewallUntested(r) {
+		return false, unknownEvidence()
+	}
+	control := controlReceptions(r)
+
 	var (
-		key        string
-		mappedIP   net.IP
-		mappedPort int
+		through    []*net.UDPAddr
+		unanswered int
 	)
-	for _, probe := range r.MappingProbes {
-		if probe.Timeout {
-			continue
+	if r.FirewallProbes.Matrix == nil {
+		control = nil
+		for _, recv := range r.FirewallProbes.Received {
+			if varied(recv) {
+				through = append(through, recv)
+			} else {
+				control = append(control, recv)
+			}
 		}
-		if mappedIP == nil {
-			key = keyFunc(probe)
-			mappedIP = probe.Mapped.IP
-			mappedPort = probe.Mapped.Port
+	}
+	for _, o := range r.FirewallProbes.Matrix {
+		if o.FreshPort || !varies(o) {
 			continue
 		}
+		through = append(through, o.From...)
+		unanswered += o.Sent - o.Received
+	}
 
-		if keyFunc(probe) == key {
-			continue
-		}
-		if !mappedIP.Equal(probe.Mapped.IP) || probe.Mapped.Port != mappedPort {
-			return true
-		}
+	if len(through) > 0 {
+		// A single response from a varied source proves that the
+		// firewall doesn't enforce.
+		return false, receptionEvidence(through, nil).proven()
 	}
-	return false
+	// Receptions from the probed address don't prove enforcement,
+	// but they show that the firewall probe itself worked.
+	// Enforcement is concluded from the unanswered probes, which older
+	// results didn't count.
+	ev := receptionEvidence(control, nil)
+	if r.FirewallProbes.Matrix != nil {
+		ev.scored(unanswered, 0)
+	}
+	if ev.Unknown {
+		return false, ev
+	}
+	return true, ev
 }
 
-func firewallEnforcesDestIP(r *Result) bool {
+// unsolicitedInbound reports whether responses from fresh sources,
+// which nothing on the client ever sent to, got through the firewall.
+// It's untested unless the server honored fresh requests and its
+// responses to the probed address itself got through.
+func unsolicitedInbound(r *Result) (InboundVerdict, *Evidence) {
 	if r.FirewallProbes == nil {
-		return false
+		return InboundUntested, unknownEvidence()
 	}
-	outIP := r.FirewallProbes.Remote.IP
-	for _, recv := range r.FirewallProbes.Received {
-		if !recv.IP.Equal(outIP) {
-			return false
+	var (
+		control    = controlReceptions(r)
+		fresh      []*net.UDPAddr
+		unanswered int
+	)
+	for _, o := range r.FirewallProbes.Matrix {
+		if o.FreshPort && o.Unsupported == 0 {
+			fresh = append(fresh, o.From...)
+			unanswered += o.Sent - o.Received
 		}
 	}
 
-	return true
+	switch {
+	case len(fresh) > 0:
+		return InboundAllowed, receptionEvidence(fresh, nil).proven()
+	case unanswered == 0 || len(control) == 0:
+		return InboundUntested, unknownEvidence()
+	default:
+		// As for firewallEnforcesDestIP, receptions from the probed
+		// address show that the probe itself worked.
+		return InboundBlocked, receptionEvidence(control, nil).scored(unanswered, 0)
+	}
 }
 
-func firewallEnforcesDestPort(r *Result) bool {
-	if r.FirewallProbes == nil {
-		return false
+// thirdPartyInbound reports whether packets from the probed server's
+// peers, hosts that the client never contacted, got through the
+// firewall. It's untested unless the server relayed the request and
+// its own responses got through.
+func thirdPartyInbound(r *Result) (InboundVerdict, *Evidence) {
+	if r.FirewallProbes == nil || r.FirewallProbes.ThirdParty == nil {
+		return InboundUntested, unknownEvidence()
 	}
-	outPort := r.FirewallProbes.Remote.Port
-	for _, recv := range r.FirewallProbes.Received {
-		if recv.Port != outPort {
-			return false
+	tp := r.FirewallProbes.ThirdParty
+	control := controlReceptions(r)
+
+	switch {
+	case len(tp.From) > 0:
+		return InboundAllowed, receptionEvidence(tp.From, nil).proven()
+	case tp.Replies == 0 || tp.Peers == 0 || len(control) == 0:
+		return InboundUntested, unknownEvidence()
+	default:
+		// Each acknowledged relay request should have brought packets
+		// from the peers. Peers that are down look the same as a
+		// firewall that blocks them, though.
+		return InboundBlocked, receptionEvidence(control, nil).scored(tp.Replies, 0)
+	}
+}
+
+// controlReceptions returns where responses to firewall probes that
+// asked for a response from the probed address came from. If there
+// are any, the firewall probe worked.
+func controlReceptions(r *Result) []*net.UDPAddr {
+	for _, o := range r.FirewallProbes.Matrix {
+		if !o.VaryAddr && !o.VaryPort {
+			return o.From
 		}
 	}
-	return true
+	return nil
 }
 
-func mappingPreservesSourcePort(r *Result) bool {
-	total, preserved := 0, 0
+func mappingPreservesSourcePort(r *Result) (bool, *Evidence) {
+	var preserved, changed []*MappingProbe
 	for _, probe := range r.MappingProbes {
 		if probe.Timeout {
 			continue
 		}
-		total++
 		if probe.Local.Port == probe.Mapped.Port {
-			preserved++
+			preserved = append(preserved, probe)
+		} else {
+			changed = append(changed, probe)
 		}
 	}
 
 	// Consider the NAT port-preserving if >80% of probes have
-	// preserved ports.
-	return (float64(preserved) / float64(total)) >= 0.8
+	// preserved ports. Ports that went the other way weaken the
+	// verdict without disproving it.
+	total := len(preserved) + len(changed)
+	if total == 0 {
+		return false, unknownEvidence()
+	}
+	if (float64(len(preserved)) / float64(total)) >= 0.8 {
+		return true, mappingEvidence(preserved, changed)
+	}
+	return false, mappingEvidence(changed, preserved)
 }
 
-func multiplePublicIPs(r *Result) bool {
-	ips := map[string]bool{}
+// maxSequentialGap is the largest distance between two public ports
+// that still counts as sequential allocation. It leaves room for
+// mappings that other hosts behind the NAT opened in between.
+const maxSequentialGap = 16
+
+func mappingSequential(r *Result) (bool, *Evidence) {
+	// Mappings that preserve the LAN port say nothing about how the
+	// NAT picks ports when it can't.
+	probes := map[string][]*MappingProbe{}
+	var mapped []*net.UDPAddr
+	for _, probe := range r.MappingProbes {
+		if probe.Timeout || probe.Local.Port == probe.Mapped.Port {
+			continue
+		}
+		k := probe.Mapped.String()
+		if probes[k] == nil {
+			mapped = append(mapped, probe.Mapped)
+		}
+		probes[k] = append(probes[k], probe)
+	}
+	// Ports can't be close to each other by chance with fewer than
+	// three mappings to compare.
+	if len(mapped) < 3 {
+		return false, unknownEvidence()
+	}
+
+	sort.Slice(mapped, func(i, j int) bool {
+		if c := bytes.Compare(mapped[i].IP.To16(), mapped[j].IP.To16()); c != 0 {
+			return c < 0
+		}
+		return mapped[i].Port < mapped[j].Port
+	})
+	near := func(i, j int) bool {
+		if i < 0 || j >= len(mapped) || !mapped[i].IP.Equal(mapped[j].IP) {
+			return false
+		}
+		return mapped[j].Port-mapped[i].Port <= maxSequentialGap
+	}
+	var inSequence, isolated []*MappingProbe
+	n := 0
+	for i, addr := range mapped {
+		if near(i-1, i) || near(i, i+1) {
+			inSequence = append(inSequence, probes[addr.String()]...)
+			n++
+		} else {
+			isolated = append(isolated, probes[addr.String()]...)
+		}
+	}
+
+	// Like port preservation, consider allocation sequential if >80%
+	// of mappings sit next to another one. Randomly allocated ports
+	// almost never do.
+	if float64(n)/float64(len(mapped)) >= 0.8 {
+		return true, mappingEvidence(inSequence, isolated)
+	}
+	return false, mappingEvidence(isolated, inSequence)
+}
+
+func multiplePublicIPs(r *Result) (bool, *Evidence) {
+	var (
+		ips   = map[string]bool{}
+		first []*MappingProbe
+		all   []*MappingProbe
+	)
 	for _, probe := range r.MappingProbes {
 		if probe.Timeout {
 			continue
 		}
+		if !ips[probe.Mapped.IP.String()] {
+			first = append(first, probe)
+		}
 		ips[probe.Mapped.IP.String()] = true
+		all = append(all, probe)
+	}
+
+	if len(ips) > 1 {
+		// One probe per public IP is all it takes.
+		return true, mappingEvidence(first, nil).proven()
 	}
-	return len(ips) > 1
+	return false, mappingEvidence(all, nil)
 }
 
-func filteredEgress(r *Result) []int {
+func filteredEgress(r *Result) ([]int, *Evidence) {
 	working := map[int]bool{}
 	for _, probe := range r.MappingProbes {
 		if !probe.Timeout {
 			working[probe.Remote.Port] = true
 		}
 	}
-	ret := []int{}
+
+	var (
+		ret      = []int{}
+		filtered = map[int]bool{}
+		// Timeouts on ports that work with other servers or sockets
+		// point at packet loss rather than filtering.
+		lost    []*MappingProbe
+		blocked []*MappingProbe
+	)
 	for _, probe := range r.MappingProbes {
-		if probe.Timeout && !working[probe.Remote.Port] {
+		if !probe.Timeout {
+			continue
+		}
+		if working[probe.Remote.Port] {
+			lost = append(lost, probe)
+			continue
+		}
+		blocked = append(blocked, probe)
+		if !filtered[probe.Remote.Port] {
 			ret = append(ret, probe.Remote.Port)
-			working[probe.Remote.Port] = true
+			filtered[probe.Remote.Port] = true
 		}
 	}
 	sort.Ints(ret)
+
+	if len(ret) > 0 {
+		return ret, mappingEvidence(blocked, lost)
+	}
+	var responses []*MappingProbe
+	for _, probe := range r.MappingProbes {
+		if !probe.Timeout {
+			responses = append(responses, probe)
+		}
+	}
+	return ret, mappingEvidence(responses, lost)
+}
+
+// sharedAddressSpace is the RFC 6598 range for carrier-grade NAT.
+var sharedAddressSpace = &net.IPNet{
+	IP:   net.IPv4(100, 64, 0, 0),
+	Mask: net.CIDRMask(10, 32),
+}
+
+// privateNetworks are the RFC 1918 private ranges.
+var privateNetworks = []*net.IPNet{
+	{IP: net.IPv4(10, 0, 0, 0), Mask: net.CIDRMask(8, 32)},
+	{IP: net.IPv4(172, 16, 0, 0), Mask: net.CIDRMask(12, 32)},
+	{IP: net.IPv4(192, 168, 0, 0), Mask: net.CIDRMask(16, 32)},
+}
+
+func isPrivate(ip net.IP) bool {
+	for _, n := range privateNetworks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// upstreamAddresses returns the addresses seen between the client and
+// the internet, other than its own: those of routers on the path to
+// the probe servers, and its gateway's external address.
+func upstreamAddresses(r *Result) []*AddressObservation {
+	ret := hopAddresses(r)
+	if o := gatewayAddress(r); o != nil {
+		ret = append(ret, o)
+	}
+	return ret
+}
+
+// egressAddresses returns the client's addresses that its traffic to
+// the probe servers may leave from. That's the egress IP when the
+// result has it, and guessed is false. Older results only have all
+// the local IPs, which may belong to overlay, VPN or container
+// networks that never see the probe traffic.
+func egressAddresses(r *Result) (ret []*AddressObservation, guessed bool) {
+	if r.EgressIP != nil {
+		return []*AddressObservation{{"egress", r.EgressIP}}, false
+	}
+	for _, ip := range r.LocalIPs {
+		if ip.IsLoopback() || ip.IsLinkLocalUnicast() {
+			continue
+		}
+		ret = append(ret, &AddressObservation{"local", ip})
+	}
+	return ret, true
+}
+
+func hopAddresses(r *Result) []*AddressObservation {
+	if r.Path == nil {
+		return nil
+	}
+	var ret []*AddressObservation
+	for _, h := range r.Path.Hops {
+		if h.IP != nil {
+			ret = append(ret, &AddressObservation{fmt.Sprintf("hop %d", h.TTL), h.IP})
+		}
+	}
+	return ret
+}
+
+func gatewayAddress(r *Result) *AddressObservation {
+	if r.Gateway == nil || r.Gateway.ExternalIP == nil {
+		return nil
+	}
+	return &AddressObservation{"gateway external", r.Gateway.ExternalIP}
+}
+
+func mappingAddress(r *Result) *AddressObservation {
+	if r.Gateway == nil || r.Gateway.Mapping == nil || r.Gateway.Mapping.External.IP == nil {
+		return nil
+	}
+	return &AddressObservation{"gateway mapping", r.Gateway.Mapping.External.IP}
+}
+
+// cgnat reports whether the shared address space shows up in the
+// client's egress address or anywhere upstream of it. Only
+// carrier-grade NATs should use it, but some use RFC 1918 addresses
+// instead, which doubleNAT catches when the gateway reports them.
+func cgnat(r *Result) (bool, *Evidence) {
+	var shared, guesses, other []*AddressObservation
+	local, guessed := egressAddresses(r)
+	for _, o := range append(local, upstreamAddresses(r)...) {
+		switch {
+		case !sharedAddressSpace.Contains(o.IP):
+			other = append(other, o)
+		case guessed && o.Source == "local":
+			guesses = append(guesses, o)
+		default:
+			shared = append(shared, o)
+		}
+	}
+
+	switch {
+	case len(shared) > 0:
+		return true, addressEvidence(append(shared, guesses...), nil).proven()
+	case len(guesses) > 0:
+		// A shared local address may be an overlay network's, the
+		// other addresses weigh against it.
+		return true, addressEvidence(guesses, other)
+	default:
+		return false, addressEvidence(other, nil)
+	}
+}
+
+// doubleNAT reports whether there's another NAT beyond the client's
+// gateway: the gateway's external address is itself private, or
+// isn't the public IP that probe servers see, or a probe server saw
+// traffic from a mapping the gateway granted come from another IP, or
+// the path leaves a private LAN through carrier-grade NAT.
+//
+// Routers with RFC 1918 addresses past the gateway aren't counted,
+// since plenty of ISPs number their own routers that way without
+// doing any NAT.
+func doubleNAT(r *Result) (bool, *Evidence) {
+	var supporting, contradicting []*AddressObservation
+	if gw := gatewayAddress(r); gw != nil {
+		public := publicIPs(r)
+		switch {
+		case isPrivate(gw.IP) || sharedAddressSpace.Contains(gw.IP):
+			supporting = append(supporting, gw)
+		case containsIP(public, gw.IP):
+			contradicting = append(contradicting, gw)
+		case len(public) > 0:
+			supporting = append(supporting, gw)
+		}
+	}
+	if m := mappingAddress(r); m != nil && r.Gateway.Mapping.Observed != nil {
+		if r.Gateway.Mapping.Observed.IP.Equal(m.IP) {
+			contradicting = append(contradicting, m)
+		} else {
+			supporting = append(supporting, m)
+		}
+	}
+	var (
+		local, guessed = egressAddresses(r)
+		privateLAN     = false
+		beyondLAN      []*AddressObservation
+	)
+	for _, o := range local {
+		privateLAN = privateLAN || isPrivate(o.IP)
+	}
+	if privateLAN {
+		for _, o := range hopAddresses(r) {
+			if sharedAddressSpace.Contains(o.IP) {
+				beyondLAN = append(beyondLAN, o)
+			}
+		}
+	}
+
+	switch {
+	case len(supporting) > 0:
+		// Any of these addresses proves another NAT: the
+		// contradicting ones only show that the gateway isn't it.
+		return true, addressEvidence(append(supporting, beyondLAN...), contradicting).proven()
+	case len(beyondLAN) > 0 && !guessed:
+		return true, addressEvidence(beyondLAN, contradicting).proven()
+	case len(beyondLAN) > 0:
+		// The private local address may be a container or VPN
+		// network's, rather than the LAN's the path leaves from.
+		return true, addressEvidence(beyondLAN, contradicting)
+	default:
+		return false, addressEvidence(contradicting, nil)
+	}
+}
+
+// portMapping returns the protocol over which the client's gateway
+// granted a mapping, or "" if it granted none.
+func portMapping(r *Result) (string, *Evidence) {
+	if r.Gateway == nil {
+		return "", unknownEvidence()
+	}
+	var supporting []*AddressObservation
+	if m := mappingAddress(r); m != nil {
+		supporting = append(supporting, m)
+	}
+	ev := &Evidence{SupportingAddresses: supporting}
+	switch {
+	case r.Gateway.Mapping != nil:
+		return r.Gateway.Mapping.Protocol, ev.proven()
+	case r.Gateway.PCP || r.Gateway.NATPMP:
+		// The gateway answered, and didn't grant a mapping.
+		return "", ev.proven()
+	default:
+		// The gateway ignored both the address query and the mapping
+		// request.
+		return "", ev.scored(2, 0)
+	}
+}
+
+func containsIP(ips []net.IP, ip net.IP) bool {
+	for _, i := range ips {
+		if i.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func publicIPs(r *Result) []net.IP {
+	var (
+		ret  []net.IP
+		seen = map[string]bool{}
+	)
+	for _, probe := range r.MappingProbes {
+		if probe.Timeout || seen[probe.Mapped.IP.String()] {
+			continue
+		}
+		ret = append(ret, probe.Mapped.IP)
+		seen[probe.Mapped.IP.String()] = true
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return bytes.Compare(ret[i].To16(), ret[j].To16()) < 0
+	})
 	return ret
 }
 
 // Analysis is a high level "feature" analysis of NAT behavior.
 type Analysis struct {
+	// How the analyzed Result was obtained, if known.
+	Metadata *Metadata
+
 	// There is no data to analyze.
 	NoData bool
 	// There is no NAT, at least one local IP appears to be a public IP.
@@ -328,13 +1161,58 @@ type Analysis struct {
 	// Firewall requires outbound traffic to a port before allowing
 	// inbound traffic from that port.
 	FirewallEnforcesDestPort bool
+	// The firewall probe got no response, not even from the probed
+	// address, so the firewall's filtering is unknown. Both
+	// FirewallEnforces fields are false then.
+	FirewallUntested bool
+	// Whether the firewall allows inbound traffic from ip:ports that
+	// nothing on the client ever sent to, the strictest test of
+	// endpoint-independent filtering.
+	UnsolicitedInbound InboundVerdict
+	// Whether the firewall allows inbound traffic from third-party
+	// hosts, unrelated to the probe server the client talked to.
+	ThirdPartyInbound InboundVerdict
 	// Assigned public port tries to be the same as the LAN port.
 	MappingPreservesSourcePort bool
+	// Assigned public ports that don't preserve the LAN port are
+	// allocated close to each other, so the port of the next mapping
+	// can be guessed from the previous ones.
+	MappingSequential bool
 	// Observed multiple assigned public IPs.
 	MultiplePublicIPs bool
 	// Outbound probes that didn't see a response, indicating outbound
 	// filtering.
 	FilteredEgress []int
+	// The public IPs assigned to the client's mappings.
+	PublicIPs []net.IP
+	// The client is behind carrier-grade NAT: the shared address space
+	// reserved for it (100.64.0.0/10, RFC 6598) shows up on a local
+	// interface, on the path to the probe servers, or as the gateway's
+	// external address.
+	CGNAT bool
+	// There is more than one layer of NAT between the client and the
+	// internet, e.g. a home router behind an ISP modem that also does
+	// NAT, or behind carrier-grade NAT.
+	DoubleNAT bool
+	// The port mapping protocol, "pcp" or "nat-pmp", over which the
+	// client's gateway granted a temporary mapping. Empty if it didn't
+	// grant one.
+	PortMapping string
+
+	// The probe results supporting each of the conclusions above. May
+	// be nil if the caller discarded it.
+	Evidence *AnalysisEvidence
+}
+
+func portMappingName(proto string) string {
+	switch proto {
+	case "pcp":
+		return "PCP"
+	case "nat-pmp":
+		return "NAT-PMP"
+	default:
+		return proto
+	}
 }
 
 // String returns a human-readable description of the analysis.
@@ -349,6 +1227,29 @@ func (a *Analysis) String() string {
 
 	ret := []string{}
 
+	switch {
+	case a.CGNAT && a.DoubleNAT:
+		ret = append(ret, `Your ISP seems to use carrier-grade NAT, and your own NAT sits behind it.
+    Port forwards on your router can't make you reachable from the internet, and traffic goes through two NATs.
+    This makes NAT traversal more difficult.`)
+	case a.CGNAT:
+		ret = append(ret, `Your ISP seems to use carrier-grade NAT, sharing public IPs between customers.
+    Port forwards can't make you reachable from the internet, ask your ISP for a public IP if you need that.`)
+	case a.DoubleNAT:
+		ret = append(ret, `There seem to be two layers of NAT between you and the internet, e.g. a router behind an ISP modem that also does NAT.
+    Port forwards must be set up on both NATs, or the inner router put in the outer one's DMZ.
+    This makes NAT traversal more difficult.`)
+	}
+
+	switch {
+	case a.PortMapping != "" && a.DoubleNAT:
+		ret = append(ret, fmt.Sprintf(`Your router grants port mappings over %s, but they don't reach past the other NAT.`, portMappingName(a.PortMapping)))
+	case a.PortMapping != "":
+		ret = append(ret, fmt.Sprintf(`Your router grants port mappings over %s.
+    Applications can open ports without manual port forwards.
+    This makes NAT traversal easier.`, portMappingName(a.PortMapping)))
+	}
+
 	switch {
 	case a.MappingVariesByDestPort && a.MappingVariesByDestIP:
 		ret = append(ret, `NAT allocates a new ip:port for every unique 5-tuple (protocol, source ip, source port, destination ip, destination port).
@@ -367,6 +1268,9 @@ func (a *Analysis) String() string {
 	}
 
 	switch {
+	case a.FirewallUntested:
+		ret = append(ret, `Firewall behavior is unknown: the firewall probe got no responses at all, not even from the server it sent to.
+    Something may be blocking the probe's traffic, or the server stopped responding.`)
 	case a.FirewallEnforcesDestIP && a.FirewallEnforcesDestPort:
 		ret = append(ret, `Firewall requires outbound traffic to an ip:port before allowing inbound traffic from that ip:port.
     This is common practice for NAT gateways.
@@ -383,8 +1287,26 @@ func (a *Analysis) String() string {
     This is best practice for "traversal-friendly" NAT devices.`)
 	}
 
+	switch {
+	case a.UnsolicitedInbound == InboundAllowed:
+		ret = append(ret, `Firewall allows inbound traffic even from ip:ports that nothing on your LAN ever sent to.`)
+	case a.UnsolicitedInbound == InboundBlocked && a.FilteringBehavior() == EndpointIndependent:
+		ret = append(ret, `However, firewall blocks inbound traffic from ip:ports that nothing on your LAN ever sent to.
+    It may track every destination your LAN talks to, rather than filtering per mapping.`)
+	}
+
+	switch {
+	case a.ThirdPartyInbound == InboundAllowed:
+		ret = append(ret, `Firewall allows inbound traffic from third-party hosts, unrelated to the ones your LAN talked to.`)
+	case a.ThirdPartyInbound == InboundBlocked && a.FilteringBehavior() == EndpointIndependent:
+		ret = append(ret, `However, firewall seems to block inbound traffic from third-party hosts, unrelated to the ones your LAN talked to.
+    It may treat unknown networks differently from other IPs of hosts you talked to.`)
+	}
+
 	if a.MappingPreservesSourcePort {
 		ret = append(ret, `NAT seems to try and make the public port number match the LAN port number.`)
+	} else if a.MappingSequential {
+		ret = append(ret, `NAT seems to allocate public ports sequentially, so new mappings are predictable.`)
 	} else {
 		ret = append(ret, `NAT seems to randomize the public port when allocating a new mapping.`)
 	}
@@ -410,3 +1332,106 @@ func (a *Analysis) String() string {
 
 	return strings.Join(ret, "\n")
 }
+
+// InboundVerdict is the outcome of a test of whether the firewall
+// allows some kind of inbound traffic.
+type InboundVerdict int
+
+const (
+	// The test didn't run, or the server couldn't perform it.
+	InboundUntested InboundVerdict = iota
+	// The inbound traffic got through.
+	InboundAllowed
+	// The inbound traffic was blocked.
+	InboundBlocked
+)
+
+func (v InboundVerdict) String() string {
+	switch v {
+	case InboundUntested:
+		return "untested"
+	case InboundAllowed:
+		return "allowed"
+	case InboundBlocked:
+		return "blocked"
+	default:
+		return fmt.Sprintf("InboundVerdict(%d)", int(v))
+	}
+}
+
+// Behavior classifies how a NAT mapping or firewall filtering
+// decision depends on the destination of outbound traffic, using the
+// terminology of RFC 4787.
+type Behavior int
+
+const (
+	// The destination does not matter.
+	EndpointIndependent Behavior = iota
+	// Only the destination IP matters.
+	AddressDependent
+	// Only the destination port matters. RFC 4787 doesn't
+	// acknowledge this one, but some devices do it anyway.
+	PortDependent
+	// Both the destination IP and port matter.
+	AddressAndPortDependent
+	// There wasn't enough data to tell.
+	UnknownBehavior
+)
+
+func (b Behavior) String() string {
+	switch b {
+	case EndpointIndependent:
+		return "endpoint-independent"
+	case AddressDependent:
+		return "address-dependent"
+	case PortDependent:
+		return "port-dependent"
+	case AddressAndPortDependent:
+		return "address-and-port-dependent"
+	case UnknownBehavior:
+		return "unknown"
+	default:
+		return fmt.Sprintf("Behavior(%d)", int(b))
+	}
+}
+
+// strictness ranks behaviors by how much they hinder NAT traversal.
+// It's meaningless for UnknownBehavior.
+func (b Behavior) strictness() int {
+	switch b {
+	case EndpointIndependent:
+		return 0
+	case AddressAndPortDependent:
+		return 2
+	default:
+		return 1
+	}
+}
+
+func behavior(byAddr, byPort bool) Behavior {
+	switch {
+	case byAddr && byPort:
+		return AddressAndPortDependent
+	case byAddr:
+		return AddressDependent
+	case byPort:
+		return PortDependent
+	default:
+		return EndpointIndependent
+	}
+}
+
+// MappingBehavior returns the NAT's mapping behavior.
+func (a *Analysis) MappingBehavior() Behavior {
+	return behavior(a.MappingVariesByDestIP, a.MappingVariesByDestPort)
+}
+
+// FilteringBehavior returns the firewall's inbound filtering
+// behavior, which is UnknownBehavior if the firewall probe didn't
+// work.
+func (a *Analysis) FilteringBehavior() Behavior {
+	if a.FirewallUntested {
+		return UnknownBehavior
+	}
+	return behavior(a.FirewallEnforcesDestIP, a.FirewallEnforcesDestPort)
+}
@@ -0,0 +1,130 @@
+package client
+
+import (
+	"net"
+	"testing"
+)
+
+// upstreamResult returns a result with the given local IPs, egress
+// IP, path hops and gateway external IP, whose mappings to the probe
+// servers are on public.
+func upstreamResult(local []string, egress string, hops []string, gateway string, public string) *Result {
+	r := &Result{}
+	for _, ip := range local {
+		r.LocalIPs = append(r.LocalIPs, net.ParseIP(ip))
+	}
+	if egress != "" {
+		r.EgressIP = net.ParseIP(egress)
+	}
+	if hops != nil {
+		r.Path = &PathProbe{Remote: mustUDPAddr("203.0.113.1:3478"), Reached: true}
+		for i, ip := range hops {
+			r.Path.Hops = append(r.Path.Hops, &Hop{TTL: i + 1, IP: net.ParseIP(ip)})
+		}
+	}
+	if gateway != "" {
+		r.Gateway = &GatewayProbe{IP: net.ParseIP("192.168.1.1"), NATPMP: true, ExternalIP: net.ParseIP(gateway)}
+	}
+	if public != "" {
+		r.MappingProbes = []*MappingProbe{
+			{Local: mustUDPAddr("0.0.0.0:5000"), Mapped: &net.UDPAddr{IP: net.ParseIP(public), Port: 6000}, Remote: mustUDPAddr("203.0.113.1:3478")},
+		}
+	}
+	return r
+}
+
+func TestCGNAT(t *testing.T) {
+	tests := []struct {
+		desc       string
+		r          *Result
+		want       bool
+		confidence float64
+		unknown    bool
+	}{
+		{"no data", &Result{}, false, 0, true},
+		{
+			"public LAN",
+			upstreamResult([]string{"198.51.100.7"}, "198.51.100.7", []string{"198.51.100.1"}, "", "198.51.100.7"),
+			false, 2.0 / 3, false,
+		},
+		{
+			"egress in shared space",
+			upstreamResult([]string{"100.64.3.4"}, "100.64.3.4", nil, "", "198.51.100.7"),
+			true, 1, false,
+		},
+		{
+			"CGNAT router on the path",
+			upstreamResult([]string{"192.168.1.10"}, "192.168.1.10", []string{"192.168.1.1", "100.64.0.1"}, "", "198.51.100.7"),
+			true, 1, false,
+		},
+		{
+			"gateway external IP in shared space",
+			upstreamResult([]string{"192.168.1.10"}, "192.168.1.10", nil, "100.64.3.4", "198.51.100.7"),
+			true, 1, false,
+		},
+		{
+			// Tailscale and friends number their overlay in the
+			// shared address space.
+			"overlay interface",
+			upstreamResult([]string{"192.168.1.10", "100.101.102.103"}, "192.168.1.10", []string{"192.168.1.1", "198.51.100.1"}, "198.51.100.7", "198.51.100.7"),
+			false, 0.8, false,
+		},
+		{
+			"overlay interface without egress IP",
+			upstreamResult([]string{"192.168.1.10", "100.101.102.103"}, "", []string{"192.168.1.1", "198.51.100.1"}, "", "198.51.100.7"),
+			true, 0.2, false,
+		},
+	}
+	for _, test := range tests {
+		got, ev := cgnat(test.r)
+		checkEvidence(t, test.desc, got, test.want, ev, test.confidence, test.unknown)
+	}
+}
+
+func TestDoubleNAT(t *testing.T) {
+	tests := []struct {
+		desc       string
+		r          *Result
+		want       bool
+		confidence float64
+		unknown    bool
+	}{
+		{"no data", &Result{}, false, 0, true},
+		{
+			"gateway external IP is public",
+			upstreamResult([]string{"192.168.1.10"}, "192.168.1.10", nil, "198.51.100.7", "198.51.100.7"),
+			false, 0.5, false,
+		},
+		{
+			"gateway external IP is private",
+			upstreamResult([]string{"192.168.1.10"}, "192.168.1.10", nil, "10.0.0.2", "198.51.100.7"),
+			true, 1, false,
+		},
+		{
+			"gateway external IP isn't the public IP",
+			upstreamResult([]string{"192.168.1.10"}, "192.168.1.10", nil, "198.51.100.9", "198.51.100.7"),
+			true, 1, false,
+		},
+		{
+			"private LAN behind CGNAT",
+			upstreamResult([]string{"192.168.1.10"}, "192.168.1.10", []string{"192.168.1.1", "100.64.0.1"}, "", "198.51.100.7"),
+			true, 1, false,
+		},
+		{
+			// The path leaves from the public egress address, the
+			// private one is docker0's.
+			"container network",
+			upstreamResult([]string{"198.51.100.7", "172.17.0.1"}, "198.51.100.7", []string{"100.64.0.1"}, "", "198.51.100.7"),
+			false, 0, true,
+		},
+		{
+			"container network without egress IP",
+			upstreamResult([]string{"198.51.100.7", "172.17.0.1"}, "", []string{"100.64.0.1"}, "", "198.51.100.7"),
+			true, 0.5, false,
+		},
+	}
+	for _, test := range tests {
+		got, ev := doubleNAT(test.r)
+		checkEvidence(t, test.desc, got, test.want, ev, test.confidence, test.unknown)
+	}
+}
@@ -0,0 +1,194 @@
+//go:build linux
+// +build linux
+
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.universe.tf/natprobe/internal"
+	"golang.org/x/sys/unix"
+)
+
+// sockExtendedErrLen is the size of struct sock_extended_err, which
+// the kernel follows with the address of the ICMP error's sender.
+const sockExtendedErrLen = 16
+
+// ICMP message types that end a hop probe.
+const (
+	icmpDestUnreachable = 3
+	icmpTimeExceeded    = 11
+)
+
+// traceHop sends probes to dest with the given TTL from a fresh
+// socket, every txInterval until ctx is done or something answers. It
+// returns the router that reported the TTL running out, or reached if
+// dest itself answered.
+//
+// Using a socket per TTL lets every TTL be probed at once, without
+// mixing up late ICMP errors between TTLs.
+func traceHop(ctx context.Context, dest *net.UDPAddr, ttl int, txInterval time.Duration, rep *reporter) (hop net.IP, reached bool, err error) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		return nil, false, &SocketError{"listen", err}
+	}
+	defer conn.Close()
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, false, &SocketError{"listen", err}
+	}
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		if serr = unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_TTL, ttl); serr != nil {
+			return
+		}
+		// Queue ICMP errors on the socket, with their sender.
+		serr = unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_RECVERR, 1)
+	})
+	if err == nil {
+		err = serr
+	}
+	if err != nil {
+		return nil, false, &SocketError{"set options", err}
+	}
+	local := copyUDPAddr(conn.LocalAddr().(*net.UDPAddr))
+	rep.notify(&Event{Type: EventSocketOpened, Phase: PhasePath, Local: local})
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		panic("deadline unexpectedly not set in context")
+	}
+	if err = conn.SetReadDeadline(deadline); err != nil {
+		return nil, false, &SocketError{"set deadline", err}
+	}
+	defer cancelReads(ctx, conn)()
+
+	txDone := make(chan struct{})
+	go func() {
+		defer close(txDone)
+		transmit(ctx, conn, []*net.UDPAddr{dest}, txInterval, func(dest *net.UDPAddr, err error) {
+			rep.notify(&Event{Type: EventPacketSent, Phase: PhasePath, Local: local, Remote: dest, Err: err})
+		})
+	}()
+	defer func() {
+		cancel()
+		<-txDone
+	}()
+
+	var (
+		buf [1500]byte
+		oob [512]byte
+	)
+	err = raw.Read(func(fd uintptr) bool {
+		for {
+			_, oobn, _, _, err := unix.Recvmsg(int(fd), buf[:], oob[:], unix.MSG_ERRQUEUE|unix.MSG_DONTWAIT)
+			if err == nil {
+				var ok bool
+				if hop, ok = parseICMPError(oob[:oobn]); ok {
+					reached = hop.Equal(dest.IP)
+					return true
+				}
+				continue
+			}
+
+			n, _, err := unix.Recvfrom(int(fd), buf[:], unix.MSG_DONTWAIT)
+			switch {
+			case err == unix.EAGAIN:
+				return false
+			case err != nil:
+				// The pending ICMP error is reported once as a read
+				// error, on top of being queued.
+				continue
+			}
+			if _, _, _, ok := internal.ParseResponse(buf[:n]); ok {
+				reached = true
+				return true
+			}
+		}
+	})
+	if err != nil {
+		if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+			return nil, false, nil
+		}
+		return nil, false, &SocketError{"read", err}
+	}
+	if reached {
+		rep.notify(&Event{Type: EventResponseReceived, Phase: PhasePath, Local: local, Remote: copyUDPAddr(dest)})
+		return nil, true, nil
+	}
+	rep.notify(&Event{Type: EventResponseReceived, Phase: PhasePath, Local: local, Remote: &net.UDPAddr{IP: hop}})
+	return hop, false, nil
+}
+
+// parseICMPError returns the sender of the ICMP error described by
+// the control messages in oob, if it's one that ends a hop probe.
+func parseICMPError(oob []byte) (net.IP, bool) {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, false
+	}
+	for _, msg := range msgs {
+		if msg.Header.Level != unix.SOL_IP || msg.Header.Type != unix.IP_RECVERR {
+			continue
+		}
+		// The sender is a struct sockaddr_in, whose address starts
+		// after the family and port.
+		if len(msg.Data) < sockExtendedErrLen+8 {
+			continue
+		}
+		origin, typ := msg.Data[4], msg.Data[5]
+		if origin != unix.SO_EE_ORIGIN_ICMP || (typ != icmpTimeExceeded && typ != icmpDestUnreachable) {
+			continue
+		}
+		sa := msg.Data[sockExtendedErrLen:]
+		return net.IPv4(sa[4], sa[5], sa[6], sa[7]).To4(), true
+	}
+	return nil, false
+}
+
+// defaultGateway returns the gateway of the IPv4 default route, from
+// the kernel's routing table.
+func defaultGateway() (net.IP, error) {
+	f, err := os.Open("/proc/net/route")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// Fields are interface, destination, gateway, flags, and more,
+	// with addresses in little-endian hex.
+	const rtfGateway = 0x2
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 8 || fields[1] != "00000000" || fields[7] != "00000000" {
+			continue
+		}
+		flags, err := strconv.ParseUint(fields[3], 16, 16)
+		if err != nil || flags&rtfGateway == 0 {
+			continue
+		}
+		gw, err := strconv.ParseUint(fields[2], 16, 32)
+		if err != nil {
+			continue
+		}
+		ret := make(net.IP, 4)
+		binary.LittleEndian.PutUint32(ret, uint32(gw))
+		return ret, nil
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return nil, errors.New("no IPv4 default route")
+}
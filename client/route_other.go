@@ -0,0 +1,21 @@
+//go:build !linux
+// +build !linux
+
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+var errRouteUnsupported = errors.New("not supported on this platform")
+
+func traceHop(ctx context.Context, dest *net.UDPAddr, ttl int, txInterval time.Duration, rep *reporter) (hop net.IP, reached bool, err error) {
+	return nil, false, errRouteUnsupported
+}
+
+func defaultGateway() (net.IP, error) {
+	return nil, errRouteUnsupported
+}
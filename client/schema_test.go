@@ -0,0 +1,302 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// schemaValidator validates JSON documents against schema.json. It
+// implements the subset of JSON Schema draft 7 that schema.json uses,
+// and fails on any other keyword so that the subset can't silently
+// fall behind.
+type schemaValidator struct {
+	root map[string]interface{}
+}
+
+func loadSchema(t *testing.T) *schemaValidator {
+	t.Helper()
+	bs, err := ioutil.ReadFile("schema.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var root map[string]interface{}
+	if err := json.Unmarshal(bs, &root); err != nil {
+		t.Fatalf("parsing schema.json: %s", err)
+	}
+	return &schemaValidator{root}
+}
+
+// Keywords that don't constrain documents.
+var schemaAnnotations = map[string]bool{
+	"$schema":     true,
+	"$id":         true,
+	"title":       true,
+	"description": true,
+	"definitions": true,
+}
+
+func (v *schemaValidator) validate(schema map[string]interface{}, doc interface{}, path string) error {
+	for kw, arg := range schema {
+		if schemaAnnotations[kw] {
+			continue
+		}
+		if err := v.keyword(kw, arg, doc, path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (v *schemaValidator) keyword(kw string, arg interface{}, doc interface{}, path string) error {
+	switch kw {
+	case "$ref":
+		ref := arg.(string)
+		if !strings.HasPrefix(ref, "#/definitions/") {
+			return fmt.Errorf("%s: unsupported $ref %q", path, ref)
+		}
+		def, ok := v.root["definitions"].(map[string]interface{})[strings.TrimPrefix(ref, "#/definitions/")].(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s: undefined $ref %q", path, ref)
+		}
+		return v.validate(def, doc, path)
+
+	case "type":
+		if !schemaType(arg.(string), doc) {
+			return fmt.Errorf("%s: %v is not of type %s", path, doc, arg)
+		}
+
+	case "const":
+		if doc != arg {
+			return fmt.Errorf("%s: %v, want %v", path, doc, arg)
+		}
+
+	case "enum":
+		for _, e := range arg.([]interface{}) {
+			if doc == e {
+				return nil
+			}
+		}
+		return fmt.Errorf("%s: %v is not one of %v", path, doc, arg)
+
+	case "minimum", "maximum":
+		n, ok := doc.(float64)
+		if !ok {
+			return nil
+		}
+		if (kw == "minimum" && n < arg.(float64)) || (kw == "maximum" && n > arg.(float64)) {
+			return fmt.Errorf("%s: %v is out of range, %s is %v", path, n, kw, arg)
+		}
+
+	case "pattern":
+		s, ok := doc.(string)
+		if !ok {
+			return nil
+		}
+		if !regexp.MustCompile(arg.(string)).MatchString(s) {
+			return fmt.Errorf("%s: %q doesn't match %s", path, s, arg)
+		}
+
+	case "format":
+		s, ok := doc.(string)
+		if !ok {
+			return nil
+		}
+		ok = true
+		switch arg {
+		case "ipv4":
+			ip := net.ParseIP(s)
+			ok = ip != nil && ip.To4() != nil && !strings.Contains(s, ":")
+		case "ipv6":
+			ok = net.ParseIP(s) != nil && strings.Contains(s, ":")
+		case "date-time":
+			_, err := time.Parse(time.RFC3339Nano, s)
+			ok = err == nil
+		default:
+			return fmt.Errorf("%s: unsupported format %q", path, arg)
+		}
+		if !ok {
+			return fmt.Errorf("%s: %q is not a valid %s", path, s, arg)
+		}
+
+	case "oneOf":
+		matched := 0
+		var errs []string
+		for _, sub := range arg.([]interface{}) {
+			if err := v.validate(sub.(map[string]interface{}), doc, path); err != nil {
+				errs = append(errs, err.Error())
+			} else {
+				matched++
+			}
+		}
+		if matched != 1 {
+			return fmt.Errorf("%s: matches %d schemas of oneOf, want 1 (%s)", path, matched, strings.Join(errs, "; "))
+		}
+
+	case "required":
+		obj, ok := doc.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		for _, name := range arg.([]interface{}) {
+			if _, ok := obj[name.(string)]; !ok {
+				return fmt.Errorf("%s: missing required property %q", path, name)
+			}
+		}
+
+	case "properties":
+		obj, ok := doc.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		for name, sub := range arg.(map[string]interface{}) {
+			if val, ok := obj[name]; ok {
+				if err := v.validate(sub.(map[string]interface{}), val, path+"."+name); err != nil {
+					return err
+				}
+			}
+		}
+
+	case "additionalProperties":
+		obj, ok := doc.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		for name, val := range obj {
+			if err := v.validate(arg.(map[string]interface{}), val, path+"."+name); err != nil {
+				return err
+			}
+		}
+
+	case "items":
+		arr, ok := doc.([]interface{})
+		if !ok {
+			return nil
+		}
+		for i, val := range arr {
+			if err := v.validate(arg.(map[string]interface{}), val, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+
+	default:
+		return fmt.Errorf("%s: unsupported schema keyword %q", path, kw)
+	}
+	return nil
+}
+
+func schemaType(typ string, doc interface{}) bool {
+	switch typ {
+	case "object":
+		_, ok := doc.(map[string]interface{})
+		return ok
+	case "array":
+		_, ok := doc.([]interface{})
+		return ok
+	case "string":
+		_, ok := doc.(string)
+		return ok
+	case "boolean":
+		_, ok := doc.(bool)
+		return ok
+	case "number":
+		_, ok := doc.(float64)
+		return ok
+	case "integer":
+		n, ok := doc.(float64)
+		return ok && n == float64(int64(n))
+	case "null":
+		return doc == nil
+	}
+	return false
+}
+
+func TestSchema(t *testing.T) {
+	v := loadSchema(t)
+
+	sub, err := NewSubmission(testResult(), testAnonymizer(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	docs := []interface{}{
+		testResult(),
+		testResult().Analyze(),
+		&Result{},
+		&Analysis{NoData: true},
+		Compare(&Analysis{MappingPreservesSourcePort: true}, testResult().Analyze()),
+		Predict(testResult().Analyze(), &Analysis{NoNAT: true}),
+		&PunchResult{
+			Success:       true,
+			Local:         mustUDPAddr("192.168.1.10:5000"),
+			Mapped:        mustUDPAddr("198.51.100.7:6000"),
+			PeerMapped:    mustUDPAddr("198.51.100.8:7000"),
+			PeerLocal:     mustUDPAddr("10.0.0.2:7000"),
+			Remote:        mustUDPAddr("198.51.100.8:7000"),
+			TimeToConnect: 150 * time.Millisecond,
+		},
+		&SprayResult{
+			Sockets:             2,
+			Mappings:            []*net.UDPAddr{mustUDPAddr("198.51.100.7:6000"), mustUDPAddr("198.51.100.7:6001")},
+			Target:              net.ParseIP("198.51.100.7"),
+			PacketsSent:         100,
+			Hits:                []*SprayHit{{Seq: 42, Local: mustUDPAddr("192.168.1.10:5000"), Mapped: mustUDPAddr("198.51.100.7:6000")}},
+			FirstHit:            42,
+			ExpectedProbability: 0.003,
+		},
+		&ForwardResult{
+			Target:              mustUDPAddr("198.51.100.7:8080"),
+			LocalPort:           8080,
+			Listened:            []int{8080},
+			PacketsSent:         5,
+			Hits:                []*ForwardHit{{Seq: 1, Local: mustUDPAddr("0.0.0.0:8080"), From: mustUDPAddr("203.0.113.1:40000"), SourcePort: 40000}},
+			Arrived:             true,
+			ArrivedOnLocalPort:  true,
+			SourcePortPreserved: true,
+		},
+		&Directory{
+			Expires: time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC),
+			Servers: []*Server{
+				{Name: "natprobe1.example.", IPs: []net.IP{net.ParseIP("203.0.113.1")}, Ports: []int{3478}, Capabilities: []string{CapabilityProbe}},
+				{IPs: []net.IP{net.ParseIP("2001:db8::1")}},
+			},
+		},
+		sub,
+	}
+	for _, doc := range docs {
+		bs, err := json.Marshal(doc)
+		if err != nil {
+			t.Fatalf("marshaling %T: %s", doc, err)
+		}
+		var parsed interface{}
+		if err := json.Unmarshal(bs, &parsed); err != nil {
+			t.Fatal(err)
+		}
+		if err := v.validate(v.root, parsed, "$"); err != nil {
+			t.Errorf("%T doesn't match schema.json: %s\n%s", doc, err, bs)
+		}
+	}
+}
+
+func TestSchemaRejects(t *testing.T) {
+	v := loadSchema(t)
+	docs := []string{
+		`{"schemaVersion": 1, "kind": "result"}`,
+		`{"schemaVersion": 1, "kind": "nonsense"}`,
+		`{"schemaVersion": 2, "kind": "analysis", "noData": true}`,
+		`{"kind": "diff", "changes": []}`,
+	}
+	for _, doc := range docs {
+		var parsed interface{}
+		if err := json.Unmarshal([]byte(doc), &parsed); err != nil {
+			t.Fatal(err)
+		}
+		if err := v.validate(v.root, parsed, "$"); err == nil {
+			t.Errorf("schema.json accepted %s", doc)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package client
+
+import (
+	"context"
+	"net"
+	"sort"
+	"time"
+
+	"go.universe.tf/natprobe/internal"
+)
+
+// ServerSelection records how Probe chose which probe server IPs to
+// use, out of all the IPs that the probe servers resolved to.
+type ServerSelection struct {
+	// All the IPs considered, ordered by RTT, unreachable ones last.
+	Candidates []*Candidate
+	// The IPs used for probing. Nil if no candidate was reachable, in
+	// which case all of them were used.
+	Selected []net.IP
+}
+
+// Candidate is a probe server IP considered for selection.
+type Candidate struct {
+	IP net.IP
+	// At least one port on IP responded to pings.
+	Reachable bool
+	// The lowest RTT measured to any port on IP, zero if it's not
+	// reachable.
+	RTT time.Duration
+}
+
+func (c *Candidate) selected(ips []net.IP) bool {
+	for _, ip := range ips {
+		if ip.Equal(c.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// selectServers pings all ports on ips, and selects the two
+// reachable IPs with the lowest RTT.
+func selectServers(ctx context.Context, ips []net.IP, ports []int, duration, txInterval time.Duration, rep *reporter) (*ServerSelection, error) {
+	rep.notify(&Event{Type: EventPhaseStarted, Phase: PhaseSelect})
+	defer rep.notify(&Event{Type: EventPhaseFinished, Phase: PhaseSelect})
+
+	var (
+		candidates []*Candidate
+		byIP       = map[string]*Candidate{}
+	)
+	for _, ip := range ips {
+		if byIP[ip.String()] == nil {
+			c := &Candidate{IP: ip}
+			candidates = append(candidates, c)
+			byIP[ip.String()] = c
+		}
+	}
+
+	stats, err := ping(ctx, dests(ips, ports), duration, txInterval, len(candidates), rep)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range stats {
+		if s.Received == 0 {
+			continue
+		}
+		c := byIP[s.Remote.IP.String()]
+		if !c.Reachable || s.RTT < c.RTT {
+			c.Reachable, c.RTT = true, s.RTT
+		}
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if a.Reachable != b.Reachable {
+			return a.Reachable
+		}
+		return a.RTT < b.RTT
+	})
+
+	ret := &ServerSelection{
+		Candidates: candidates,
+	}
+	for _, c := range candidates {
+		if c.Reachable && len(ret.Selected) < 2 {
+			ret.Selected = append(ret.Selected, c.IP)
+		}
+	}
+	return ret, nil
+}
+
+// ping sends mapping probes to dests from a single socket until
+// duration expires or wantIPs distinct IPs have responded, and
+// returns the traffic stats for each destination.
+func ping(ctx context.Context, dests []*net.UDPAddr, duration, txInterval time.Duration, wantIPs int, rep *reporter) ([]*ServerStats, error) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		return nil, &SocketError{"listen", err}
+	}
+	defer conn.Close()
+	local := copyUDPAddr(conn.LocalAddr().(*net.UDPAddr))
+	rep.notify(&Event{Type: EventSocketOpened, Phase: PhaseSelect, Local: local})
+
+	ctx, cancel := context.WithTimeout(ctx, duration)
+	defer cancel()
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		panic("deadline unexpectedly not set in context")
+	}
+	if err = conn.SetReadDeadline(deadline); err != nil {
+		return nil, &SocketError{"set deadline", err}
+	}
+	defer cancelReads(ctx, conn)()
+
+	exchange := newExchangeStats(dests)
+	txDone := make(chan struct{})
+	go func() {
+		defer close(txDone)
+		transmit(ctx, conn, dests, txInterval, func(dest *net.UDPAddr, err error) {
+			if err == nil {
+				exchange.sent(dest)
+			}
+			rep.notify(&Event{Type: EventPacketSent, Phase: PhaseSelect, Local: local, Remote: dest, Err: err})
+		})
+	}()
+	defer func() {
+		cancel()
+		<-txDone
+	}()
+
+	var (
+		buf       [1500]byte
+		responded = map[string]bool{}
+	)
+	for len(responded) < wantIPs {
+		n, addr, err := conn.ReadFromUDP(buf[:])
+		if err != nil {
+			if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+				break
+			}
+			return exchange.get(), &SocketError{"read", err}
+		}
+		if _, _, _, ok := internal.ParseResponse(buf[:n]); !ok {
+			continue
+		}
+		exchange.received(addr)
+		rep.notify(&Event{Type: EventResponseReceived, Phase: PhaseSelect, Local: local, Remote: copyUDPAddr(addr)})
+		responded[addr.IP.String()] = true
+	}
+
+	return exchange.get(), nil
+}
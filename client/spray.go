@@ -0,0 +1,447 @@
+package client
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.universe.tf/natprobe/internal"
+)
+
+// SprayOptions configures a birthday spraying experiment. All zero
+// values are replaced with sensible defaults.
+type SprayOptions struct {
+	// The host:port of the probe server to use. The server must have
+	// spraying enabled. If empty, a server with CapabilitySpray is
+	// found with Discover.
+	Server string
+	// Configures discovery, when Server is empty.
+	Discovery *DiscoveryOptions
+
+	// The number of sockets to open, each of which gets its own
+	// mapping for the server to hit.
+	Sockets int
+	// The number of packets to ask the server to spray. The server may
+	// spray fewer.
+	Packets int
+
+	// How long to spend getting mappings for the sockets, and
+	// negotiating with the server.
+	MappingDuration time.Duration
+	// How frequently to send mapping probe and spray request packets.
+	TransmitInterval time.Duration
+	// How long to wait for sprayed packets to arrive.
+	SprayDuration time.Duration
+}
+
+func (o *SprayOptions) addDefaults() {
+	if o.Sockets == 0 {
+		o.Sockets = 256
+	}
+	if o.Packets == 0 {
+		o.Packets = 1024
+	}
+	if o.MappingDuration == 0 {
+		o.MappingDuration = 3 * time.Second
+	}
+	if o.TransmitInterval == 0 {
+		o.TransmitInterval = 200 * time.Millisecond
+	}
+	if o.SprayDuration == 0 {
+		o.SprayDuration = 5 * time.Second
+	}
+}
+
+// SprayResult is the outcome of a birthday spraying experiment.
+type SprayResult struct {
+	// The number of sockets opened.
+	Sockets int
+	// The public addresses of the sockets' mappings to the server,
+	// for sockets that got a mapping.
+	Mappings []*net.UDPAddr
+	// The public IP that the server sprayed.
+	Target net.IP
+	// The number of packets the server sprayed.
+	PacketsSent int
+	// Sprayed packets that made it through the NAT, ordered by
+	// sequence number.
+	Hits []*SprayHit
+	// The sequence number of the first sprayed packet that made it
+	// through, i.e. the number of packets needed for a hit. Zero if
+	// there were no hits.
+	FirstHit int
+	// The probability of at least one hit that the birthday paradox
+	// predicts, given the mappings on Target and the packets sent.
+	ExpectedProbability float64
+}
+
+// SprayHit is a sprayed packet that made it through the NAT.
+type SprayHit struct {
+	// The packet's sequence number, starting at 1.
+	Seq int
+	// The socket that received the packet.
+	Local *net.UDPAddr
+	// The socket's mapping, which the packet hit.
+	Mapped *net.UDPAddr
+}
+
+// String returns a human-readable description of the result.
+func (r *SprayResult) String() string {
+	var ret []string
+	if r.FirstHit > 0 {
+		ret = append(ret, fmt.Sprintf("Birthday spraying hit a mapping after %d of %d packets.", r.FirstHit, r.PacketsSent))
+	} else {
+		ret = append(ret, fmt.Sprintf("Birthday spraying did not hit any mapping with %d packets.", r.PacketsSent))
+	}
+	ret = append(ret,
+		fmt.Sprintf("    Sockets: %d, mappings obtained: %d", r.Sockets, len(r.Mappings)),
+		fmt.Sprintf("    Sprayed IP: %s", r.Target),
+		fmt.Sprintf("    Hits: %d", len(r.Hits)),
+		fmt.Sprintf("    Expected probability of at least one hit: %.1f%%", r.ExpectedProbability*100),
+	)
+	for _, hit := range r.Hits {
+		ret = append(ret, fmt.Sprintf("    Packet %d hit %s (local %s)", hit.Seq, hit.Mapped, hit.Local))
+	}
+	return strings.Join(ret, "\n")
+}
+
+// Spray runs a birthday spraying experiment: it opens many sockets,
+// each with a mapping to the server, then asks the server to spray
+// packets at random ports on the local machine's public IP, and
+// records which of them make it through the NAT.
+//
+// This is a stand-in for a peer spraying a symmetric NAT during NAT
+// traversal, to measure how many mappings and packets are needed in
+// practice.
+func Spray(ctx context.Context, opts *SprayOptions) (*SprayResult, error) {
+	if opts == nil {
+		opts = &SprayOptions{}
+	}
+	opts.addDefaults()
+	if opts.Packets > 65535 {
+		return nil, fmt.Errorf("can't spray more than 65535 packets, got %d", opts.Packets)
+	}
+	if opts.Server == "" {
+		addr, err := discoverServer(ctx, opts.Discovery, CapabilitySpray)
+		if err != nil {
+			return nil, err
+		}
+		opts.Server = addr
+	}
+
+	server, err := resolveServer(ctx, opts.Server, opts.MappingDuration)
+	if err != nil {
+		return nil, err
+	}
+
+	var conns []*net.UDPConn
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+	for i := 0; i < opts.Sockets; i++ {
+		conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+		if err != nil {
+			return nil, err
+		}
+		conns = append(conns, conn)
+	}
+
+	mappings := mapSockets(ctx, conns, server, opts.MappingDuration, opts.TransmitInterval)
+	ret := &SprayResult{
+		Sockets: len(conns),
+	}
+	for _, m := range mappings {
+		if m != nil {
+			ret.Mappings = append(ret.Mappings, m)
+		}
+	}
+	if len(ret.Mappings) == 0 {
+		return nil, errors.New("no sockets got a mapping from the server")
+	}
+
+	reply, err := requestSpray(ctx, server, opts)
+	if err != nil {
+		return nil, err
+	}
+	ret.Target = reply.Mapped.IP
+	ret.PacketsSent = int(reply.Packets)
+
+	// Count only the mappings the server can actually hit.
+	targets := map[int]bool{}
+	for _, m := range ret.Mappings {
+		if m.IP.Equal(ret.Target) && m.Port >= internal.SprayMinPort {
+			targets[m.Port] = true
+		}
+	}
+	ret.ExpectedProbability = sprayHitProbability(len(targets), ret.PacketsSent)
+
+	var (
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		deadline = time.Now().Add(opts.SprayDuration)
+	)
+	for i, conn := range conns {
+		if mappings[i] == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(conn *net.UDPConn, mapped *net.UDPAddr) {
+			defer wg.Done()
+			for _, seq := range receiveSpray(conn, server, reply.Nonce, deadline) {
+				mu.Lock()
+				ret.Hits = append(ret.Hits, &SprayHit{
+					Seq:    seq,
+					Local:  copyUDPAddr(conn.LocalAddr().(*net.UDPAddr)),
+					Mapped: mapped,
+				})
+				mu.Unlock()
+			}
+		}(conn, mappings[i])
+	}
+	wg.Wait()
+
+	sort.Slice(ret.Hits, func(i, j int) bool { return ret.Hits[i].Seq < ret.Hits[j].Seq })
+	if len(ret.Hits) > 0 {
+		ret.FirstHit = ret.Hits[0].Seq
+	}
+
+	return ret, nil
+}
+
+// mapSockets gets a mapping to server for each of conns, and returns
+// the mapped addresses. Sockets that didn't get a mapping have a nil
+// mapped address.
+func mapSockets(ctx context.Context, conns []*net.UDPConn, server *net.UDPAddr, duration, txInterval time.Duration) []*net.UDPAddr {
+	ctx, cancel := context.WithTimeout(ctx, duration)
+	defer cancel()
+
+	var (
+		ret = make([]*net.UDPAddr, len(conns))
+		wg  sync.WaitGroup
+	)
+	for i, conn := range conns {
+		wg.Add(1)
+		go func(i int, conn *net.UDPConn) {
+			defer wg.Done()
+			ret[i] = mapSocket(ctx, conn, server, txInterval)
+		}(i, conn)
+	}
+	wg.Wait()
+
+	return ret
+}
+
+func mapSocket(ctx context.Context, conn *net.UDPConn, server *net.UDPAddr, txInterval time.Duration) *net.UDPAddr {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		panic("deadline unexpectedly not set in context")
+	}
+	if err := conn.SetReadDeadline(deadline); err != nil {
+		return nil
+	}
+
+	go transmit(ctx, conn, []*net.UDPAddr{server}, txInterval, nil)
+
+	var buf [1500]byte
+	for {
+		n, addr, err := conn.ReadFromUDP(buf[:])
+		if err != nil {
+			return nil
+		}
+		if !addr.IP.Equal(server.IP) {
+			continue
+		}
+		if mapped, _, _, ok := internal.ParseResponse(buf[:n]); ok {
+			return mapped
+		}
+	}
+}
+
+// requestSpray asks server to start spraying, and returns the
+// server's final reply.
+func requestSpray(ctx context.Context, server *net.UDPAddr, opts *SprayOptions) (*internal.SprayReply, error) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	var nonce [8]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nil, err
+	}
+	req := &internal.SprayRequest{
+		Nonce:   binary.BigEndian.Uint64(nonce[:]),
+		Packets: uint16(opts.Packets),
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, opts.MappingDuration)
+	defer cancel()
+
+	// The first round gets a cookie, the second starts the spray.
+	var reply *internal.SprayReply
+	for round := 0; round < 2; round++ {
+		pkt := internal.MarshalMessage(req)
+		err := exchangeMessages(ctx, conn, opts.TransmitInterval,
+			func() {
+				conn.WriteToUDP(pkt, server)
+			},
+			func(addr *net.UDPAddr, msg internal.Message) bool {
+				r, ok := msg.(*internal.SprayReply)
+				if !ok || r.Nonce != req.Nonce || !addr.IP.Equal(server.IP) {
+					return false
+				}
+				if round == 1 && !r.Started && r.Packets != 0 {
+					// Retransmitted reply to the first round.
+					return false
+				}
+				reply = r
+				return true
+			})
+		switch {
+		case err == context.DeadlineExceeded:
+			return nil, errors.New("no reply from server to spray request")
+		case err != nil:
+			return nil, err
+		case reply.Packets == 0:
+			return nil, errors.New("server refused to spray, it may have spraying disabled or be rate limiting this IP")
+		case reply.Mapped == nil:
+			return nil, errors.New("server did not report the IP to spray")
+		}
+		req.Cookie = reply.Cookie
+	}
+	if !reply.Started {
+		return nil, errors.New("server did not start spraying")
+	}
+
+	return reply, nil
+}
+
+// receiveSpray returns the sequence numbers of packets sprayed by
+// server that arrive on conn before deadline.
+func receiveSpray(conn *net.UDPConn, server *net.UDPAddr, nonce uint64, deadline time.Time) []int {
+	if err := conn.SetReadDeadline(deadline); err != nil {
+		return nil
+	}
+
+	var (
+		ret []int
+		buf [1500]byte
+	)
+	for {
+		n, addr, err := conn.ReadFromUDP(buf[:])
+		if err != nil {
+			return ret
+		}
+		msg, err := internal.ParseMessage(buf[:n])
+		if err != nil {
+			continue
+		}
+		if probe, ok := msg.(*internal.SprayProbe); ok && probe.Nonce == nonce && addr.IP.Equal(server.IP) {
+			ret = append(ret, int(probe.Seq))
+		}
+	}
+}
+
+// sprayHitProbability returns the probability that spraying packets
+// at distinct random ports hits at least one of targets mappings,
+// when both are spread over the ports servers spray.
+func sprayHitProbability(targets, packets int) float64 {
+	ports := 65536 - internal.SprayMinPort
+	miss := 1.0
+	for i := 0; i < packets && miss > 0; i++ {
+		if ports-i <= targets {
+			return 1
+		}
+		miss *= float64(ports-targets-i) / float64(ports-i)
+	}
+	return 1 - miss
+}
+
+type jsonSprayResult struct {
+	header
+	Sockets             int         `json:"sockets"`
+	Mappings            []udpAddr   `json:"mappings"`
+	Target              net.IP      `json:"target"`
+	PacketsSent         int         `json:"packetsSent"`
+	Hits                []*SprayHit `json:"hits"`
+	FirstHit            int         `json:"firstHit"`
+	ExpectedProbability float64     `json:"expectedProbability"`
+}
+
+// MarshalJSON implements json.Marshaler.
+func (r SprayResult) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonSprayResult{
+		header:              header{SchemaVersion, kindSpray},
+		Sockets:             r.Sockets,
+		Mappings:            toUDPAddrs(r.Mappings),
+		Target:              r.Target,
+		PacketsSent:         r.PacketsSent,
+		Hits:                r.Hits,
+		FirstHit:            r.FirstHit,
+		ExpectedProbability: r.ExpectedProbability,
+	})
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (r *SprayResult) UnmarshalJSON(bs []byte) error {
+	var j jsonSprayResult
+	if err := json.Unmarshal(bs, &j); err != nil {
+		return err
+	}
+	if err := j.check(kindSpray); err != nil {
+		return err
+	}
+	*r = SprayResult{
+		Sockets:             j.Sockets,
+		Mappings:            fromUDPAddrs(j.Mappings),
+		Target:              j.Target,
+		PacketsSent:         j.PacketsSent,
+		Hits:                j.Hits,
+		FirstHit:            j.FirstHit,
+		ExpectedProbability: j.ExpectedProbability,
+	}
+	return nil
+}
+
+type jsonSprayHit struct {
+	Seq    int     `json:"seq"`
+	Local  udpAddr `json:"local"`
+	Mapped udpAddr `json:"mapped"`
+}
+
+// MarshalJSON implements json.Marshaler.
+func (h SprayHit) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonSprayHit{
+		Seq:    h.Seq,
+		Local:  udpAddr{h.Local},
+		Mapped: udpAddr{h.Mapped},
+	})
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (h *SprayHit) UnmarshalJSON(bs []byte) error {
+	var j jsonSprayHit
+	if err := json.Unmarshal(bs, &j); err != nil {
+		return err
+	}
+	*h = SprayHit{
+		Seq:    j.Seq,
+		Local:  j.Local.UDPAddr,
+		Mapped: j.Mapped.UDPAddr,
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package client
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// ServerStats summarizes the mapping probe traffic exchanged with one
+// probe server address.
+type ServerStats struct {
+	Remote *net.UDPAddr
+	// Number of probe packets sent to Remote, across all sockets.
+	Sent int
+	// Number of responses received from Remote, across all sockets.
+	Received int
+	// The round-trip time to Remote, measured as the time between
+	// sending the first probe packet and receiving the first response
+	// on a socket, and minimized across sockets. Packet loss on the
+	// first exchange inflates this value. Zero if no responses were
+	// received.
+	RTT time.Duration
+}
+
+// Loss returns the fraction of probe packets to Remote that got no
+// response.
+func (s *ServerStats) Loss() float64 {
+	if s.Sent == 0 || s.Received >= s.Sent {
+		return 0
+	}
+	return 1 - float64(s.Received)/float64(s.Sent)
+}
+
+// exchangeStats tracks the packets exchanged between one socket and
+// its destinations.
+type exchangeStats struct {
+	mu       sync.Mutex
+	firstTx  map[string]time.Time
+	stats    map[string]*ServerStats
+	ordering []string
+}
+
+func newExchangeStats(dests []*net.UDPAddr) *exchangeStats {
+	ret := &exchangeStats{
+		firstTx: map[string]time.Time{},
+		stats:   map[string]*ServerStats{},
+	}
+	for _, dest := range dests {
+		ret.stats[dest.String()] = &ServerStats{Remote: copyUDPAddr(dest)}
+		ret.ordering = append(ret.ordering, dest.String())
+	}
+	return ret
+}
+
+func (e *exchangeStats) sent(dest *net.UDPAddr) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	s := e.stats[dest.String()]
+	if s == nil {
+		return
+	}
+	if s.Sent == 0 {
+		e.firstTx[dest.String()] = time.Now()
+	}
+	s.Sent++
+}
+
+func (e *exchangeStats) received(from *net.UDPAddr) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	s := e.stats[from.String()]
+	if s == nil || s.Sent == 0 {
+		return
+	}
+	if s.Received == 0 {
+		s.RTT = time.Since(e.firstTx[from.String()])
+	}
+	s.Received++
+}
+
+func (e *exchangeStats) get() []*ServerStats {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var ret []*ServerStats
+	for _, dest := range e.ordering {
+		s := *e.stats[dest]
+		ret = append(ret, &s)
+	}
+	return ret
+}
+
+// mergeServerStats combines per-socket stats into per-server stats.
+func mergeServerStats(stats []*ServerStats) []*ServerStats {
+	var (
+		ret   []*ServerStats
+		byDst = map[string]*ServerStats{}
+	)
+	for _, s := range stats {
+		m := byDst[s.Remote.String()]
+		if m == nil {
+			m = &ServerStats{Remote: s.Remote}
+			byDst[s.Remote.String()] = m
+			ret = append(ret, m)
+		}
+		m.Sent += s.Sent
+		m.Received += s.Received
+		if s.Received > 0 && (m.RTT == 0 || s.RTT < m.RTT) {
+			m.RTT = s.RTT
+		}
+	}
+	return ret
+}
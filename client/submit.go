@@ -0,0 +1,115 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+// Submission is a probe result contributed to a collector of
+// aggregate NAT statistics.
+type Submission struct {
+	// The anonymized result.
+	Result *Result
+	// The analysis of the result, computed before anonymization and
+	// without evidence.
+	Analysis *Analysis
+	// A local IP is in the shared address space reserved for
+	// carrier-grade NAT (100.64.0.0/10, RFC 6598). Anonymization hides
+	// this from Result.
+	SharedAddressSpace bool
+}
+
+// NewSubmission returns a Submission of r, anonymized with a. r is
+// not modified.
+func NewSubmission(r *Result, a *Anonymizer) (*Submission, error) {
+	// Round-trip through JSON for a deep copy.
+	bs, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+	var anon Result
+	if err := json.Unmarshal(bs, &anon); err != nil {
+		return nil, err
+	}
+	anon.AnonymizeWith(a)
+
+	// Analyze before anonymization hides the shared address space, but
+	// don't leak the public IPs.
+	analysis := r.Analyze()
+	analysis.Evidence = nil
+	if analysis, err = analysis.Anonymized(a); err != nil {
+		return nil, err
+	}
+	ret := &Submission{
+		Result:   &anon,
+		Analysis: analysis,
+	}
+	for _, ip := range r.LocalIPs {
+		if sharedAddressSpace.Contains(ip) {
+			ret.SharedAddressSpace = true
+		}
+	}
+	return ret, nil
+}
+
+// Submit sends s to the collector at url.
+func Submit(ctx context.Context, url string, s *Submission) error {
+	bs, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(bs))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("submitting result: HTTP status %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+type jsonSubmission struct {
+	header
+	Result             *Result   `json:"result"`
+	Analysis           *Analysis `json:"analysis"`
+	SharedAddressSpace bool      `json:"sharedAddressSpace"`
+}
+
+// MarshalJSON implements json.Marshaler.
+func (s Submission) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonSubmission{
+		header:             header{SchemaVersion, kindSubmission},
+		Result:             s.Result,
+		Analysis:           s.Analysis,
+		SharedAddressSpace: s.SharedAddressSpace,
+	})
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (s *Submission) UnmarshalJSON(bs []byte) error {
+	var j jsonSubmission
+	if err := json.Unmarshal(bs, &j); err != nil {
+		return err
+	}
+	if err := j.check(kindSubmission); err != nil {
+		return err
+	}
+	*s = Submission{
+		Result:             j.Result,
+		Analysis:           j.Analysis,
+		SharedAddressSpace: j.SharedAddressSpace,
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+// Command gatewayd is a stand-in for a gateway's NAT-PMP (RFC 6886)
+// and PCP (RFC 6887) server, for testing natprobe's gateway probe
+// without a real router. It answers external address and mapping
+// requests, but doesn't forward any traffic: mappings it grants exist
+// only on paper.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"go.universe.tf/natprobe/internal"
+)
+
+var (
+	ip          = flag.String("ip", "0.0.0.0", "IP to listen on")
+	port        = flag.Int("port", internal.PortMapPort, "UDP port to listen on")
+	externalIP  = flag.String("external-ip", "", "external IP to report, and to grant mappings on")
+	protocols   = flag.String("protocols", "pcp,nat-pmp", "comma-separated protocols to support, out of pcp and nat-pmp")
+	maxLifetime = flag.Duration("max-lifetime", 2*time.Hour, "longest mapping lifetime to grant")
+	portOffset  = flag.Int("port-offset", 0, "offset from the internal port to the external port of granted mappings")
+	refuse      = flag.Bool("refuse", false, "refuse all mapping requests with NOT_AUTHORIZED")
+)
+
+func main() {
+	flag.Parse()
+	logger := internal.NewLogger()
+
+	s, err := newServer()
+	if err != nil {
+		logger.Error(err, "Failed to create gateway")
+		os.Exit(1)
+	}
+	s.Logger = logger
+
+	addr := &net.UDPAddr{IP: net.ParseIP(*ip), Port: *port}
+	if addr.IP == nil {
+		logger.Error(fmt.Errorf("invalid -ip %q", *ip), "Failed to create gateway")
+		os.Exit(1)
+	}
+	conn, err := net.ListenUDP("udp4", addr)
+	if err != nil {
+		logger.Error(err, "Failed to listen", "local-addr", addr.String())
+		os.Exit(1)
+	}
+	logger.Info("Created UDP listening port", "local-addr", addr.String(), "pcp", s.PCP, "nat-pmp", s.NATPMP)
+
+	logger.Info("Startup complete")
+	err = s.Serve(conn)
+	logger.Error(err, "Error reading from socket", "local-addr", conn.LocalAddr())
+	os.Exit(1)
+}
+
+// newServer returns the port mapping server that the flags describe.
+func newServer() (*internal.PortMapServer, error) {
+	ret := &internal.PortMapServer{
+		MaxLifetime: *maxLifetime,
+		PortOffset:  *portOffset,
+		Refuse:      *refuse,
+		Start:       time.Now(),
+	}
+	if ret.ExternalIP = net.ParseIP(*externalIP).To4(); ret.ExternalIP == nil {
+		return nil, fmt.Errorf("invalid -external-ip %q, want an IPv4 address", *externalIP)
+	}
+	for _, p := range strings.Split(*protocols, ",") {
+		switch strings.TrimSpace(p) {
+		case "pcp":
+			ret.PCP = true
+		case "nat-pmp":
+			ret.NATPMP = true
+		default:
+			return nil, fmt.Errorf("unknown protocol %q in -protocols", p)
+		}
+	}
+	if *maxLifetime < time.Second {
+		return nil, errors.New("-max-lifetime must be at least 1s")
+	}
+	return ret, nil
+}
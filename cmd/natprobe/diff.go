@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	cli "github.com/urfave/cli/v2"
+	"go.universe.tf/natprobe/client"
+)
+
+// exitRegression is the exit status of diff when it finds a
+// regression.
+const exitRegression = 2
+
+func diff(c *cli.Context) error {
+	if c.NArg() != 2 {
+		return fmt.Errorf("diff takes exactly two file arguments, got %d", c.NArg())
+	}
+
+	output, err := getPrinter(c)
+	if err != nil {
+		return err
+	}
+
+	before, err := loadAnalysis(c.Args().Get(0))
+	if err != nil {
+		return err
+	}
+	after, err := loadAnalysis(c.Args().Get(1))
+	if err != nil {
+		return err
+	}
+
+	d := client.Compare(before, after)
+	if err := output(d); err != nil {
+		return err
+	}
+	if d.Regressed() {
+		return cli.Exit("", exitRegression)
+	}
+	return nil
+}
+
+// loadAnalysis reads the first JSON-encoded client.Analysis, or
+// client.Result which it then analyzes, from path.
+func loadAnalysis(path string) (*client.Analysis, error) {
+	bs, kind, name, err := readDocument(path, "result", "analysis")
+	if err != nil {
+		return nil, err
+	}
+
+	if kind == "result" {
+		var result client.Result
+		if err := json.Unmarshal(bs, &result); err != nil {
+			return nil, fmt.Errorf("decoding result from %s: %s", name, err)
+		}
+		return result.Analyze(), nil
+	}
+
+	var ret client.Analysis
+	if err := json.Unmarshal(bs, &ret); err != nil {
+		return nil, fmt.Errorf("decoding analysis from %s: %s", name, err)
+	}
+	return &ret, nil
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	cli "github.com/urfave/cli/v2"
+	"go.universe.tf/natprobe/client"
+)
+
+// Exit statuses when --expect expectations fail, one per class of
+// expectation. When several classes fail, natprobe exits with the
+// lowest status.
+const (
+	exitNoData           = 3
+	exitMapping          = 4
+	exitFiltering        = 5
+	exitFilteredEgress   = 6
+	exitPortPreservation = 7
+	exitNAT              = 8
+	exitPublicIPs        = 9
+)
+
+// expectDescription documents --expect in the app's help.
+const expectDescription = `With --expect EXPR, natprobe checks the analysis against EXPR and
+exits with a nonzero status if it doesn't hold. Expressions are:
+
+   mapping=BEHAVIOR[,BEHAVIOR...]  mapping behavior is one of these
+   mapping<=BEHAVIOR               mapping behavior is no stricter than this
+   filtering=..., filtering<=...   same, for filtering behavior
+   port-preservation               the NAT preserves source ports
+   filtered-egress[=PORT,...]      any of these ports (default: any port) is filtered
+   nat                             there is a NAT
+   multiple-public-ips             the NAT uses multiple public IPs
+
+Prefix an expression with ! to negate it, e.g. '!filtered-egress=3478'.
+Behaviors are endpoint-independent, address-dependent, port-dependent and
+address-and-port-dependent. Filtering behavior is unknown if the firewall
+probe got no responses at all, which fails every filtering expectation.
+
+Failed expectations exit with status 3 if probing got no data, 4 for
+mapping, 5 for filtering, 6 for filtered egress, 7 for port preservation,
+8 for nat and 9 for multiple-public-ips. If several fail, the lowest
+status wins.`
+
+// expectation is a parsed --expect expression.
+type expectation struct {
+	expr string
+	// The exit status if the expectation fails.
+	status int
+	// check reports whether a meets the expectation, ignoring
+	// negation, and describes what a has instead.
+	check func(a *client.Analysis) (ok bool, got string)
+	// known, if set, reports whether a's property is known at all.
+	// Expectations on unknown properties fail even when negated.
+	known  func(a *client.Analysis) bool
+	negate bool
+}
+
+func parseExpectations(c *cli.Context) ([]*expectation, error) {
+	var ret []*expectation
+	for _, s := range c.StringSlice("expect") {
+		e, err := parseExpectation(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --expect %q: %s", s, err)
+		}
+		ret = append(ret, e)
+	}
+	return ret, nil
+}
+
+func parseExpectation(expr string) (*expectation, error) {
+	ret := &expectation{expr: expr}
+	s := expr
+	if strings.HasPrefix(s, "!") {
+		ret.negate = true
+		s = s[1:]
+	}
+
+	var name, op, value string
+	switch {
+	case strings.Contains(s, "<="):
+		i := strings.Index(s, "<=")
+		name, op, value = s[:i], "<=", s[i+2:]
+	case strings.Contains(s, "="):
+		i := strings.Index(s, "=")
+		name, op, value = s[:i], "=", s[i+1:]
+	default:
+		name = s
+	}
+
+	switch name {
+	case "mapping", "filtering":
+		behavior := (*client.Analysis).MappingBehavior
+		ret.status = exitMapping
+		if name == "filtering" {
+			behavior = (*client.Analysis).FilteringBehavior
+			ret.status = exitFiltering
+		}
+		check, err := behaviorCheck(op, value)
+		if err != nil {
+			return nil, err
+		}
+		ret.check = func(a *client.Analysis) (bool, string) {
+			b := behavior(a)
+			return check(b), b.String()
+		}
+		ret.known = func(a *client.Analysis) bool {
+			return behavior(a) != client.UnknownBehavior
+		}
+
+	case "port-preservation":
+		if op != "" {
+			return nil, fmt.Errorf("%s takes no value", name)
+		}
+		ret.status = exitPortPreservation
+		ret.check = func(a *client.Analysis) (bool, string) {
+			return a.MappingPreservesSourcePort, strconv.FormatBool(a.MappingPreservesSourcePort)
+		}
+
+	case "nat":
+		if op != "" {
+			return nil, fmt.Errorf("%s takes no value", name)
+		}
+		ret.status = exitNAT
+		ret.check = func(a *client.Analysis) (bool, string) {
+			return !a.NoNAT, strconv.FormatBool(!a.NoNAT)
+		}
+
+	case "multiple-public-ips":
+		if op != "" {
+			return nil, fmt.Errorf("%s takes no value", name)
+		}
+		ret.status = exitPublicIPs
+		ret.check = func(a *client.Analysis) (bool, string) {
+			return a.MultiplePublicIPs, fmt.Sprintf("%d public IPs", len(a.PublicIPs))
+		}
+
+	case "filtered-egress":
+		if op == "<=" {
+			return nil, fmt.Errorf("%s doesn't support <=", name)
+		}
+		var ports []int
+		if op == "=" {
+			for _, p := range strings.Split(value, ",") {
+				port, err := strconv.Atoi(p)
+				if err != nil || port <= 0 || port > 65535 {
+					return nil, fmt.Errorf("invalid port %q", p)
+				}
+				ports = append(ports, port)
+			}
+		}
+		ret.status = exitFilteredEgress
+		ret.check = func(a *client.Analysis) (bool, string) {
+			got := fmt.Sprintf("filtered ports %v", a.FilteredEgress)
+			if ports == nil {
+				return len(a.FilteredEgress) > 0, got
+			}
+			for _, filtered := range a.FilteredEgress {
+				for _, p := range ports {
+					if p == filtered {
+						return true, got
+					}
+				}
+			}
+			return false, got
+		}
+
+	default:
+		return nil, fmt.Errorf("unknown property %q", name)
+	}
+
+	return ret, nil
+}
+
+var behaviors = map[string]client.Behavior{}
+
+func init() {
+	for _, b := range []client.Behavior{client.EndpointIndependent, client.AddressDependent, client.PortDependent, client.AddressAndPortDependent} {
+		behaviors[b.String()] = b
+	}
+}
+
+// behaviorCheck returns a function that checks a behavior against
+// the value of a mapping or filtering expectation.
+func behaviorCheck(op, value string) (func(client.Behavior) bool, error) {
+	if op == "" {
+		return nil, fmt.Errorf("want =BEHAVIOR or <=BEHAVIOR")
+	}
+	var want []client.Behavior
+	for _, s := range strings.Split(value, ",") {
+		b, ok := behaviors[s]
+		if !ok {
+			return nil, fmt.Errorf("unknown behavior %q", s)
+		}
+		want = append(want, b)
+	}
+
+	switch op {
+	case "=":
+		return func(got client.Behavior) bool {
+			for _, b := range want {
+				if got == b {
+					return true
+				}
+			}
+			return false
+		}, nil
+	default:
+		if len(want) != 1 {
+			return nil, fmt.Errorf("<= takes a single behavior")
+		}
+		// Address- and port-dependent behaviors are both stricter
+		// than endpoint-independent and laxer than
+		// address-and-port-dependent, but not comparable to each
+		// other.
+		max := want[0]
+		return func(got client.Behavior) bool {
+			if got == client.UnknownBehavior {
+				return false
+			}
+			return got == client.EndpointIndependent || got == max || max == client.AddressAndPortDependent
+		}, nil
+	}
+}
+
+// checkExpectations checks a against expectations, and returns an
+// error carrying the right exit status if any failed, after listing
+// the failures on stderr.
+func checkExpectations(expectations []*expectation, a *client.Analysis) error {
+	if len(expectations) == 0 {
+		return nil
+	}
+	if a.NoData {
+		fmt.Fprintln(os.Stderr, "Probing got no data, can't check expectations.")
+		return cli.Exit("", exitNoData)
+	}
+
+	status := 0
+	failed := 0
+	for _, e := range expectations {
+		ok, got := e.check(a)
+		if ok != e.negate && (e.known == nil || e.known(a)) {
+			continue
+		}
+		failed++
+		fmt.Fprintf(os.Stderr, "Expectation failed: %s (got %s)\n", e.expr, got)
+		if status == 0 || e.status < status {
+			status = e.status
+		}
+	}
+	if failed == 0 {
+		return nil
+	}
+	fmt.Fprintf(os.Stderr, "%d of %d expectations failed.\n", failed, len(expectations))
+	return cli.Exit("", status)
+}
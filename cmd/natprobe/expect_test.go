@@ -0,0 +1,188 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+
+	cli "github.com/urfave/cli/v2"
+	"go.universe.tf/natprobe/client"
+)
+
+// expectAnalysis is from behind an address-dependent NAT that
+// preserves source ports, with an address-and-port-dependent firewall
+// that filters DNS.
+func expectAnalysis() *client.Analysis {
+	return &client.Analysis{
+		MappingVariesByDestIP:      true,
+		FirewallEnforcesDestIP:     true,
+		FirewallEnforcesDestPort:   true,
+		MappingPreservesSourcePort: true,
+		FilteredEgress:             []int{53},
+		PublicIPs:                  []net.IP{net.ParseIP("198.51.100.7")},
+	}
+}
+
+func TestParseExpectation(t *testing.T) {
+	tests := []struct {
+		expr    string
+		wantErr bool
+		// Whether expectAnalysis meets the expectation, and the exit
+		// status if it doesn't.
+		want       bool
+		wantStatus int
+	}{
+		{expr: "mapping=address-dependent", want: true, wantStatus: exitMapping},
+		{expr: "mapping=endpoint-independent,address-dependent", want: true, wantStatus: exitMapping},
+		{expr: "mapping=endpoint-independent", want: false, wantStatus: exitMapping},
+		{expr: "!mapping=address-dependent", want: false, wantStatus: exitMapping},
+		{expr: "mapping<=address-dependent", want: true, wantStatus: exitMapping},
+		{expr: "mapping<=address-and-port-dependent", want: true, wantStatus: exitMapping},
+		// Address- and port-dependent behaviors don't compare.
+		{expr: "mapping<=port-dependent", want: false, wantStatus: exitMapping},
+		{expr: "filtering=address-and-port-dependent", want: true, wantStatus: exitFiltering},
+		{expr: "filtering<=endpoint-independent", want: false, wantStatus: exitFiltering},
+		{expr: "port-preservation", want: true, wantStatus: exitPortPreservation},
+		{expr: "!port-preservation", want: false, wantStatus: exitPortPreservation},
+		{expr: "nat", want: true, wantStatus: exitNAT},
+		{expr: "multiple-public-ips", want: false, wantStatus: exitPublicIPs},
+		{expr: "!multiple-public-ips", want: true, wantStatus: exitPublicIPs},
+		{expr: "filtered-egress", want: true, wantStatus: exitFilteredEgress},
+		{expr: "filtered-egress=53,123", want: true, wantStatus: exitFilteredEgress},
+		{expr: "filtered-egress=123", want: false, wantStatus: exitFilteredEgress},
+		{expr: "!filtered-egress=123", want: true, wantStatus: exitFilteredEgress},
+
+		{expr: "", wantErr: true},
+		{expr: "!", wantErr: true},
+		{expr: "hairpinning", wantErr: true},
+		{expr: "mapping", wantErr: true},
+		{expr: "mapping=", wantErr: true},
+		{expr: "mapping=sideways", wantErr: true},
+		{expr: "mapping<=endpoint-independent,address-dependent", wantErr: true},
+		{expr: "filtering=unknown", wantErr: true},
+		{expr: "port-preservation=true", wantErr: true},
+		{expr: "nat=yes", wantErr: true},
+		{expr: "multiple-public-ips<=2", wantErr: true},
+		{expr: "filtered-egress<=53", wantErr: true},
+		{expr: "filtered-egress=0", wantErr: true},
+		{expr: "filtered-egress=65536", wantErr: true},
+		{expr: "filtered-egress=dns", wantErr: true},
+		{expr: "filtered-egress=53,", wantErr: true},
+	}
+	for _, test := range tests {
+		e, err := parseExpectation(test.expr)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("parseExpectation(%q) succeeded, want an error", test.expr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseExpectation(%q): %s", test.expr, err)
+			continue
+		}
+		ok, _ := e.check(expectAnalysis())
+		if got := ok != e.negate; got != test.want {
+			t.Errorf("expectation %q holds = %v, want %v", test.expr, got, test.want)
+		}
+		if e.status != test.wantStatus {
+			t.Errorf("expectation %q exits with status %d, want %d", test.expr, e.status, test.wantStatus)
+		}
+	}
+}
+
+// discardStderr discards what natprobe writes to stderr, like failed
+// expectations, until the returned function is called.
+func discardStderr(t *testing.T) func() {
+	t.Helper()
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stderr := os.Stderr
+	os.Stderr = devNull
+	return func() {
+		os.Stderr = stderr
+		devNull.Close()
+	}
+}
+
+func TestCheckExpectations(t *testing.T) {
+	defer discardStderr(t)()
+
+	untested := expectAnalysis()
+	untested.FirewallUntested = true
+
+	tests := []struct {
+		desc       string
+		exprs      []string
+		a          *client.Analysis
+		wantStatus int
+	}{
+		{"no expectations", nil, expectAnalysis(), 0},
+		{"all hold", []string{"nat", "mapping<=address-dependent", "port-preservation", "!filtered-egress=3478"}, expectAnalysis(), 0},
+		{"mapping fails", []string{"nat", "mapping=endpoint-independent"}, expectAnalysis(), exitMapping},
+		{"lowest status wins", []string{"!nat", "!filtered-egress", "mapping=endpoint-independent"}, expectAnalysis(), exitMapping},
+		{"egress and public IPs fail", []string{"multiple-public-ips", "!filtered-egress=53"}, expectAnalysis(), exitFilteredEgress},
+		{"negated property fails", []string{"!port-preservation"}, expectAnalysis(), exitPortPreservation},
+		{"no NAT", []string{"nat"}, &client.Analysis{NoNAT: true}, exitNAT},
+		{"untested firewall fails filtering", []string{"filtering<=address-and-port-dependent"}, untested, exitFiltering},
+		{"untested firewall fails negated filtering", []string{"!filtering=endpoint-independent"}, untested, exitFiltering},
+		{"no data", []string{"!nat"}, &client.Analysis{NoData: true}, exitNoData},
+	}
+	for _, test := range tests {
+		var expectations []*expectation
+		for _, expr := range test.exprs {
+			e, err := parseExpectation(expr)
+			if err != nil {
+				t.Fatalf("%s: parseExpectation(%q): %s", test.desc, expr, err)
+			}
+			expectations = append(expectations, e)
+		}
+		err := checkExpectations(expectations, test.a)
+		if got := exitStatus(err); got != test.wantStatus {
+			t.Errorf("%s: exit status %d (%v), want %d", test.desc, got, err, test.wantStatus)
+		}
+	}
+}
+
+// exitStatus returns the exit status that natprobe would exit with
+// after err.
+func exitStatus(err error) int {
+	if err == nil {
+		return 0
+	}
+	if ec, ok := err.(cli.ExitCoder); ok {
+		return ec.ExitCode()
+	}
+	return 1
+}
+
+func TestAnalyzeExpect(t *testing.T) {
+	dir, err := ioutil.TempDir("", "natprobe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := writeResult(t, dir)
+	defer discardStderr(t)()
+
+	tests := []struct {
+		args       []string
+		wantStatus int
+	}{
+		{[]string{"--expect", "mapping=address-dependent"}, 0},
+		{[]string{"--expect", "nat", "--expect", "mapping=endpoint-independent"}, exitMapping},
+		{[]string{"--expect", "port-preservation"}, exitPortPreservation},
+		// Invalid expressions fail before analysis.
+		{[]string{"--expect", "mapping=sideways"}, 1},
+	}
+	for _, test := range tests {
+		args := append(append([]string{"analyze", "--format=json"}, test.args...), path)
+		_, err := runApp(t, args...)
+		if got := exitStatus(err); got != test.wantStatus {
+			t.Errorf("natprobe %v: exit status %d (%v), want %d", test.args, got, err, test.wantStatus)
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	cli "github.com/urfave/cli/v2"
+	"go.universe.tf/natprobe/client"
+)
+
+func exporter(c *cli.Context) error {
+	interval := c.Duration("interval")
+	if interval <= 0 {
+		return errors.New("--interval must be positive")
+	}
+
+	opts, err := probeOptions(c)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := interruptContext()
+	defer cancel()
+
+	e := &metricsExporter{}
+	srv := &http.Server{
+		Addr:    c.String("listen"),
+		Handler: e,
+	}
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- srv.ListenAndServe()
+	}()
+	logger.Info("Serving metrics", "addr", srv.Addr)
+
+	shutdown := func() error {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		return srv.Shutdown(shutdownCtx)
+	}
+
+	for {
+		start := time.Now()
+		result, err := client.Probe(ctx, opts)
+		if ctx.Err() != nil {
+			// Interrupted mid-probe, which says nothing about the NAT.
+			return shutdown()
+		}
+		if err != nil {
+			logger.Error(err, "Probe failed, will retry", "interval", interval.String())
+		}
+		e.update(result, err, time.Since(start))
+
+		select {
+		case err := <-serveErr:
+			return err
+		case <-ctx.Done():
+			return shutdown()
+		case <-time.After(interval):
+		}
+	}
+}
+
+// metricsExporter serves the outcome of the latest probe in the
+// Prometheus text exposition format.
+type metricsExporter struct {
+	mu            sync.Mutex
+	probes        int
+	failures      int
+	lastDuration  time.Duration
+	lastSuccess   time.Time
+	lastFailed    bool
+	result        *client.Result
+	analysis      *client.Analysis
+	probedPorts   []int
+	lastProbeTime time.Time
+}
+
+func (e *metricsExporter) update(result *client.Result, err error, duration time.Duration) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.probes++
+	e.lastDuration = duration
+	e.lastProbeTime = time.Now()
+	if err != nil {
+		e.failures++
+		e.lastFailed = true
+		return
+	}
+	e.lastFailed = false
+	e.lastSuccess = time.Now()
+	e.result = result
+	e.analysis = result.Analyze()
+	e.probedPorts = nil
+	if result.Metadata != nil && result.Metadata.Options != nil {
+		e.probedPorts = result.Metadata.Options.Ports
+	}
+}
+
+func (e *metricsExporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/metrics" {
+		http.NotFound(w, r)
+		return
+	}
+
+	var b bytes.Buffer
+	e.write(&b)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(b.Bytes())
+}
+
+func (e *metricsExporter) write(b *bytes.Buffer) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	metric := func(name, typ, help string) {
+		fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	}
+	value := func(name string, labels string, v float64) {
+		fmt.Fprintf(b, "%s%s %s\n", name, labels, strconv.FormatFloat(v, 'g', -1, 64))
+	}
+	gauge := func(name, help string, v float64) {
+		metric(name, "gauge", help)
+		value(name, "", v)
+	}
+
+	metric("natprobe_probes_total", "counter", "Number of probes run.")
+	value("natprobe_probes_total", "", float64(e.probes))
+	metric("natprobe_probe_failures_total", "counter", "Number of probes that returned an error.")
+	value("natprobe_probe_failures_total", "", float64(e.failures))
+	if e.probes > 0 {
+		gauge("natprobe_last_probe_success", "Whether the latest probe succeeded.", boolValue(!e.lastFailed))
+		gauge("natprobe_last_probe_duration_seconds", "How long the latest probe took.", e.lastDuration.Seconds())
+		gauge("natprobe_last_probe_timestamp_seconds", "When the latest probe finished.", unixSeconds(e.lastProbeTime))
+	}
+
+	if e.analysis == nil {
+		return
+	}
+	a := e.analysis
+	gauge("natprobe_last_success_timestamp_seconds", "When the latest successful probe finished. The metrics below come from that probe.", unixSeconds(e.lastSuccess))
+	gauge("natprobe_no_data", "Probing got no useful data at all.", boolValue(a.NoData))
+	gauge("natprobe_no_nat", "There seems to be no NAT between the client and the internet.", boolValue(a.NoNAT))
+	gauge("natprobe_mapping_varies_by_dest_ip", "Assigned public ip:port depends on the destination IP.", boolValue(a.MappingVariesByDestIP))
+	gauge("natprobe_mapping_varies_by_dest_port", "Assigned public ip:port depends on the destination port.", boolValue(a.MappingVariesByDestPort))
+	gauge("natprobe_firewall_enforces_dest_ip", "Firewall requires outbound traffic to an IP before allowing inbound traffic from it.", boolValue(a.FirewallEnforcesDestIP))
+	gauge("natprobe_firewall_enforces_dest_port", "Firewall requires outbound traffic to a port before allowing inbound traffic from it.", boolValue(a.FirewallEnforcesDestPort))
+	gauge("natprobe_firewall_untested", "The firewall probe got no responses, so the firewall's filtering is unknown.", boolValue(a.FirewallUntested))
+	gauge("natprobe_mapping_preserves_source_port", "Assigned public port tries to be the same as the LAN port.", boolValue(a.MappingPreservesSourcePort))
+	gauge("natprobe_mapping_sequential", "Assigned public ports are allocated sequentially.", boolValue(a.MappingSequential))
+	gauge("natprobe_multiple_public_ips", "Observed multiple assigned public IPs.", boolValue(a.MultiplePublicIPs))
+	gauge("natprobe_public_ips", "Number of distinct public IPs assigned to the client.", float64(len(a.PublicIPs)))
+	gauge("natprobe_cgnat", "The client seems to be behind carrier-grade NAT.", boolValue(a.CGNAT))
+	gauge("natprobe_double_nat", "There seems to be more than one layer of NAT between the client and the internet.", boolValue(a.DoubleNAT))
+	metric("natprobe_port_mapping", "gauge", "Whether the gateway granted a temporary mapping over the port mapping protocol.")
+	for _, proto := range []string{"pcp", "nat-pmp"} {
+		value("natprobe_port_mapping", fmt.Sprintf("{protocol=%q}", proto), boolValue(a.PortMapping == proto))
+	}
+	if gw := e.result.Gateway; gw != nil && gw.Mapping != nil {
+		gauge("natprobe_port_mapping_lifetime_seconds", "Lifetime the gateway granted to the temporary mapping.", gw.Mapping.Lifetime.Seconds())
+	}
+
+	filtered := map[int]bool{}
+	for _, port := range a.FilteredEgress {
+		filtered[port] = true
+	}
+	ports := e.probedPorts
+	if len(ports) == 0 {
+		ports = a.FilteredEgress
+	}
+	metric("natprobe_egress_filtered", "gauge", "Whether outbound UDP to the port seems to be blocked.")
+	for _, port := range ports {
+		value("natprobe_egress_filtered", fmt.Sprintf("{port=%q}", strconv.Itoa(port)), boolValue(filtered[port]))
+	}
+
+	if len(e.result.ServerStats) == 0 {
+		return
+	}
+	metric("natprobe_server_rtt_seconds", "gauge", "Round-trip time to the probe server address. Zero if it never responded.")
+	for _, s := range e.result.ServerStats {
+		value("natprobe_server_rtt_seconds", serverLabel(s), s.RTT.Seconds())
+	}
+	metric("natprobe_server_loss_ratio", "gauge", "Fraction of mapping probes to the probe server address that got no response.")
+	for _, s := range e.result.ServerStats {
+		value("natprobe_server_loss_ratio", serverLabel(s), s.Loss())
+	}
+	metric("natprobe_server_packets_sent", "gauge", "Mapping probe packets sent to the probe server address.")
+	for _, s := range e.result.ServerStats {
+		value("natprobe_server_packets_sent", serverLabel(s), float64(s.Sent))
+	}
+	metric("natprobe_server_packets_received", "gauge", "Responses received from the probe server address.")
+	for _, s := range e.result.ServerStats {
+		value("natprobe_server_packets_received", serverLabel(s), float64(s.Received))
+	}
+}
+
+func serverLabel(s *client.ServerStats) string {
+	return fmt.Sprintf("{server=%q,port=%q}", s.Remote.IP.String(), strconv.Itoa(s.Remote.Port))
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func unixSeconds(t time.Time) float64 {
+	return float64(t.UnixNano()) / 1e9
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+
+	cli "github.com/urfave/cli/v2"
+	"go.universe.tf/natprobe/client"
+)
+
+func forward(c *cli.Context) error {
+	output, err := getPrinter(c)
+	if err != nil {
+		return err
+	}
+
+	result, err := client.CheckForward(context.Background(), &client.ForwardOptions{
+		Server:    c.String("server"),
+		Port:      c.Int("port"),
+		LocalPort: c.Int("local-port"),
+		Packets:   c.Int("packets"),
+		Duration:  c.Duration("duration"),
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := output(result); err != nil {
+		return err
+	}
+	if !result.ArrivedOnLocalPort {
+		return cli.Exit("", 1)
+	}
+	return nil
+}
@@ -2,29 +2,49 @@ package main
 
 import (
 	"context"
+	"crypto/ed25519"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
+	"github.com/go-logr/logr"
 	cli "github.com/urfave/cli/v2"
 	"go.universe.tf/natprobe/client"
+	"go.universe.tf/natprobe/format"
 	"go.universe.tf/natprobe/internal"
 )
 
-var logger = internal.NewLogger()
+// logger is configured by the global logging flags before any
+// command runs.
+var logger logr.Logger
 
 func main() {
+	if err := newApp().Run(os.Args); err != nil {
+		fmt.Fprintf(os.Stderr, "natprobe: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+func newApp() *cli.App {
 	app := &cli.App{
-		Name:   "natprobe",
-		Usage:  "detect and characterize NAT devices",
-		Action: run,
+		Name:        "natprobe",
+		Usage:       "detect and characterize NAT devices",
+		Description: expectDescription,
+		Action:      run,
+		Before:      setupLogger,
 		Flags: []cli.Flag{
 			// Probe servers
 			&cli.StringSliceFlag{
 				Name:  "servers",
-				Usage: "prober servers to use",
-				Value: cli.NewStringSlice("natprobe1.universe.tf.", "natprobe2.universe.tf."),
+				Usage: "prober servers to use (default: discovered through DNS)",
 			},
 			&cli.IntSliceFlag{
 				Name:  "ports",
@@ -32,12 +52,35 @@ func main() {
 				Value: cli.NewIntSlice(internal.Ports...),
 			},
 
-			// DNS
+			// DNS and discovery
 			&cli.DurationFlag{
 				Name:  "resolve-timeout",
 				Usage: "DNS resolution timeout",
 				Value: 3 * time.Second,
 			},
+			&cli.StringFlag{
+				Name:  "directory-url",
+				Usage: "URL of a signed probe server directory, used if DNS SRV discovery fails",
+			},
+			&cli.StringFlag{
+				Name:  "directory-key",
+				Usage: "base64 ed25519 public key that must have signed the directory",
+			},
+			&cli.StringSliceFlag{
+				Name:  "bootstrap-ips",
+				Usage: "probe server IPs to use if discovery fails (default: the IPs built into natprobe)",
+			},
+
+			// Server selection
+			&cli.BoolFlag{
+				Name:  "all-servers",
+				Usage: "probe every probe server IP, instead of the two closest ones",
+			},
+			&cli.DurationFlag{
+				Name:  "selection-duration",
+				Usage: "how long to ping probe servers to select the closest ones",
+				Value: time.Second,
+			},
 
 			// Mapping
 			&cli.DurationFlag{
@@ -68,79 +111,629 @@ func main() {
 				Value: 50 * time.Millisecond,
 			},
 
-			// Reporting
-			&cli.BoolFlag{
-				Name:  "print-results",
-				Usage: "write the uninterpreted results to stdout",
-				Value: false,
+			// Upstream network
+			&cli.IntFlag{
+				Name:  "path-max-hops",
+				Usage: "highest TTL to probe the path to a probe server with",
+				Value: 8,
 			},
+			&cli.DurationFlag{
+				Name:  "path-duration",
+				Usage: "path probe duration",
+				Value: time.Second,
+			},
+			&cli.StringFlag{
+				Name:  "gateway",
+				Usage: "IP of the gateway to query over NAT-PMP and PCP (default: the default route's gateway)",
+			},
+			&cli.IntFlag{
+				Name:  "gateway-port",
+				Usage: "UDP port that the gateway serves NAT-PMP and PCP on",
+				Value: internal.PortMapPort,
+			},
+			&cli.DurationFlag{
+				Name:  "gateway-duration",
+				Usage: "timeout of each gateway request, and of checking its mapping against a probe server",
+				Value: time.Second,
+			},
+
+			// Progress
 			&cli.BoolFlag{
-				Name:  "anonymize-results",
-				Usage: "anonymize IP addresses in results",
+				Name:  "progress",
+				Usage: "write probe events to stderr as they happen",
 				Value: false,
 			},
-			&cli.BoolFlag{
-				Name:  "print-analysis",
-				Usage: "write the interpreted analysis to stdout",
-				Value: true,
+
+			// Logging
+			&cli.IntFlag{
+				Name:  "verbose",
+				Usage: "log verbosity: 0 logs only errors and major events, 1 adds probe phases, 2 adds every packet",
+				Value: 0,
+			},
+			&cli.StringFlag{
+				Name:  "log-format",
+				Usage: "log format (auto, console or json)",
+				Value: "auto",
 			},
+
+			// Submission
 			&cli.StringFlag{
-				Name:  "format",
-				Usage: "output format for results and analyses (text or json)",
-				Value: "text",
+				Name:  "submit",
+				Usage: "URL of a collector to contribute the anonymized results to (e.g. http://collector.example:8080/submit)",
 			},
 		},
+		Commands: []*cli.Command{
+			{
+				Name:      "analyze",
+				Usage:     "analyze previously saved JSON results",
+				ArgsUsage: "[FILE]",
+				Description: `Reads a result previously written with --print-results --format=json
+from FILE, or from stdin if FILE is omitted or "-", and analyzes it.`,
+				Action: analyze,
+				Flags:  reportFlags(),
+			},
+			{
+				Name:      "diff",
+				Usage:     "compare NAT behavior between two saved results or analyses",
+				ArgsUsage: "BEFORE AFTER",
+				Description: `Compares two JSON results or analyses, as written by --format=json, and
+reports which NAT behaviors changed. Exits with status 2 if any change
+is a regression.`,
+				Action: diff,
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "format",
+						Usage: "output format for the diff (text or json)",
+						Value: "text",
+					},
+				},
+			},
+			{
+				Name:      "predict",
+				Usage:     "predict whether two peers can connect with direct UDP",
+				ArgsUsage: "A B",
+				Description: `Reads saved JSON results or analyses for two peers, as written by
+--format=json, and predicts whether they can establish direct UDP
+connectivity, and with which technique.`,
+				Action: predict,
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "format",
+						Usage: "output format for the prediction (text or json)",
+						Value: "text",
+					},
+				},
+			},
+			{
+				Name:  "punch",
+				Usage: "test UDP hole punching with a peer",
+				Description: `Meets a peer running "natprobe punch" with the same --session and
+--server, then attempts simultaneous UDP hole punching with it and
+reports whether it worked. Exits with status 1 if hole punching
+failed.`,
+				Action: punch,
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "server",
+						Usage: "probe server to use for rendezvous, as host:port (default: discovered)",
+					},
+					&cli.StringFlag{
+						Name:     "session",
+						Usage:    "session code shared with the peer",
+						Required: true,
+					},
+					&cli.DurationFlag{
+						Name:  "rendezvous-timeout",
+						Usage: "how long to wait for the peer to join the session",
+						Value: time.Minute,
+					},
+					&cli.DurationFlag{
+						Name:  "punch-duration",
+						Usage: "how long to attempt hole punching",
+						Value: 10 * time.Second,
+					},
+					&cli.StringFlag{
+						Name:  "format",
+						Usage: "output format for the result (text or json)",
+						Value: "text",
+					},
+				},
+			},
+			{
+				Name:  "spray",
+				Usage: "measure how well birthday spraying gets through the NAT",
+				Description: `Opens many sockets with a mapping to --server each, then asks the
+server to spray packets at random ports on this machine's public IP,
+and reports how many got through. This measures how many mappings and
+packets birthday spraying needs to traverse this NAT.
+
+The server must have spraying enabled, and limits how often and how
+much it sprays.`,
+				Action: spray,
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "server",
+						Usage: "probe server with spraying enabled to use, as host:port (default: discovered)",
+					},
+					&cli.IntFlag{
+						Name:  "sockets",
+						Usage: "number of sockets to open",
+						Value: 256,
+					},
+					&cli.IntFlag{
+						Name:  "packets",
+						Usage: "number of packets to ask the server to spray",
+						Value: 1024,
+					},
+					&cli.DurationFlag{
+						Name:  "spray-duration",
+						Usage: "how long to wait for sprayed packets",
+						Value: 5 * time.Second,
+					},
+					&cli.StringFlag{
+						Name:  "format",
+						Usage: "output format for the result (text or json)",
+						Value: "text",
+					},
+				},
+			},
+			{
+				Name:  "forward",
+				Usage: "check that a port forward or DMZ host setup works",
+				Description: `Listens on --local-port, then asks --server to send probes to --port
+on this machine's public IP, from ports this machine never sent to,
+and reports whether they arrived, on which local port, and whether
+their source port was preserved. If --port differs from --local-port,
+also listens on --port to catch forwards to the wrong local port.
+Exits with status 1 unless probes arrived on --local-port.`,
+				Action: forward,
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "server",
+						Usage: "probe server to use, as host:port",
+						Value: client.DefaultServer,
+					},
+					&cli.IntFlag{
+						Name:     "port",
+						Usage:    "public port that should be forwarded to this machine",
+						Required: true,
+					},
+					&cli.IntFlag{
+						Name:  "local-port",
+						Usage: "local port the forward should deliver to (default: --port)",
+					},
+					&cli.IntFlag{
+						Name:  "packets",
+						Usage: "number of probes to ask the server to send",
+						Value: 5,
+					},
+					&cli.DurationFlag{
+						Name:  "duration",
+						Usage: "how long to wait for probes",
+						Value: 3 * time.Second,
+					},
+					&cli.StringFlag{
+						Name:  "format",
+						Usage: "output format for the result (text or json)",
+						Value: "text",
+					},
+				},
+			},
+			{
+				Name:  "monitor",
+				Usage: "probe periodically and report changes in NAT behavior",
+				Description: `Probes the NAT every --interval, using the global probe flags, and
+emits an event whenever its behavior or public IP changes. The first
+successful probe emits a baseline event.`,
+				Action: monitor,
+				Flags: []cli.Flag{
+					&cli.DurationFlag{
+						Name:  "interval",
+						Usage: "time between probes",
+						Value: 5 * time.Minute,
+					},
+					&cli.StringFlag{
+						Name:  "events",
+						Usage: "where to send events (log, json or webhook)",
+						Value: "log",
+					},
+					&cli.StringFlag{
+						Name:  "webhook-url",
+						Usage: "URL to POST JSON events to, with --events=webhook",
+					},
+				},
+			},
+			{
+				Name:  "exporter",
+				Usage: "probe periodically and serve the results as Prometheus metrics",
+				Description: `Probes the NAT every --interval, using the global probe flags, and
+serves the outcome of the latest probe at /metrics.`,
+				Action: exporter,
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "listen",
+						Usage: "address to serve metrics on",
+						Value: ":9750",
+					},
+					&cli.DurationFlag{
+						Name:  "interval",
+						Usage: "time between probes",
+						Value: time.Minute,
+					},
+				},
+			},
+		},
+	}
+	app.Flags = append(app.Flags, reportFlags()...)
+	return app
+}
+
+// reportFlags returns the flags that control the output of all
+// commands that produce results and analyses. Each call returns new
+// flags: urfave/cli keeps a flag's value in the flag itself, so
+// sharing one between flag sets mixes up their values.
+func reportFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.BoolFlag{
+			Name:  "print-results",
+			Usage: "write the uninterpreted results to stdout",
+			Value: false,
+		},
+		&cli.BoolFlag{
+			Name:  "anonymize-results",
+			Usage: "anonymize IP addresses in results",
+			Value: false,
+		},
+		&cli.StringFlag{
+			Name:  "anonymize-key",
+			Usage: "base64 32-byte key for --anonymize-results, to get the same pseudonyms across runs (default: random)",
+		},
+		&cli.BoolFlag{
+			Name:  "anonymize-ports",
+			Usage: "also anonymize port numbers with --anonymize-results",
+		},
+		&cli.BoolFlag{
+			Name:  "print-analysis",
+			Usage: "write the interpreted analysis to stdout",
+			Value: true,
+		},
+		&cli.BoolFlag{
+			Name:  "explain",
+			Usage: "include the evidence and confidence behind each conclusion of the analysis",
+			Value: false,
+		},
+		&cli.StringFlag{
+			Name:  "format",
+			Usage: "output format for results and analyses (" + strings.Join(format.Names(), ", ") + ")",
+			Value: "text",
+		},
+		&cli.StringSliceFlag{
+			Name:  "expect",
+			Usage: "exit with a nonzero status unless the analysis matches this expression, see DESCRIPTION",
+		},
 	}
-	app.Run(os.Args)
 }
 
 func run(c *cli.Context) error {
-	var printer func(interface{})
-	switch c.String("format") {
-	case "text":
-		printer = textPrinter
-	case "json":
-		printer = jsonPrinter
-	default:
-		return fmt.Errorf("unknown --format value %q", c.String("format"))
+	output, err := getPrinter(c)
+	if err != nil {
+		return err
+	}
+	anon, err := getAnonymizer(c)
+	if err != nil {
+		return err
+	}
+	expectations, err := parseExpectations(c)
+	if err != nil {
+		return err
+	}
+	// Submissions are always anonymized.
+	var subAnon *client.Anonymizer
+	if c.String("submit") != "" {
+		if subAnon, err = newAnonymizer(c); err != nil {
+			return err
+		}
+	}
+
+	ctx, cancel := interruptContext()
+	defer cancel()
+
+	// Report whatever data the probe gathered, even if it failed
+	// partway through or was interrupted.
+	opts, err := probeOptions(c)
+	if err != nil {
+		return err
+	}
+	result, err := client.Probe(ctx, opts)
+
+	// Analyze before report anonymizes result in place, anonymization
+	// hides some of what the analysis looks for.
+	analysis := result.Analyze()
+	if err != nil || len(result.MappingProbes) == 0 {
+		if err == nil {
+			err = errors.New("probing got no data")
+		}
+		// Don't submit partial results, they'd skew the statistics.
+		if reportErr := report(c, output, anon, result, analysis); reportErr != nil {
+			return reportErr
+		}
+		return err
+	}
+
+	// Build the submission first, report anonymizes result in place.
+	var sub *client.Submission
+	if subAnon != nil {
+		if sub, err = client.NewSubmission(result, subAnon); err != nil {
+			return err
+		}
+	}
+
+	if err := report(c, output, anon, result, analysis); err != nil {
+		return err
+	}
+
+	if sub != nil {
+		ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		defer cancel()
+		if err := client.Submit(ctx, c.String("submit"), sub); err != nil {
+			return err
+		}
+	}
+	return checkExpectations(expectations, analysis)
+}
+
+// interruptContext returns a context that is canceled when the
+// process receives SIGINT or SIGTERM.
+func interruptContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		defer signal.Stop(sigs)
+		select {
+		case <-sigs:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+func setupLogger(c *cli.Context) error {
+	l, err := internal.NewLoggerWith(c.String("log-format"), c.Int("verbose"))
+	if err != nil {
+		return err
 	}
+	logger = l
+	return nil
+}
 
-	opts := &client.Options{
+// probeOptions returns client options built from the global probe
+// flags.
+func probeOptions(c *cli.Context) (*client.Options, error) {
+	discovery, err := discoveryOptions(c)
+	if err != nil {
+		return nil, err
+	}
+
+	var gateway net.IP
+	if s := c.String("gateway"); s != "" {
+		if gateway = net.ParseIP(s).To4(); gateway == nil {
+			return nil, fmt.Errorf("invalid --gateway %q, want an IPv4 address", s)
+		}
+	}
+
+	var obs client.Observer
+	if c.Bool("progress") {
+		obs = client.ObserverFunc(func(e *client.Event) {
+			fmt.Fprintln(os.Stderr, e)
+		})
+	}
+	return &client.Options{
 		ServerAddrs:              c.StringSlice("servers"),
-		Ports:                    c.IntSlice("ports"),
+		Ports:                    intSlice(c, "ports"),
+		Discovery:                discovery,
 		ResolveDuration:          c.Duration("resolve-timeout"),
+		DisableSelection:         c.Bool("all-servers"),
+		SelectionDuration:        c.Duration("selection-duration"),
 		MappingDuration:          c.Duration("mapping-duration"),
 		MappingTransmitInterval:  c.Duration("mapping-tx-interval"),
 		MappingSockets:           c.Int("mapping-sockets"),
 		FirewallDuration:         c.Duration("firewall-duration"),
 		FirewallTransmitInterval: c.Duration("firewall-tx-interval"),
+		PathMaxHops:              c.Int("path-max-hops"),
+		PathDuration:             c.Duration("path-duration"),
+		Gateway:                  gateway,
+		GatewayPort:              c.Int("gateway-port"),
+		GatewayDuration:          c.Duration("gateway-duration"),
+		Observer:                 obs,
+		Logger:                   logger,
+	}, nil
+}
+
+func discoveryOptions(c *cli.Context) (*client.DiscoveryOptions, error) {
+	ret := &client.DiscoveryOptions{
+		DirectoryURL: c.String("directory-url"),
+	}
+	if k := c.String("directory-key"); k != "" {
+		bs, err := base64.StdEncoding.DecodeString(k)
+		if err != nil || len(bs) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid --directory-key %q, want a base64 ed25519 public key", k)
+		}
+		ret.DirectoryKey = ed25519.PublicKey(bs)
+	}
+	for _, s := range c.StringSlice("bootstrap-ips") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid --bootstrap-ips value %q", s)
+		}
+		ret.BootstrapIPs = append(ret.BootstrapIPs, ip)
+	}
+	return ret, nil
+}
+
+func analyze(c *cli.Context) error {
+	if c.NArg() > 1 {
+		return fmt.Errorf("analyze takes at most one file argument, got %d", c.NArg())
 	}
 
-	result, err := client.Probe(context.Background(), opts)
+	output, err := getPrinter(c)
+	if err != nil {
+		return err
+	}
+	anon, err := getAnonymizer(c)
+	if err != nil {
+		return err
+	}
+	expectations, err := parseExpectations(c)
 	if err != nil {
 		return err
 	}
 
-	if c.Bool("anonymize-results") {
-		result.Anonymize()
+	result, err := loadResult(c.Args().First())
+	if err != nil {
+		return err
 	}
-	if c.Bool("print-results") {
-		printer(result)
+
+	analysis := result.Analyze()
+	if err := report(c, output, anon, result, analysis); err != nil {
+		return err
 	}
-	if c.Bool("print-analysis") {
-		printer(result.Analyze())
+	return checkExpectations(expectations, analysis)
+}
+
+// loadResult reads the first JSON-encoded client.Result from path, or
+// from stdin if path is empty or "-".
+func loadResult(path string) (*client.Result, error) {
+	bs, _, name, err := readDocument(path, "result")
+	if err != nil {
+		return nil, err
+	}
+
+	var ret client.Result
+	if err := json.Unmarshal(bs, &ret); err != nil {
+		return nil, fmt.Errorf("decoding result from %s: %s", name, err)
+	}
+	return &ret, nil
+}
+
+// readDocument returns the first JSON document in path, or in stdin
+// if path is empty or "-", whose kind is one of kinds, along with
+// that kind and a name for the input suitable for error messages.
+//
+// --format=json writes one document per requested output, e.g. a
+// result followed by its analysis, so the input may hold several.
+func readDocument(path string, kinds ...string) (json.RawMessage, string, string, error) {
+	r, name := io.Reader(os.Stdin), "stdin"
+	if path != "" && path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, "", "", err
+		}
+		defer f.Close()
+		r, name = f, path
+	}
+
+	dec := json.NewDecoder(r)
+	for {
+		var doc json.RawMessage
+		if err := dec.Decode(&doc); err == io.EOF {
+			return nil, "", "", fmt.Errorf("no %s document in %s", strings.Join(kinds, " or "), name)
+		} else if err != nil {
+			return nil, "", "", fmt.Errorf("decoding %s: %s", name, err)
+		}
+		docKind, err := client.DocumentKind(doc)
+		if err != nil {
+			return nil, "", "", fmt.Errorf("decoding %s: %s", name, err)
+		}
+		for _, kind := range kinds {
+			if docKind == kind {
+				return doc, kind, name, nil
+			}
+		}
+	}
+}
+
+// intSlice returns the value of an IntSliceFlag. Unlike
+// c.IntSlice, it finds flags defined on parent commands.
+func intSlice(c *cli.Context, name string) []int {
+	for _, ctx := range c.Lineage() {
+		if v := ctx.IntSlice(name); v != nil {
+			return v
+		}
 	}
 	return nil
 }
 
-func textPrinter(obj interface{}) {
-	fmt.Println(obj)
+// printer writes documents to stdout in the format chosen by the
+// --format flag.
+type printer func(docs ...interface{}) error
+
+func getPrinter(c *cli.Context) (printer, error) {
+	f, err := format.Lookup(c.String("format"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid --format: %w", err)
+	}
+	return func(docs ...interface{}) error {
+		return f.Format(os.Stdout, docs)
+	}, nil
+}
+
+// getAnonymizer returns the Anonymizer configured by the reporting
+// flags, or nil if results shouldn't be anonymized.
+func getAnonymizer(c *cli.Context) (*client.Anonymizer, error) {
+	if !c.Bool("anonymize-results") {
+		return nil, nil
+	}
+	return newAnonymizer(c)
 }
 
-func jsonPrinter(obj interface{}) {
-	bs, err := json.MarshalIndent(obj, "", "  ")
+// newAnonymizer returns an Anonymizer configured by the
+// --anonymize-key and --anonymize-ports flags.
+func newAnonymizer(c *cli.Context) (*client.Anonymizer, error) {
+	var (
+		ret *client.Anonymizer
+		err error
+	)
+	if k := c.String("anonymize-key"); k != "" {
+		bs, decodeErr := base64.StdEncoding.DecodeString(k)
+		if decodeErr != nil || len(bs) != client.AnonymizerKeySize {
+			return nil, fmt.Errorf("invalid --anonymize-key %q, want %d base64-encoded bytes", k, client.AnonymizerKeySize)
+		}
+		ret, err = client.NewAnonymizer(bs)
+	} else {
+		ret, err = client.NewRandomAnonymizer()
+	}
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+	ret.MaskPorts = c.Bool("anonymize-ports")
+	return ret, nil
+}
+
+// report prints result and its analysis as requested by the
+// reporting flags. If anon is not nil, result is anonymized in place
+// first, and an anonymized copy of analysis is printed.
+func report(c *cli.Context, output printer, anon *client.Anonymizer, result *client.Result, analysis *client.Analysis) error {
+	if anon != nil {
+		// Copy the analysis first, its evidence shares addresses with
+		// result.
+		var err error
+		if analysis, err = analysis.Anonymized(anon); err != nil {
+			return err
+		}
+		result.AnonymizeWith(anon)
+	}
+	var docs []interface{}
+	if c.Bool("print-results") {
+		docs = append(docs, result)
+	}
+	if c.Bool("print-analysis") {
+		printed := *analysis
+		if !c.Bool("explain") {
+			printed.Evidence = nil
+		}
+		docs = append(docs, &printed)
 	}
-	fmt.Println(string(bs))
+	return output(docs...)
 }
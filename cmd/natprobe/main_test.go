@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	cli "github.com/urfave/cli/v2"
+	"go.universe.tf/natprobe/client"
+)
+
+// runApp runs natprobe with args, and returns what it wrote to stdout.
+func runApp(t *testing.T, args ...string) ([]byte, error) {
+	t.Helper()
+	out, err := ioutil.TempFile("", "natprobe-stdout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(out.Name())
+	defer out.Close()
+
+	stdout, exiter := os.Stdout, cli.OsExiter
+	os.Stdout, cli.OsExiter = out, func(int) {}
+	err = newApp().Run(append([]string{"natprobe"}, args...))
+	os.Stdout, cli.OsExiter = stdout, exiter
+
+	bs, readErr := ioutil.ReadFile(out.Name())
+	if readErr != nil {
+		t.Fatal(readErr)
+	}
+	return bs, err
+}
+
+func udpAddr(ip string, port int) *net.UDPAddr {
+	return &net.UDPAddr{IP: net.ParseIP(ip), Port: port}
+}
+
+// writeResult saves a result from behind an endpoint-dependent NAT
+// in dir, and returns its path.
+func writeResult(t *testing.T, dir string) string {
+	t.Helper()
+	r := &client.Result{
+		LocalIPs: []net.IP{net.ParseIP("192.168.1.10")},
+		MappingProbes: []*client.MappingProbe{
+			{Local: udpAddr("192.168.1.10", 5000), Mapped: udpAddr("198.51.100.7", 6000), Remote: udpAddr("203.0.113.1", 3478)},
+			{Local: udpAddr("192.168.1.10", 5000), Mapped: udpAddr("198.51.100.7", 6001), Remote: udpAddr("203.0.113.2", 3478)},
+		},
+	}
+	bs, err := json.Marshal(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "result.json")
+	if err := ioutil.WriteFile(path, bs, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReanalyzeOutput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "natprobe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// By default, the analysis follows the result.
+	out, err := runApp(t, "analyze", "--print-results", "--format=json", writeResult(t, dir))
+	if err != nil {
+		t.Fatalf("analyze: %s", err)
+	}
+	dec := json.NewDecoder(bytes.NewReader(out))
+	var r client.Result
+	var a client.Analysis
+	if err := dec.Decode(&r); err != nil {
+		t.Fatalf("decoding result: %s\n%s", err, out)
+	}
+	if err := dec.Decode(&a); err != nil {
+		t.Fatalf("decoding analysis: %s\n%s", err, out)
+	}
+	saved := filepath.Join(dir, "out.json")
+	if err := ioutil.WriteFile(saved, out, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	again, err := runApp(t, "analyze", "--format=json", saved)
+	if err != nil {
+		t.Fatalf("analyze of saved output: %s", err)
+	}
+	var reanalyzed client.Analysis
+	if err := json.Unmarshal(again, &reanalyzed); err != nil {
+		t.Fatalf("decoding analysis of saved output: %s\n%s", err, again)
+	}
+	if !reanalyzed.MappingVariesByDestIP || reanalyzed.MappingVariesByDestIP != a.MappingVariesByDestIP {
+		t.Errorf("reanalysis found MappingVariesByDestIP=%v, want true", reanalyzed.MappingVariesByDestIP)
+	}
+
+	if _, err := runApp(t, "diff", saved, saved); err != nil {
+		t.Errorf("diff of saved output: %s", err)
+	}
+	if _, err := runApp(t, "predict", saved, saved); err != nil {
+		t.Errorf("predict of saved output: %s", err)
+	}
+}
+
+func TestReadDocumentKinds(t *testing.T) {
+	dir, err := ioutil.TempDir("", "natprobe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "docs.json")
+	docs := `{"schemaVersion": 1, "kind": "diff", "changes": []}
+{"schemaVersion": 1, "kind": "analysis"}
+{"schemaVersion": 1, "kind": "result"}
+`
+	if err := ioutil.WriteFile(path, []byte(docs), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		kinds   []string
+		want    string
+		wantErr bool
+	}{
+		{[]string{"result"}, "result", false},
+		{[]string{"result", "analysis"}, "analysis", false},
+		{[]string{"diff"}, "diff", false},
+		{[]string{"prediction"}, "", true},
+	}
+	for _, test := range tests {
+		_, kind, _, err := readDocument(path, test.kinds...)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("readDocument(%v) found a %q document, want error", test.kinds, kind)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("readDocument(%v): %s", test.kinds, err)
+		} else if kind != test.want {
+			t.Errorf("readDocument(%v) found a %q document, want %q", test.kinds, kind, test.want)
+		}
+	}
+}
+
+func TestUnknownFormat(t *testing.T) {
+	dir, err := ioutil.TempDir("", "natprobe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	out, err := runApp(t, "analyze", "--format=yaml", writeResult(t, dir))
+	if want := `invalid --format: unknown format "yaml", want one of csv, html, json, markdown, text`; err == nil || err.Error() != want {
+		t.Errorf("analyze --format=yaml returned error %v, want %q", err, want)
+	}
+	if len(out) != 0 {
+		t.Errorf("analyze --format=yaml printed output:\n%s", out)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	cli "github.com/urfave/cli/v2"
+	"go.universe.tf/natprobe/client"
+)
+
+// event reports a change in NAT behavior observed by monitor.
+type event struct {
+	Time time.Time `json:"time"`
+	// "baseline" for the first successful probe, "change" afterwards.
+	Type     string           `json:"type"`
+	Diff     *client.Diff     `json:"diff,omitempty"`
+	Analysis *client.Analysis `json:"analysis"`
+}
+
+func monitor(c *cli.Context) error {
+	emit, err := getEmitter(c)
+	if err != nil {
+		return err
+	}
+	interval := c.Duration("interval")
+	if interval <= 0 {
+		return errors.New("--interval must be positive")
+	}
+
+	opts, err := probeOptions(c)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := interruptContext()
+	defer cancel()
+
+	var last *client.Analysis
+	for {
+		result, err := client.Probe(ctx, opts)
+		switch {
+		case ctx.Err() != nil:
+			return nil
+		case err != nil:
+			logger.Error(err, "Probe failed, will retry", "interval", interval.String())
+		default:
+			analysis := result.Analyze()
+			analysis.Evidence = nil
+			var e *event
+			if last == nil {
+				e = &event{
+					Time:     time.Now(),
+					Type:     "baseline",
+					Analysis: analysis,
+				}
+			} else if d := client.Compare(last, analysis); len(d.Changes) > 0 {
+				e = &event{
+					Time:     time.Now(),
+					Type:     "change",
+					Diff:     d,
+					Analysis: analysis,
+				}
+			}
+			if e != nil {
+				if err := emit(e); err != nil {
+					logger.Error(err, "Failed to emit event", "type", e.Type)
+				}
+			}
+			last = analysis
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(interval):
+		}
+	}
+}
+
+func getEmitter(c *cli.Context) (func(*event) error, error) {
+	switch c.String("events") {
+	case "log":
+		return logEvent, nil
+	case "json":
+		return jsonEvent, nil
+	case "webhook":
+		url := c.String("webhook-url")
+		if url == "" {
+			return nil, errors.New("--events=webhook requires --webhook-url")
+		}
+		return func(e *event) error { return postEvent(url, e) }, nil
+	default:
+		return nil, fmt.Errorf("unknown --events value %q", c.String("events"))
+	}
+}
+
+func logEvent(e *event) error {
+	if e.Diff == nil {
+		logger.Info("Recorded baseline NAT behavior", "analysis", e.Analysis.String())
+		return nil
+	}
+	logger.Info("NAT behavior changed", "changes", e.Diff.String(), "regressed", e.Diff.Regressed())
+	return nil
+}
+
+func jsonEvent(e *event) error {
+	bs, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("marshaling event: %w", err)
+	}
+	fmt.Println(string(bs))
+	return nil
+}
+
+func postEvent(url string, e *event) error {
+	bs, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("marshaling event: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(bs))
+	if err != nil {
+		return fmt.Errorf("creating webhook request for %s: %w", url, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("delivering event to webhook %s: %w", url, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook %s rejected event: HTTP status %s", url, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"fmt"
+
+	cli "github.com/urfave/cli/v2"
+	"go.universe.tf/natprobe/client"
+)
+
+func predict(c *cli.Context) error {
+	if c.NArg() != 2 {
+		return fmt.Errorf("predict takes exactly two file arguments, got %d", c.NArg())
+	}
+
+	output, err := getPrinter(c)
+	if err != nil {
+		return err
+	}
+
+	a, err := loadAnalysis(c.Args().Get(0))
+	if err != nil {
+		return err
+	}
+	b, err := loadAnalysis(c.Args().Get(1))
+	if err != nil {
+		return err
+	}
+
+	return output(client.Predict(a, b))
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+
+	cli "github.com/urfave/cli/v2"
+	"go.universe.tf/natprobe/client"
+)
+
+func punch(c *cli.Context) error {
+	output, err := getPrinter(c)
+	if err != nil {
+		return err
+	}
+	discovery, err := discoveryOptions(c)
+	if err != nil {
+		return err
+	}
+
+	result, err := client.Punch(context.Background(), &client.PunchOptions{
+		Server:            c.String("server"),
+		Discovery:         discovery,
+		Session:           c.String("session"),
+		RendezvousTimeout: c.Duration("rendezvous-timeout"),
+		PunchDuration:     c.Duration("punch-duration"),
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := output(result); err != nil {
+		return err
+	}
+	if !result.Success {
+		return cli.Exit("", 1)
+	}
+	return nil
+}
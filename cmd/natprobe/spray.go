@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+
+	cli "github.com/urfave/cli/v2"
+	"go.universe.tf/natprobe/client"
+)
+
+func spray(c *cli.Context) error {
+	output, err := getPrinter(c)
+	if err != nil {
+		return err
+	}
+	discovery, err := discoveryOptions(c)
+	if err != nil {
+		return err
+	}
+
+	result, err := client.Spray(context.Background(), &client.SprayOptions{
+		Server:        c.String("server"),
+		Discovery:     discovery,
+		Sockets:       c.Int("sockets"),
+		Packets:       c.Int("packets"),
+		SprayDuration: c.Duration("spray-duration"),
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := output(result); err != nil {
+		return err
+	}
+	return nil
+}
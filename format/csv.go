@@ -0,0 +1,48 @@
+package format
+
+import (
+	"encoding/csv"
+	"errors"
+	"io"
+	"strconv"
+
+	"go.universe.tf/natprobe/client"
+)
+
+func init() {
+	Register("csv", FormatterFunc(formatCSV))
+}
+
+// csvHeader is the header of the CSV export. Each row is either a
+// mapping probe, or a packet received by the firewall probe.
+var csvHeader = []string{"probe", "local", "remote", "mapped", "received_from", "timeout"}
+
+// formatCSV writes the individual probes of the results in docs as a
+// CSV table. Other documents, like analyses, are derived from the
+// probes and skipped.
+func formatCSV(w io.Writer, docs []interface{}) error {
+	var results []*client.Result
+	for _, doc := range docs {
+		if r, ok := doc.(*client.Result); ok {
+			results = append(results, r)
+		}
+	}
+	if len(results) == 0 {
+		return errors.New("csv format only exports probe results, nothing to export")
+	}
+
+	cw := csv.NewWriter(w)
+	cw.Write(csvHeader)
+	for _, r := range results {
+		for _, p := range r.MappingProbes {
+			cw.Write([]string{"mapping", addrString(p.Local), addrString(p.Remote), addrString(p.Mapped), "", strconv.FormatBool(p.Timeout)})
+		}
+		if fw := r.FirewallProbes; fw != nil {
+			for _, addr := range fw.Received {
+				cw.Write([]string{"firewall", addrString(fw.Local), addrString(fw.Remote), "", addrString(addr), "false"})
+			}
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
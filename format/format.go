@@ -0,0 +1,67 @@
+// Package format renders natprobe's documents (client.Result,
+// client.Analysis and friends) for humans and other programs.
+//
+// Formatters are looked up by name in a registry. The text, json,
+// markdown, html and csv formatters are built in, and other packages
+// can Register more.
+package format
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Formatter writes documents to w. All the documents produced by one
+// command are formatted by a single call, so that formats like HTML
+// can wrap them into a single report.
+type Formatter interface {
+	Format(w io.Writer, docs []interface{}) error
+}
+
+// FormatterFunc adapts a function into a Formatter.
+type FormatterFunc func(w io.Writer, docs []interface{}) error
+
+// Format implements Formatter.
+func (f FormatterFunc) Format(w io.Writer, docs []interface{}) error { return f(w, docs) }
+
+var (
+	mu         sync.Mutex
+	formatters = map[string]Formatter{}
+)
+
+// Register makes f available under name. It panics if name is
+// already registered.
+func Register(name string, f Formatter) {
+	mu.Lock()
+	defer mu.Unlock()
+	if _, ok := formatters[name]; ok {
+		panic(fmt.Sprintf("format: formatter %q registered twice", name))
+	}
+	formatters[name] = f
+}
+
+// Lookup returns the formatter registered under name.
+func Lookup(name string) (Formatter, error) {
+	mu.Lock()
+	f := formatters[name]
+	mu.Unlock()
+	if f == nil {
+		return nil, fmt.Errorf("unknown format %q, want one of %s", name, strings.Join(Names(), ", "))
+	}
+	return f, nil
+}
+
+// Names returns the names of all registered formatters, sorted.
+func Names() []string {
+	mu.Lock()
+	defer mu.Unlock()
+	var ret []string
+	for name := range formatters {
+		ret = append(ret, name)
+	}
+	sort.Strings(ret)
+	return ret
+}
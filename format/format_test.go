@@ -0,0 +1,83 @@
+package format
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"go.universe.tf/natprobe/client"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata with the current output")
+
+// testDocs returns the documents in testdata/result.json, its
+// analysis, and a prediction for connecting it to an open peer.
+func testDocs(t *testing.T) []interface{} {
+	t.Helper()
+	bs, err := ioutil.ReadFile(filepath.Join("testdata", "result.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var r client.Result
+	if err := json.Unmarshal(bs, &r); err != nil {
+		t.Fatal(err)
+	}
+	a := r.Analyze()
+	return []interface{}{&r, a, client.Predict(a, &client.Analysis{NoNAT: true})}
+}
+
+func TestGolden(t *testing.T) {
+	docs := testDocs(t)
+	for _, name := range Names() {
+		f, err := Lookup(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if err := f.Format(&buf, docs); err != nil {
+			t.Errorf("%s: Format: %s", name, err)
+			continue
+		}
+
+		golden := filepath.Join("testdata", name+".golden")
+		if *update {
+			if err := ioutil.WriteFile(golden, buf.Bytes(), 0644); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		want, err := ioutil.ReadFile(golden)
+		if err != nil {
+			t.Errorf("%s: %s, run with -update to create it", name, err)
+			continue
+		}
+		if got := buf.String(); got != string(want) {
+			t.Errorf("%s: output differs from %s, run with -update if the change is intended\ngot:\n%s\nwant:\n%s", name, golden, got, want)
+		}
+	}
+}
+
+func TestLookupUnknown(t *testing.T) {
+	f, err := Lookup("yaml")
+	if f != nil || err == nil {
+		t.Fatalf("Lookup(yaml) returned %v, %v, want an error", f, err)
+	}
+	if want := `unknown format "yaml", want one of csv, html, json, markdown, text`; err.Error() != want {
+		t.Errorf("Lookup(yaml) error is %q, want %q", err, want)
+	}
+}
+
+func TestCSVWithoutResults(t *testing.T) {
+	docs := testDocs(t)
+	f, err := Lookup("csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := f.Format(&buf, docs[1:]); err == nil {
+		t.Errorf("csv formatted documents without a result:\n%s", buf.String())
+	}
+}
@@ -0,0 +1,73 @@
+package format
+
+import (
+	"html/template"
+	"io"
+)
+
+func init() {
+	Register("html", FormatterFunc(formatHTML))
+}
+
+// formatHTML writes docs as a self-contained HTML report, with no
+// external stylesheets or scripts.
+func formatHTML(w io.Writer, docs []interface{}) error {
+	var sections []*section
+	for _, doc := range docs {
+		sections = append(sections, newSection(doc))
+	}
+	return htmlTemplate.Execute(w, sections)
+}
+
+// htmlSection is a section along with its heading level.
+type htmlSection struct {
+	S     *section
+	Level int
+}
+
+var htmlTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"heading": func(level int) int {
+		if level > 6 {
+			return 6
+		}
+		return level
+	},
+	"inc": func(i int) int { return i + 1 },
+	"withLevel": func(s *section, level int) *htmlSection {
+		return &htmlSection{s, level}
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>natprobe report</title>
+<style>
+body { font-family: sans-serif; max-width: 60em; margin: 2em auto; padding: 0 1em; color: #222; }
+table { border-collapse: collapse; margin: 1em 0; }
+caption { text-align: left; font-weight: bold; padding-bottom: 0.3em; }
+th, td { border: 1px solid #ccc; padding: 0.2em 0.6em; text-align: left; font-family: monospace; }
+th { background: #f0f0f0; font-family: sans-serif; }
+pre { background: #f6f6f6; padding: 0.8em; overflow-x: auto; }
+</style>
+</head>
+<body>
+<h1>natprobe report</h1>
+{{range .}}{{template "section" (withLevel . 2)}}{{end}}
+</body>
+</html>
+{{define "section"}}{{with .S}}
+<section>
+{{if .Title}}<h{{heading $.Level}}>{{.Title}}</h{{heading $.Level}}>{{end}}
+{{range .Text}}<p>{{.}}</p>
+{{end}}{{if .List}}<ul>
+{{range .List}}<li>{{.Text}}{{if .Sub}}<ul>{{range .Sub}}<li>{{.}}</li>{{end}}</ul>{{end}}</li>
+{{end}}</ul>
+{{end}}{{range .Tables}}<table>
+<caption>{{.Caption}}</caption>
+<tr>{{range .Header}}<th>{{.}}</th>{{end}}</tr>
+{{range .Rows}}<tr>{{range .}}<td>{{.}}</td>{{end}}</tr>
+{{end}}</table>
+{{end}}{{if .Pre}}<pre>{{.Pre}}</pre>
+{{end}}{{range .Sections}}{{template "section" (withLevel . (inc $.Level))}}{{end}}
+</section>
+{{end}}{{end}}`))
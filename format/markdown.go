@@ -0,0 +1,80 @@
+package format
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+func init() {
+	Register("markdown", FormatterFunc(formatMarkdown))
+}
+
+// formatMarkdown writes docs as a GitHub-flavored Markdown report.
+func formatMarkdown(w io.Writer, docs []interface{}) error {
+	b := bufio.NewWriter(w)
+	fmt.Fprintf(b, "# natprobe report\n")
+	for _, doc := range docs {
+		writeMarkdownSection(b, newSection(doc), 2)
+	}
+	return b.Flush()
+}
+
+func writeMarkdownSection(b *bufio.Writer, s *section, level int) {
+	if s.Title != "" {
+		fmt.Fprintf(b, "\n%s %s\n", strings.Repeat("#", level), s.Title)
+	}
+	for _, p := range s.Text {
+		fmt.Fprintf(b, "\n%s\n", markdownEscape(p))
+	}
+	if len(s.List) > 0 {
+		b.WriteString("\n")
+		for _, item := range s.List {
+			fmt.Fprintf(b, "- %s\n", markdownEscape(item.Text))
+			for _, sub := range item.Sub {
+				fmt.Fprintf(b, "  - %s\n", markdownEscape(sub))
+			}
+		}
+	}
+	for _, t := range s.Tables {
+		fmt.Fprintf(b, "\n**%s**\n\n", markdownEscape(t.Caption))
+		writeMarkdownRow(b, t.Header)
+		b.WriteString("|" + strings.Repeat(" --- |", len(t.Header)) + "\n")
+		for _, row := range t.Rows {
+			writeMarkdownRow(b, row)
+		}
+	}
+	if s.Pre != "" {
+		fmt.Fprintf(b, "\n```\n%s\n```\n", strings.TrimRight(s.Pre, "\n"))
+	}
+	for _, sub := range s.Sections {
+		writeMarkdownSection(b, sub, level+1)
+	}
+}
+
+func writeMarkdownRow(b *bufio.Writer, cells []string) {
+	b.WriteString("|")
+	for _, cell := range cells {
+		fmt.Fprintf(b, " %s |", markdownEscape(cell))
+	}
+	b.WriteString("\n")
+}
+
+var markdownEscaper = strings.NewReplacer(
+	`\`, `\\`,
+	"`", "\\`",
+	"*", `\*`,
+	"_", `\_`,
+	"|", `\|`,
+	"<", `\<`,
+	">", `\>`,
+	"[", `\[`,
+	"]", `\]`,
+)
+
+// markdownEscape escapes the characters in s that Markdown would
+// otherwise interpret as markup, like the brackets of IPv6 addresses.
+func markdownEscape(s string) string {
+	return markdownEscaper.Replace(s)
+}
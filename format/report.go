@@ -0,0 +1,314 @@
+package format
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"go.universe.tf/natprobe/client"
+)
+
+// section is a format-neutral rendering of a document, which the
+// markdown and html formatters turn into their own markup.
+type section struct {
+	Title string
+	// Paragraphs of text.
+	Text []string
+	// A bulleted list, each item with optional sub-items.
+	List   []*listItem
+	Tables []*table
+	// Preformatted text.
+	Pre      string
+	Sections []*section
+}
+
+type listItem struct {
+	Text string
+	Sub  []string
+}
+
+type table struct {
+	Caption string
+	Header  []string
+	Rows    [][]string
+}
+
+func (t *table) add(row ...string) {
+	t.Rows = append(t.Rows, row)
+}
+
+// newSection renders doc as a section.
+func newSection(doc interface{}) *section {
+	switch d := doc.(type) {
+	case *client.Result:
+		return resultSection(d)
+	case *client.Analysis:
+		return analysisSection(d)
+	case *client.Diff:
+		return &section{Title: "Comparison", Pre: d.String()}
+	case *client.Prediction:
+		return &section{Title: "Connectivity prediction", Pre: d.String()}
+	case *client.PunchResult:
+		return &section{Title: "Hole punching", Pre: d.String()}
+	case *client.SprayResult:
+		return &section{Title: "Birthday spraying", Pre: d.String()}
+	case *client.ForwardResult:
+		return &section{Title: "Port forwarding", Pre: d.String()}
+	default:
+		return &section{Pre: fmt.Sprint(doc)}
+	}
+}
+
+func resultSection(r *client.Result) *section {
+	ret := &section{Title: "Probe results"}
+	if m := r.Metadata; m != nil {
+		ret.Text = append(ret.Text, fmt.Sprintf("Probed with natprobe %s on %s, in %s.", m.ToolVersion, m.Started.Format("2006-01-02 15:04:05 MST"), m.Duration.Round(1e6)))
+	}
+	if len(r.MappingProbes) == 0 {
+		ret.Text = append(ret.Text, "No data (did the probe fail?)")
+		return ret
+	}
+	ret.Text = append(ret.Text, "Local IPs on the client: "+joinIPs(r.LocalIPs)+".")
+	if r.EgressIP != nil {
+		ret.Text = append(ret.Text, "Traffic to the probe servers leaves from "+r.EgressIP.String()+".")
+	}
+
+	if r.Selection != nil {
+		t := &table{
+			Caption: "Probe server selection",
+			Header:  []string{"Server IP", "Reachable", "RTT", "Selected"},
+		}
+		for _, c := range r.Selection.Candidates {
+			rtt := ""
+			if c.Reachable {
+				rtt = c.RTT.String()
+			}
+			selected := false
+			for _, ip := range r.Selection.Selected {
+				selected = selected || ip.Equal(c.IP)
+			}
+			t.add(c.IP.String(), yesNo(c.Reachable), rtt, yesNo(selected))
+		}
+		ret.Tables = append(ret.Tables, t)
+	}
+
+	ret.Tables = append(ret.Tables, mappingTable("Mapping probes", r.MappingProbes))
+
+	if fw := r.FirewallProbes; fw == nil {
+		ret.Text = append(ret.Text, "No firewall probe data.")
+	} else {
+		t := &table{
+			Caption: fmt.Sprintf("Firewall receptions after outbound traffic %s -> %s", fw.Local, fw.Remote),
+			Header:  []string{"Received from", "Same IP", "Same port"},
+		}
+		for _, addr := range fw.Received {
+			t.add(addr.String(), yesNo(addr.IP.Equal(fw.Remote.IP)), yesNo(addr.Port == fw.Remote.Port))
+		}
+		ret.Tables = append(ret.Tables, t)
+		if len(fw.Matrix) > 0 {
+			t := &table{
+				Caption: "Firewall probes by requested response",
+				Header:  []string{"Respond from", "Sent", "Received", "Unsupported", "Received from"},
+			}
+			for _, o := range fw.Matrix {
+				t.add(o.Combination(), strconv.Itoa(o.Sent), strconv.Itoa(o.Received), strconv.Itoa(o.Unsupported), addrsString(o.From))
+			}
+			if tp := fw.ThirdParty; tp != nil {
+				unsupported := 0
+				if tp.Replies == 0 || tp.Peers == 0 {
+					unsupported = tp.Sent
+				}
+				t.add("third-party peers", strconv.Itoa(tp.Sent), strconv.Itoa(tp.Received), strconv.Itoa(unsupported), addrsString(tp.From))
+			}
+			ret.Tables = append(ret.Tables, t)
+		}
+	}
+
+	if len(r.ServerStats) > 0 {
+		t := &table{
+			Caption: "Server statistics",
+			Header:  []string{"Server", "Sent", "Received", "Loss", "RTT"},
+		}
+		for _, s := range r.ServerStats {
+			t.add(s.Remote.String(), strconv.Itoa(s.Sent), strconv.Itoa(s.Received), fmt.Sprintf("%.0f%%", s.Loss()*100), s.RTT.String())
+		}
+		ret.Tables = append(ret.Tables, t)
+	}
+
+	if p := r.Path; p != nil {
+		t := &table{
+			Caption: fmt.Sprintf("Path to %s", p.Remote),
+			Header:  []string{"TTL", "Router"},
+		}
+		for _, h := range p.Hops {
+			t.add(strconv.Itoa(h.TTL), h.String())
+		}
+		if p.Reached {
+			t.add(strconv.Itoa(len(p.Hops)+1), p.Remote.IP.String())
+		}
+		ret.Tables = append(ret.Tables, t)
+	}
+	if gw := r.Gateway; gw != nil {
+		switch {
+		case !gw.NATPMP && !gw.PCP:
+			ret.Text = append(ret.Text, fmt.Sprintf("Gateway %s doesn't answer NAT-PMP or PCP.", gw.IP))
+		case gw.ExternalIP == nil:
+			ret.Text = append(ret.Text, fmt.Sprintf("Gateway %s reported no external address.", gw.IP))
+		default:
+			ret.Text = append(ret.Text, fmt.Sprintf("Gateway %s reported external address %s.", gw.IP, gw.ExternalIP))
+		}
+		if m := gw.Mapping; m != nil {
+			t := &table{
+				Caption: fmt.Sprintf("Port mapping granted over %s", m.Protocol),
+				Header:  []string{"Local", "External", "Lifetime", "Seen by server"},
+			}
+			ext, observed := "unknown", "no response"
+			if m.External.IP != nil {
+				ext = m.External.String()
+			}
+			if m.Observed != nil {
+				observed = m.Observed.String()
+			}
+			t.add(m.Local.String(), ext, m.Lifetime.String(), observed)
+			ret.Tables = append(ret.Tables, t)
+			if m.Mismatch() {
+				ret.Text = append(ret.Text, "The probe server saw the mapping from a different address, so another NAT sits beyond the gateway.")
+			}
+		} else if gw.MappingError != "" {
+			ret.Text = append(ret.Text, fmt.Sprintf("Gateway %s refused a port mapping: %s.", gw.IP, gw.MappingError))
+		}
+	}
+
+	return ret
+}
+
+func analysisSection(a *client.Analysis) *section {
+	ret := &section{Title: "Analysis"}
+
+	// Analysis.String has one conclusion per line, with indented
+	// details.
+	for _, line := range strings.Split(a.String(), "\n") {
+		if strings.HasPrefix(line, " ") && len(ret.List) > 0 {
+			item := ret.List[len(ret.List)-1]
+			item.Sub = append(item.Sub, strings.TrimSpace(line))
+		} else {
+			ret.List = append(ret.List, &listItem{Text: line})
+		}
+	}
+
+	if a.Evidence == nil {
+		return ret
+	}
+	for _, c := range a.Conclusions() {
+		sub := &section{Title: fmt.Sprintf("%s: %v", c.Name, c.Verdict)}
+		e := c.Evidence
+		if e == nil {
+			sub.Text = []string{"No evidence."}
+			ret.Sections = append(ret.Sections, sub)
+			continue
+		}
+		if e.Unknown {
+			sub.Text = []string{"Unknown, no observations."}
+		} else {
+			sub.Text = []string{fmt.Sprintf("Confidence %.0f%%.", e.Confidence*100)}
+		}
+		if len(e.SupportingMappings) > 0 {
+			sub.Tables = append(sub.Tables, mappingTable("Supporting mapping probes", e.SupportingMappings))
+		}
+		if len(e.ContradictingMappings) > 0 {
+			sub.Tables = append(sub.Tables, mappingTable("Contradicting mapping probes", e.ContradictingMappings))
+		}
+		if len(e.SupportingReceptions) > 0 {
+			sub.Tables = append(sub.Tables, receptionTable("Supporting firewall receptions", e.SupportingReceptions))
+		}
+		if len(e.ContradictingReceptions) > 0 {
+			sub.Tables = append(sub.Tables, receptionTable("Contradicting firewall receptions", e.ContradictingReceptions))
+		}
+		if len(e.SupportingAddresses) > 0 {
+			sub.Tables = append(sub.Tables, addressTable("Supporting addresses", e.SupportingAddresses))
+		}
+		if len(e.ContradictingAddresses) > 0 {
+			sub.Tables = append(sub.Tables, addressTable("Contradicting addresses", e.ContradictingAddresses))
+		}
+		ret.Sections = append(ret.Sections, sub)
+	}
+	return ret
+}
+
+func mappingTable(caption string, probes []*client.MappingProbe) *table {
+	ret := &table{
+		Caption: caption,
+		Header:  []string{"Local", "Mapped", "Remote", "Outcome"},
+	}
+	for _, p := range probes {
+		if p.Timeout {
+			ret.add(addrString(p.Local), "", addrString(p.Remote), "timeout")
+		} else {
+			ret.add(addrString(p.Local), addrString(p.Mapped), addrString(p.Remote), "response")
+		}
+	}
+	return ret
+}
+
+func receptionTable(caption string, addrs []*net.UDPAddr) *table {
+	ret := &table{
+		Caption: caption,
+		Header:  []string{"Received from"},
+	}
+	for _, addr := range addrs {
+		ret.add(addrString(addr))
+	}
+	return ret
+}
+
+func addressTable(caption string, addrs []*client.AddressObservation) *table {
+	ret := &table{
+		Caption: caption,
+		Header:  []string{"Address", "Seen as"},
+	}
+	for _, o := range addrs {
+		ret.add(o.IP.String(), o.Source)
+	}
+	return ret
+}
+
+func addrString(addr *net.UDPAddr) string {
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
+}
+
+// addrsString lists addrs, abbreviated past a few since fresh
+// firewall responses each come from a different port.
+func addrsString(addrs []*net.UDPAddr) string {
+	const max = 3
+	var ret []string
+	for i, addr := range addrs {
+		if i == max {
+			ret = append(ret, fmt.Sprintf("and %d more", len(addrs)-max))
+			break
+		}
+		ret = append(ret, addr.String())
+	}
+	return strings.Join(ret, " ")
+}
+
+func joinIPs(ips []net.IP) string {
+	if len(ips) == 0 {
+		return "none"
+	}
+	var ret []string
+	for _, ip := range ips {
+		ret = append(ret, ip.String())
+	}
+	return strings.Join(ret, ", ")
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
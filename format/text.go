@@ -0,0 +1,44 @@
+package format
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"go.universe.tf/natprobe/client"
+)
+
+func init() {
+	Register("text", FormatterFunc(formatText))
+	Register("json", FormatterFunc(formatJSON))
+}
+
+// formatText writes the String form of each document, followed by
+// the explanation of analyses that have evidence.
+func formatText(w io.Writer, docs []interface{}) error {
+	for _, doc := range docs {
+		if _, err := fmt.Fprintln(w, doc); err != nil {
+			return err
+		}
+		if a, ok := doc.(*client.Analysis); ok && a.Evidence != nil {
+			if _, err := fmt.Fprintln(w, a.Explain()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// formatJSON writes each document as an indented JSON document.
+func formatJSON(w io.Writer, docs []interface{}) error {
+	for _, doc := range docs {
+		bs, err := json.MarshalIndent(doc, "", "  ")
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintln(w, string(bs)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
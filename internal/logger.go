@@ -7,27 +7,67 @@ import (
 	"github.com/go-logr/logr"
 	"github.com/go-logr/zapr"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 	"golang.org/x/sys/unix"
 )
 
 func NewLogger() logr.Logger {
-	var (
-		logger *zap.Logger
-		err    error
-	)
-	if isTerminal() {
-		logger, err = zap.NewDevelopment()
-	} else {
-		logger, err = zap.NewProduction()
-	}
+	logger, err := NewLoggerWith("auto", 0)
 	if err != nil {
 		panic(fmt.Sprintf("Failed to initialize logger: %s", err))
 	}
+	return logger
+}
+
+// NewLoggerWith returns a logger that writes in the given format, and
+// logs messages up to the given verbosity level. Format is "console"
+// for human-readable logs, "json" for structured logs, or "auto" for
+// console logs when stdout is a terminal and JSON logs otherwise.
+func NewLoggerWith(format string, verbosity int) (logr.Logger, error) {
+	if format == "auto" {
+		if isTerminal() {
+			format = "console"
+		} else {
+			format = "json"
+		}
+	}
 
-	return zapr.NewLogger(logger)
+	var cfg zap.Config
+	switch format {
+	case "console":
+		cfg = zap.NewDevelopmentConfig()
+	case "json":
+		cfg = zap.NewProductionConfig()
+	default:
+		return nil, fmt.Errorf("unknown log format %q", format)
+	}
+	// logr verbosity levels map to negative zap levels.
+	cfg.Level = zap.NewAtomicLevelAt(zapcore.Level(-verbosity))
+
+	logger, err := cfg.Build()
+	if err != nil {
+		return nil, err
+	}
+	return zapr.NewLogger(logger), nil
 }
 
 func isTerminal() bool {
 	_, err := unix.IoctlGetTermios(int(os.Stdout.Fd()), 0)
 	return err == nil
 }
+
+// DiscardLogger returns a logger that discards all logs.
+func DiscardLogger() logr.Logger {
+	return discardLogger{}
+}
+
+type discardLogger struct{}
+
+func (discardLogger) Info(string, ...interface{})         {}
+func (discardLogger) Enabled() bool                       { return false }
+func (discardLogger) Error(error, string, ...interface{}) {}
+func (l discardLogger) V(int) logr.InfoLogger             { return l }
+func (l discardLogger) WithValues(...interface{}) logr.Logger {
+	return l
+}
+func (l discardLogger) WithName(string) logr.Logger { return l }
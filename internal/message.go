@@ -0,0 +1,540 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// Control messages are the part of the natprobe protocol that isn't
+// mapping probes. They all start with magic, which can't be confused
+// with the mostly-zero 180 byte mapping probes.
+var magic = [4]byte{'N', 'P', 'R', 'B'}
+
+// MaxSessionLen is the maximum length of a session code.
+const MaxSessionLen = 64
+
+// MsgType identifies the type of a control message.
+type MsgType byte
+
+const (
+	// Client to server: join a rendezvous session.
+	MsgRendezvous MsgType = iota + 1
+	// Server to client: the other member of a rendezvous session.
+	MsgPeer
+	// Client to client: hole punching attempt.
+	MsgPunch
+	// Client to server: spray packets at my public IP.
+	MsgSprayRequest
+	// Server to client: response to a MsgSprayRequest.
+	MsgSprayReply
+	// Server to client: one sprayed packet.
+	MsgSprayProbe
+	// Client to server: have peer servers send me a packet.
+	MsgRelayRequest
+	// Server to client: response to a MsgRelayRequest.
+	MsgRelayReply
+	// Server to peer server: send a packet to a client.
+	MsgRelayForward
+	// Peer server to client: the relayed packet.
+	MsgRelayProbe
+	// Client to server: send a packet to a port on my public IP.
+	MsgForwardRequest
+	// Server to client: response to a MsgForwardRequest.
+	MsgForwardReply
+	// Server to client: the packet sent to the forwarded port.
+	MsgForwardProbe
+	// Server to client: response to a MsgRendezvous without a valid
+	// cookie.
+	MsgRendezvousReply
+)
+
+// SprayMinPort is the lowest port that servers spray. Lower ports are
+// rarely used for NAT mappings.
+const SprayMinPort = 1024
+
+// Message is a control message.
+type Message interface {
+	Type() MsgType
+}
+
+// Rendezvous asks the server to pair the sender with the other client
+// that sends the same Session.
+//
+// As for SprayRequest, the server first answers with a cookie in a
+// RendezvousReply, and only pairs up clients whose requests carry it.
+type Rendezvous struct {
+	Session string
+	// The sender's LAN address, for peers on the same network.
+	Local *net.UDPAddr
+	// The cookie from the server's RendezvousReply, or zero.
+	Cookie uint64
+}
+
+// Type implements Message.
+func (*Rendezvous) Type() MsgType { return MsgRendezvous }
+
+// RendezvousReply answers a Rendezvous that doesn't carry a valid
+// cookie.
+type RendezvousReply struct {
+	Session string
+	Cookie  uint64
+}
+
+// Type implements Message.
+func (*RendezvousReply) Type() MsgType { return MsgRendezvousReply }
+
+// Peer tells a client about its partner in a rendezvous session.
+type Peer struct {
+	Session string
+	// The recipient's address, as seen by the server.
+	Mapped *net.UDPAddr
+	// The partner's address, as seen by the server.
+	PeerMapped *net.UDPAddr
+	// The partner's LAN address, as reported by the partner.
+	PeerLocal *net.UDPAddr
+}
+
+// Type implements Message.
+func (*Peer) Type() MsgType { return MsgPeer }
+
+// Punch is exchanged between the two clients of a rendezvous session
+// to open a path through their NATs.
+type Punch struct {
+	Session string
+	// The sender has received a Punch from the recipient.
+	Ack bool
+}
+
+// Type implements Message.
+func (*Punch) Type() MsgType { return MsgPunch }
+
+// SprayRequest asks the server to spray packets at random ports on
+// the sender's public IP, from the address the request was sent to.
+//
+// The server first answers with a cookie, without spraying. Spraying
+// starts when the client repeats the request with that cookie, which
+// proves that the client really is at the IP to be sprayed.
+type SprayRequest struct {
+	// Random value identifying the experiment.
+	Nonce uint64
+	// The cookie from the server's SprayReply, or zero.
+	Cookie uint64
+	// The number of packets the client would like sprayed.
+	Packets uint16
+}
+
+// Type implements Message.
+func (*SprayRequest) Type() MsgType { return MsgSprayRequest }
+
+// SprayReply answers a SprayRequest.
+type SprayReply struct {
+	Nonce  uint64
+	Cookie uint64
+	// The number of packets the server will spray, zero if it refuses
+	// to spray.
+	Packets uint16
+	// The server has started spraying.
+	Started bool
+	// The requester's address, as seen by the server.
+	Mapped *net.UDPAddr
+}
+
+// Type implements Message.
+func (*SprayReply) Type() MsgType { return MsgSprayReply }
+
+// SprayProbe is one of the packets sprayed by the server.
+type SprayProbe struct {
+	Nonce uint64
+	// Sequence number of the packet, starting at 1.
+	Seq uint16
+}
+
+// Type implements Message.
+func (*SprayProbe) Type() MsgType { return MsgSprayProbe }
+
+// RelayRequest asks the server to have its peer servers send a
+// RelayProbe to the sender, from hosts the sender never contacted.
+//
+// As for SprayRequest, the server first answers with a cookie, and
+// only relays requests that carry it.
+type RelayRequest struct {
+	// Random value identifying the experiment.
+	Nonce uint64
+	// The cookie from the server's RelayReply, or zero.
+	Cookie uint64
+}
+
+// Type implements Message.
+func (*RelayRequest) Type() MsgType { return MsgRelayRequest }
+
+// RelayReply answers a RelayRequest.
+type RelayReply struct {
+	Nonce  uint64
+	Cookie uint64
+	// The number of peers the server relays through, zero if it has
+	// no peers.
+	Peers uint16
+	// The request carried the cookie, and was forwarded to the peers.
+	Forwarded bool
+}
+
+// Type implements Message.
+func (*RelayReply) Type() MsgType { return MsgRelayReply }
+
+// RelayForward asks a peer server to send a RelayProbe to Target.
+// Peers only accept it from servers on their allowlist, with a MAC
+// made with the secret that peers share.
+type RelayForward struct {
+	Nonce uint64
+	// The requesting client's address, as seen by the forwarding
+	// server.
+	Target *net.UDPAddr
+	// When the forward was sent, in seconds since the Unix epoch.
+	Time uint64
+	// HMAC-SHA256 of the other fields, truncated to 64 bits.
+	MAC uint64
+}
+
+// Type implements Message.
+func (*RelayForward) Type() MsgType { return MsgRelayForward }
+
+// RelayProbe is the packet a peer server sends to the client.
+type RelayProbe struct {
+	Nonce uint64
+}
+
+// Type implements Message.
+func (*RelayProbe) Type() MsgType { return MsgRelayProbe }
+
+// ForwardRequest asks the server to send a ForwardProbe to Port on
+// the sender's public IP, to check that the port is forwarded to the
+// sender.
+//
+// As for SprayRequest, the server first answers with a cookie, and
+// only sends the probe for requests that carry it.
+type ForwardRequest struct {
+	// Random value identifying the experiment.
+	Nonce uint64
+	// The cookie from the server's ForwardReply, or zero.
+	Cookie uint64
+	// Identifies this request within the experiment.
+	Seq uint16
+	// The public port to send the probe to.
+	Port uint16
+}
+
+// Type implements Message.
+func (*ForwardRequest) Type() MsgType { return MsgForwardRequest }
+
+// ForwardReply answers a ForwardRequest.
+type ForwardReply struct {
+	Nonce  uint64
+	Cookie uint64
+	Seq    uint16
+	// The server is sending the probe. Servers rate limit probes, so
+	// they don't send one for every request.
+	Sent bool
+	// The requester's address, as seen by the server.
+	Mapped *net.UDPAddr
+}
+
+// Type implements Message.
+func (*ForwardReply) Type() MsgType { return MsgForwardReply }
+
+// ForwardProbe is the packet sent to the forwarded port.
+type ForwardProbe struct {
+	Nonce uint64
+	Seq   uint16
+	// The port the server sent the probe from, to detect rewriting
+	// along the way.
+	SourcePort uint16
+}
+
+// Type implements Message.
+func (*ForwardProbe) Type() MsgType { return MsgForwardProbe }
+
+// IsMessage reports whether bs looks like a control message.
+func IsMessage(bs []byte) bool {
+	return len(bs) > len(magic) && bytes.Equal(bs[:len(magic)], magic[:])
+}
+
+// MarshalMessage returns the wire encoding of m.
+func MarshalMessage(m Message) []byte {
+	var b bytes.Buffer
+	b.Write(magic[:])
+	b.WriteByte(byte(m.Type()))
+
+	switch m := m.(type) {
+	case *Rendezvous:
+		writeString(&b, m.Session)
+		writeAddr(&b, m.Local)
+		writeUint64(&b, m.Cookie)
+	case *RendezvousReply:
+		writeString(&b, m.Session)
+		writeUint64(&b, m.Cookie)
+	case *Peer:
+		writeString(&b, m.Session)
+		writeAddr(&b, m.Mapped)
+		writeAddr(&b, m.PeerMapped)
+		writeAddr(&b, m.PeerLocal)
+	case *Punch:
+		writeString(&b, m.Session)
+		writeBool(&b, m.Ack)
+	case *SprayRequest:
+		writeUint64(&b, m.Nonce)
+		writeUint64(&b, m.Cookie)
+		writeUint16(&b, m.Packets)
+	case *SprayReply:
+		writeUint64(&b, m.Nonce)
+		writeUint64(&b, m.Cookie)
+		writeUint16(&b, m.Packets)
+		writeBool(&b, m.Started)
+		writeAddr(&b, m.Mapped)
+	case *SprayProbe:
+		writeUint64(&b, m.Nonce)
+		writeUint16(&b, m.Seq)
+	case *RelayRequest:
+		writeUint64(&b, m.Nonce)
+		writeUint64(&b, m.Cookie)
+	case *RelayReply:
+		writeUint64(&b, m.Nonce)
+		writeUint64(&b, m.Cookie)
+		writeUint16(&b, m.Peers)
+		writeBool(&b, m.Forwarded)
+	case *RelayForward:
+		writeUint64(&b, m.Nonce)
+		writeAddr(&b, m.Target)
+		writeUint64(&b, m.Time)
+		writeUint64(&b, m.MAC)
+	case *RelayProbe:
+		writeUint64(&b, m.Nonce)
+	case *ForwardRequest:
+		writeUint64(&b, m.Nonce)
+		writeUint64(&b, m.Cookie)
+		writeUint16(&b, m.Seq)
+		writeUint16(&b, m.Port)
+	case *ForwardReply:
+		writeUint64(&b, m.Nonce)
+		writeUint64(&b, m.Cookie)
+		writeUint16(&b, m.Seq)
+		writeBool(&b, m.Sent)
+		writeAddr(&b, m.Mapped)
+	case *ForwardProbe:
+		writeUint64(&b, m.Nonce)
+		writeUint16(&b, m.Seq)
+		writeUint16(&b, m.SourcePort)
+	default:
+		panic(fmt.Sprintf("unknown message type %T", m))
+	}
+
+	return b.Bytes()
+}
+
+// ParseMessage decodes a control message.
+func ParseMessage(bs []byte) (Message, error) {
+	if !IsMessage(bs) {
+		return nil, errors.New("not a control message")
+	}
+	r := &reader{b: bs[len(magic)+1:]}
+
+	var ret Message
+	switch MsgType(bs[len(magic)]) {
+	case MsgRendezvous:
+		ret = &Rendezvous{
+			Session: r.string(),
+			Local:   r.addr(),
+			Cookie:  r.uint64(),
+		}
+	case MsgRendezvousReply:
+		ret = &RendezvousReply{
+			Session: r.string(),
+			Cookie:  r.uint64(),
+		}
+	case MsgPeer:
+		ret = &Peer{
+			Session:    r.string(),
+			Mapped:     r.addr(),
+			PeerMapped: r.addr(),
+			PeerLocal:  r.addr(),
+		}
+	case MsgPunch:
+		ret = &Punch{
+			Session: r.string(),
+			Ack:     r.bool(),
+		}
+	case MsgSprayRequest:
+		ret = &SprayRequest{
+			Nonce:   r.uint64(),
+			Cookie:  r.uint64(),
+			Packets: r.uint16(),
+		}
+	case MsgSprayReply:
+		ret = &SprayReply{
+			Nonce:   r.uint64(),
+			Cookie:  r.uint64(),
+			Packets: r.uint16(),
+			Started: r.bool(),
+			Mapped:  r.addr(),
+		}
+	case MsgSprayProbe:
+		ret = &SprayProbe{
+			Nonce: r.uint64(),
+			Seq:   r.uint16(),
+		}
+	case MsgRelayRequest:
+		ret = &RelayRequest{
+			Nonce:  r.uint64(),
+			Cookie: r.uint64(),
+		}
+	case MsgRelayReply:
+		ret = &RelayReply{
+			Nonce:     r.uint64(),
+			Cookie:    r.uint64(),
+			Peers:     r.uint16(),
+			Forwarded: r.bool(),
+		}
+	case MsgRelayForward:
+		ret = &RelayForward{
+			Nonce:  r.uint64(),
+			Target: r.addr(),
+			Time:   r.uint64(),
+			MAC:    r.uint64(),
+		}
+	case MsgRelayProbe:
+		ret = &RelayProbe{
+			Nonce: r.uint64(),
+		}
+	case MsgForwardRequest:
+		ret = &ForwardRequest{
+			Nonce:  r.uint64(),
+			Cookie: r.uint64(),
+			Seq:    r.uint16(),
+			Port:   r.uint16(),
+		}
+	case MsgForwardReply:
+		ret = &ForwardReply{
+			Nonce:  r.uint64(),
+			Cookie: r.uint64(),
+			Seq:    r.uint16(),
+			Sent:   r.bool(),
+			Mapped: r.addr(),
+		}
+	case MsgForwardProbe:
+		ret = &ForwardProbe{
+			Nonce:      r.uint64(),
+			Seq:        r.uint16(),
+			SourcePort: r.uint16(),
+		}
+	default:
+		return nil, fmt.Errorf("unknown message type %d", bs[len(magic)])
+	}
+
+	if r.err != nil {
+		return nil, r.err
+	}
+	return ret, nil
+}
+
+func writeString(b *bytes.Buffer, s string) {
+	if len(s) > MaxSessionLen {
+		s = s[:MaxSessionLen]
+	}
+	b.WriteByte(byte(len(s)))
+	b.WriteString(s)
+}
+
+func writeAddr(b *bytes.Buffer, a *net.UDPAddr) {
+	var buf [18]byte
+	if a != nil {
+		copy(buf[:16], a.IP.To16())
+		binary.BigEndian.PutUint16(buf[16:], uint16(a.Port))
+	}
+	b.Write(buf[:])
+}
+
+func writeBool(b *bytes.Buffer, v bool) {
+	if v {
+		b.WriteByte(1)
+	} else {
+		b.WriteByte(0)
+	}
+}
+
+func writeUint16(b *bytes.Buffer, v uint16) {
+	var buf [2]byte
+	binary.BigEndian.PutUint16(buf[:], v)
+	b.Write(buf[:])
+}
+
+func writeUint64(b *bytes.Buffer, v uint64) {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], v)
+	b.Write(buf[:])
+}
+
+// reader decodes message fields, remembering the first error.
+type reader struct {
+	b   []byte
+	err error
+}
+
+func (r *reader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if len(r.b) < n {
+		r.err = errors.New("truncated control message")
+		return nil
+	}
+	ret := r.b[:n]
+	r.b = r.b[n:]
+	return ret
+}
+
+func (r *reader) string() string {
+	l := r.next(1)
+	if l == nil {
+		return ""
+	}
+	return string(r.next(int(l[0])))
+}
+
+func (r *reader) addr() *net.UDPAddr {
+	bs := r.next(18)
+	if bs == nil {
+		return nil
+	}
+	ip := net.IP(append([]byte(nil), bs[:16]...))
+	port := int(binary.BigEndian.Uint16(bs[16:]))
+	if ip.IsUnspecified() && port == 0 {
+		return nil
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	return &net.UDPAddr{IP: ip, Port: port}
+}
+
+func (r *reader) bool() bool {
+	bs := r.next(1)
+	return bs != nil && bs[0] != 0
+}
+
+func (r *reader) uint16() uint16 {
+	bs := r.next(2)
+	if bs == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint16(bs)
+}
+
+func (r *reader) uint64() uint64 {
+	bs := r.next(8)
+	if bs == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint64(bs)
+}
@@ -0,0 +1,321 @@
+package internal
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// Gateways serve two port mapping protocols on PortMapPort: NAT-PMP
+// (RFC 6886), and its successor PCP (RFC 6887). Packets of both start
+// with a version byte, which tells them apart, then an opcode byte
+// whose top bit marks responses.
+const PortMapPort = 5351
+
+const (
+	NATPMPVersion = 0
+	PCPVersion    = 2
+)
+
+// OpResponse is set in the opcode of responses.
+const OpResponse = 0x80
+
+// NAT-PMP opcodes.
+const (
+	NATPMPOpExternalAddr = 0
+	NATPMPOpMapUDP       = 1
+)
+
+// PCPOpMap is the PCP opcode that requests a mapping.
+const PCPOpMap = 1
+
+// PCPProtoUDP is the protocol number of UDP, as used in PCP mappings.
+const PCPProtoUDP = 17
+
+// Result codes that both protocols share.
+const (
+	PortMapSuccess            = 0
+	PortMapUnsupportedVersion = 1
+	PortMapNotAuthorized      = 2
+)
+
+// NATPMPUnsupportedOpcode is the NAT-PMP result code for unknown
+// opcodes.
+const NATPMPUnsupportedOpcode = 5
+
+// PCP-specific result codes.
+const (
+	PCPUnsupportedOpcode   = 4
+	PCPUnsupportedProtocol = 9
+	// The request's client IP isn't its source IP, i.e. a NAT sits
+	// between the client and the server.
+	PCPAddressMismatch = 12
+)
+
+var (
+	natpmpResults = []string{"SUCCESS", "UNSUPP_VERSION", "NOT_AUTHORIZED", "NETWORK_FAILURE", "NO_RESOURCES", "UNSUPP_OPCODE"}
+	pcpResults    = []string{"SUCCESS", "UNSUPP_VERSION", "NOT_AUTHORIZED", "MALFORMED_REQUEST", "UNSUPP_OPCODE", "UNSUPP_OPTION", "MALFORMED_OPTION", "NETWORK_FAILURE", "NO_RESOURCES", "UNSUPP_PROTOCOL", "USER_EX_QUOTA", "CANNOT_PROVIDE_EXTERNAL", "ADDRESS_MISMATCH", "EXCESSIVE_REMOTE_PEERS"}
+)
+
+// NATPMPResultName returns the name of a NAT-PMP result code.
+func NATPMPResultName(code uint16) string {
+	if int(code) < len(natpmpResults) {
+		return natpmpResults[code]
+	}
+	return fmt.Sprintf("RESULT_%d", code)
+}
+
+// PCPResultName returns the name of a PCP result code.
+func PCPResultName(code byte) string {
+	if int(code) < len(pcpResults) {
+		return pcpResults[code]
+	}
+	return fmt.Sprintf("RESULT_%d", code)
+}
+
+// NATPMPRequest is a NAT-PMP request for the gateway's external
+// address, or for a UDP mapping.
+type NATPMPRequest struct {
+	Op byte
+	// For mapping requests only. A zero Lifetime, in seconds, deletes
+	// the mapping.
+	InternalPort uint16
+	ExternalPort uint16
+	Lifetime     uint32
+}
+
+// NATPMPResponse is a response to a NATPMPRequest.
+type NATPMPResponse struct {
+	// The request's opcode, without OpResponse.
+	Op     byte
+	Result uint16
+	// Seconds since the gateway last lost its mappings.
+	Epoch uint32
+	// For external address responses.
+	ExternalIP net.IP
+	// For mapping responses.
+	InternalPort uint16
+	ExternalPort uint16
+	Lifetime     uint32
+}
+
+// MarshalNATPMPRequest returns the wire encoding of r.
+func MarshalNATPMPRequest(r *NATPMPRequest) []byte {
+	if r.Op == NATPMPOpExternalAddr {
+		return []byte{NATPMPVersion, r.Op}
+	}
+	ret := make([]byte, 12)
+	ret[0], ret[1] = NATPMPVersion, r.Op
+	binary.BigEndian.PutUint16(ret[4:], r.InternalPort)
+	binary.BigEndian.PutUint16(ret[6:], r.ExternalPort)
+	binary.BigEndian.PutUint32(ret[8:], r.Lifetime)
+	return ret
+}
+
+// ParseNATPMPRequest parses a NATPMPRequest.
+func ParseNATPMPRequest(bs []byte) (*NATPMPRequest, error) {
+	if len(bs) < 2 || bs[0] != NATPMPVersion || bs[1]&OpResponse != 0 {
+		return nil, errors.New("not a NAT-PMP request")
+	}
+	ret := &NATPMPRequest{Op: bs[1]}
+	if ret.Op == NATPMPOpExternalAddr {
+		return ret, nil
+	}
+	if len(bs) < 12 {
+		return nil, errors.New("short NAT-PMP mapping request")
+	}
+	ret.InternalPort = binary.BigEndian.Uint16(bs[4:])
+	ret.ExternalPort = binary.BigEndian.Uint16(bs[6:])
+	ret.Lifetime = binary.BigEndian.Uint32(bs[8:])
+	return ret, nil
+}
+
+// MarshalNATPMPResponse returns the wire encoding of r.
+func MarshalNATPMPResponse(r *NATPMPResponse) []byte {
+	ret := make([]byte, 8, 16)
+	ret[0], ret[1] = NATPMPVersion, r.Op|OpResponse
+	binary.BigEndian.PutUint16(ret[2:], r.Result)
+	binary.BigEndian.PutUint32(ret[4:], r.Epoch)
+	switch {
+	case r.Result != PortMapSuccess:
+	case r.Op == NATPMPOpExternalAddr:
+		ret = append(ret, r.ExternalIP.To4()...)
+	default:
+		ret = ret[:16]
+		binary.BigEndian.PutUint16(ret[8:], r.InternalPort)
+		binary.BigEndian.PutUint16(ret[10:], r.ExternalPort)
+		binary.BigEndian.PutUint32(ret[12:], r.Lifetime)
+	}
+	return ret
+}
+
+// ParseNATPMPResponse parses a NATPMPResponse. Error responses may
+// omit the opcode-specific fields.
+func ParseNATPMPResponse(bs []byte) (*NATPMPResponse, error) {
+	if len(bs) < 8 || bs[0] != NATPMPVersion || bs[1]&OpResponse == 0 {
+		return nil, errors.New("not a NAT-PMP response")
+	}
+	ret := &NATPMPResponse{
+		Op:     bs[1] &^ OpResponse,
+		Result: binary.BigEndian.Uint16(bs[2:]),
+		Epoch:  binary.BigEndian.Uint32(bs[4:]),
+	}
+	switch {
+	case ret.Result != PortMapSuccess:
+	case ret.Op == NATPMPOpExternalAddr:
+		if len(bs) < 12 {
+			return nil, errors.New("short NAT-PMP external address response")
+		}
+		ret.ExternalIP = net.IP(append([]byte(nil), bs[8:12]...))
+	default:
+		if len(bs) < 16 {
+			return nil, errors.New("short NAT-PMP mapping response")
+		}
+		ret.InternalPort = binary.BigEndian.Uint16(bs[8:])
+		ret.ExternalPort = binary.BigEndian.Uint16(bs[10:])
+		ret.Lifetime = binary.BigEndian.Uint32(bs[12:])
+	}
+	return ret, nil
+}
+
+// PCPMap is the payload of PCP MAP requests and responses.
+type PCPMap struct {
+	// Chosen by the client, and echoed in the response.
+	Nonce        [12]byte
+	Protocol     byte
+	InternalPort uint16
+	// Suggested in requests, assigned in responses.
+	ExternalPort uint16
+	ExternalIP   net.IP
+}
+
+// PCPRequest is a PCP request.
+type PCPRequest struct {
+	Op byte
+	// In seconds. Zero deletes the mapping.
+	Lifetime uint32
+	// The client's IP, which the server checks against the source of
+	// the request to detect NATs in between.
+	ClientIP net.IP
+	// Set for PCPOpMap.
+	Map *PCPMap
+}
+
+// PCPResponse is a response to a PCPRequest.
+type PCPResponse struct {
+	// The request's opcode, without OpResponse.
+	Op     byte
+	Result byte
+	// In seconds, how long the mapping lasts, or how long an error
+	// is expected to persist.
+	Lifetime uint32
+	// Seconds since the gateway last lost its mappings.
+	Epoch uint32
+	// Set for PCPOpMap, if the server echoed the request's payload.
+	Map *PCPMap
+}
+
+const (
+	pcpHeaderLen = 24
+	pcpMapLen    = 36
+)
+
+// MarshalPCPRequest returns the wire encoding of r.
+func MarshalPCPRequest(r *PCPRequest) []byte {
+	ret := make([]byte, pcpHeaderLen)
+	ret[0], ret[1] = PCPVersion, r.Op
+	binary.BigEndian.PutUint32(ret[4:], r.Lifetime)
+	copy(ret[8:24], pcpIP(r.ClientIP))
+	if r.Map != nil {
+		ret = append(ret, marshalPCPMap(r.Map)...)
+	}
+	return ret
+}
+
+// ParsePCPRequest parses a PCPRequest.
+func ParsePCPRequest(bs []byte) (*PCPRequest, error) {
+	if len(bs) < pcpHeaderLen || bs[0] != PCPVersion || bs[1]&OpResponse != 0 {
+		return nil, errors.New("not a PCP request")
+	}
+	ret := &PCPRequest{
+		Op:       bs[1],
+		Lifetime: binary.BigEndian.Uint32(bs[4:]),
+		ClientIP: parsePCPIP(bs[8:24]),
+	}
+	if ret.Op == PCPOpMap {
+		if len(bs) < pcpHeaderLen+pcpMapLen {
+			return nil, errors.New("short PCP MAP request")
+		}
+		ret.Map = parsePCPMap(bs[pcpHeaderLen:])
+	}
+	return ret, nil
+}
+
+// MarshalPCPResponse returns the wire encoding of r.
+func MarshalPCPResponse(r *PCPResponse) []byte {
+	ret := make([]byte, pcpHeaderLen)
+	ret[0], ret[1] = PCPVersion, r.Op|OpResponse
+	ret[3] = r.Result
+	binary.BigEndian.PutUint32(ret[4:], r.Lifetime)
+	binary.BigEndian.PutUint32(ret[8:], r.Epoch)
+	if r.Map != nil {
+		ret = append(ret, marshalPCPMap(r.Map)...)
+	}
+	return ret
+}
+
+// ParsePCPResponse parses a PCPResponse.
+func ParsePCPResponse(bs []byte) (*PCPResponse, error) {
+	if len(bs) < pcpHeaderLen || bs[0] != PCPVersion || bs[1]&OpResponse == 0 {
+		return nil, errors.New("not a PCP response")
+	}
+	ret := &PCPResponse{
+		Op:       bs[1] &^ OpResponse,
+		Result:   bs[3],
+		Lifetime: binary.BigEndian.Uint32(bs[4:]),
+		Epoch:    binary.BigEndian.Uint32(bs[8:]),
+	}
+	if ret.Op == PCPOpMap && len(bs) >= pcpHeaderLen+pcpMapLen {
+		ret.Map = parsePCPMap(bs[pcpHeaderLen:])
+	}
+	return ret, nil
+}
+
+func marshalPCPMap(m *PCPMap) []byte {
+	ret := make([]byte, pcpMapLen)
+	copy(ret, m.Nonce[:])
+	ret[12] = m.Protocol
+	binary.BigEndian.PutUint16(ret[16:], m.InternalPort)
+	binary.BigEndian.PutUint16(ret[18:], m.ExternalPort)
+	copy(ret[20:], pcpIP(m.ExternalIP))
+	return ret
+}
+
+func parsePCPMap(bs []byte) *PCPMap {
+	ret := &PCPMap{
+		Protocol:     bs[12],
+		InternalPort: binary.BigEndian.Uint16(bs[16:]),
+		ExternalPort: binary.BigEndian.Uint16(bs[18:]),
+		ExternalIP:   parsePCPIP(bs[20:36]),
+	}
+	copy(ret.Nonce[:], bs)
+	return ret
+}
+
+// pcpIP returns the 16-byte form of ip that PCP uses, with IPv4
+// addresses mapped into IPv6.
+func pcpIP(ip net.IP) net.IP {
+	if ip == nil {
+		ip = net.IPv4zero
+	}
+	return ip.To16()
+}
+
+func parsePCPIP(bs []byte) net.IP {
+	ip := net.IP(append([]byte(nil), bs...))
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
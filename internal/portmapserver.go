@@ -0,0 +1,176 @@
+package internal
+
+import (
+	"net"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+// PortMapServer answers NAT-PMP and PCP requests like a gateway's
+// port mapping server would. It grants mappings without forwarding
+// any traffic, so they exist only on paper. It stands in for a real
+// router when testing the gateway probe.
+type PortMapServer struct {
+	// The external IP to report, and to grant mappings on.
+	ExternalIP net.IP
+	// The protocols to support.
+	NATPMP, PCP bool
+	// The longest mapping lifetime to grant.
+	MaxLifetime time.Duration
+	// Offset from the internal port to the external port of granted
+	// mappings.
+	PortOffset int
+	// Refuse all mapping requests with NOT_AUTHORIZED.
+	Refuse bool
+	// Epochs count from Start.
+	Start  time.Time
+	Logger logr.Logger
+}
+
+// Serve answers the requests that arrive on conn, until reading from
+// conn fails.
+func (s *PortMapServer) Serve(conn *net.UDPConn) error {
+	var buf [1100]byte
+	for {
+		n, addr, err := conn.ReadFromUDP(buf[:])
+		if err != nil {
+			return err
+		}
+		resp := s.Handle(addr, buf[:n])
+		if resp == nil {
+			continue
+		}
+		if _, err := conn.WriteToUDP(resp, addr); err != nil {
+			s.Logger.Error(err, "Failed to send response", "remote-addr", addr)
+		}
+	}
+}
+
+// Handle returns the response to pkt, received from addr, or nil if
+// it deserves none.
+func (s *PortMapServer) Handle(addr *net.UDPAddr, pkt []byte) []byte {
+	switch {
+	case len(pkt) < 2 || pkt[1]&OpResponse != 0:
+		s.Logger.Info("Ignoring packet that isn't a request", "remote-addr", addr, "packet-size", len(pkt))
+		return nil
+	case pkt[0] == NATPMPVersion && s.NATPMP:
+		return s.handleNATPMP(addr, pkt)
+	case pkt[0] == PCPVersion && s.PCP:
+		return s.handlePCP(addr, pkt)
+	default:
+		return s.unsupportedVersion(addr, pkt)
+	}
+}
+
+func (s *PortMapServer) epoch() uint32 {
+	return uint32(time.Since(s.Start) / time.Second)
+}
+
+// lifetime returns the lifetime to grant for a requested one.
+func (s *PortMapServer) lifetime(requested uint32) uint32 {
+	max := uint32(s.MaxLifetime / time.Second)
+	if requested > max {
+		return max
+	}
+	return requested
+}
+
+// externalPort returns the external port to map an internal port to.
+func (s *PortMapServer) externalPort(internalPort uint16) uint16 {
+	return uint16(int(internalPort) + s.PortOffset)
+}
+
+func (s *PortMapServer) handleNATPMP(addr *net.UDPAddr, pkt []byte) []byte {
+	req, err := ParseNATPMPRequest(pkt)
+	if err != nil {
+		s.Logger.Info("Ignoring malformed NAT-PMP request", "remote-addr", addr, "err", err.Error())
+		return nil
+	}
+	resp := &NATPMPResponse{Op: req.Op, Epoch: s.epoch()}
+	switch {
+	case req.Op == NATPMPOpExternalAddr:
+		resp.ExternalIP = s.ExternalIP
+		s.Logger.Info("Provided external address over NAT-PMP", "remote-addr", addr)
+	case req.Op != NATPMPOpMapUDP:
+		// TCP mappings are of no use to natprobe.
+		resp.Result = NATPMPUnsupportedOpcode
+		s.Logger.Info("Refused unsupported NAT-PMP opcode", "remote-addr", addr, "op", req.Op)
+	case s.Refuse:
+		resp.Result = PortMapNotAuthorized
+		s.Logger.Info("Refused NAT-PMP mapping", "remote-addr", addr, "internal-port", req.InternalPort)
+	default:
+		resp.InternalPort = req.InternalPort
+		resp.ExternalPort = s.externalPort(req.InternalPort)
+		resp.Lifetime = s.lifetime(req.Lifetime)
+		if req.Lifetime == 0 {
+			resp.ExternalPort = 0
+			s.Logger.Info("Deleted NAT-PMP mapping", "remote-addr", addr, "internal-port", resp.InternalPort)
+			break
+		}
+		s.Logger.Info("Granted NAT-PMP mapping", "remote-addr", addr, "internal-port", resp.InternalPort, "external-port", resp.ExternalPort, "lifetime", resp.Lifetime)
+	}
+	return MarshalNATPMPResponse(resp)
+}
+
+func (s *PortMapServer) handlePCP(addr *net.UDPAddr, pkt []byte) []byte {
+	req, err := ParsePCPRequest(pkt)
+	if err != nil {
+		s.Logger.Info("Ignoring malformed PCP request", "remote-addr", addr, "err", err.Error())
+		return nil
+	}
+	resp := &PCPResponse{Op: req.Op, Epoch: s.epoch(), Map: req.Map}
+	switch {
+	case req.Op != PCPOpMap:
+		// PEER requests are of no use to natprobe.
+		resp.Result = PCPUnsupportedOpcode
+		s.Logger.Info("Refused unsupported PCP opcode", "remote-addr", addr, "op", req.Op)
+	case !req.ClientIP.Equal(addr.IP):
+		// A NAT between the client and this server rewrote the
+		// request's source.
+		resp.Result = PCPAddressMismatch
+		s.Logger.Info("Refused PCP mapping from mismatched address", "remote-addr", addr, "client-ip", req.ClientIP)
+	case req.Map.Protocol != PCPProtoUDP:
+		resp.Result = PCPUnsupportedProtocol
+		s.Logger.Info("Refused PCP mapping for unsupported protocol", "remote-addr", addr, "protocol", req.Map.Protocol)
+	case s.Refuse:
+		resp.Result = PortMapNotAuthorized
+		s.Logger.Info("Refused PCP mapping", "remote-addr", addr, "internal-port", req.Map.InternalPort)
+	default:
+		m := *req.Map
+		m.ExternalIP = s.ExternalIP
+		m.ExternalPort = s.externalPort(m.InternalPort)
+		resp.Map = &m
+		resp.Lifetime = s.lifetime(req.Lifetime)
+		if req.Lifetime == 0 {
+			s.Logger.Info("Deleted PCP mapping", "remote-addr", addr, "internal-port", m.InternalPort)
+			break
+		}
+		s.Logger.Info("Granted PCP mapping", "remote-addr", addr, "internal-port", m.InternalPort, "external-port", m.ExternalPort, "lifetime", resp.Lifetime)
+	}
+	if resp.Result != PortMapSuccess && resp.Lifetime == 0 {
+		// How long the client should wait before asking again.
+		resp.Lifetime = 30
+	}
+	return MarshalPCPResponse(resp)
+}
+
+// unsupportedVersion returns the response to a request in a protocol
+// that the server doesn't support: UNSUPP_VERSION, in the newest
+// version the server does support.
+func (s *PortMapServer) unsupportedVersion(addr *net.UDPAddr, pkt []byte) []byte {
+	s.Logger.Info("Refused unsupported version", "remote-addr", addr, "version", pkt[0])
+	if s.PCP {
+		return MarshalPCPResponse(&PCPResponse{
+			Op:       pkt[1],
+			Result:   PortMapUnsupportedVersion,
+			Lifetime: 30,
+			Epoch:    s.epoch(),
+		})
+	}
+	return MarshalNATPMPResponse(&NATPMPResponse{
+		Op:     pkt[1],
+		Result: PortMapUnsupportedVersion,
+		Epoch:  s.epoch(),
+	})
+}
@@ -0,0 +1,82 @@
+package internal
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+// Mapping probes are ProbeLen bytes long, mostly zeros. The first
+// byte holds flags, and bytes 1-8 a transaction ID if
+// ProbeFlagTxID is set.
+//
+// The server responds with the client's address as it saw it: a
+// 16-byte IP and a 2-byte port, followed by the probe's transaction
+// ID if it had one.
+const (
+	ProbeLen = 180
+
+	// Respond from a different IP than the probe was sent to.
+	ProbeFlagVaryAddr = 1 << 0
+	// Respond from a different port than the probe was sent to.
+	ProbeFlagVaryPort = 1 << 1
+	// The probe has a transaction ID, which the response must echo.
+	ProbeFlagTxID = 1 << 2
+	// Respond from a freshly opened socket with a random port, which
+	// the client can't have sent to.
+	ProbeFlagFreshPort = 1 << 3
+	// Respond from a fresh port on an IP the server doesn't probe on.
+	// Servers without such IPs respond from the probed address
+	// instead.
+	ProbeFlagFreshAddr = 1 << 4
+
+	// Length of responses to probes without a transaction ID.
+	ResponseLen = 18
+	// Length of responses to probes with a transaction ID.
+	ResponseTxIDLen = ResponseLen + 8
+)
+
+// ProbeTxID returns the transaction ID of probe, and whether it has
+// one.
+func ProbeTxID(probe []byte) (uint64, bool) {
+	if len(probe) != ProbeLen || probe[0]&ProbeFlagTxID == 0 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint64(probe[1:9]), true
+}
+
+// SetProbeTxID sets the transaction ID of probe.
+func SetProbeTxID(probe []byte, txid uint64) {
+	probe[0] |= ProbeFlagTxID
+	binary.BigEndian.PutUint64(probe[1:9], txid)
+}
+
+// MarshalResponse returns the response to a probe from addr, echoing
+// txid if hasTxID.
+func MarshalResponse(addr *net.UDPAddr, txid uint64, hasTxID bool) []byte {
+	ret := make([]byte, ResponseLen, ResponseTxIDLen)
+	copy(ret[:16], addr.IP.To16())
+	binary.BigEndian.PutUint16(ret[16:18], uint16(addr.Port))
+	if hasTxID {
+		ret = ret[:ResponseTxIDLen]
+		binary.BigEndian.PutUint64(ret[18:], txid)
+	}
+	return ret
+}
+
+// ParseResponse parses a response to a probe. ok is false if bs isn't
+// a valid response. hasTxID reports whether the response echoes a
+// transaction ID.
+func ParseResponse(bs []byte) (mapped *net.UDPAddr, txid uint64, hasTxID, ok bool) {
+	switch len(bs) {
+	case ResponseLen:
+	case ResponseTxIDLen:
+		txid, hasTxID = binary.BigEndian.Uint64(bs[18:]), true
+	default:
+		return nil, 0, false, false
+	}
+	mapped = &net.UDPAddr{
+		IP:   append(net.IP(nil), bs[:16]...),
+		Port: int(binary.BigEndian.Uint16(bs[16:18])),
+	}
+	return mapped, txid, hasTxID, true
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/go-logr/logr"
+	"go.universe.tf/natprobe/client"
+)
+
+// maxSubmissionSize is the largest submission the collector accepts.
+const maxSubmissionSize = 1 << 20
+
+// collector stores probe results submitted by clients, and serves
+// aggregate statistics about them.
+type collector struct {
+	logger logr.Logger
+
+	mu    sync.Mutex
+	store *os.File
+	stats stats
+}
+
+// newCollector returns a collector that appends submissions to the
+// JSON-lines file at path, after loading the submissions already
+// there.
+func newCollector(path string, logger logr.Logger) (*collector, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	ret := &collector{
+		logger: logger,
+		store:  f,
+	}
+
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, maxSubmissionSize)
+	for line := 1; sc.Scan(); line++ {
+		sub, err := parseSubmission(sc.Bytes())
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("%s:%d: %s", path, line, err)
+		}
+		ret.stats.add(sub)
+	}
+	if err := sc.Err(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	logger.Info("Loaded stored submissions", "path", path, "submissions", ret.stats.Submissions)
+
+	return ret, nil
+}
+
+func (c *collector) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/submit", c.submit)
+	mux.HandleFunc("/stats", c.serveStats)
+	return mux
+}
+
+func (c *collector) submit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "submissions must be POSTed", http.StatusMethodNotAllowed)
+		return
+	}
+	bs, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxSubmissionSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	sub, err := parseSubmission(bs)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if sub.Analysis.NoData {
+		http.Error(w, "submission has no data", http.StatusBadRequest)
+		return
+	}
+
+	// Store the canonical encoding, not whatever the client sent.
+	bs, err = json.Marshal(sub)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, err := c.store.Write(append(bs, '\n')); err != nil {
+		c.logger.Error(err, "Failed to store submission")
+		http.Error(w, "failed to store submission", http.StatusInternalServerError)
+		return
+	}
+	c.stats.add(sub)
+	c.logger.Info("Stored submission", "remote-addr", r.RemoteAddr, "submissions", c.stats.Submissions)
+}
+
+// documentHeader is the header of natprobe's JSON documents.
+type documentHeader struct {
+	SchemaVersion int    `json:"schemaVersion"`
+	Kind          string `json:"kind"`
+}
+
+// checkDocument checks that bs is a kind document, in a schema
+// version that this collector supports.
+func checkDocument(bs []byte, kind string) error {
+	var h documentHeader
+	if err := json.Unmarshal(bs, &h); err != nil {
+		return fmt.Errorf("decoding %s: %s", kind, err)
+	}
+	switch {
+	case h.Kind != kind:
+		return fmt.Errorf("document kind is %q, want %q", h.Kind, kind)
+	case h.SchemaVersion < 1 || h.SchemaVersion > client.SchemaVersion:
+		return fmt.Errorf("%s has schema version %d, want 1 to %d", kind, h.SchemaVersion, client.SchemaVersion)
+	}
+	return nil
+}
+
+// parseSubmission decodes a submission, after checking that it and
+// the result and analysis it carries are documents of the right kind
+// and a supported schema version. On their own, the client's decoders
+// also accept results and analyses in the unversioned legacy format,
+// which any JSON object passes for.
+func parseSubmission(bs []byte) (*client.Submission, error) {
+	if err := checkDocument(bs, "submission"); err != nil {
+		return nil, err
+	}
+	var docs struct {
+		Result   json.RawMessage `json:"result"`
+		Analysis json.RawMessage `json:"analysis"`
+	}
+	if err := json.Unmarshal(bs, &docs); err != nil {
+		return nil, err
+	}
+	if len(docs.Result) == 0 || string(docs.Result) == "null" || len(docs.Analysis) == 0 || string(docs.Analysis) == "null" {
+		return nil, errors.New("submission must have a result and an analysis")
+	}
+	if err := checkDocument(docs.Result, "result"); err != nil {
+		return nil, err
+	}
+	if err := checkDocument(docs.Analysis, "analysis"); err != nil {
+		return nil, err
+	}
+
+	var ret client.Submission
+	if err := json.Unmarshal(bs, &ret); err != nil {
+		return nil, err
+	}
+	return &ret, nil
+}
+
+func (c *collector) serveStats(w http.ResponseWriter, r *http.Request) {
+	c.mu.Lock()
+	bs, err := json.MarshalIndent(c.stats.report(), "", "  ")
+	c.mu.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(bs)
+}
+
+// stats accumulates counters over submissions.
+type stats struct {
+	Submissions int
+	NoNAT       int
+	// Counters by NAT behavior, for submissions behind a NAT.
+	Mapping          map[string]int
+	Filtering        map[string]int
+	PortPreservation int
+	// Counters by filtered port.
+	FilteredEgress map[int]int
+	CGNAT          int
+}
+
+func (s *stats) add(sub *client.Submission) {
+	if s.Mapping == nil {
+		s.Mapping = map[string]int{}
+		s.Filtering = map[string]int{}
+		s.FilteredEgress = map[int]int{}
+	}
+	a := sub.Analysis
+	if a == nil || a.NoData {
+		return
+	}
+
+	s.Submissions++
+	if a.CGNAT || sub.SharedAddressSpace {
+		s.CGNAT++
+	}
+	for _, port := range a.FilteredEgress {
+		s.FilteredEgress[port]++
+	}
+	if a.NoNAT {
+		s.NoNAT++
+		return
+	}
+	s.Mapping[a.MappingBehavior().String()]++
+	s.Filtering[a.FilteringBehavior().String()]++
+	if a.MappingPreservesSourcePort {
+		s.PortPreservation++
+	}
+}
+
+// share is a count out of some total.
+type share struct {
+	Count    int     `json:"count"`
+	Fraction float64 `json:"fraction"`
+}
+
+func newShare(count, total int) share {
+	if total == 0 {
+		return share{}
+	}
+	return share{count, float64(count) / float64(total)}
+}
+
+// statsReport is the JSON form of stats. Fractions of NAT behaviors
+// are relative to the submissions behind a NAT, all other fractions
+// to all submissions.
+type statsReport struct {
+	Submissions       int              `json:"submissions"`
+	NoNAT             share            `json:"noNAT"`
+	MappingBehavior   map[string]share `json:"mappingBehavior"`
+	FilteringBehavior map[string]share `json:"filteringBehavior"`
+	PortPreservation  share            `json:"portPreservation"`
+	FilteredEgress    map[int]share    `json:"filteredEgress"`
+	CGNAT             share            `json:"cgnat"`
+}
+
+func (s *stats) report() *statsReport {
+	natted := s.Submissions - s.NoNAT
+	ret := &statsReport{
+		Submissions:       s.Submissions,
+		NoNAT:             newShare(s.NoNAT, s.Submissions),
+		MappingBehavior:   map[string]share{},
+		FilteringBehavior: map[string]share{},
+		PortPreservation:  newShare(s.PortPreservation, natted),
+		FilteredEgress:    map[int]share{},
+		CGNAT:             newShare(s.CGNAT, s.Submissions),
+	}
+	for b, n := range s.Mapping {
+		ret.MappingBehavior[b] = newShare(n, natted)
+	}
+	for b, n := range s.Filtering {
+		ret.FilteringBehavior[b] = newShare(n, natted)
+	}
+	for port, n := range s.FilteredEgress {
+		ret.FilteredEgress[port] = newShare(n, s.Submissions)
+	}
+	return ret
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	logrtesting "github.com/go-logr/logr/testing"
+	"go.universe.tf/natprobe/client"
+)
+
+// testSubmissions returns submissions from a symmetric NAT with a
+// port-restricted firewall, a full-cone NAT behind CGNAT, no NAT, and
+// no data.
+func testSubmissions() []*client.Submission {
+	return []*client.Submission{
+		{
+			Result: &client.Result{},
+			Analysis: &client.Analysis{
+				MappingVariesByDestIP:      true,
+				MappingVariesByDestPort:    true,
+				FirewallEnforcesDestIP:     true,
+				FirewallEnforcesDestPort:   true,
+				MappingPreservesSourcePort: true,
+				FilteredEgress:             []int{53, 123},
+			},
+		},
+		{
+			Result:             &client.Result{},
+			Analysis:           &client.Analysis{FirewallUntested: true},
+			SharedAddressSpace: true,
+		},
+		{
+			Result:   &client.Result{},
+			Analysis: &client.Analysis{NoNAT: true, FilteredEgress: []int{53}},
+		},
+		{
+			Result:   &client.Result{},
+			Analysis: &client.Analysis{NoData: true},
+		},
+	}
+}
+
+func TestStats(t *testing.T) {
+	var s stats
+	for _, sub := range testSubmissions() {
+		s.add(sub)
+	}
+	got := s.report()
+	want := &statsReport{
+		Submissions: 3,
+		NoNAT:       share{1, 1.0 / 3},
+		MappingBehavior: map[string]share{
+			"address-and-port-dependent": {1, 0.5},
+			"endpoint-independent":       {1, 0.5},
+		},
+		FilteringBehavior: map[string]share{
+			"address-and-port-dependent": {1, 0.5},
+			"unknown":                    {1, 0.5},
+		},
+		PortPreservation: share{1, 0.5},
+		FilteredEgress: map[int]share{
+			53:  {2, 2.0 / 3},
+			123: {1, 1.0 / 3},
+		},
+		CGNAT: share{1, 1.0 / 3},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("stats report is %+v, want %+v", got, want)
+	}
+
+	var empty stats
+	if got := empty.report(); got.Submissions != 0 || got.NoNAT != (share{}) {
+		t.Errorf("empty stats report is %+v, want zero shares", got)
+	}
+}
+
+// tempCollector returns a collector that stores submissions in a
+// temporary directory, and the store's path.
+func tempCollector(t *testing.T) (*collector, string) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "collector")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "submissions.jsonl")
+	c, err := newCollector(path, logrtesting.NullLogger{})
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return c, path
+}
+
+// editJSON returns the JSON encoding of v, after passing it as a
+// generic JSON object through edit.
+func editJSON(t *testing.T, v interface{}, edit func(map[string]interface{})) []byte {
+	t.Helper()
+	bs, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc map[string]interface{}
+	if err := json.Unmarshal(bs, &doc); err != nil {
+		t.Fatal(err)
+	}
+	edit(doc)
+	if bs, err = json.Marshal(doc); err != nil {
+		t.Fatal(err)
+	}
+	return bs
+}
+
+func TestCollectorSubmit(t *testing.T) {
+	c, path := tempCollector(t)
+	defer os.RemoveAll(filepath.Dir(path))
+	defer c.store.Close()
+	srv := httptest.NewServer(c.handler())
+	defer srv.Close()
+
+	sub := testSubmissions()[0]
+	nested := func(field string, edit func(map[string]interface{})) func(map[string]interface{}) {
+		return func(doc map[string]interface{}) {
+			edit(doc[field].(map[string]interface{}))
+		}
+	}
+	tests := []struct {
+		desc       string
+		body       []byte
+		wantStatus int
+	}{
+		{"valid", editJSON(t, sub, func(map[string]interface{}) {}), http.StatusOK},
+		{"not JSON", []byte("submission"), http.StatusBadRequest},
+		{"not a submission", editJSON(t, sub.Analysis, func(map[string]interface{}) {}), http.StatusBadRequest},
+		{"future schema version", editJSON(t, sub, func(doc map[string]interface{}) {
+			doc["schemaVersion"] = client.SchemaVersion + 1
+		}), http.StatusBadRequest},
+		{"no analysis", editJSON(t, sub, func(doc map[string]interface{}) {
+			delete(doc, "analysis")
+		}), http.StatusBadRequest},
+		{"legacy analysis", editJSON(t, sub, func(doc map[string]interface{}) {
+			doc["analysis"] = map[string]interface{}{"NoData": false, "NoNAT": true}
+		}), http.StatusBadRequest},
+		{"unversioned result", editJSON(t, sub, nested("result", func(doc map[string]interface{}) {
+			delete(doc, "schemaVersion")
+		})), http.StatusBadRequest},
+		{"analysis in place of the result", editJSON(t, sub, func(doc map[string]interface{}) {
+			doc["result"] = doc["analysis"]
+		}), http.StatusBadRequest},
+		{"analysis from the future", editJSON(t, sub, nested("analysis", func(doc map[string]interface{}) {
+			doc["schemaVersion"] = client.SchemaVersion + 1
+		})), http.StatusBadRequest},
+		{"no data", editJSON(t, testSubmissions()[3], func(map[string]interface{}) {}), http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		resp, err := http.Post(srv.URL+"/submit", "application/json", bytes.NewReader(test.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != test.wantStatus {
+			t.Errorf("%s: submission got HTTP status %d (%s), want %d", test.desc, resp.StatusCode, bytes.TrimSpace(msg), test.wantStatus)
+		}
+	}
+
+	resp, err := http.Get(srv.URL + "/submit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("GET /submit got HTTP status %d, want %d", resp.StatusCode, http.StatusMethodNotAllowed)
+	}
+
+	// Only the valid submission counts and gets stored.
+	resp, err = http.Get(srv.URL + "/stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var report statsReport
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	if report.Submissions != 1 {
+		t.Errorf("stats report %d submissions, want 1", report.Submissions)
+	}
+	stored, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(stored), "\n"); lines != 1 {
+		t.Errorf("store has %d lines, want 1", lines)
+	}
+}
+
+func TestCollectorReload(t *testing.T) {
+	c, path := tempCollector(t)
+	defer os.RemoveAll(filepath.Dir(path))
+	srv := httptest.NewServer(c.handler())
+	for _, sub := range testSubmissions()[:3] {
+		bs, err := json.Marshal(sub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.Post(srv.URL+"/submit", "application/json", bytes.NewReader(bs))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("submission got HTTP status %d, want %d", resp.StatusCode, http.StatusOK)
+		}
+	}
+	srv.Close()
+	c.store.Close()
+
+	reloaded, err := newCollector(path, logrtesting.NullLogger{})
+	if err != nil {
+		t.Fatalf("reloading collector: %s", err)
+	}
+	if got, want := reloaded.stats.report(), c.stats.report(); !reflect.DeepEqual(got, want) {
+		t.Errorf("reloaded stats are %+v, want %+v", got, want)
+	}
+	reloaded.store.Close()
+
+	// A store with a document that isn't a valid submission fails to
+	// load, pointing at the bad line.
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write(append(editJSON(t, testSubmissions()[0], func(doc map[string]interface{}) {
+		doc["kind"] = "analysis"
+	}), '\n'))
+	f.Close()
+	if c, err := newCollector(path, logrtesting.NullLogger{}); err == nil {
+		c.store.Close()
+		t.Error("collector loaded a store with an invalid submission")
+	} else if !strings.Contains(err.Error(), path+":4:") {
+		t.Errorf("loading a store with an invalid fourth line failed with %q, want it to point at line 4", err)
+	}
+}
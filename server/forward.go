@@ -0,0 +1,68 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"net"
+
+	"go.universe.tf/natprobe/internal"
+)
+
+// forwarder sends packets to ports on clients' public IPs, so that
+// clients can check that their port forwards work.
+type forwarder struct {
+	secret []byte
+	fresh  *freshResponder
+}
+
+func newForwarder(fresh *freshResponder) (*forwarder, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	return &forwarder{
+		secret: secret,
+		fresh:  fresh,
+	}, nil
+}
+
+// cookie returns the cookie that a client at ip must present to get
+// probes sent to its port.
+func (f *forwarder) cookie(ip net.IP, nonce uint64, port uint16) uint64 {
+	mac := hmac.New(sha256.New, f.secret)
+	mac.Write(ip.To16())
+	binary.Write(mac, binary.BigEndian, nonce)
+	binary.Write(mac, binary.BigEndian, port)
+	return binary.BigEndian.Uint64(mac.Sum(nil))
+}
+
+// request handles a ForwardRequest received on conn, and returns the
+// reply to send. With the right cookie, it also has f.fresh send a
+// single probe to the requested port, from a fresh socket on conn's IP
+// so that no mapping the client already has can let it through.
+func (f *forwarder) request(conn *net.UDPConn, addr *net.UDPAddr, req *internal.ForwardRequest) internal.Message {
+	reply := &internal.ForwardReply{
+		Nonce:  req.Nonce,
+		Cookie: f.cookie(addr.IP, req.Nonce, req.Port),
+		Seq:    req.Seq,
+		Mapped: addr,
+	}
+	if req.Cookie != reply.Cookie || req.Port == 0 {
+		return reply
+	}
+
+	// The probe is built after request returns, so it mustn't refer
+	// to req.
+	dest := &net.UDPAddr{IP: addr.IP, Port: int(req.Port)}
+	nonce, seq := req.Nonce, req.Seq
+	reply.Sent = f.fresh.forward(conn.LocalAddr().(*net.UDPAddr).IP, dest, func(local *net.UDPAddr) []byte {
+		return internal.MarshalMessage(&internal.ForwardProbe{
+			Nonce:      nonce,
+			Seq:        seq,
+			SourcePort: uint16(local.Port),
+		})
+	})
+	return reply
+}
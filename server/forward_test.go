@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	logrtesting "github.com/go-logr/logr/testing"
+	"go.universe.tf/natprobe/internal"
+)
+
+// receiveForwardProbe returns the next forward probe that arrives on
+// conn, or nil if none arrives within timeout.
+func receiveForwardProbe(t *testing.T, conn *net.UDPConn, timeout time.Duration) (*internal.ForwardProbe, *net.UDPAddr) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	var buf [1500]byte
+	n, from, err := conn.ReadFromUDP(buf[:])
+	if err != nil {
+		return nil, nil
+	}
+	msg, err := internal.ParseMessage(buf[:n])
+	if err != nil {
+		t.Fatalf("parsing forward probe: %s", err)
+	}
+	probe, ok := msg.(*internal.ForwardProbe)
+	if !ok {
+		t.Fatalf("received %T, want a forward probe", msg)
+	}
+	return probe, from
+}
+
+func TestForwardRequest(t *testing.T) {
+	server := listenLoopback(t)
+	defer server.Close()
+	target := listenLoopback(t)
+	defer target.Close()
+
+	f, err := newForwarder(newFreshResponder(logrtesting.NullLogger{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000}
+	req := &internal.ForwardRequest{
+		Nonce: 42,
+		Port:  uint16(target.LocalAddr().(*net.UDPAddr).Port),
+	}
+	request := func(seq uint16, cookie uint64) *internal.ForwardReply {
+		req.Seq, req.Cookie = seq, cookie
+		return f.request(server, client, req).(*internal.ForwardReply)
+	}
+
+	// Without a cookie, the server only hands one out.
+	reply := request(1, 0)
+	if reply.Sent {
+		t.Fatal("server sent a forward probe without a cookie")
+	}
+	cookie := reply.Cookie
+	if reply := request(1, cookie+1); reply.Sent {
+		t.Fatal("server sent a forward probe for a wrong cookie")
+	}
+	if probe, _ := receiveForwardProbe(t, target, 100*time.Millisecond); probe != nil {
+		t.Fatalf("forward probe %d arrived without a valid cookie", probe.Seq)
+	}
+
+	if reply := request(2, cookie); !reply.Sent {
+		t.Fatal("server didn't send a forward probe for a valid cookie")
+	}
+	probe, from := receiveForwardProbe(t, target, time.Second)
+	if probe == nil {
+		t.Fatal("forward probe didn't arrive")
+	}
+	if probe.Nonce != req.Nonce || probe.Seq != 2 {
+		t.Errorf("forward probe has nonce %d, seq %d, want %d, 2", probe.Nonce, probe.Seq, req.Nonce)
+	}
+	if from.Port == server.LocalAddr().(*net.UDPAddr).Port || int(probe.SourcePort) != from.Port {
+		t.Errorf("forward probe claims source port %d, came from %s, want a fresh port", probe.SourcePort, from)
+	}
+
+	// Requests within freshCooldown are dropped.
+	if reply := request(3, cookie); reply.Sent {
+		t.Error("server sent a second forward probe within freshCooldown")
+	}
+	if probe, _ := receiveForwardProbe(t, target, 100*time.Millisecond); probe != nil {
+		t.Errorf("forward probe %d arrived within freshCooldown", probe.Seq)
+	}
+
+	// As are requests while too many fresh sockets are open.
+	time.Sleep(freshCooldown)
+	f.fresh.mu.Lock()
+	f.fresh.active = maxActiveFresh
+	f.fresh.mu.Unlock()
+	if reply := request(4, cookie); reply.Sent {
+		t.Error("server sent a forward probe with maxActiveFresh responses in progress")
+	}
+	f.fresh.mu.Lock()
+	f.fresh.active = 0
+	f.fresh.mu.Unlock()
+
+	if reply := request(5, cookie); !reply.Sent {
+		t.Fatal("server didn't send a forward probe after freshCooldown")
+	}
+	if probe, _ := receiveForwardProbe(t, target, time.Second); probe == nil || probe.Seq != 5 {
+		t.Errorf("got forward probe %+v after freshCooldown, want seq 5", probe)
+	}
+}
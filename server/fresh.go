@@ -0,0 +1,110 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+const (
+	// How long a client IP must wait between two fresh responses to
+	// the same kind of probe. Clients send these probes a few times a
+	// second at most, faster ones are flooding the server with socket
+	// openings.
+	freshCooldown = 250 * time.Millisecond
+	// Maximum number of fresh responses being sent at once.
+	maxActiveFresh = 32
+)
+
+// freshResponder sends packets from newly opened sockets, off the read
+// loops: responses to firewall probes that ask for a response from a
+// source the client never sent to, and port forward probes.
+type freshResponder struct {
+	logger logr.Logger
+
+	mu     sync.Mutex
+	active int
+	// Most recent fresh packet for each client IP and kind of packet.
+	recent map[freshKey]time.Time
+	pruned time.Time
+}
+
+type freshKey struct {
+	ip string
+	// The flags of the probe being responded to.
+	flags byte
+	// The packet is a port forward probe, not a probe response.
+	forward bool
+}
+
+func newFreshResponder(logger logr.Logger) *freshResponder {
+	return &freshResponder{
+		logger: logger,
+		recent: map[freshKey]time.Time{},
+	}
+}
+
+// respond sends resp to addr from a newly opened socket on ip, in the
+// background. flags are those of the probe being responded to. The
+// response is dropped if addr's IP got a response to the same kind of
+// probe less than freshCooldown ago, or if too many responses are in
+// progress.
+func (f *freshResponder) respond(ip net.IP, addr *net.UDPAddr, flags byte, resp []byte) {
+	f.start(freshKey{ip: addr.IP.String(), flags: flags}, ip, addr, func(*net.UDPAddr) []byte { return resp })
+}
+
+// forward sends the packet that build returns to addr from a newly
+// opened socket on ip, in the background. build gets the socket's
+// address. Like responses, forward probes are subject to
+// freshCooldown and maxActiveFresh. Returns whether the probe is
+// being sent.
+func (f *freshResponder) forward(ip net.IP, addr *net.UDPAddr, build func(local *net.UDPAddr) []byte) bool {
+	return f.start(freshKey{ip: addr.IP.String(), forward: true}, ip, addr, build)
+}
+
+func (f *freshResponder) start(key freshKey, ip net.IP, addr *net.UDPAddr, build func(*net.UDPAddr) []byte) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(f.recent[key]) < freshCooldown {
+		return false
+	}
+	if f.active >= maxActiveFresh {
+		f.logger.Info("Too many fresh responses in progress, dropping one", "remote-addr", addr)
+		return false
+	}
+
+	if now.Sub(f.pruned) >= freshCooldown {
+		for k, t := range f.recent {
+			if now.Sub(t) >= freshCooldown {
+				delete(f.recent, k)
+			}
+		}
+		f.pruned = now
+	}
+	f.recent[key] = now
+	f.active++
+	go f.send(ip, addr, build)
+	return true
+}
+
+func (f *freshResponder) send(ip net.IP, addr *net.UDPAddr, build func(*net.UDPAddr) []byte) {
+	defer func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.active--
+	}()
+
+	fresh, err := net.ListenUDP("udp4", &net.UDPAddr{IP: ip})
+	if err != nil {
+		f.logger.Error(err, "Failed to open fresh socket", "local-ip", ip)
+		return
+	}
+	defer fresh.Close()
+	if _, err := fresh.WriteToUDP(build(fresh.LocalAddr().(*net.UDPAddr)), addr); err != nil {
+		f.logger.Error(err, "Failed to send response", "local-addr", fresh.LocalAddr(), "remote-addr", addr)
+	}
+}
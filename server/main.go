@@ -1,11 +1,14 @@
 package main
 
 import (
-	"encoding/binary"
+	"bytes"
 	"errors"
 	"flag"
 	"fmt"
+	"io/ioutil"
+	"math/rand"
 	"net"
+	"net/http"
 	"os"
 	"strconv"
 	"strings"
@@ -15,7 +18,16 @@ import (
 )
 
 var (
-	ports = flag.String("ports", "", "UDP listener ports")
+	ports    = flag.String("ports", "", "UDP listener ports")
+	ips      = flag.String("ips", "", "IPs to listen on, instead of all public IPs (e.g. loopback IPs for local testing)")
+	freshIPs = flag.String("fresh-ips", "", "IPs that the server doesn't listen on, to respond from when clients ask for a response from an IP they never sent to")
+	peers    = flag.String("peers", "", "comma-separated ip:ports of peer servers, which relay third-party probes for this server's clients and vice versa (servers relay from their first listening IP and port)")
+	sprayMax = flag.Int("spray-max", 0, "maximum number of packets to spray for the birthday spraying experiment, 0 disables spraying")
+
+	peerSecretFile = flag.String("peer-secret-file", "", "file holding the secret shared with all peer servers, which authenticates relay forwards between them (required with -peers)")
+
+	collectorAddr = flag.String("collector", "", "TCP address to serve the result collector's HTTP API on (e.g. :8080), empty disables the collector")
+	collectorDB   = flag.String("collector-db", "submissions.jsonl", "file in which the collector stores submitted results")
 )
 
 func main() {
@@ -32,7 +44,12 @@ func main() {
 }
 
 func newServer(logger logr.Logger) (*server, error) {
-	ips, err := publicIPs()
+	fresh, err := parseFreshIPs()
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse fresh IPs: %s", err)
+	}
+
+	ips, err := listenIPs(fresh)
 	if err != nil {
 		return nil, fmt.Errorf("failed to enumerate local public IPs: %s", err)
 	}
@@ -45,8 +62,61 @@ func newServer(logger logr.Logger) (*server, error) {
 		return nil, fmt.Errorf("failed to parse listening ports: %s", err)
 	}
 
+	peerAddrs, err := parsePeers(*peers)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse peers: %s", err)
+	}
+
+	sprayer, err := newSprayer(*sprayMax, logger)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize sprayer: %s", err)
+	}
+
+	var peerSecret []byte
+	if *peerSecretFile != "" {
+		bs, err := ioutil.ReadFile(*peerSecretFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read peer secret: %s", err)
+		}
+		peerSecret = bytes.TrimSpace(bs)
+	}
+
+	relay, err := newRelay(peerAddrs, peerSecret, logger)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize relay: %s", err)
+	}
+
+	rendezvous, err := newRendezvous()
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize rendezvous: %s", err)
+	}
+
+	freshResponder := newFreshResponder(logger)
+	forwarder, err := newForwarder(freshResponder)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize forwarder: %s", err)
+	}
+
 	ret := &server{
-		logger: logger,
+		logger:     logger,
+		freshIPs:   fresh,
+		fresh:      freshResponder,
+		rendezvous: rendezvous,
+		sprayer:    sprayer,
+		relay:      relay,
+		forwarder:  forwarder,
+	}
+
+	if *collectorAddr != "" {
+		ret.collector, err = newCollector(*collectorDB, logger)
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize collector: %s", err)
+		}
+		ret.collectorListener, err = net.Listen("tcp", *collectorAddr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to listen on %s: %s", *collectorAddr, err)
+		}
+		logger.Info("Created collector listener", "local-addr", ret.collectorListener.Addr().String())
 	}
 
 	for _, ip := range ips {
@@ -65,14 +135,32 @@ func newServer(logger logr.Logger) (*server, error) {
 }
 
 type server struct {
-	conns  []*net.UDPConn
-	logger logr.Logger
+	conns      []*net.UDPConn
+	logger     logr.Logger
+	rendezvous *rendezvous
+	sprayer    *sprayer
+	relay      *relay
+	forwarder  *forwarder
+
+	// IPs to respond from to probes with ProbeFlagFreshAddr.
+	freshIPs []net.IP
+	fresh    *freshResponder
+
+	collector         *collector
+	collectorListener net.Listener
 }
 
 func (s *server) run() {
 	for _, conn := range s.conns {
 		go s.handle(conn)
 	}
+	if s.collector != nil {
+		go func() {
+			err := http.Serve(s.collectorListener, s.collector.handler())
+			s.logger.Error(err, "Collector stopped serving")
+			os.Exit(1)
+		}()
+	}
 	s.logger.Info("Startup complete")
 	select {}
 }
@@ -83,36 +171,176 @@ func (s *server) handle(conn *net.UDPConn) error {
 		n, addr, err := conn.ReadFromUDP(buf[:])
 		if err != nil {
 			s.logger.Error(err, "Error reading from socket", "local-addr", conn.LocalAddr())
+			continue
+		}
+		s.handlePacket(conn, addr, buf[:n])
+	}
+}
+
+// handlePacket handles pkt, received on conn from addr: a control
+// message, or a probe to respond to.
+func (s *server) handlePacket(conn *net.UDPConn, addr *net.UDPAddr, pkt []byte) {
+	if internal.IsMessage(pkt) {
+		s.handleMessage(conn, addr, pkt)
+		return
+	}
+	if len(pkt) != internal.ProbeLen {
+		s.logger.Info("Ignoring packet of unexpected length", "local-addr", conn.LocalAddr(), "remote-addr", addr, "packet-size", len(pkt))
+		return
+	}
+
+	varyAddr, varyPort := pkt[0]&internal.ProbeFlagVaryAddr != 0, pkt[0]&internal.ProbeFlagVaryPort != 0
+	txid, hasTxID := internal.ProbeTxID(pkt)
+	resp := internal.MarshalResponse(addr, txid, hasTxID)
+	if pkt[0]&(internal.ProbeFlagFreshPort|internal.ProbeFlagFreshAddr) != 0 {
+		s.respondFresh(conn, addr, pkt[0], resp)
+		return
+	}
+	respConn := s.responseConn(conn, varyAddr, varyPort)
+	if respConn == nil {
+		// Only happens if the server was started with a single
+		// port.
+		s.logger.Info("No socket to respond from", "local-addr", conn.LocalAddr(), "remote-addr", addr, "vary-addr", varyAddr, "vary-port", varyPort)
+		return
+	}
+
+	if _, err := respConn.WriteToUDP(resp, addr); err != nil {
+		s.logger.Error(err, "Failed to send response", "remote-addr", addr)
+		return
+	}
+
+	s.logger.Info("Provided NAT mapping", "local-addr", respConn.LocalAddr(), "remote-addr", addr, "vary-addr", varyAddr, "vary-port", varyPort)
+}
+
+// responseConn returns the socket to respond from to a probe received
+// on conn, or nil if there's no socket with the requested IP and port
+// variation.
+func (s *server) responseConn(conn *net.UDPConn, varyAddr, varyPort bool) *net.UDPConn {
+	myaddr := conn.LocalAddr().(*net.UDPAddr)
+	for _, c := range s.conns {
+		uaddr := c.LocalAddr().(*net.UDPAddr)
+		if uaddr.IP.Equal(myaddr.IP) == varyAddr {
+			continue
 		}
-		if n != 180 {
-			s.logger.Info("Ignoring packet of unexpected length", "local-addr", conn.LocalAddr(), "remote-addr", addr, "packet-size", n)
+		if (uaddr.Port == myaddr.Port) == varyPort {
 			continue
 		}
+		return c
+	}
+	return nil
+}
 
-		varyAddr, varyPort := buf[0]&1 != 0, buf[0]&2 != 0
-		var respConn *net.UDPConn
-		for _, c := range s.conns {
-			myaddr := conn.LocalAddr().(*net.UDPAddr)
-			uaddr := c.LocalAddr().(*net.UDPAddr)
-			if uaddr.IP.Equal(myaddr.IP) == varyAddr {
-				continue
-			}
-			if (uaddr.Port == myaddr.Port) == varyPort {
-				continue
+// respondFresh sends resp to addr from a newly opened socket with a
+// random port, for a probe with flags. The socket is on one of the
+// fresh IPs if the probe asks for a fresh address, on a different
+// listening IP than conn's if it asks for a different address, and on
+// conn's IP otherwise. Without fresh IPs, a fresh address response
+// comes from conn instead, which tells the client that the request
+// can't be honored.
+func (s *server) respondFresh(conn *net.UDPConn, addr *net.UDPAddr, flags byte, resp []byte) {
+	ip := conn.LocalAddr().(*net.UDPAddr).IP
+	switch {
+	case flags&internal.ProbeFlagFreshAddr != 0 && len(s.freshIPs) == 0:
+		if _, err := conn.WriteToUDP(resp, addr); err != nil {
+			s.logger.Error(err, "Failed to send response", "remote-addr", addr)
+		}
+		return
+	case flags&internal.ProbeFlagFreshAddr != 0:
+		ip = s.freshIPs[rand.Intn(len(s.freshIPs))]
+	case flags&internal.ProbeFlagVaryAddr != 0:
+		if c := s.responseConn(conn, true, false); c != nil {
+			ip = c.LocalAddr().(*net.UDPAddr).IP
+		}
+	}
+	s.fresh.respond(ip, addr, flags, resp)
+}
+
+func (s *server) handleMessage(conn *net.UDPConn, addr *net.UDPAddr, pkt []byte) {
+	msg, err := internal.ParseMessage(pkt)
+	if err != nil {
+		s.logger.Info("Ignoring malformed control message", "local-addr", conn.LocalAddr(), "remote-addr", addr, "err", err.Error())
+		return
+	}
+
+	var out []outbound
+	switch m := msg.(type) {
+	case *internal.Rendezvous:
+		out = s.rendezvous.join(conn, copyUDPAddr(addr), m)
+		// Pairing sends a Peer to both clients.
+		s.logger.Info("Rendezvous request", "local-addr", conn.LocalAddr(), "remote-addr", addr, "paired", len(out) == 2)
+	case *internal.SprayRequest:
+		reply := s.sprayer.request(conn, copyUDPAddr(addr), m)
+		out = []outbound{{conn, addr, reply}}
+	case *internal.RelayRequest:
+		out = s.relay.request(conn, s.conns[0], copyUDPAddr(addr), m)
+	case *internal.RelayForward:
+		out = s.relay.forward(conn, addr, m)
+	case *internal.ForwardRequest:
+		reply := s.forwarder.request(conn, copyUDPAddr(addr), m)
+		out = []outbound{{conn, addr, reply}}
+	default:
+		s.logger.Info("Ignoring unexpected control message", "local-addr", conn.LocalAddr(), "remote-addr", addr, "type", msg.Type())
+	}
+
+	for _, o := range out {
+		if _, err := o.conn.WriteToUDP(internal.MarshalMessage(o.msg), o.to); err != nil {
+			s.logger.Error(err, "Failed to send control message", "remote-addr", o.to)
+		}
+	}
+}
+
+func copyUDPAddr(a *net.UDPAddr) *net.UDPAddr {
+	return &net.UDPAddr{
+		IP:   append(net.IP(nil), a.IP...),
+		Port: a.Port,
+	}
+}
+
+// listenIPs returns the IPs to listen on. They exclude fresh, since
+// clients mustn't be able to send to fresh IPs.
+func listenIPs(fresh []net.IP) ([]net.IP, error) {
+	if *ips == "" {
+		all, err := publicIPs()
+		if err != nil {
+			return nil, err
+		}
+		var ret []net.IP
+		for _, ip := range all {
+			if !containsIP(fresh, ip) {
+				ret = append(ret, ip)
 			}
-			respConn = c
-			break
 		}
+		return ret, nil
+	}
 
-		copy(buf[:16], addr.IP.To16())
-		binary.BigEndian.PutUint16(buf[16:18], uint16(addr.Port))
-		if _, err = respConn.WriteToUDP(buf[:18], addr); err != nil {
-			s.logger.Error(err, "Failed to send response", "remote-addr", addr)
-			continue
+	var ret []net.IP
+	for _, s := range strings.Split(*ips, ",") {
+		ip := net.ParseIP(s).To4()
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IPv4 address %q", s)
+		}
+		if containsIP(fresh, ip) {
+			return nil, fmt.Errorf("%s is also a fresh IP", ip)
 		}
+		ret = append(ret, ip)
+	}
+	return ret, nil
+}
+
+func parseFreshIPs() ([]net.IP, error) {
+	if *freshIPs == "" {
+		return nil, nil
+	}
 
-		s.logger.Info("Provided NAT mapping", "local-addr", respConn.LocalAddr(), "remote-addr", addr, "vary-addr", varyAddr, "vary-port", varyPort)
+	var ret []net.IP
+	for _, s := range strings.Split(*freshIPs, ",") {
+		ip := net.ParseIP(s).To4()
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IPv4 address %q", s)
+		}
+		ret = append(ret, ip)
 	}
+	return ret, nil
 }
 
 func publicIPs() ([]net.IP, error) {
@@ -156,6 +384,15 @@ func parsePorts() ([]int, error) {
 	return ret, nil
 }
 
+func containsIP(ips []net.IP, ip net.IP) bool {
+	for _, i := range ips {
+		if i.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
 func isrfc1918(ip net.IP) bool {
 	ip = ip.To4()
 	return ip[0] == 10 ||
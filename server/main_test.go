@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func listenLoopback(t *testing.T) *net.UDPConn {
+	t.Helper()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+// serve has s handle the packets that arrive on a socket on
+// 127.0.0.1, until the returned socket is closed.
+func serve(t *testing.T, s *server) *net.UDPConn {
+	t.Helper()
+	conn := listenLoopback(t)
+	s.conns = append(s.conns, conn)
+	go func() {
+		var buf [1500]byte
+		for {
+			n, addr, err := conn.ReadFromUDP(buf[:])
+			if err != nil {
+				return
+			}
+			s.handlePacket(conn, addr, buf[:n])
+		}
+	}()
+	return conn
+}
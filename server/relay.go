@@ -0,0 +1,147 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	"go.universe.tf/natprobe/internal"
+)
+
+// How old a relay forward can be when it arrives. Peers' clocks must
+// agree to within this.
+const maxForwardAge = 30 * time.Second
+
+// relay has peer servers send packets to clients that ask for it, so
+// that clients can test whether their firewall lets in packets from
+// hosts they never contacted.
+//
+// Peers are an allowlist both ways: the server only forwards requests
+// to its peers, and only honors forwards that come from a peer's IP
+// and carry a MAC made with the secret that peers share, since source
+// IPs are easy to spoof. Forwards go out from the server's first
+// socket, so that a peer only needs to know one address for it.
+type relay struct {
+	peers      []*net.UDPAddr
+	peerSecret []byte
+	secret     []byte
+	logger     logr.Logger
+}
+
+func newRelay(peers []*net.UDPAddr, peerSecret []byte, logger logr.Logger) (*relay, error) {
+	if len(peers) > 0 && len(peerSecret) < 16 {
+		return nil, errors.New("relaying to peers requires a peer secret of at least 16 bytes")
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	return &relay{
+		peers:      peers,
+		peerSecret: peerSecret,
+		secret:     secret,
+		logger:     logger,
+	}, nil
+}
+
+// cookie returns the cookie that a client at ip must present to get
+// probes relayed to it. Without it, spoofed requests would turn every
+// peer into a reflector.
+func (r *relay) cookie(ip net.IP, nonce uint64) uint64 {
+	mac := hmac.New(sha256.New, r.secret)
+	mac.Write(ip.To16())
+	binary.Write(mac, binary.BigEndian, nonce)
+	return binary.BigEndian.Uint64(mac.Sum(nil))
+}
+
+// mac returns the MAC that authenticates fwd between peers.
+func (r *relay) mac(fwd *internal.RelayForward) uint64 {
+	mac := hmac.New(sha256.New, r.peerSecret)
+	binary.Write(mac, binary.BigEndian, fwd.Nonce)
+	if fwd.Target != nil {
+		mac.Write(fwd.Target.IP.To16())
+		binary.Write(mac, binary.BigEndian, uint16(fwd.Target.Port))
+	}
+	binary.Write(mac, binary.BigEndian, fwd.Time)
+	return binary.BigEndian.Uint64(mac.Sum(nil))
+}
+
+// request handles a RelayRequest from addr received on conn, and
+// returns the messages to send: with the right cookie, forwards to the
+// peers from fwdConn, and in any case the reply to addr.
+func (r *relay) request(conn, fwdConn *net.UDPConn, addr *net.UDPAddr, req *internal.RelayRequest) []outbound {
+	reply := &internal.RelayReply{
+		Nonce:  req.Nonce,
+		Cookie: r.cookie(addr.IP, req.Nonce),
+		Peers:  uint16(len(r.peers)),
+	}
+	var ret []outbound
+	if req.Cookie == reply.Cookie && len(r.peers) > 0 {
+		fwd := &internal.RelayForward{
+			Nonce:  req.Nonce,
+			Target: addr,
+			Time:   uint64(time.Now().Unix()),
+		}
+		fwd.MAC = r.mac(fwd)
+		for _, peer := range r.peers {
+			ret = append(ret, outbound{fwdConn, peer, fwd})
+		}
+		reply.Forwarded = true
+	}
+	return append(ret, outbound{conn, addr, reply})
+}
+
+// forward handles a RelayForward from addr received on conn, and
+// returns the probe to send, if addr is a peer and fwd is authentic
+// and recent.
+func (r *relay) forward(conn *net.UDPConn, addr *net.UDPAddr, fwd *internal.RelayForward) []outbound {
+	if !r.isPeer(addr.IP) {
+		r.logger.Info("Ignoring relay forward from non-peer", "local-addr", conn.LocalAddr(), "remote-addr", addr)
+		return nil
+	}
+	if fwd.MAC != r.mac(fwd) {
+		r.logger.Info("Ignoring relay forward with invalid MAC", "local-addr", conn.LocalAddr(), "remote-addr", addr)
+		return nil
+	}
+	if age := time.Since(time.Unix(int64(fwd.Time), 0)); age > maxForwardAge || age < -maxForwardAge {
+		r.logger.Info("Ignoring stale relay forward", "local-addr", conn.LocalAddr(), "remote-addr", addr, "age", age.String())
+		return nil
+	}
+	if fwd.Target == nil {
+		return nil
+	}
+	return []outbound{{conn, fwd.Target, &internal.RelayProbe{Nonce: fwd.Nonce}}}
+}
+
+func (r *relay) isPeer(ip net.IP) bool {
+	for _, peer := range r.peers {
+		if peer.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parsePeers parses a comma-separated list of peer ip:ports.
+func parsePeers(s string) ([]*net.UDPAddr, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	var ret []*net.UDPAddr
+	for _, p := range strings.Split(s, ",") {
+		addr, err := net.ResolveUDPAddr("udp4", p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid peer %q: %s", p, err)
+		}
+		ret = append(ret, addr)
+	}
+	return ret, nil
+}
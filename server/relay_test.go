@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	logrtesting "github.com/go-logr/logr/testing"
+	"go.universe.tf/natprobe/internal"
+)
+
+func TestRelayForward(t *testing.T) {
+	conn := listenLoopback(t)
+	defer conn.Close()
+
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	serverA := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 3478}
+	serverB := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 3478}
+	a, err := newRelay([]*net.UDPAddr{serverB}, secret, logrtesting.NullLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := newRelay([]*net.UDPAddr{serverA}, secret, logrtesting.NullLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := newRelay([]*net.UDPAddr{serverB}, []byte("another secret, not b's"), logrtesting.NullLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	target := &net.UDPAddr{IP: net.IPv4(198, 51, 100, 7), Port: 6000}
+	// forwardFrom returns the RelayForward that r sends to its peers
+	// when target asks for a relay.
+	forwardFrom := func(r *relay) *internal.RelayForward {
+		req := &internal.RelayRequest{Nonce: 42}
+		out := r.request(conn, conn, target, req)
+		req.Cookie = out[len(out)-1].msg.(*internal.RelayReply).Cookie
+		for _, o := range r.request(conn, conn, target, req) {
+			if fwd, ok := o.msg.(*internal.RelayForward); ok {
+				return fwd
+			}
+		}
+		t.Fatal("relay request with a valid cookie wasn't forwarded")
+		return nil
+	}
+	genuine := forwardFrom(a)
+	retargeted := *genuine
+	retargeted.Target = &net.UDPAddr{IP: net.IPv4(203, 0, 113, 50), Port: 53}
+	stale := &internal.RelayForward{Nonce: 42, Target: target, Time: uint64(time.Now().Add(-time.Minute).Unix())}
+	stale.MAC = a.mac(stale)
+
+	tests := []struct {
+		desc string
+		from *net.UDPAddr
+		fwd  *internal.RelayForward
+		want bool
+	}{
+		{"genuine", serverA, genuine, true},
+		{"not from a peer", &net.UDPAddr{IP: net.IPv4(203, 0, 113, 9), Port: 3478}, genuine, false},
+		{"forged without MAC", serverA, &internal.RelayForward{Nonce: 42, Target: target, Time: uint64(time.Now().Unix())}, false},
+		{"retargeted", serverA, &retargeted, false},
+		{"wrong secret", serverA, forwardFrom(other), false},
+		{"stale", serverA, stale, false},
+	}
+	for _, test := range tests {
+		out := b.forward(conn, test.from, test.fwd)
+		if !test.want {
+			if len(out) != 0 {
+				t.Errorf("%s: peer sent %v, want nothing", test.desc, out)
+			}
+			continue
+		}
+		if len(out) != 1 || out[0].to.String() != target.String() {
+			t.Errorf("%s: peer sent %v, want a RelayProbe to %s", test.desc, out, target)
+		}
+	}
+}
+
+func TestRelayRequiresPeerSecret(t *testing.T) {
+	peers := []*net.UDPAddr{{IP: net.IPv4(192, 0, 2, 2), Port: 3478}}
+	if _, err := newRelay(peers, nil, logrtesting.NullLogger{}); err == nil {
+		t.Error("newRelay accepted peers without a peer secret")
+	}
+	if _, err := newRelay(nil, nil, logrtesting.NullLogger{}); err != nil {
+		t.Errorf("newRelay without peers: %s", err)
+	}
+}
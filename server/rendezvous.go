@@ -0,0 +1,134 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+
+	"go.universe.tf/natprobe/internal"
+)
+
+const (
+	// How long a rendezvous session stays around after it's created.
+	sessionLifetime = 2 * time.Minute
+	// Maximum number of concurrent rendezvous sessions.
+	maxSessions = 10000
+)
+
+// rendezvous pairs up clients that present the same session code, so
+// that they can attempt hole punching to each other.
+type rendezvous struct {
+	secret []byte
+
+	mu       sync.Mutex
+	sessions map[string]*session
+}
+
+type session struct {
+	created time.Time
+	clients []*sessionClient
+}
+
+type sessionClient struct {
+	// The server socket the client talks to.
+	conn   *net.UDPConn
+	mapped *net.UDPAddr
+	local  *net.UDPAddr
+}
+
+// outbound is a message that the server needs to send.
+type outbound struct {
+	conn *net.UDPConn
+	to   *net.UDPAddr
+	msg  internal.Message
+}
+
+func newRendezvous() (*rendezvous, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	return &rendezvous{
+		secret:   secret,
+		sessions: map[string]*session{},
+	}, nil
+}
+
+// cookie returns the cookie that a client at mapped must present to
+// join the named session. Requiring it stops spoofed requests from
+// filling sessions with addresses that never asked to join.
+func (r *rendezvous) cookie(mapped *net.UDPAddr, code string) uint64 {
+	mac := hmac.New(sha256.New, r.secret)
+	mac.Write(mapped.IP.To16())
+	binary.Write(mac, binary.BigEndian, uint16(mapped.Port))
+	mac.Write([]byte(code))
+	return binary.BigEndian.Uint64(mac.Sum(nil))
+}
+
+// join handles a Rendezvous from mapped received on conn. Without the
+// right cookie, it returns a RendezvousReply carrying it. Otherwise,
+// it adds the client to the requested session, and returns the Peer
+// messages to send if the session is complete. Clients retransmit
+// their join requests until they get a Peer, so join is idempotent.
+func (r *rendezvous) join(conn *net.UDPConn, mapped *net.UDPAddr, req *internal.Rendezvous) []outbound {
+	code, local := req.Session, req.Local
+	if cookie := r.cookie(mapped, code); req.Cookie != cookie {
+		return []outbound{{conn, mapped, &internal.RendezvousReply{Session: code, Cookie: cookie}}}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	s := r.sessions[code]
+	if s != nil && now.Sub(s.created) > sessionLifetime {
+		delete(r.sessions, code)
+		s = nil
+	}
+	if s == nil {
+		if len(r.sessions) >= maxSessions {
+			r.expire(now)
+			if len(r.sessions) >= maxSessions {
+				return nil
+			}
+		}
+		s = &session{created: now}
+		r.sessions[code] = s
+	}
+
+	var found bool
+	for _, c := range s.clients {
+		if c.mapped.String() == mapped.String() {
+			c.conn, c.local = conn, local
+			found = true
+		}
+	}
+	if !found {
+		if len(s.clients) == 2 {
+			// Session is full, ignore interlopers.
+			return nil
+		}
+		s.clients = append(s.clients, &sessionClient{conn, mapped, local})
+	}
+
+	if len(s.clients) < 2 {
+		return nil
+	}
+	a, b := s.clients[0], s.clients[1]
+	return []outbound{
+		{a.conn, a.mapped, &internal.Peer{Session: code, Mapped: a.mapped, PeerMapped: b.mapped, PeerLocal: b.local}},
+		{b.conn, b.mapped, &internal.Peer{Session: code, Mapped: b.mapped, PeerMapped: a.mapped, PeerLocal: a.local}},
+	}
+}
+
+func (r *rendezvous) expire(now time.Time) {
+	for code, s := range r.sessions {
+		if now.Sub(s.created) > sessionLifetime {
+			delete(r.sessions, code)
+		}
+	}
+}
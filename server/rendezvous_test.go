@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	logrtesting "github.com/go-logr/logr/testing"
+	"go.universe.tf/natprobe/client"
+	"go.universe.tf/natprobe/internal"
+)
+
+func TestRendezvousCookie(t *testing.T) {
+	conn := listenLoopback(t)
+	defer conn.Close()
+	r, err := newRendezvous()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5000}
+	b := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 6000}
+	// join returns the cookie that the server hands out for a request
+	// from mapped, or 0 if it paired mapped up instead.
+	join := func(mapped *net.UDPAddr, cookie uint64) (uint64, []outbound) {
+		out := r.join(conn, mapped, &internal.Rendezvous{Session: "s", Cookie: cookie})
+		if len(out) == 1 {
+			if reply, ok := out[0].msg.(*internal.RendezvousReply); ok && out[0].to == mapped {
+				return reply.Cookie, nil
+			}
+		}
+		return 0, out
+	}
+
+	cookieA, out := join(a, 0)
+	if cookieA == 0 {
+		t.Fatalf("join without a cookie returned %v, want a RendezvousReply", out)
+	}
+	cookieB, _ := join(b, 0)
+	if len(r.sessions) != 0 {
+		t.Fatal("join without a cookie recorded a session")
+	}
+
+	// Another address can't use a's cookie, nor can a from another
+	// port.
+	if cookie, _ := join(b, cookieA); cookie != cookieB {
+		t.Errorf("join from b with a's cookie wasn't answered with b's cookie")
+	}
+	if cookie, _ := join(&net.UDPAddr{IP: a.IP, Port: a.Port + 1}, cookieA); cookie == 0 || cookie == cookieA {
+		t.Errorf("join from another port with a's cookie wasn't answered with a new cookie")
+	}
+	if len(r.sessions) != 0 {
+		t.Fatal("join with the wrong cookie recorded a session")
+	}
+
+	if cookie, out := join(a, cookieA); cookie != 0 || len(out) != 0 {
+		t.Fatalf("join from a with its cookie returned %v, want nothing until the peer joins", out)
+	}
+	_, out = join(b, cookieB)
+	if len(out) != 2 {
+		t.Fatalf("join from b with its cookie returned %v, want a Peer for each client", out)
+	}
+	for _, o := range out {
+		peer, ok := o.msg.(*internal.Peer)
+		if !ok {
+			t.Fatalf("join returned %T, want a Peer", o.msg)
+		}
+		want := a
+		if o.to == a {
+			want = b
+		}
+		if peer.PeerMapped.String() != want.String() {
+			t.Errorf("Peer for %s introduces %s, want %s", o.to, peer.PeerMapped, want)
+		}
+	}
+}
+
+func TestPunchLoopback(t *testing.T) {
+	r, err := newRendezvous()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := serve(t, &server{logger: logrtesting.NullLogger{}, rendezvous: r})
+	defer conn.Close()
+
+	var (
+		wg      sync.WaitGroup
+		results [2]*client.PunchResult
+		errs    [2]error
+	)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], errs[i] = client.Punch(context.Background(), &client.PunchOptions{
+				Server:            conn.LocalAddr().String(),
+				Session:           "loopback",
+				RendezvousTimeout: 5 * time.Second,
+				PunchDuration:     5 * time.Second,
+				TransmitInterval:  20 * time.Millisecond,
+			})
+		}(i)
+	}
+	wg.Wait()
+
+	for i, res := range results {
+		if errs[i] != nil {
+			t.Fatalf("peer %d: Punch: %s", i, errs[i])
+		}
+		if !res.Success {
+			t.Errorf("peer %d: hole punching failed: %s", i, res)
+		}
+	}
+	if results[0].Mapped.String() != results[1].PeerMapped.String() || results[1].Mapped.String() != results[0].PeerMapped.String() {
+		t.Errorf("peers were introduced as %s and %s, but are at %s and %s", results[1].PeerMapped, results[0].PeerMapped, results[0].Mapped, results[1].Mapped)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	mrand "math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"go.universe.tf/natprobe/internal"
+)
+
+const (
+	// How long a client IP must wait between sprays.
+	sprayCooldown = time.Minute
+	// Maximum number of sprays in progress at once.
+	maxActiveSprays = 4
+	// Time between two sprayed packets.
+	sprayInterval = time.Millisecond
+)
+
+// sprayer sprays packets at random ports of clients that ask for it,
+// for the birthday spraying experiment.
+type sprayer struct {
+	// Maximum number of packets per spray, 0 disables spraying.
+	max int
+	// Time between two sprayed packets.
+	interval time.Duration
+	secret   []byte
+	logger   logr.Logger
+
+	mu     sync.Mutex
+	active int
+	// Most recent spray for each client IP.
+	recent map[string]*spray
+}
+
+type spray struct {
+	started time.Time
+	nonce   uint64
+	packets uint16
+}
+
+func newSprayer(max int, logger logr.Logger) (*sprayer, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	// Each packet goes to a distinct port.
+	if max > 65536-internal.SprayMinPort {
+		max = 65536 - internal.SprayMinPort
+	}
+	return &sprayer{
+		max:      max,
+		interval: sprayInterval,
+		secret:   secret,
+		logger:   logger,
+		recent:   map[string]*spray{},
+	}, nil
+}
+
+// cookie returns the cookie that a client at ip must present to
+// start a spray.
+func (s *sprayer) cookie(ip net.IP, nonce uint64) uint64 {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write(ip.To16())
+	binary.Write(mac, binary.BigEndian, nonce)
+	return binary.BigEndian.Uint64(mac.Sum(nil))
+}
+
+// request handles a SprayRequest received on conn, and returns the
+// reply to send.
+func (s *sprayer) request(conn *net.UDPConn, addr *net.UDPAddr, req *internal.SprayRequest) internal.Message {
+	reply := &internal.SprayReply{
+		Nonce:  req.Nonce,
+		Mapped: addr,
+	}
+	if s.max == 0 {
+		return reply
+	}
+
+	packets := req.Packets
+	if int(packets) > s.max {
+		packets = uint16(s.max)
+	}
+	cookie := s.cookie(addr.IP, req.Nonce)
+	if req.Cookie != cookie {
+		reply.Cookie = cookie
+		reply.Packets = packets
+		return reply
+	}
+	reply.Cookie = cookie
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if prev := s.recent[addr.IP.String()]; prev != nil && now.Sub(prev.started) < sprayCooldown {
+		if prev.nonce == req.Nonce {
+			// Retransmitted request for a spray we already started.
+			reply.Packets, reply.Started = prev.packets, true
+		}
+		return reply
+	}
+	if s.active >= maxActiveSprays {
+		return reply
+	}
+
+	for ip, prev := range s.recent {
+		if now.Sub(prev.started) >= sprayCooldown {
+			delete(s.recent, ip)
+		}
+	}
+	s.recent[addr.IP.String()] = &spray{now, req.Nonce, packets}
+	s.active++
+	go s.spray(conn, addr.IP, req.Nonce, packets)
+
+	reply.Packets, reply.Started = packets, true
+	return reply
+}
+
+// spray sends packets to distinct random ports on ip.
+func (s *sprayer) spray(conn *net.UDPConn, ip net.IP, nonce uint64, packets uint16) {
+	defer func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.active--
+	}()
+
+	s.logger.Info("Starting spray", "local-addr", conn.LocalAddr(), "remote-ip", ip, "packets", packets)
+	ports := mrand.Perm(65536 - internal.SprayMinPort)
+	for i := 0; i < int(packets); i++ {
+		dest := &net.UDPAddr{IP: ip, Port: internal.SprayMinPort + ports[i]}
+		pkt := internal.MarshalMessage(&internal.SprayProbe{Nonce: nonce, Seq: uint16(i + 1)})
+		if _, err := conn.WriteToUDP(pkt, dest); err != nil {
+			s.logger.Error(err, "Failed to send spray packet", "remote-addr", dest)
+		}
+		time.Sleep(s.interval)
+	}
+	s.logger.Info("Finished spray", "local-addr", conn.LocalAddr(), "remote-ip", ip, "packets", packets)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	logrtesting "github.com/go-logr/logr/testing"
+	"go.universe.tf/natprobe/client"
+	"go.universe.tf/natprobe/internal"
+)
+
+func TestSprayRequest(t *testing.T) {
+	conn := listenLoopback(t)
+	defer conn.Close()
+	// Sprays go to 127.0.0.2, away from the sockets of other tests.
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2), Port: 40000}
+
+	disabled, err := newSprayer(0, logrtesting.NullLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply := disabled.request(conn, addr, &internal.SprayRequest{Nonce: 1, Packets: 10}).(*internal.SprayReply); reply.Packets != 0 || reply.Cookie != 0 || reply.Started {
+		t.Errorf("sprayer with spraying disabled replied %+v, want a refusal", reply)
+	}
+
+	s, err := newSprayer(4, logrtesting.NullLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.interval = 0
+	request := func(from *net.UDPAddr, nonce, cookie uint64) *internal.SprayReply {
+		req := &internal.SprayRequest{Nonce: nonce, Cookie: cookie, Packets: 10}
+		return s.request(conn, from, req).(*internal.SprayReply)
+	}
+
+	// Without a cookie, the server only hands one out, along with the
+	// number of packets it's willing to spray.
+	reply := request(addr, 1, 0)
+	if reply.Started || reply.Cookie == 0 || reply.Packets != 4 {
+		t.Fatalf("request without a cookie got %+v, want a cookie and 4 packets", reply)
+	}
+	cookie := reply.Cookie
+	if reply := request(addr, 1, cookie+1); reply.Started {
+		t.Fatal("server sprayed for a wrong cookie")
+	}
+	if reply := request(addr, 2, cookie); reply.Started {
+		t.Fatal("server sprayed for another nonce's cookie")
+	}
+	other := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 3), Port: 40000}
+	if reply := request(other, 1, cookie); reply.Started {
+		t.Fatal("server sprayed another IP for the client's cookie")
+	}
+	if len(s.recent) != 0 || s.active != 0 {
+		t.Fatal("requests without a valid cookie started a spray")
+	}
+
+	if reply := request(addr, 1, cookie); !reply.Started || reply.Packets != 4 {
+		t.Fatalf("request with a valid cookie got %+v, want a started spray of 4 packets", reply)
+	}
+	// A retransmitted request gets the same answer, without a second
+	// spray.
+	if reply := request(addr, 1, cookie); !reply.Started || reply.Packets != 4 {
+		t.Errorf("retransmitted request got %+v, want a started spray of 4 packets", reply)
+	}
+	// But a new spray must wait for sprayCooldown, even from another
+	// port.
+	from := &net.UDPAddr{IP: addr.IP, Port: addr.Port + 1}
+	reply = request(from, 3, 0)
+	if reply := request(from, 3, reply.Cookie); reply.Started {
+		t.Error("server sprayed the same IP twice within sprayCooldown")
+	}
+
+	// And there is a limit to sprays in progress.
+	s.mu.Lock()
+	s.active = maxActiveSprays
+	s.mu.Unlock()
+	reply = request(other, 4, 0)
+	if reply := request(other, 4, reply.Cookie); reply.Started {
+		t.Error("server sprayed with maxActiveSprays sprays in progress")
+	}
+}
+
+func TestSprayLoopback(t *testing.T) {
+	s, err := newSprayer(16384, logrtesting.NullLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.interval = 0
+	conn := serve(t, &server{logger: logrtesting.NullLogger{}, sprayer: s})
+	defer conn.Close()
+
+	// 64 mappings and 16384 packets miss with a probability of about
+	// e^-16.
+	res, err := client.Spray(context.Background(), &client.SprayOptions{
+		Server:           conn.LocalAddr().String(),
+		Sockets:          64,
+		Packets:          16384,
+		MappingDuration:  2 * time.Second,
+		TransmitInterval: 20 * time.Millisecond,
+		SprayDuration:    2 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("Spray: %s", err)
+	}
+
+	if len(res.Mappings) != 64 || !res.Target.Equal(net.IPv4(127, 0, 0, 1)) || res.PacketsSent != 16384 {
+		t.Fatalf("Spray got %d mappings, spraying %d packets at %s, want 64 mappings and 16384 packets at 127.0.0.1", len(res.Mappings), res.PacketsSent, res.Target)
+	}
+	if res.ExpectedProbability < 0.99 {
+		t.Errorf("expected probability of a hit is %v, want >0.99", res.ExpectedProbability)
+	}
+	if len(res.Hits) == 0 {
+		t.Fatal("no sprayed packet hit a mapping")
+	}
+	if res.FirstHit != res.Hits[0].Seq {
+		t.Errorf("FirstHit is %d, but the first hit is packet %d", res.FirstHit, res.Hits[0].Seq)
+	}
+	for i, hit := range res.Hits {
+		if hit.Seq < 1 || hit.Seq > res.PacketsSent || (i > 0 && hit.Seq <= res.Hits[i-1].Seq) {
+			t.Errorf("hit %d has seq %d, out of order or range", i, hit.Seq)
+		}
+		// Without a NAT, a socket's mapping is its own address.
+		if hit.Mapped.Port != hit.Local.Port {
+			t.Errorf("packet %d hit %s, but was received on %s", hit.Seq, hit.Mapped, hit.Local)
+		}
+	}
+}